@@ -0,0 +1,416 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/datastore"
+	"github.com/phillarmonic/syncopate-db/internal/persistence"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+)
+
+// runAdminCommand runs an offline maintenance subcommand
+// It returns false if the arguments do not name a subcommand, so the server starts instead
+func runAdminCommand(args []string) bool {
+	if len(args) == 0 {
+		return false
+	}
+
+	var err error
+	switch args[0] {
+	case "backup":
+		err = runBackupCommand(args[1:])
+	case "restore":
+		err = runRestoreCommand(args[1:])
+	case "recover":
+		err = runRecoverCommand(args[1:])
+	case "verify":
+		err = runVerifyCommand(args[1:])
+	case "upgrade":
+		err = runUpgradeCommand(args[1:])
+	case "fsck":
+		err = runFsckCommand(args[1:])
+	case "rotate-key":
+		err = runRotateKeyCommand(args[1:])
+	default:
+		return false
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s failed: %v\n", args[0], err)
+		os.Exit(1)
+	}
+	return true
+}
+
+// runBackupCommand writes a backup of a data directory to a file
+// The server must not be running on the same data directory
+func runBackupCommand(args []string) error {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	output := flags.String("output", "", "File to write the backup to")
+	compress := flags.Bool("compress", false, "Compress the backup with zstd")
+	since := flags.Uint64("since", 0, "Only back up changes made after this version of a previous backup")
+	flags.Parse(args)
+
+	if *output == "" {
+		return fmt.Errorf("-output is required")
+	}
+
+	manager, err := openOfflineManager(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	f, err := os.Create(*output)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+
+	version := manager.BackupVersion()
+	if err := manager.StreamBackup(f, common.BackupOptions{Compress: *compress, Since: *since}); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+
+	fmt.Printf("Backup of %s written to %s (version %d, pass -since %d for the next incremental backup)\n",
+		*dataDir, *output, version, version)
+	return nil
+}
+
+// runRestoreCommand replaces a data directory with the contents of a backup file
+// The server must not be running on the same data directory
+func runRestoreCommand(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	input := flags.String("input", "", "Backup file to restore, compressed or not")
+	incremental := flags.Bool("incremental", false, "Apply an incremental backup on top of the current data")
+	until := flags.String("until", "", "Rewind the restored data to this RFC 3339 time")
+	untilSequence := flags.String("until-sequence", "", "Rewind the restored data to this WAL sequence number")
+	flags.Parse(args)
+
+	if *input == "" {
+		return fmt.Errorf("-input is required")
+	}
+
+	target, err := common.ParseRecoveryTarget(*until, *untilSequence)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(*input)
+	if err != nil {
+		return fmt.Errorf("failed to open backup file: %w", err)
+	}
+	defer f.Close()
+
+	manager, err := openOfflineManager(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	// The restore rebuilds the engine state, which is snapshotted when the manager closes
+	engine := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       manager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+	manager.SetEngine(engine)
+
+	if err := manager.Restore(f, common.RestoreOptions{Incremental: *incremental, Target: target}); err != nil {
+		return err
+	}
+
+	fmt.Printf("Restored %s from %s (%d entity types)\n", *dataDir, *input, len(engine.ListEntityTypes()))
+	return nil
+}
+
+// runRecoverCommand rewinds a data directory to a point in its WAL history
+// The server must not be running on the same data directory
+func runRecoverCommand(args []string) error {
+	flags := flag.NewFlagSet("recover", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	until := flags.String("until", "", "Recover to this RFC 3339 time")
+	untilSequence := flags.String("until-sequence", "", "Recover to this WAL sequence number")
+	flags.Parse(args)
+
+	target, err := common.ParseRecoveryTarget(*until, *untilSequence)
+	if err != nil {
+		return err
+	}
+	if target == nil {
+		return fmt.Errorf("-until or -until-sequence is required")
+	}
+
+	manager, err := openOfflineManager(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	engine := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       manager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+	manager.SetEngine(engine)
+
+	if err := manager.Recover(*target); err != nil {
+		return err
+	}
+
+	fmt.Printf("Recovered %s to %s (%d entity types)\n", *dataDir, target, len(engine.ListEntityTypes()))
+	return nil
+}
+
+// runVerifyCommand checks that every WAL entry and snapshot of a data directory can be read
+// and reports their on-disk format versions
+// The server must not be running on the same data directory
+func runVerifyCommand(args []string) error {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	flags.Parse(args)
+
+	manager, err := openOfflineManager(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	report, err := manager.VerifyFormat()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Data directory: %s\n", *dataDir)
+	if report.DirectoryVersion > 0 {
+		fmt.Printf("Format version: %d (current: %d)\n", report.DirectoryVersion, persistence.FormatVersion)
+	} else {
+		fmt.Printf("Format version: not recorded (current: %d)\n", persistence.FormatVersion)
+	}
+	printFormatCounts("WAL entries", report.WALEntries)
+	printFormatCounts("Snapshots", report.Snapshots)
+	fmt.Printf("Snapshot chunks: %d\n", report.SnapshotChunks)
+
+	for _, problem := range report.Problems {
+		fmt.Printf("Unreadable: %s\n", problem)
+	}
+	if len(report.Problems) > 0 {
+		return fmt.Errorf("%d records cannot be read", len(report.Problems))
+	}
+
+	if report.NeedsUpgrade() {
+		fmt.Println("Some data uses an older format, run the upgrade command to convert it")
+	} else {
+		fmt.Println("All data uses the current format")
+	}
+	return nil
+}
+
+// printFormatCounts prints record counts by format version
+func printFormatCounts(label string, counts map[int]int) {
+	versions := make([]int, 0, len(counts))
+	total := 0
+	for version, count := range counts {
+		versions = append(versions, version)
+		total += count
+	}
+	sort.Ints(versions)
+
+	fmt.Printf("%s: %d\n", label, total)
+	for _, version := range versions {
+		fmt.Printf("  version %d: %d\n", version, counts[version])
+	}
+}
+
+// runUpgradeCommand rewrites a data directory in the current on-disk format version
+// The server must not be running on the same data directory
+func runUpgradeCommand(args []string) error {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	backup := flags.String("backup", "", "Write a backup of the data directory to this file before upgrading")
+	flags.Parse(args)
+
+	manager, err := openOfflineManager(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	if *backup != "" {
+		if err := writeSafetyBackup(manager, *dataDir, *backup); err != nil {
+			return err
+		}
+	}
+
+	applied, err := manager.UpgradeFormat()
+	for _, migration := range applied {
+		fmt.Printf("Migrated %s\n", migration)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s uses format version %d\n", *dataDir, persistence.FormatVersion)
+	return nil
+}
+
+// runFsckCommand checks the consistency of a data directory and optionally repairs it
+// The server must not be running on the same data directory
+func runFsckCommand(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	repair := flags.Bool("repair", false, "Rebuild the data directory from the last intact snapshot plus the WAL")
+	backup := flags.String("backup", "", "Write a backup of the data directory to this file before repairing")
+	flags.Parse(args)
+
+	manager, err := openOfflineManager(*dataDir)
+	if err != nil {
+		return err
+	}
+	defer manager.Close()
+
+	// The engine is not attached to the manager, so checking leaves the data untouched
+	engine := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       manager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+
+	issues, err := manager.CheckIntegrity(engine)
+	if err != nil {
+		return err
+	}
+	for _, issue := range issues {
+		fmt.Println(issue)
+	}
+
+	if len(issues) == 0 {
+		fmt.Printf("%s is consistent\n", *dataDir)
+		return nil
+	}
+	if !*repair {
+		return fmt.Errorf("%d issues found, run with -repair to fix them", len(issues))
+	}
+
+	if *backup != "" {
+		if err := writeSafetyBackup(manager, *dataDir, *backup); err != nil {
+			return err
+		}
+	}
+
+	actions, err := manager.Repair(engine)
+	for _, action := range actions {
+		fmt.Printf("Repair: %s\n", action)
+	}
+	if err != nil {
+		return err
+	}
+
+	remaining, err := manager.CheckIntegrity(engine)
+	if err != nil {
+		return err
+	}
+	for _, issue := range remaining {
+		fmt.Println(issue)
+	}
+	if len(remaining) > 0 {
+		return fmt.Errorf("%d issues remain after the repair", len(remaining))
+	}
+
+	fmt.Printf("%s repaired, %d entity types\n", *dataDir, len(engine.ListEntityTypes()))
+	return nil
+}
+
+// runRotateKeyCommand re-encrypts a data directory with a new encryption key
+// The server must not be running on the same data directory
+func runRotateKeyCommand(args []string) error {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	dataDir := flags.String("data-dir", "./data", "Directory for data storage")
+	keyFile := flags.String("key-file", settings.Config.EncryptionKeyFile, "File holding the current encryption key, leave empty for unencrypted data")
+	newKeyFile := flags.String("new-key-file", "", "File holding the new encryption key")
+	keepOld := flags.Bool("keep-old", false, "Keep the previous data directory, still encrypted with the old key")
+	flags.Parse(args)
+
+	if *newKeyFile == "" {
+		return fmt.Errorf("-new-key-file is required")
+	}
+
+	oldKey, err := persistence.LoadEncryptionKey(*keyFile, settings.Config.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	newKey, err := persistence.LoadEncryptionKey(*newKeyFile, "")
+	if err != nil {
+		return err
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	previousPath, err := persistence.RotateEncryptionKey(*dataDir, oldKey, newKey, *keepOld, logger)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%s re-encrypted with the new key (AES-%d)\n", *dataDir, len(newKey)*8)
+	if previousPath != "" {
+		fmt.Printf("WARNING: the previous data is kept at %s, still readable with the old key. Delete it once the server starts with the new key\n", previousPath)
+	}
+	return nil
+}
+
+// writeSafetyBackup writes a full backup before a command modifies a data directory
+func writeSafetyBackup(manager *persistence.Manager, dataDir, path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create backup file: %w", err)
+	}
+	if err := manager.StreamBackup(f, common.BackupOptions{}); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write backup file: %w", err)
+	}
+
+	fmt.Printf("Backup of %s written to %s\n", dataDir, path)
+	return nil
+}
+
+// openOfflineManager opens a data directory without background snapshots or garbage collection
+func openOfflineManager(dataDir string) (*persistence.Manager, error) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.WarnLevel)
+
+	// Encrypted directories are opened with the key from ENCRYPTION_KEY_FILE or ENCRYPTION_KEY
+	encryptionKey, err := persistence.LoadEncryptionKey(settings.Config.EncryptionKeyFile, settings.Config.EncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+
+	manager, err := persistence.NewManager(persistence.Config{
+		Path:          filepath.Clean(dataDir),
+		CacheSize:     1000,
+		SyncWrites:    true,
+		Logger:        logger,
+		EncryptionKey: encryptionKey,
+		// Keep archiving WAL entries when the final snapshot prunes them
+		WALArchiveRetention: persistence.DefaultConfig().WALArchiveRetention,
+		SnapshotRetention:   persistence.DefaultConfig().SnapshotRetention,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open data directory: %w", err)
+	}
+
+	return manager, nil
+}
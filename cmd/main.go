@@ -1,10 +1,15 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/phillarmonic/syncopate-db/internal/about"
@@ -13,12 +18,21 @@ import (
 	"github.com/sirupsen/logrus"
 
 	"github.com/phillarmonic/syncopate-db/internal/api"
+	"github.com/phillarmonic/syncopate-db/internal/cluster"
+	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/datastore"
 	"github.com/phillarmonic/syncopate-db/internal/persistence"
+	"github.com/phillarmonic/syncopate-db/internal/replication"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
 )
 
 func main() {
+	// Offline maintenance subcommands, e.g. "syncopatedb backup -output backup.zst -compress"
+	if runAdminCommand(os.Args[1:]) {
+		return
+	}
+
 	fmt.Println("SyncopateDB - Precise by design. On point by performance.")
 	fmt.Println("High performance, SSD-optimized database")
 	fmt.Println("By Phillarmonic Software <the PhillarMonkeys team>")
@@ -29,9 +43,37 @@ func main() {
 	port := flag.Int("port", settings.Config.Port, "Port to listen on")
 	logLevel := flag.String("log-level", string(settings.Config.LogLevel), "Log level (debug, info, warn, error)")
 	dataDir := flag.String("data-dir", "./data", "Directory for data storage")
+	storageBackend := flag.String("storage-backend", string(settings.Config.StorageBackend), "Storage backend of the data directory (badger, file)")
 	cacheSize := flag.Int("cache-size", 10000, "Number of entities to cache in memory")
+	lazyEntities := flag.Bool("lazy-entities", settings.Config.LazyEntities, "Keep entity bodies on disk, with only the --cache-size most recently used in memory")
 	snapshotInterval := flag.Int("snapshot-interval", 600, "Snapshot interval in seconds")
+	snapshotRetention := flag.Int("snapshot-retention", 3, "Number of snapshots to keep, the WAL is pruned up to the oldest one")
+	restoreBackupRetention := flag.Int("restore-backup-retention", persistence.DefaultRestoreBackupRetention, "Number of data directories replaced by restores to keep next to the data directory")
 	syncWrites := flag.Bool("sync-writes", true, "Sync writes to disk immediately")
+	durability := flag.String("durability", string(settings.Config.Durability), "Default durability of writes (sync, group, async), empty means sync")
+	groupCommitInterval := flag.Int("group-commit-interval", settings.Config.GroupCommitInterval, "Milliseconds between group commits of the log")
+	replicaOf := flag.String("replica-of", settings.Config.ReplicaOf, "Run as a read-only replica of the primary at this URL, e.g. http://primary:8080")
+	replicaID := flag.String("replica-id", settings.Config.ReplicaID, "Name the primary reports this replica under (defaults to its address)")
+	replicationPollInterval := flag.Int("replication-poll-interval", settings.Config.ReplicationPollInterval, "Milliseconds between WAL requests of a caught up replica")
+	clusterNodeID := flag.String("cluster-node-id", settings.Config.ClusterNodeID, "Name of this node in the cluster, enables cluster mode")
+	clusterRaftAddress := flag.String("cluster-raft-address", settings.Config.ClusterRaftAddress, "Address the cluster transport listens on, other nodes reach this node there")
+	clusterAPIAddress := flag.String("cluster-api-address", settings.Config.ClusterAPIAddress, "URL other nodes forward writes to when this node leads (defaults to http://127.0.0.1:<port>)")
+	clusterBootstrap := flag.Bool("cluster-bootstrap", settings.Config.ClusterBootstrap, "Start a new cluster with this node as its first member")
+	clusterJoin := flag.String("cluster-join", settings.Config.ClusterJoin, "URL of a cluster member to join the cluster through, e.g. http://node1:8080")
+	clusterDir := flag.String("cluster-dir", "", "Directory of the cluster log and snapshots (defaults to <data-dir>-raft)")
+	otlpEndpoint := flag.String("otlp-endpoint", settings.Config.TracingEndpoint, "OTLP/HTTP collector to export traces to, e.g. localhost:4318 or https://collector:4318 (empty disables the export)")
+	otlpInsecure := flag.Bool("otlp-insecure", settings.Config.TracingInsecure, "Export traces over plain HTTP")
+	tracingSampleRatio := flag.Int("tracing-sample-ratio", settings.Config.TracingSampleRatio, "Percentage of new traces that are sampled, traces started by a caller follow its decision")
+	slowQueryThreshold := flag.Int("slow-query-threshold", settings.Config.SlowQueryThreshold, "Milliseconds after which a query is logged as slow (0 disables the slow query log)")
+	slowQueryLogSize := flag.Int("slow-query-log-size", settings.Config.SlowQueryLogSize, "Number of slow queries kept in memory")
+	slowQuerySampleRatio := flag.Int("slow-query-sample-ratio", settings.Config.SlowQuerySampleRatio, "Percentage of slow queries that are logged")
+	queryTimeout := flag.Int("query-timeout", settings.Config.QueryTimeout, "Milliseconds a query may run before it fails (0 disables the timeout)")
+	maxQueryJoins := flag.Int("max-query-joins", settings.Config.MaxQueryJoins, "Joins a query may have (0 disables the limit)")
+	maxQueryFilters := flag.Int("max-query-filters", settings.Config.MaxQueryFilters, "Filters a query may have, those of its joins included (0 disables the limit)")
+	maxQueryResults := flag.Int("max-query-results", settings.Config.MaxQueryResults, "Entities a query may return (0 disables the limit)")
+	encryptionKeyFile := flag.String("encryption-key-file", settings.Config.EncryptionKeyFile, "File holding the 16, 24 or 32 byte data encryption key (hex, base64 or raw)")
+	indexCacheSize := flag.Int64("index-cache-size", 0, "Badger index cache size in MB (0 uses 100 MB when encryption is enabled)")
+	walArchiveRetention := flag.Int("wal-archive-retention", 168, "Hours to keep pruned WAL entries for point-in-time recovery (0 disables archiving)")
 	debugMode := flag.Bool("debug", settings.Config.Debug, "Enable debug mode (disables goroutines for easier debugging)")
 	colorLogs := flag.Bool("color-logs", settings.Config.ColorizedLogs, "Enable colorized log output")
 	ignoreLogPaths := flag.String("ignore-log-paths", settings.Config.IgnoreLogPaths, "Comma-separated list of paths to ignore in access logs")
@@ -50,6 +92,28 @@ func main() {
 	settings.Config.Debug = *debugMode
 	settings.Config.ColorizedLogs = *colorLogs
 	settings.Config.IgnoreLogPaths = *ignoreLogPaths
+	settings.Config.LazyEntities = *lazyEntities
+	settings.Config.StorageBackend = settings.StorageBackend(*storageBackend)
+	settings.Config.Durability = common.Durability(*durability)
+	settings.Config.GroupCommitInterval = *groupCommitInterval
+	settings.Config.ReplicaOf = *replicaOf
+	settings.Config.ReplicaID = *replicaID
+	settings.Config.ReplicationPollInterval = *replicationPollInterval
+	settings.Config.ClusterNodeID = *clusterNodeID
+	settings.Config.ClusterRaftAddress = *clusterRaftAddress
+	settings.Config.ClusterAPIAddress = *clusterAPIAddress
+	settings.Config.ClusterBootstrap = *clusterBootstrap
+	settings.Config.ClusterJoin = *clusterJoin
+	settings.Config.TracingEndpoint = *otlpEndpoint
+	settings.Config.TracingInsecure = *otlpInsecure
+	settings.Config.TracingSampleRatio = *tracingSampleRatio
+	settings.Config.SlowQueryThreshold = *slowQueryThreshold
+	settings.Config.SlowQueryLogSize = *slowQueryLogSize
+	settings.Config.SlowQuerySampleRatio = *slowQuerySampleRatio
+	settings.Config.QueryTimeout = *queryTimeout
+	settings.Config.MaxQueryJoins = *maxQueryJoins
+	settings.Config.MaxQueryFilters = *maxQueryFilters
+	settings.Config.MaxQueryResults = *maxQueryResults
 
 	// Set up logging
 	logger := logrus.New()
@@ -81,9 +145,66 @@ func main() {
 		logger.Info("Debug mode enabled - server will run synchronously")
 	}
 
+	if !settings.Config.StorageBackend.IsValid() {
+		logger.Fatalf("Unknown storage backend %q, use badger or file", settings.Config.StorageBackend)
+	}
+	if settings.Config.Durability != "" && !settings.Config.Durability.IsValid() {
+		logger.Fatalf("Unknown durability %q, use sync, group or async", settings.Config.Durability)
+	}
+	if settings.Config.ReplicaOf != "" && (settings.Config.StorageBackend != settings.StorageBackendBadger || !settings.Config.EnableWAL) {
+		logger.Fatal("Replication requires the badger storage backend with the WAL enabled")
+	}
+	if settings.Config.ClusterNodeID != "" {
+		if settings.Config.StorageBackend != settings.StorageBackendBadger {
+			logger.Fatal("Cluster mode requires the badger storage backend")
+		}
+		if settings.Config.ReplicaOf != "" {
+			logger.Fatal("Cluster mode and --replica-of cannot be combined")
+		}
+		// The cluster log is the durable record of a write and replays it after a restart,
+		// so writes are not logged a second time in the local WAL
+		settings.Config.EnableWAL = false
+	}
+
+	if settings.Config.TracingSampleRatio < 0 || settings.Config.TracingSampleRatio > 100 {
+		logger.Fatalf("Invalid tracing sample ratio %d, use a percentage from 0 to 100", settings.Config.TracingSampleRatio)
+	}
+	if settings.Config.SlowQueryThreshold < 0 || settings.Config.SlowQueryLogSize < 1 {
+		logger.Fatal("The slow query threshold must not be negative and the slow query log must hold at least one query")
+	}
+	if settings.Config.SlowQuerySampleRatio < 0 || settings.Config.SlowQuerySampleRatio > 100 {
+		logger.Fatalf("Invalid slow query sample ratio %d, use a percentage from 0 to 100", settings.Config.SlowQuerySampleRatio)
+	}
+	if settings.Config.QueryTimeout < 0 || settings.Config.MaxQueryJoins < 0 ||
+		settings.Config.MaxQueryFilters < 0 || settings.Config.MaxQueryResults < 0 {
+		logger.Fatal("The query timeout and query limits must not be negative")
+	}
+
+	// Continue the traces of callers and export spans when a collector is configured
+	shutdownTracing, err := tracing.Setup(context.Background(), tracing.Options{
+		Endpoint:    settings.Config.TracingEndpoint,
+		Insecure:    settings.Config.TracingInsecure,
+		SampleRatio: float64(settings.Config.TracingSampleRatio) / 100,
+	})
+	if err != nil {
+		logger.Fatalf("Failed to set up tracing: %v", err)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Errorf("Error flushing traces: %v", err)
+		}
+	}()
+	if settings.Config.TracingEndpoint != "" {
+		logger.Infof("Exporting traces to %s", settings.Config.TracingEndpoint)
+	}
+
 	var engine *datastore.Engine
 	var queryService *datastore.QueryService
 	var persistenceManager *persistence.Manager
+	var persistenceProvider common.PersistenceProvider
+	var clusterNode *cluster.Node
 
 	// Ensure data directory exists
 	if err := os.MkdirAll(*dataDir, 0755); err != nil {
@@ -93,34 +214,109 @@ func main() {
 	// Initialize persistent data store
 	logger.Info("Loading the persistent data store...")
 
-	// Configure persistence
-	persistenceConfig := persistence.Config{
-		Path:             filepath.Clean(*dataDir),
-		CacheSize:        *cacheSize,
-		SyncWrites:       *syncWrites,
-		SnapshotInterval: time.Duration(*snapshotInterval) * time.Second,
-		Logger:           logger,
-	}
+	if settings.Config.StorageBackend == settings.StorageBackendFile {
+		// The file backend keeps a plain log and snapshot files, without Badger's encryption,
+		// value log garbage collection or the online backup and recovery endpoints
+		logger.Info("Using the file storage backend")
+
+		fileEngine, err := persistence.NewFileEngine(persistence.FileConfig{
+			Path:             filepath.Clean(*dataDir),
+			SyncWrites:       *syncWrites,
+			SnapshotInterval: time.Duration(*snapshotInterval) * time.Second,
+			Logger:           logger,
+			// Writes wait for the group commit of the log as long as their durability requires
+			Durability:          settings.Config.Durability,
+			GroupCommitInterval: time.Duration(settings.Config.GroupCommitInterval) * time.Millisecond,
+		})
+		if err != nil {
+			logger.Fatalf("Failed to initialize persistence: %v", err)
+		}
+		defer func() {
+			if err := fileEngine.Close(); err != nil {
+				logger.Errorf("Error closing file storage: %v", err)
+			}
+		}()
+
+		persistenceProvider = fileEngine
+		engine = datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceProvider,
+			EnablePersistence: true,
+			LazyEntities:      settings.Config.LazyEntities,
+		})
+
+		// Snapshot the engine periodically and on shutdown
+		fileEngine.SetEngine(engine)
+	} else {
+		// The key file takes precedence over the ENCRYPTION_KEY environment variable
+		encryptionKey, err := persistence.LoadEncryptionKey(*encryptionKeyFile, settings.Config.EncryptionKey)
+		if err != nil {
+			logger.Fatalf("Failed to load encryption key: %v", err)
+		}
+		if encryptionKey != nil {
+			logger.Infof("Data encryption enabled (AES-%d)", len(encryptionKey)*8)
+		}
 
-	// Create a persistence manager
-	persistenceManager, err = persistence.NewManager(persistenceConfig)
-	if err != nil {
-		logger.Fatalf("Failed to initialize persistence: %v", err)
-	}
-	defer func() {
-		if err := persistenceManager.Close(); err != nil {
-			logger.Errorf("Error closing persistence manager: %v", err)
+		// Configure persistence
+		persistenceConfig := persistence.Config{
+			Path:             filepath.Clean(*dataDir),
+			CacheSize:        *cacheSize,
+			SyncWrites:       *syncWrites,
+			SnapshotInterval: time.Duration(*snapshotInterval) * time.Second,
+			Logger:           logger,
+			// Snapshots older than the retained ones are removed along with their WAL entries
+			SnapshotRetention: *snapshotRetention,
+			// Archived WAL entries allow point-in-time recovery to before the last snapshot
+			WALArchiveRetention: time.Duration(*walArchiveRetention) * time.Hour,
+			EncryptionKey:       encryptionKey,
+			IndexCacheSize:      *indexCacheSize << 20,
+			// Writes wait for the group commit of the WAL as long as their durability requires
+			Durability:          settings.Config.Durability,
+			GroupCommitInterval: time.Duration(settings.Config.GroupCommitInterval) * time.Millisecond,
+			// Data directories replaced by restores are kept up to this number, the oldest are removed
+			RestoreBackupRetention: *restoreBackupRetention,
 		}
-	}()
 
-	// Create the datastore engine with persistence
-	engine = datastore.NewDataStoreEngine(datastore.EngineConfig{
-		Persistence:       persistenceManager.GetPersistenceProvider(),
-		EnablePersistence: true,
-	})
+		// Create a persistence manager
+		persistenceManager, err = persistence.NewManager(persistenceConfig)
+		if err != nil {
+			logger.Fatalf("Failed to initialize persistence: %v", err)
+		}
+		defer func() {
+			if err := persistenceManager.Close(); err != nil {
+				logger.Errorf("Error closing persistence manager: %v", err)
+			}
+		}()
+
+		// Create the datastore engine with persistence
+		persistenceProvider = persistenceManager.GetPersistenceProvider()
+
+		// In cluster mode writes go through the cluster log before they reach the local persistence
+		if settings.Config.ClusterNodeID != "" {
+			clusterNode = newClusterNode(*dataDir, *clusterDir, persistenceManager, logger)
+			persistenceProvider = clusterNode.Provider()
+		}
 
-	// Set the engine in the persistence manager
-	persistenceManager.SetEngine(engine)
+		engine = datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceProvider,
+			EnablePersistence: true,
+			LazyEntities:      settings.Config.LazyEntities,
+		})
+
+		// Set the engine in the persistence manager
+		persistenceManager.SetEngine(engine)
+
+		if clusterNode != nil {
+			clusterNode.SetEngine(engine)
+			if err := clusterNode.Start(); err != nil {
+				logger.Fatalf("Failed to start cluster node: %v", err)
+			}
+			defer func() {
+				if err := clusterNode.Shutdown(); err != nil {
+					logger.Errorf("Error shutting down cluster node: %v", err)
+				}
+			}()
+		}
+	}
 
 	// Set up a background garbage collection
 	if persistenceManager != nil && !settings.Config.Debug {
@@ -133,6 +329,25 @@ func main() {
 	// Initialize query service
 	queryService = datastore.NewQueryService(engine)
 
+	// Record queries exceeding the slow query threshold
+	if settings.Config.SlowQueryThreshold > 0 {
+		queryService.SetSlowQueryLog(datastore.NewSlowQueryLog(datastore.SlowQueryLogConfig{
+			Threshold:   time.Duration(settings.Config.SlowQueryThreshold) * time.Millisecond,
+			Size:        settings.Config.SlowQueryLogSize,
+			SampleRatio: float64(settings.Config.SlowQuerySampleRatio) / 100,
+			Logger:      logger,
+		}))
+		logger.Infof("Logging queries slower than %dms", settings.Config.SlowQueryThreshold)
+	}
+
+	// Bound the running time and complexity of queries
+	queryService.SetQueryLimits(datastore.QueryLimits{
+		Timeout:    time.Duration(settings.Config.QueryTimeout) * time.Millisecond,
+		MaxJoins:   settings.Config.MaxQueryJoins,
+		MaxFilters: settings.Config.MaxQueryFilters,
+		MaxResults: settings.Config.MaxQueryResults,
+	})
+
 	// Configure and start the server
 	serverConfig := api.ServerConfig{
 		Port:         settings.Config.Port,
@@ -145,7 +360,51 @@ func main() {
 		DebugMode:    settings.Config.Debug, // Set debug mode from settings
 	}
 
-	server := api.NewServer(engine, queryService, serverConfig)
+	// Cluster nodes commit writes to the cluster log before they reach the datastore
+	var serverEngine common.DatastoreEngine = engine
+	if clusterNode != nil {
+		serverEngine = clusterNode.Engine()
+	}
+	server := api.NewServer(serverEngine, queryService, serverConfig)
+
+	// Enable the online backup and restore endpoints, which need the Badger backend
+	if persistenceManager != nil {
+		server.SetBackupProvider(persistenceManager)
+		server.SetStorageMetrics(persistenceManager)
+	}
+
+	// Ship the WAL to replicas, or follow a primary as a read-only replica
+	if persistenceManager != nil && settings.Config.EnableWAL {
+		server.SetReplicationSource(persistenceManager)
+	}
+	if settings.Config.ReplicaOf != "" {
+		replicaConfig := replication.DefaultConfig()
+		replicaConfig.PrimaryURL = settings.Config.ReplicaOf
+		replicaConfig.ReplicaID = settings.Config.ReplicaID
+		replicaConfig.PollInterval = time.Duration(settings.Config.ReplicationPollInterval) * time.Millisecond
+		replicaConfig.Logger = logger
+		replicaConfig.Exclusive = server.RunExclusive
+
+		replica, err := replication.NewReplica(replicaConfig, persistenceManager)
+		if err != nil {
+			logger.Fatalf("Failed to set up replication: %v", err)
+		}
+		server.SetReplica(replica)
+		replica.Start()
+		defer replica.Stop()
+
+		logger.Infof("Running as a read-only replica of %s", settings.Config.ReplicaOf)
+	}
+
+	// Forward writes to the cluster leader, and join the cluster through an existing member
+	if clusterNode != nil {
+		server.SetCluster(clusterNode)
+		if settings.Config.ClusterJoin != "" {
+			go joinCluster(settings.Config.ClusterJoin, clusterNode.Config(), logger)
+		}
+
+		logger.Infof("Running as cluster node %s", settings.Config.ClusterNodeID)
+	}
 
 	// Set up the terminal memory monitor if enabled
 	if *monitorMemory {
@@ -181,7 +440,7 @@ func main() {
 	}
 
 	// Add graceful shutdown for persistence
-	if persistenceManager != nil {
+	if persistenceProvider != nil {
 		// Force a snapshot before exiting
 		fmt.Println("Press Ctrl+C to exit and save data")
 	}
@@ -194,6 +453,58 @@ func main() {
 	logger.Info(server.Start())
 }
 
+// newClusterNode creates the cluster node of this server from the settings
+func newClusterNode(dataDir, clusterDir string, local cluster.Local, logger *logrus.Logger) *cluster.Node {
+	if clusterDir == "" {
+		clusterDir = filepath.Clean(dataDir) + "-raft"
+	}
+
+	config := cluster.DefaultConfig()
+	config.NodeID = settings.Config.ClusterNodeID
+	config.RaftAddress = settings.Config.ClusterRaftAddress
+	config.APIAddress = settings.Config.ClusterAPIAddress
+	if config.APIAddress == "" {
+		config.APIAddress = fmt.Sprintf("http://127.0.0.1:%d", settings.Config.Port)
+	}
+	config.DataDir = clusterDir
+	config.Bootstrap = settings.Config.ClusterBootstrap
+	config.Logger = logger
+
+	node, err := cluster.NewNode(config, local)
+	if err != nil {
+		logger.Fatalf("Failed to set up cluster node: %v", err)
+	}
+	return node
+}
+
+// joinCluster asks a cluster member to add this node, retrying until the cluster has a leader to do so
+func joinCluster(memberURL string, config cluster.Config, logger *logrus.Logger) {
+	body, _ := json.Marshal(map[string]string{
+		"id":           config.NodeID,
+		"raft_address": config.RaftAddress,
+		"api_address":  config.APIAddress,
+	})
+	endpoint := strings.TrimRight(memberURL, "/") + "/api/v1/admin/cluster/nodes"
+
+	for attempt := 1; ; attempt++ {
+		resp, err := http.Post(endpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				logger.Infof("Joined the cluster through %s", memberURL)
+				return
+			}
+			err = fmt.Errorf("status %d", resp.StatusCode)
+		}
+		if attempt == 10 {
+			logger.Errorf("Failed to join the cluster through %s: %v", memberURL, err)
+			return
+		}
+		logger.Warnf("Failed to join the cluster through %s, retrying: %v", memberURL, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
 // runGarbageCollection periodically runs Badger garbage collection
 func runGarbageCollection(manager *persistence.Manager, logger *logrus.Logger) {
 	ticker := time.NewTicker(5 * time.Minute)
@@ -3,6 +3,7 @@ package api
 import (
 	"fmt"
 	"github.com/phillarmonic/syncopate-db/internal/about"
+	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/monitoring"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
 	"net/http"
@@ -103,6 +104,10 @@ func (s *Server) handleDiagnostics(w http.ResponseWriter, r *http.Request) {
 			"total_count": totalEntities,
 			"counts":      entityCounts,
 		},
+		"replication": s.replicationDiagnostics(),
+	}
+	if s.cluster != nil {
+		diagnostic["cluster"] = s.cluster.Status()
 	}
 
 	// Format based on the query parameter
@@ -217,6 +222,36 @@ func (s *Server) writeDiagnosticsText(w http.ResponseWriter, diag map[string]int
 	}
 	w.Write([]byte("\n"))
 
+	// Replication info
+	replication := diag["replication"].(map[string]interface{})
+	w.Write([]byte("Replication:\n"))
+	w.Write([]byte("------------\n"))
+	w.Write([]byte("Role:         " + replication["role"].(string) + "\n"))
+	if status, ok := replication["replica"].(common.ReplicationStatus); ok {
+		w.Write([]byte("Primary:      " + status.Primary + "\n"))
+		w.Write([]byte("State:        " + status.State + "\n"))
+		w.Write([]byte("Applied:      " + uintToString(status.AppliedSequence) + "\n"))
+		w.Write([]byte("Lag Entries:  " + uintToString(status.LagEntries) + "\n"))
+		w.Write([]byte(fmt.Sprintf("Lag Seconds:  %.3f\n", status.LagSeconds)))
+	} else if replicas, ok := replication["replicas"].([]map[string]interface{}); ok {
+		w.Write([]byte("Sequence:     " + uintToString(replication["sequence"].(uint64)) + "\n"))
+		w.Write([]byte("Replicas:     " + intToString(len(replicas)) + "\n"))
+	}
+	w.Write([]byte("\n"))
+
+	// Cluster info
+	if status, ok := diag["cluster"].(common.ClusterStatus); ok {
+		w.Write([]byte("Cluster:\n"))
+		w.Write([]byte("--------\n"))
+		w.Write([]byte("Node:         " + status.NodeID + "\n"))
+		w.Write([]byte("State:        " + status.State + "\n"))
+		w.Write([]byte("Leader:       " + status.LeaderID + "\n"))
+		w.Write([]byte("Term:         " + uintToString(status.Term) + "\n"))
+		w.Write([]byte("Applied:      " + uintToString(status.AppliedIndex) + "\n"))
+		w.Write([]byte("Members:      " + intToString(len(status.Members)) + "\n"))
+		w.Write([]byte("\n"))
+	}
+
 	// Settings info
 	w.Write([]byte("Settings:\n"))
 	w.Write([]byte("---------\n"))
@@ -0,0 +1,345 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// exclusivePaths are the routes that replace the database and take the restore gate exclusively
+var exclusivePaths = map[string]bool{
+	"/api/v1/admin/restore": true,
+	"/api/v1/admin/recover": true,
+}
+
+// streamingPaths are the routes that stream the whole database from a point-in-time view
+// They stay out of the restore gate, where a restore waiting for a long stream would hold every
+// other request back until the stream ends. A restore fails while one of them runs instead
+var streamingPaths = map[string]bool{
+	"/api/v1/admin/backup":         true,
+	"/api/v1/replication/snapshot": true,
+}
+
+// errBackupInProgress is returned when the database is to be replaced while a backup streams from it
+var errBackupInProgress = fmt.Errorf("a backup is streaming from the database, retry when it is done")
+
+// errReplaceInProgress is returned when a backup is to stream while the database is being replaced
+var errReplaceInProgress = fmt.Errorf("the database is being replaced, retry when it is done")
+
+// BackupProvider is implemented by persistence backends that support online backup and restore
+type BackupProvider interface {
+	StreamBackup(w io.Writer, options common.BackupOptions) error
+	BackupVersion() uint64
+	Restore(r io.Reader, options common.RestoreOptions) error
+	Recover(target common.RecoveryTarget) error
+	ListWALEntries(afterSequence uint64, limit int) ([]common.WALRecord, error)
+}
+
+// SetBackupProvider enables the backup and restore endpoints
+func (s *Server) SetBackupProvider(provider BackupProvider) {
+	s.backupProvider = provider
+}
+
+// restoreGateMiddleware holds requests while a restore replaces the database
+// Requests share the gate, a restore takes it exclusively so it never runs alongside other operations.
+// Backup streams are counted instead, and do not start while the database is being replaced
+func (s *Server) restoreGateMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if exclusivePaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if streamingPaths[r.URL.Path] {
+			if err := s.beginStream(); err != nil {
+				s.respondWithError(w, http.StatusConflict, err.Error(),
+					errors.NewError(errors.ErrCodeBackupInProgress, err.Error()))
+				return
+			}
+			defer s.endStream()
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		s.restoreGate.RLock()
+		defer s.restoreGate.RUnlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// beginStream registers a backup stream, unless the database is being replaced
+func (s *Server) beginStream() error {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	if s.replacing {
+		return errReplaceInProgress
+	}
+	s.streams++
+	return nil
+}
+
+// endStream unregisters a backup stream
+func (s *Server) endStream() {
+	s.streamsMu.Lock()
+	defer s.streamsMu.Unlock()
+	s.streams--
+}
+
+// RunExclusive runs fn while the restore gate holds every other request back
+// It lets database replacements started outside a request, like replica bootstraps, wait
+// for running requests to finish the same way a restore does. It fails at once with
+// errBackupInProgress while a backup streams from the database
+func (s *Server) RunExclusive(fn func() error) error {
+	s.streamsMu.Lock()
+	if s.streams > 0 {
+		s.streamsMu.Unlock()
+		return errBackupInProgress
+	}
+	s.replacing = true
+	s.streamsMu.Unlock()
+
+	defer func() {
+		s.streamsMu.Lock()
+		s.replacing = false
+		s.streamsMu.Unlock()
+	}()
+
+	s.restoreGate.Lock()
+	defer s.restoreGate.Unlock()
+	return fn()
+}
+
+// respondReplaceFailed responds to a failed restore or recovery
+func (s *Server) respondReplaceFailed(w http.ResponseWriter, message string, err error) {
+	if err == errBackupInProgress {
+		s.respondWithError(w, http.StatusConflict, err.Error(),
+			errors.NewError(errors.ErrCodeBackupInProgress, err.Error()))
+		return
+	}
+	s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("%s: %v", message, err),
+		errors.NewError(errors.ErrCodeRestoreFailed, err.Error()))
+}
+
+// handleBackup streams a backup of the database
+// The backup is zstd-compressed if the compress query parameter is set, and only holds the
+// changes made after a previous backup if the since parameter is set to its X-Backup-Version
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	if s.backupProvider == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "Backups require persistence to be enabled",
+			errors.NewError(errors.ErrCodeNotImplemented, "No backup provider configured"))
+		return
+	}
+
+	compress := false
+	switch r.URL.Query().Get("compress") {
+	case "", "false", "none":
+	case "true", "zstd":
+		compress = true
+	default:
+		s.respondWithError(w, http.StatusBadRequest, "Invalid compress parameter, use 'zstd' or 'none'",
+			errors.NewError(errors.ErrCodeInvalidRequest, "Invalid compress parameter"))
+		return
+	}
+
+	var since uint64
+	if sinceParam := r.URL.Query().Get("since"); sinceParam != "" {
+		var err error
+		if since, err = strconv.ParseUint(sinceParam, 10, 64); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid since parameter, use the X-Backup-Version of a previous backup",
+				errors.NewError(errors.ErrCodeInvalidRequest, "Invalid since parameter"))
+			return
+		}
+	}
+
+	// Large backups take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	filename := fmt.Sprintf("syncopatedb-%s.backup", time.Now().Format("20060102150405"))
+	if since > 0 {
+		filename = fmt.Sprintf("syncopatedb-%s.since-%d.backup", time.Now().Format("20060102150405"), since)
+	}
+	if compress {
+		filename += ".zst"
+	}
+
+	bw := &backupWriter{ResponseWriter: w, filename: filename, version: s.backupProvider.BackupVersion()}
+	options := common.BackupOptions{Compress: compress, Since: since}
+	if err := s.backupProvider.StreamBackup(bw, options); err != nil {
+		if !bw.started {
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create backup: %v", err),
+				errors.NewError(errors.ErrCodeBackupFailed, err.Error()))
+			return
+		}
+
+		// The status line is already sent, the client sees a truncated stream
+		s.logger.Errorf("Backup stream interrupted: %v", err)
+	}
+}
+
+// handleRestore replaces the database with the backup sent in the request body
+// Compressed and uncompressed backups are both accepted. With incremental=true the backup is
+// applied on top of the current data, and until or untilSequence rewind the result to that point
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	if s.backupProvider == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "Restores require persistence to be enabled",
+			errors.NewError(errors.ErrCodeNotImplemented, "No backup provider configured"))
+		return
+	}
+
+	query := r.URL.Query()
+	options := common.RestoreOptions{}
+
+	if incremental := query.Get("incremental"); incremental != "" {
+		var err error
+		if options.Incremental, err = strconv.ParseBool(incremental); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid incremental parameter, use 'true' or 'false'",
+				errors.NewError(errors.ErrCodeInvalidRequest, "Invalid incremental parameter"))
+			return
+		}
+	}
+
+	target, err := common.ParseRecoveryTarget(query.Get("until"), query.Get("untilSequence"))
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error(),
+			errors.NewError(errors.ErrCodeInvalidRequest, "Invalid recovery target"))
+		return
+	}
+	options.Target = target
+
+	// Large backups take longer than the server read timeout
+	http.NewResponseController(w).SetReadDeadline(time.Time{})
+
+	// Wait for running requests to finish and hold new ones until the restore is done
+	start := time.Now()
+	err = s.RunExclusive(func() error {
+		return s.backupProvider.Restore(r.Body, options)
+	})
+	if err != nil {
+		s.respondReplaceFailed(w, "Failed to restore backup", err)
+		return
+	}
+
+	response := map[string]interface{}{
+		"message":       "Database restored from backup",
+		"duration":      time.Since(start).String(),
+		"entity_counts": s.entityCounts(),
+	}
+	if target != nil {
+		response["recovered_to"] = target.String()
+	}
+
+	s.respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleRecover rewinds the database to a point in its WAL history
+// The target is given as an RFC 3339 time in until, or as a WAL sequence number in untilSequence
+func (s *Server) handleRecover(w http.ResponseWriter, r *http.Request) {
+	if s.backupProvider == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "Recovery requires persistence to be enabled",
+			errors.NewError(errors.ErrCodeNotImplemented, "No backup provider configured"))
+		return
+	}
+
+	target, err := common.ParseRecoveryTarget(r.URL.Query().Get("until"), r.URL.Query().Get("untilSequence"))
+	if err == nil && target == nil {
+		err = fmt.Errorf("until or untilSequence is required")
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusBadRequest, err.Error(),
+			errors.NewError(errors.ErrCodeInvalidRequest, "Invalid recovery target"))
+		return
+	}
+
+	// Wait for running requests to finish and hold new ones until the recovery is done
+	start := time.Now()
+	err = s.RunExclusive(func() error {
+		return s.backupProvider.Recover(*target)
+	})
+	if err != nil {
+		s.respondReplaceFailed(w, "Failed to recover database", err)
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":       "Database recovered",
+		"recovered_to":  target.String(),
+		"duration":      time.Since(start).String(),
+		"entity_counts": s.entityCounts(),
+	})
+}
+
+// handleListWAL lists WAL entries, to find the time or sequence number to recover to
+// Entries are listed oldest first, starting after the sequence number in the after parameter
+func (s *Server) handleListWAL(w http.ResponseWriter, r *http.Request) {
+	if s.backupProvider == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "The WAL requires persistence to be enabled",
+			errors.NewError(errors.ErrCodeNotImplemented, "No backup provider configured"))
+		return
+	}
+
+	var after uint64
+	if afterParam := r.URL.Query().Get("after"); afterParam != "" {
+		var err error
+		if after, err = strconv.ParseUint(afterParam, 10, 64); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid after parameter, use a WAL sequence number",
+				errors.NewError(errors.ErrCodeInvalidRequest, "Invalid after parameter"))
+			return
+		}
+	}
+
+	limit := 100
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 1000 {
+			limit = l
+		}
+	}
+
+	entries, err := s.backupProvider.ListWALEntries(after, limit)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read WAL: %v", err),
+			errors.NewError(errors.ErrCodeInternalServer, err.Error()))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"entries": entries,
+		"count":   len(entries),
+	})
+}
+
+// entityCounts returns the number of entities of each type
+func (s *Server) entityCounts() map[string]int {
+	entityCounts := make(map[string]int)
+	for _, entityType := range s.engine.ListEntityTypes() {
+		if count, err := s.engine.GetEntityCount(entityType); err == nil {
+			entityCounts[entityType] = count
+		}
+	}
+	return entityCounts
+}
+
+// backupWriter sends the download headers with the first chunk of a backup,
+// so that failures before any data was written can still be reported as errors
+type backupWriter struct {
+	http.ResponseWriter
+	filename string
+	version  uint64
+	started  bool
+}
+
+// Write sends the headers on first use and forwards the data
+func (bw *backupWriter) Write(p []byte) (int, error) {
+	if !bw.started {
+		bw.started = true
+		bw.Header().Set("Content-Type", "application/octet-stream")
+		bw.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", bw.filename))
+		bw.Header().Set("X-Backup-Version", strconv.FormatUint(bw.version, 10))
+		bw.WriteHeader(http.StatusOK)
+	}
+	return bw.ResponseWriter.Write(p)
+}
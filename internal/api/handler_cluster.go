@@ -0,0 +1,180 @@
+package api
+
+import (
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+
+	"github.com/gorilla/mux"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// ClusterNode is the member of a cluster the server runs on
+type ClusterNode interface {
+	IsLeader() bool
+	Leader() (id string, apiAddress string)
+	Join(id, raftAddress, apiAddress string) error
+	Remove(id string) error
+	Status() common.ClusterStatus
+}
+
+// clusterForwardedHeader marks a write a follower forwarded to the leader
+const clusterForwardedHeader = "X-Cluster-Forwarded"
+
+// clusterUnsupportedPaths are the routes that would replace the local database behind the cluster's back
+var clusterUnsupportedPaths = map[string]bool{
+	"/api/v1/admin/restore": true,
+	"/api/v1/admin/recover": true,
+}
+
+// clusterJoinRequest is the body of a request to add a node to the cluster
+type clusterJoinRequest struct {
+	ID          string `json:"id"`
+	RaftAddress string `json:"raft_address"`
+	APIAddress  string `json:"api_address"`
+}
+
+// SetCluster makes the server a member of a cluster
+// Writes are served by the leader, followers forward them to it
+func (s *Server) SetCluster(node ClusterNode) {
+	s.cluster = node
+}
+
+// clusterMiddleware sends writes to the cluster leader
+// The leader serves them, committing them to the cluster log through the engine of the
+// node, followers forward them to the leader's API
+func (s *Server) clusterMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.cluster == nil || replicaReadPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if clusterUnsupportedPaths[r.URL.Path] {
+			s.respondWithError(w, http.StatusNotImplemented, "Restores and recoveries are not available in cluster mode",
+				errors.NewError(errors.ErrCodeNotImplemented, "Not available in cluster mode"))
+			return
+		}
+
+		if s.cluster.IsLeader() {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		// Forwarding once is enough, a second hop means the leadership is changing
+		_, leaderAPI := s.cluster.Leader()
+		if leaderAPI == "" || r.Header.Get(clusterForwardedHeader) != "" {
+			s.respondWithError(w, http.StatusServiceUnavailable, "No cluster leader available, retry the request",
+				errors.NewError(errors.ErrCodeNoClusterLeader, common.ErrNotClusterLeader.Error()))
+			return
+		}
+
+		s.forwardToLeader(w, r, leaderAPI)
+	})
+}
+
+// forwardToLeader proxies a write to the API of the cluster leader
+func (s *Server) forwardToLeader(w http.ResponseWriter, r *http.Request, leaderAPI string) {
+	target, err := url.Parse(leaderAPI)
+	if err != nil {
+		s.respondWithError(w, http.StatusServiceUnavailable, fmt.Sprintf("Invalid leader address %q", leaderAPI),
+			errors.NewError(errors.ErrCodeNoClusterLeader, err.Error()))
+		return
+	}
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+		req.Host = target.Host
+		req.Header.Set(clusterForwardedHeader, "true")
+	}
+	proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		s.logger.Warnf("Failed to forward write to cluster leader %s: %v", leaderAPI, err)
+		s.respondWithError(w, http.StatusServiceUnavailable, "Cluster leader is unreachable, retry the request",
+			errors.NewError(errors.ErrCodeNoClusterLeader, err.Error()))
+	}
+
+	proxy.ServeHTTP(w, r)
+}
+
+// requireCluster responds with an error if the server is not a cluster member
+func (s *Server) requireCluster(w http.ResponseWriter) bool {
+	if s.cluster == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "Clustering is not enabled",
+			errors.NewError(errors.ErrCodeNotImplemented, "Not a cluster member"))
+		return false
+	}
+	return true
+}
+
+// handleClusterStatus describes the cluster as this node sees it
+func (s *Server) handleClusterStatus(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCluster(w) {
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, s.cluster.Status())
+}
+
+// handleClusterJoin adds a node to the cluster as a voting member
+func (s *Server) handleClusterJoin(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCluster(w) {
+		return
+	}
+
+	var req clusterJoinRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request body",
+			errors.NewError(errors.ErrCodeInvalidRequest, err.Error()))
+		return
+	}
+	if req.ID == "" || req.RaftAddress == "" {
+		s.respondWithError(w, http.StatusBadRequest, "Node ID and raft address are required",
+			errors.NewError(errors.ErrCodeInvalidRequest, "id and raft_address are required"))
+		return
+	}
+
+	if err := s.cluster.Join(req.ID, req.RaftAddress, req.APIAddress); err != nil {
+		s.respondWithClusterError(w, fmt.Sprintf("Failed to add node %s", req.ID), err)
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, s.cluster.Status())
+}
+
+// handleClusterRemove removes a node from the cluster
+func (s *Server) handleClusterRemove(w http.ResponseWriter, r *http.Request) {
+	if !s.requireCluster(w) {
+		return
+	}
+
+	id := mux.Vars(r)["id"]
+	if err := s.cluster.Remove(id); err != nil {
+		s.respondWithClusterError(w, fmt.Sprintf("Failed to remove node %s", id), err)
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, s.cluster.Status())
+}
+
+// respondWithClusterError responds with the error of a membership change
+func (s *Server) respondWithClusterError(w http.ResponseWriter, message string, err error) {
+	if stderrors.Is(err, common.ErrNotClusterLeader) {
+		s.respondWithError(w, http.StatusServiceUnavailable, message+", no cluster leader available",
+			errors.NewError(errors.ErrCodeNoClusterLeader, err.Error()))
+		return
+	}
+	s.respondWithError(w, http.StatusConflict, message,
+		errors.NewError(errors.ErrCodeClusterMembership, err.Error()))
+}
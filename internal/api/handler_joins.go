@@ -18,19 +18,28 @@ func (s *Server) handleNestedQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	ctx, cancel, ok := s.queryContext(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
 
-	// Validate that we have at least one join
-	if len(queryOpts.Joins) == 0 {
+	// Validate that we have at least one join or included relation
+	if len(queryOpts.Joins) == 0 && len(queryOpts.Include) == 0 {
 		s.respondWithError(w, http.StatusBadRequest, "No joins specified for nested query",
 			errors.NewError(errors.ErrCodeInvalidJoin, "No joins specified for nested query"))
 		return
 	}
 
+	if queryOpts.Explain != nil {
+		s.handleExplainQuery(ctx, w, queryOpts)
+		return
+	}
+
 	// Use the new function that properly handles joins without modifying original entities
-	response, err := s.queryService.ExecuteQueryWithJoins(queryOpts)
+	response, err := s.queryService.ExecuteQueryWithJoinsContext(ctx, queryOpts)
 	if err != nil {
-		s.respondWithError(w, http.StatusBadRequest, err.Error(),
-			datastore.ConvertToSyncopateError(err))
+		s.respondWithQueryError(w, err)
 		return
 	}
 
@@ -70,13 +79,14 @@ func (s *Server) handleNestedQuery(w http.ResponseWriter, r *http.Request) {
 
 	// Create the final response
 	convertedResponse := struct {
-		Total      int           `json:"total"`
-		Count      int           `json:"count"`
-		Limit      int           `json:"limit"`
-		Offset     int           `json:"offset"`
-		HasMore    bool          `json:"hasMore"`
-		EntityType string        `json:"entityType"`
-		Data       []interface{} `json:"data"`
+		Total      int                              `json:"total"`
+		Count      int                              `json:"count"`
+		Limit      int                              `json:"limit"`
+		Offset     int                              `json:"offset"`
+		HasMore    bool                             `json:"hasMore"`
+		EntityType string                           `json:"entityType"`
+		Data       []interface{}                    `json:"data"`
+		Search     map[string]datastore.SearchMatch `json:"search,omitempty"`
 	}{
 		Total:      response.Total,
 		Count:      response.Count,
@@ -85,6 +95,7 @@ func (s *Server) handleNestedQuery(w http.ResponseWriter, r *http.Request) {
 		HasMore:    response.HasMore,
 		EntityType: response.EntityType,
 		Data:       filteredData,
+		Search:     response.Search,
 	}
 
 	s.respondWithJSON(w, http.StatusOK, convertedResponse)
@@ -0,0 +1,105 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/phillarmonic/syncopate-db/internal/datastore"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// RenameEntityTypeRequest represents a request to rename an entity type
+type RenameEntityTypeRequest struct {
+	NewName string `json:"newName"`
+}
+
+// CloneEntityTypeRequest represents a request to clone an entity type
+type CloneEntityTypeRequest struct {
+	Name        string `json:"name"`        // Name of the new entity type
+	IncludeData bool   `json:"includeData"` // Copy the entities as well as the schema
+}
+
+// handleRenameEntityType handles requests to rename an entity type
+func (s *Server) handleRenameEntityType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var req RenameEntityTypeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload",
+			errors.NewError(errors.ErrCodeMalformedData, "Failed to decode rename request"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := s.engine.RenameEntityType(name, req.NewName); err != nil {
+		synErr := datastore.ConvertToSyncopateError(err)
+		s.respondWithError(w, entityTypeOperationStatus(synErr), err.Error(), synErr)
+		return
+	}
+
+	def, err := s.engine.GetEntityDefinition(req.NewName)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError,
+			"Entity type renamed but could not retrieve it",
+			errors.NewError(errors.ErrCodeEntityTypeNotFound, err.Error()))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":    fmt.Sprintf("Entity type '%s' renamed to '%s'", name, req.NewName),
+		"entityType": def,
+	})
+}
+
+// handleCloneEntityType handles requests to clone an entity type, optionally with its data
+func (s *Server) handleCloneEntityType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var req CloneEntityTypeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload",
+			errors.NewError(errors.ErrCodeMalformedData, "Failed to decode clone request"))
+		return
+	}
+	defer r.Body.Close()
+
+	if err := s.engine.CloneEntityType(name, req.Name, req.IncludeData); err != nil {
+		synErr := datastore.ConvertToSyncopateError(err)
+		s.respondWithError(w, entityTypeOperationStatus(synErr), err.Error(), synErr)
+		return
+	}
+
+	def, err := s.engine.GetEntityDefinition(req.Name)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError,
+			"Entity type cloned but could not retrieve it",
+			errors.NewError(errors.ErrCodeEntityTypeNotFound, err.Error()))
+		return
+	}
+
+	count, _ := s.engine.GetEntityCount(req.Name)
+
+	s.respondWithJSON(w, http.StatusCreated, map[string]interface{}{
+		"message":         fmt.Sprintf("Entity type '%s' cloned to '%s'", name, req.Name),
+		"entityType":      def,
+		"entities_copied": count,
+	})
+}
+
+// entityTypeOperationStatus maps the error of an entity type operation to an HTTP status
+func entityTypeOperationStatus(synErr error) int {
+	switch {
+	case errors.IsErrorCode(synErr, errors.ErrCodeEntityTypeNotFound):
+		return http.StatusNotFound
+	case errors.IsErrorCode(synErr, errors.ErrCodeEntityTypeExists):
+		return http.StatusConflict
+	case errors.IsErrorCode(synErr, errors.ErrCodePersistenceFailed):
+		return http.StatusInternalServerError
+	default:
+		return http.StatusBadRequest
+	}
+}
@@ -0,0 +1,229 @@
+package api
+
+import (
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// ReplicationSource is implemented by persistence backends that ship their WAL to replicas
+type ReplicationSource interface {
+	ReplicationPosition() (common.ReplicationPosition, error)
+	ReplicationEntries(after common.ReplicationPosition, limit int) (*common.ReplicationBatch, error)
+	StreamBackup(w io.Writer, options common.BackupOptions) error
+	BackupVersion() uint64
+}
+
+// ReplicaStatusProvider reports the state of a replica
+type ReplicaStatusProvider interface {
+	Status() common.ReplicationStatus
+}
+
+// replicaReadPaths are the routes a read-only replica serves for every method, since they do not write data
+var replicaReadPaths = map[string]bool{
+	"/api/v1/query":         true,
+	"/api/v1/query/join":    true,
+	"/api/v1/query/count":   true,
+	"/api/v1/memory/sample": true,
+	"/api/v1/memory/config": true,
+
+	"/api/v1/admin/slow-queries": true,
+}
+
+// connectedReplica is a replica that pulled WAL entries from this server
+type connectedReplica struct {
+	ID       string    `json:"id"`
+	Address  string    `json:"address"`
+	Sequence uint64    `json:"sequence"` // Last sequence number the replica reported as applied
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// SetReplicationSource enables the endpoints replicas pull the WAL and snapshots from
+func (s *Server) SetReplicationSource(source ReplicationSource) {
+	s.replicationSource = source
+}
+
+// SetReplica makes the server a read-only replica and reports its replication state
+func (s *Server) SetReplica(replica ReplicaStatusProvider) {
+	s.replica = replica
+}
+
+// replicaReadOnlyMiddleware rejects requests that would write data while the server is a replica
+// Writes have to go to the primary, the replica receives them through replication
+func (s *Server) replicaReadOnlyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.replica == nil || replicaReadPaths[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			next.ServeHTTP(w, r)
+		default:
+			s.respondWithError(w, http.StatusForbidden, "This server is a read-only replica, send writes to the primary",
+				errors.NewError(errors.ErrCodeReadOnlyReplica, "Writes are not accepted by a replica"))
+		}
+	})
+}
+
+// handleReplicationWAL returns the WAL entries after a replica's position, oldest first
+// The replica passes the history ID and the last sequence number it applied. A position
+// the WAL no longer covers is answered with SY407, after which the replica bootstraps again
+func (s *Server) handleReplicationWAL(w http.ResponseWriter, r *http.Request) {
+	if s.replicationSource == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "Replication requires the badger storage backend",
+			errors.NewError(errors.ErrCodeNotImplemented, "No replication source configured"))
+		return
+	}
+
+	query := r.URL.Query()
+	after := common.ReplicationPosition{HistoryID: query.Get("history")}
+	if afterParam := query.Get("after"); afterParam != "" {
+		var err error
+		if after.Sequence, err = strconv.ParseUint(afterParam, 10, 64); err != nil {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid after parameter, use a WAL sequence number",
+				errors.NewError(errors.ErrCodeInvalidRequest, "Invalid after parameter"))
+			return
+		}
+	}
+
+	limit := 1000
+	if limitStr := query.Get("limit"); limitStr != "" {
+		if l, err := strconv.Atoi(limitStr); err == nil && l > 0 && l <= 10000 {
+			limit = l
+		}
+	}
+
+	s.recordReplica(r, after.Sequence)
+
+	batch, err := s.replicationSource.ReplicationEntries(after, limit)
+	if stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+		s.respondWithError(w, http.StatusConflict, err.Error(),
+			errors.NewError(errors.ErrCodeReplicaOutOfSync, err.Error()))
+		return
+	}
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read WAL: %v", err),
+			errors.NewError(errors.ErrCodeInternalServer, err.Error()))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, batch)
+}
+
+// handleReplicationSnapshot streams a zstd-compressed backup for a replica to bootstrap from
+// The position the replica continues from is sent in the X-Replication-History and
+// X-Replication-Sequence headers. It is read before the backup starts, so the backup
+// contains every WAL entry up to it
+func (s *Server) handleReplicationSnapshot(w http.ResponseWriter, r *http.Request) {
+	if s.replicationSource == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "Replication requires the badger storage backend",
+			errors.NewError(errors.ErrCodeNotImplemented, "No replication source configured"))
+		return
+	}
+
+	position, err := s.replicationSource.ReplicationPosition()
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to read replication position: %v", err),
+			errors.NewError(errors.ErrCodeBackupFailed, err.Error()))
+		return
+	}
+
+	s.recordReplica(r, 0)
+
+	// Large snapshots take longer than the server write timeout
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+
+	bw := &backupWriter{ResponseWriter: w, filename: "syncopatedb-replica.backup.zst", version: s.replicationSource.BackupVersion()}
+	w.Header().Set("X-Replication-History", position.HistoryID)
+	w.Header().Set("X-Replication-Sequence", strconv.FormatUint(position.Sequence, 10))
+
+	if err := s.replicationSource.StreamBackup(bw, common.BackupOptions{Compress: true}); err != nil {
+		if !bw.started {
+			w.Header().Del("X-Replication-History")
+			w.Header().Del("X-Replication-Sequence")
+			s.respondWithError(w, http.StatusInternalServerError, fmt.Sprintf("Failed to create snapshot: %v", err),
+				errors.NewError(errors.ErrCodeBackupFailed, err.Error()))
+			return
+		}
+
+		// The status line is already sent, the replica sees a truncated stream
+		s.logger.Errorf("Replication snapshot stream interrupted: %v", err)
+	}
+}
+
+// recordReplica remembers a replica that pulled from this server, for the diagnostics
+func (s *Server) recordReplica(r *http.Request, sequence uint64) {
+	id := r.Header.Get("X-Replica-ID")
+	if id == "" {
+		id = r.RemoteAddr
+	}
+
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+
+	if s.replicas == nil {
+		s.replicas = make(map[string]*connectedReplica)
+	}
+	s.replicas[id] = &connectedReplica{
+		ID:       id,
+		Address:  r.RemoteAddr,
+		Sequence: sequence,
+		LastSeen: time.Now(),
+	}
+}
+
+// replicationDiagnostics describes the replication role of the server and its state
+func (s *Server) replicationDiagnostics() map[string]interface{} {
+	if s.replica != nil {
+		return map[string]interface{}{
+			"role":    "replica",
+			"replica": s.replica.Status(),
+		}
+	}
+
+	diagnostics := map[string]interface{}{"role": "primary"}
+	if s.replicationSource == nil {
+		return diagnostics
+	}
+
+	position, err := s.replicationSource.ReplicationPosition()
+	if err != nil {
+		diagnostics["error"] = err.Error()
+		return diagnostics
+	}
+	diagnostics["history_id"] = position.HistoryID
+	diagnostics["sequence"] = position.Sequence
+
+	s.replicasMu.Lock()
+	replicas := make([]map[string]interface{}, 0, len(s.replicas))
+	for _, replica := range s.replicas {
+		var lag uint64
+		if position.Sequence > replica.Sequence {
+			lag = position.Sequence - replica.Sequence
+		}
+		replicas = append(replicas, map[string]interface{}{
+			"id":          replica.ID,
+			"address":     replica.Address,
+			"sequence":    replica.Sequence,
+			"lag_entries": lag,
+			"last_seen":   replica.LastSeen,
+		})
+	}
+	s.replicasMu.Unlock()
+
+	sort.Slice(replicas, func(i, j int) bool {
+		return replicas[i]["id"].(string) < replicas[j]["id"].(string)
+	})
+	diagnostics["replicas"] = replicas
+
+	return diagnostics
+}
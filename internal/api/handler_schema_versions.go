@@ -0,0 +1,88 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/phillarmonic/syncopate-db/internal/datastore"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// RollbackRequest represents a request to restore a previous schema version
+type RollbackRequest struct {
+	Version int `json:"version"`
+}
+
+// handleGetEntityTypeVersions lists the schema version history of an entity type
+func (s *Server) handleGetEntityTypeVersions(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	versions, err := s.engine.GetSchemaVersions(name)
+	if err != nil {
+		s.respondWithError(w, http.StatusNotFound, err.Error(),
+			errors.NewError(errors.ErrCodeEntityTypeNotFound, fmt.Sprintf("Entity type '%s' not found", name)))
+		return
+	}
+
+	currentVersion := 0
+	if def, err := s.engine.GetEntityDefinition(name); err == nil {
+		currentVersion = def.Version
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"type":           name,
+		"currentVersion": currentVersion,
+		"versions":       versions,
+	})
+}
+
+// handleRollbackEntityType restores a previous version of an entity type definition
+func (s *Server) handleRollbackEntityType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	var req RollbackRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid request payload",
+			errors.NewError(errors.ErrCodeMalformedData, "Failed to decode rollback request"))
+		return
+	}
+	defer r.Body.Close()
+
+	if req.Version <= 0 {
+		s.respondWithError(w, http.StatusBadRequest, "Version must be a positive number",
+			errors.NewError(errors.ErrCodeInvalidRequest, "Version must be a positive number"))
+		return
+	}
+
+	if err := s.engine.RollbackEntityType(name, req.Version); err != nil {
+		synErr := datastore.ConvertToSyncopateError(err)
+
+		// Map error code to HTTP status
+		statusCode := http.StatusBadRequest
+		if errors.IsErrorCode(synErr, errors.ErrCodeEntityTypeNotFound) ||
+			errors.IsErrorCode(synErr, errors.ErrCodeSchemaVersionNotFound) {
+			statusCode = http.StatusNotFound
+		}
+
+		s.respondWithError(w, statusCode, err.Error(), synErr)
+		return
+	}
+
+	def, err := s.engine.GetEntityDefinition(name)
+	if err != nil {
+		s.respondWithError(w, http.StatusInternalServerError,
+			"Entity type rolled back but could not retrieve it",
+			errors.NewError(errors.ErrCodeEntityTypeNotFound, err.Error()))
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":         fmt.Sprintf("Entity type '%s' rolled back to version %d", name, req.Version),
+		"restoredVersion": req.Version,
+		"entityType":      def,
+	})
+}
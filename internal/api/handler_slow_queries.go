@@ -0,0 +1,42 @@
+package api
+
+import (
+	"net/http"
+
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// handleListSlowQueries lists the recorded slow queries, the most recent first
+func (s *Server) handleListSlowQueries(w http.ResponseWriter, r *http.Request) {
+	slowQueries := s.queryService.SlowQueryLog()
+	if slowQueries == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "The slow query log is disabled, set a slow query threshold to enable it",
+			errors.NewError(errors.ErrCodeNotImplemented, "Slow query log disabled"))
+		return
+	}
+
+	queries := slowQueries.Queries()
+	slow, recorded := slowQueries.Stats()
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"threshold": slowQueries.Threshold().String(),
+		"slow":      slow,
+		"recorded":  recorded,
+		"count":     len(queries),
+		"queries":   queries,
+	})
+}
+
+// handleClearSlowQueries removes the recorded slow queries
+func (s *Server) handleClearSlowQueries(w http.ResponseWriter, r *http.Request) {
+	slowQueries := s.queryService.SlowQueryLog()
+	if slowQueries == nil {
+		s.respondWithError(w, http.StatusNotImplemented, "The slow query log is disabled, set a slow query threshold to enable it",
+			errors.NewError(errors.ErrCodeNotImplemented, "Slow query log disabled"))
+		return
+	}
+
+	slowQueries.Clear()
+	s.respondWithJSON(w, http.StatusOK, map[string]string{
+		"message": "Slow query log cleared",
+	})
+}
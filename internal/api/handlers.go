@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"github.com/phillarmonic/syncopate-db/internal/about"
@@ -39,6 +40,11 @@ func (s *Server) handleSettings(w http.ResponseWriter, r *http.Request) {
 		"enableWAL":     settings.Config.EnableWAL,
 		"enableZSTD":    settings.Config.EnableZSTD,
 		"colorizedLogs": settings.Config.ColorizedLogs,
+		"lazyEntities":  settings.Config.LazyEntities,
+		"storage":       settings.Config.StorageBackend,
+		"durability":    settings.Config.Durability,
+		"replicaOf":     settings.Config.ReplicaOf,
+		"clusterNodeID": settings.Config.ClusterNodeID,
 		"serverTime":    time.Now().Format(time.RFC3339),
 		"version":       about.About().Version,
 		"environment":   determineEnvironment(),
@@ -84,6 +90,9 @@ func (s *Server) handleCreateEntityType(w http.ResponseWriter, r *http.Request)
 	}
 	defer r.Body.Close()
 
+	// Schema versions are assigned by the engine
+	def.Version = 0
+
 	// Note: If IDGenerator is an empty string, auto_increment will be used as default
 	if err := s.engine.RegisterEntityType(def); err != nil {
 		// Convert to SyncopateError if it's not already
@@ -136,6 +145,11 @@ func (s *Server) handleListEntities(w http.ResponseWriter, r *http.Request) {
 
 	// Parse query parameters
 	limit, offset, orderBy, orderDesc := s.parseQueryParams(r)
+	ctx, cancel, ok := s.queryContext(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
 
 	// Create query options
 	queryOpts := datastore.QueryOptions{
@@ -147,10 +161,9 @@ func (s *Server) handleListEntities(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Execute query
-	response, err := s.queryService.ExecutePaginatedQuery(queryOpts)
+	response, err := s.queryService.ExecutePaginatedQueryContext(ctx, queryOpts)
 	if err != nil {
-		s.respondWithError(w, http.StatusBadRequest, err.Error(),
-			datastore.ConvertToSyncopateError(err))
+		s.respondWithQueryError(w, err)
 		return
 	}
 
@@ -228,12 +241,17 @@ func (s *Server) handleCreateEntity(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	writeOptions, ok := s.parseWriteOptions(w, r)
+	if !ok {
+		return
+	}
+
 	// Convert ID to string if provided as a number for auto_increment
 	// (This is a defensive measure in case the client sends a numeric ID)
 	rawID := entityData.ID
 
 	// Insert the entity - ID will be generated if not provided
-	if err := s.engine.Insert(entityType, rawID, entityData.Fields); err != nil {
+	if err := s.engine.InsertWithOptions(entityType, rawID, entityData.Fields, writeOptions); err != nil {
 		synErr := datastore.ConvertToSyncopateError(err)
 
 		// Map specific error types to appropriate HTTP status codes
@@ -386,8 +404,13 @@ func (s *Server) handleUpdateEntity(w http.ResponseWriter, r *http.Request) {
 		}).Debug("Updating entity")
 	}
 
+	writeOptions, ok := s.parseWriteOptions(w, r)
+	if !ok {
+		return
+	}
+
 	// Use the new type-safe Update method
-	if err := s.engine.Update(entityType, normalizedID, updateData.Fields); err != nil {
+	if err := s.engine.UpdateWithOptions(entityType, normalizedID, updateData.Fields, writeOptions); err != nil {
 		synErr := datastore.ConvertToSyncopateError(err)
 		statusCode := http.StatusBadRequest
 
@@ -511,7 +534,12 @@ func (s *Server) handleDeleteEntity(w http.ResponseWriter, r *http.Request) {
 		}).Debug("Deleting entity")
 	}
 
-	if err := s.engine.Delete(entityType, normalizedID); err != nil {
+	writeOptions, ok := s.parseWriteOptions(w, r)
+	if !ok {
+		return
+	}
+
+	if err := s.engine.DeleteWithOptions(entityType, normalizedID, writeOptions); err != nil {
 		s.respondWithError(w, http.StatusBadRequest, err.Error(),
 			datastore.ConvertToSyncopateError(err))
 		return
@@ -533,6 +561,24 @@ func (s *Server) handleDeleteEntity(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// parseWriteOptions reads the write options of an entity write from its headers
+// X-Durability overrides the server's default durability for the write
+// It responds with an error and returns false if a header is invalid
+func (s *Server) parseWriteOptions(w http.ResponseWriter, r *http.Request) (common.WriteOptions, bool) {
+	options := common.WriteOptions{Context: r.Context()}
+
+	if value := r.Header.Get("X-Durability"); value != "" {
+		options.Durability = common.Durability(strings.ToLower(value))
+		if !options.Durability.IsValid() {
+			s.respondWithError(w, http.StatusBadRequest, "Invalid X-Durability header",
+				errors.NewError(errors.ErrCodeInvalidRequest, "X-Durability must be sync, group or async"))
+			return options, false
+		}
+	}
+
+	return options, true
+}
+
 // handleQuery handles complex query requests
 func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
 	var queryOpts datastore.QueryOptions
@@ -542,11 +588,20 @@ func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	ctx, cancel, ok := s.queryContext(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
+
+	if queryOpts.Explain != nil {
+		s.handleExplainQuery(ctx, w, queryOpts)
+		return
+	}
 
-	response, err := s.queryService.ExecutePaginatedQuery(queryOpts)
+	response, err := s.queryService.ExecutePaginatedQueryContext(ctx, queryOpts)
 	if err != nil {
-		synErr := datastore.ConvertToSyncopateError(err)
-		s.respondWithError(w, http.StatusBadRequest, err.Error(), synErr)
+		s.respondWithQueryError(w, err)
 		return
 	}
 
@@ -584,13 +639,14 @@ func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
 
 	// Create a new response with the filtered and converted data
 	convertedResponse := struct {
-		Total      int           `json:"total"`
-		Count      int           `json:"count"`
-		Limit      int           `json:"limit"`
-		Offset     int           `json:"offset"`
-		HasMore    bool          `json:"hasMore"`
-		EntityType string        `json:"entityType"`
-		Data       []interface{} `json:"data"`
+		Total      int                              `json:"total"`
+		Count      int                              `json:"count"`
+		Limit      int                              `json:"limit"`
+		Offset     int                              `json:"offset"`
+		HasMore    bool                             `json:"hasMore"`
+		EntityType string                           `json:"entityType"`
+		Data       []interface{}                    `json:"data"`
+		Search     map[string]datastore.SearchMatch `json:"search,omitempty"`
 	}{
 		Total:      response.Total,
 		Count:      response.Count,
@@ -599,11 +655,54 @@ func (s *Server) handleQuery(w http.ResponseWriter, r *http.Request) {
 		HasMore:    response.HasMore,
 		EntityType: response.EntityType,
 		Data:       filteredData,
+		Search:     response.Search,
 	}
 
 	s.respondWithJSON(w, http.StatusOK, convertedResponse)
 }
 
+// handleExplainQuery runs a query and responds with its plan instead of its results
+func (s *Server) handleExplainQuery(ctx context.Context, w http.ResponseWriter, queryOpts datastore.QueryOptions) {
+	plan, err := s.queryService.ExplainQueryContext(ctx, queryOpts)
+	if err != nil {
+		s.respondWithQueryError(w, err)
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, plan)
+}
+
+// queryContext returns the context of a query request, bounded by its X-Query-Timeout header
+// The server's query timeout still applies, so the header can only shorten it
+// It responds with an error and returns false if the header is invalid
+func (s *Server) queryContext(w http.ResponseWriter, r *http.Request) (context.Context, context.CancelFunc, bool) {
+	value := r.Header.Get("X-Query-Timeout")
+	if value == "" {
+		return r.Context(), func() {}, true
+	}
+
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		s.respondWithError(w, http.StatusBadRequest, "Invalid X-Query-Timeout header",
+			errors.NewError(errors.ErrCodeInvalidRequest, "X-Query-Timeout must be a positive duration, e.g. 500ms or 2s"))
+		return nil, nil, false
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, true
+}
+
+// respondWithQueryError responds with the error of a failed query
+// Queries that timed out or were canceled respond with 504, other failed queries with 400
+func (s *Server) respondWithQueryError(w http.ResponseWriter, err error) {
+	synErr := datastore.ConvertToSyncopateError(err)
+	status := http.StatusBadRequest
+	if errors.IsErrorCode(synErr, errors.ErrCodeQueryTimeout) {
+		status = http.StatusGatewayTimeout
+	}
+	s.respondWithError(w, status, err.Error(), synErr)
+}
+
 // parseQueryParams extracts common query parameters
 func (s *Server) parseQueryParams(r *http.Request) (limit int, offset int, orderBy string, orderDesc bool) {
 	// Default values
@@ -744,6 +843,9 @@ func (s *Server) handleUpdateEntityType(w http.ResponseWriter, r *http.Request)
 		updatedDef.IDGenerator = originalDef.IDGenerator
 	}
 
+	// Schema versions are assigned by the engine
+	updatedDef.Version = 0
+
 	// Check for uniqueness constraint changes
 	oldUniqueFields := make(map[string]bool)
 	for _, field := range originalDef.Fields {
@@ -808,6 +910,38 @@ func (s *Server) handleUpdateEntityType(w http.ResponseWriter, r *http.Request)
 	s.respondWithJSON(w, http.StatusOK, response)
 }
 
+// handleDeleteEntityType drops an entity type together with all of its entities
+func (s *Server) handleDeleteEntityType(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	name := vars["name"]
+
+	// Get the count before dropping for the response
+	count, err := s.engine.GetEntityCount(name)
+	if err != nil {
+		s.respondWithError(w, http.StatusNotFound, fmt.Sprintf("Entity type '%s' not found", name),
+			errors.NewError(errors.ErrCodeEntityTypeNotFound, fmt.Sprintf("Entity type '%s' not found", name)))
+		return
+	}
+
+	if err := s.engine.DropEntityType(name); err != nil {
+		synErr := datastore.ConvertToSyncopateError(err)
+
+		statusCode := http.StatusInternalServerError
+		if errors.IsErrorCode(synErr, errors.ErrCodeEntityTypeNotFound) {
+			statusCode = http.StatusNotFound
+		}
+
+		s.respondWithError(w, statusCode, fmt.Sprintf("Failed to drop entity type: %v", err), synErr)
+		return
+	}
+
+	s.respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"message":          fmt.Sprintf("Successfully dropped entity type '%s'", name),
+		"type":             name,
+		"entities_removed": count,
+	})
+}
+
 // handleDebugSchema provides detailed schema information for debugging purposes
 func (s *Server) handleDebugSchema(w http.ResponseWriter, r *http.Request) {
 	// Get an entity type from query parameter
@@ -888,6 +1022,11 @@ func (s *Server) handleCountQuery(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	defer r.Body.Close()
+	ctx, cancel, ok := s.queryContext(w, r)
+	if !ok {
+		return
+	}
+	defer cancel()
 
 	// Log the request if in debug mode
 	if s.config.DebugMode {
@@ -902,10 +1041,9 @@ func (s *Server) handleCountQuery(w http.ResponseWriter, r *http.Request) {
 	startTime := time.Now()
 
 	// Execute the auto-optimizing count query
-	count, err := s.queryService.ExecuteCountQuery(queryOpts)
+	count, err := s.queryService.ExecuteCountQueryContext(ctx, queryOpts)
 	if err != nil {
-		s.respondWithError(w, http.StatusBadRequest, err.Error(),
-			datastore.ConvertToSyncopateError(err))
+		s.respondWithQueryError(w, err)
 		return
 	}
 
@@ -2,17 +2,29 @@ package api
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/hashicorp/raft"
+	"github.com/phillarmonic/syncopate-db/internal/cluster"
 	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/datastore"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
 	"github.com/phillarmonic/syncopate-db/internal/persistence"
+	"github.com/phillarmonic/syncopate-db/internal/replication"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // setupTestServer creates a test server with the full SyncopateDB stack
@@ -66,6 +78,7 @@ func setupTestServer(t *testing.T) (*httptest.Server, func()) {
 	}
 
 	apiServer := NewServer(db, queryService, serverConfig)
+	apiServer.SetStorageMetrics(persistenceManager)
 
 	// Create test server using the handler from the API server
 	server := httptest.NewServer(apiServer.Handler())
@@ -1087,3 +1100,1097 @@ func TestAPIErrorHandling(t *testing.T) {
 		t.Errorf("Expected 404 for non-existent entity, got %d", resp.StatusCode)
 	}
 }
+
+// TestAPIBackupAndRestore tests the online backup and restore endpoints
+func TestAPIBackupAndRestore(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Setup logging
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// Configure persistence
+	persistenceConfig := persistence.Config{
+		Path:             tempDir,
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		UseCompression:   false,
+		EnableAutoGC:     false,
+	}
+
+	persistenceManager, err := persistence.NewManager(persistenceConfig)
+	if err != nil {
+		t.Fatalf("Failed to create persistence manager: %v", err)
+	}
+	defer persistenceManager.Close()
+
+	db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       persistenceManager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+	defer db.Close()
+
+	persistenceManager.SetEngine(db)
+	queryService := datastore.NewQueryService(db)
+
+	apiServer := NewServer(db, queryService, ServerConfig{
+		Port:         8080,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		LogLevel:     logrus.ErrorLevel,
+		RateLimit:    1000,
+		RateWindow:   time.Minute,
+		DebugMode:    true,
+	})
+	apiServer.SetBackupProvider(persistenceManager)
+
+	server := httptest.NewServer(apiServer.Handler())
+	defer server.Close()
+
+	schema := common.EntityDefinition{
+		Name:        "backup_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+		},
+	}
+
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", schema)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		resp, body := makeRequest(t, server, "POST", "/api/v1/entities/backup_users",
+			createEntityRequest(map[string]interface{}{"name": name}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create user: %d - %s", resp.StatusCode, string(body))
+		}
+	}
+
+	// Download a compressed backup
+	resp, backup := makeRequest(t, server, "GET", "/api/v1/admin/backup?compress=zstd", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to download backup: %d - %s", resp.StatusCode, string(backup))
+	}
+	if resp.Header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("Expected octet-stream content type, got %s", resp.Header.Get("Content-Type"))
+	}
+	if len(backup) == 0 {
+		t.Fatal("Backup is empty")
+	}
+
+	// Invalid compression parameter
+	resp, _ = makeRequest(t, server, "GET", "/api/v1/admin/backup?compress=gzip", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for unsupported compression, got %d", resp.StatusCode)
+	}
+
+	// Change the data after the backup
+	resp, body = makeRequest(t, server, "DELETE", "/api/v1/entities/backup_users/1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to delete user: %d - %s", resp.StatusCode, string(body))
+	}
+
+	// Restore the backup
+	restoreReq, err := http.NewRequest("POST", server.URL+"/api/v1/admin/restore", bytes.NewReader(backup))
+	if err != nil {
+		t.Fatalf("Failed to create restore request: %v", err)
+	}
+	restoreResp, err := http.DefaultClient.Do(restoreReq)
+	if err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+	restoreResp.Body.Close()
+	if restoreResp.StatusCode != http.StatusOK {
+		t.Fatalf("Expected status 200 for restore, got %d", restoreResp.StatusCode)
+	}
+
+	// The deleted user is back
+	resp, body = makeRequest(t, server, "GET", "/api/v1/entities/backup_users/1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected restored user to exist: %d - %s", resp.StatusCode, string(body))
+	}
+
+	// A restore fails at once while a backup streams, rather than holding other requests back until it ends
+	if err := apiServer.beginStream(); err != nil {
+		t.Fatalf("Failed to register backup stream: %v", err)
+	}
+	resp, body = makeRequest(t, server, "POST", "/api/v1/admin/restore", nil)
+	if resp.StatusCode != http.StatusConflict || !strings.Contains(string(body), string(errors.ErrCodeBackupInProgress)) {
+		t.Errorf("Expected status 409 with %s for a restore during a backup, got %d - %s",
+			errors.ErrCodeBackupInProgress, resp.StatusCode, string(body))
+	}
+	resp, _ = makeRequest(t, server, "GET", "/api/v1/entities/backup_users/1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("Expected reads to continue during a backup, got %d", resp.StatusCode)
+	}
+	apiServer.endStream()
+
+	// Backups do not start while the database is being replaced
+	err = apiServer.RunExclusive(func() error {
+		resp, _ := makeRequest(t, server, "GET", "/api/v1/admin/backup", nil)
+		if resp.StatusCode != http.StatusConflict {
+			t.Errorf("Expected status 409 for a backup during a restore, got %d", resp.StatusCode)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("Expected the exclusive run to succeed without running backups: %v", err)
+	}
+
+	// A broken backup is rejected and leaves the data untouched
+	resp, _ = makeRequest(t, server, "POST", "/api/v1/admin/restore", map[string]string{"not": "a backup"})
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("Expected status 500 for an invalid backup, got %d", resp.StatusCode)
+	}
+
+	count, err := db.GetEntityCount("backup_users")
+	if err != nil || count != 2 {
+		t.Errorf("Expected 2 users after failed restore, got %d (%v)", count, err)
+	}
+}
+
+// TestAPIPointInTimeRecovery tests incremental backups and recovering to before a truncate through the API
+func TestAPIPointInTimeRecovery(t *testing.T) {
+	tempDir := t.TempDir()
+
+	// Setup logging
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	// Configure persistence
+	persistenceConfig := persistence.Config{
+		Path:                tempDir,
+		CacheSize:           1000,
+		SyncWrites:          true,
+		SnapshotInterval:    1 * time.Minute,
+		Logger:              logger,
+		EnableAutoGC:        false,
+		WALArchiveRetention: time.Hour,
+	}
+
+	persistenceManager, err := persistence.NewManager(persistenceConfig)
+	if err != nil {
+		t.Fatalf("Failed to create persistence manager: %v", err)
+	}
+	defer persistenceManager.Close()
+
+	db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       persistenceManager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+	defer db.Close()
+
+	persistenceManager.SetEngine(db)
+	queryService := datastore.NewQueryService(db)
+
+	apiServer := NewServer(db, queryService, ServerConfig{
+		Port:         8080,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		LogLevel:     logrus.ErrorLevel,
+		RateLimit:    1000,
+		RateWindow:   time.Minute,
+		DebugMode:    true,
+	})
+	apiServer.SetBackupProvider(persistenceManager)
+
+	server := httptest.NewServer(apiServer.Handler())
+	defer server.Close()
+
+	schema := common.EntityDefinition{
+		Name:        "ledger",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "amount", Type: "integer", Required: true},
+		},
+	}
+
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", schema)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+
+	// A full backup reports the version to continue from
+	resp, backup := makeRequest(t, server, "GET", "/api/v1/admin/backup", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to download backup: %d - %s", resp.StatusCode, string(backup))
+	}
+	version := resp.Header.Get("X-Backup-Version")
+	if version == "" || version == "0" {
+		t.Fatalf("Expected a backup version header, got %q", version)
+	}
+
+	for _, amount := range []int{10, 20, 30} {
+		resp, body := makeRequest(t, server, "POST", "/api/v1/entities/ledger",
+			createEntityRequest(map[string]interface{}{"amount": amount}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create entry: %d - %s", resp.StatusCode, string(body))
+		}
+	}
+
+	// An incremental backup only holds the changes after the full one
+	resp, incremental := makeRequest(t, server, "GET", "/api/v1/admin/backup?since="+version, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to download incremental backup: %d - %s", resp.StatusCode, string(incremental))
+	}
+	if len(incremental) == 0 {
+		t.Error("Incremental backup is empty")
+	}
+
+	resp, _ = makeRequest(t, server, "GET", "/api/v1/admin/backup?since=latest", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid since parameter, got %d", resp.StatusCode)
+	}
+
+	// The accident
+	resp, body = makeRequest(t, server, "POST", "/api/v1/database/truncate", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to truncate database: %d - %s", resp.StatusCode, string(body))
+	}
+
+	// Find the truncate in the WAL
+	resp, body = makeRequest(t, server, "GET", "/api/v1/admin/wal?limit=1000", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to list WAL: %d - %s", resp.StatusCode, string(body))
+	}
+
+	var walResponse struct {
+		Entries []common.WALRecord `json:"entries"`
+	}
+	if err := json.Unmarshal(body, &walResponse); err != nil {
+		t.Fatalf("Failed to parse WAL listing: %v", err)
+	}
+
+	var truncateSequence uint64
+	for _, entry := range walResponse.Entries {
+		if entry.Operation == "truncate_database" {
+			truncateSequence = entry.SequenceNum
+		}
+	}
+	if truncateSequence == 0 {
+		t.Fatalf("Expected the truncate in the WAL listing, got %s", string(body))
+	}
+
+	// Invalid targets are rejected
+	resp, _ = makeRequest(t, server, "POST", "/api/v1/admin/recover", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 without a recovery target, got %d", resp.StatusCode)
+	}
+	resp, _ = makeRequest(t, server, "POST", "/api/v1/admin/recover?until=yesterday", nil)
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected status 400 for an invalid recovery time, got %d", resp.StatusCode)
+	}
+
+	// Recover to just before the truncate
+	resp, body = makeRequest(t, server, "POST",
+		fmt.Sprintf("/api/v1/admin/recover?untilSequence=%d", truncateSequence-1), nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to recover: %d - %s", resp.StatusCode, string(body))
+	}
+
+	count, err := db.GetEntityCount("ledger")
+	if err != nil || count != 3 {
+		t.Errorf("Expected 3 entries after recovery, got %d (%v)", count, err)
+	}
+}
+
+// TestAPIWriteDurability tests the X-Durability header of entity writes
+func TestAPIWriteDurability(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	schema := common.EntityDefinition{
+		Name:        "events",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string"}},
+	}
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", schema)
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+
+	write := func(method, path, durability string, body interface{}) int {
+		var reqBody []byte
+		if body != nil {
+			reqBody, _ = json.Marshal(body)
+		}
+		req, err := http.NewRequest(method, server.URL+path, bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Durability", durability)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status := write("POST", "/api/v1/entities/events", "group", createEntityRequest(map[string]interface{}{"name": "first"})); status != http.StatusCreated {
+		t.Fatalf("Expected 201 for a group durability insert, got %d", status)
+	}
+	if status := write("PUT", "/api/v1/entities/events/1", "ASYNC", createEntityRequest(map[string]interface{}{"name": "updated"})); status != http.StatusOK {
+		t.Fatalf("Expected 200 for an async durability update, got %d", status)
+	}
+	if status := write("POST", "/api/v1/entities/events", "eventual", createEntityRequest(map[string]interface{}{"name": "second"})); status != http.StatusBadRequest {
+		t.Fatalf("Expected 400 for an unknown durability, got %d", status)
+	}
+	if status := write("DELETE", "/api/v1/entities/events/1", "sync", nil); status != http.StatusOK {
+		t.Fatalf("Expected 200 for a sync durability delete, got %d", status)
+	}
+
+	resp, _ = makeRequest(t, server, "GET", "/api/v1/entities/events/1", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("Expected the deleted event to be gone, got %d", resp.StatusCode)
+	}
+}
+
+// TestAPIReplication tests a read-only replica following a primary over HTTP
+func TestAPIReplication(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	newPersistentServer := func() (*Server, *persistence.Manager, *datastore.Engine) {
+		persistenceManager, err := persistence.NewManager(persistence.Config{
+			Path:             t.TempDir(),
+			CacheSize:        1000,
+			SyncWrites:       true,
+			SnapshotInterval: 1 * time.Minute,
+			Logger:           logger,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		t.Cleanup(func() { persistenceManager.Close() })
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		apiServer := NewServer(db, datastore.NewQueryService(db), ServerConfig{
+			Port:         8080,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+			IdleTimeout:  60 * time.Second,
+			LogLevel:     logrus.ErrorLevel,
+			RateLimit:    1000,
+			RateWindow:   time.Minute,
+			DebugMode:    true,
+		})
+		apiServer.SetBackupProvider(persistenceManager)
+		apiServer.SetReplicationSource(persistenceManager)
+		return apiServer, persistenceManager, db
+	}
+
+	primaryServer, _, _ := newPersistentServer()
+	primary := httptest.NewServer(primaryServer.Handler())
+	defer primary.Close()
+
+	resp, body := makeRequest(t, primary, "POST", "/api/v1/entity-types", common.EntityDefinition{
+		Name:        "replicated_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		resp, body := makeRequest(t, primary, "POST", "/api/v1/entities/replicated_users",
+			createEntityRequest(map[string]interface{}{"name": name}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create user: %d - %s", resp.StatusCode, string(body))
+		}
+	}
+
+	replicaServer, replicaManager, replicaDB := newPersistentServer()
+	config := replication.DefaultConfig()
+	config.PrimaryURL = primary.URL
+	config.ReplicaID = "replica-1"
+	config.BatchSize = 2
+	config.Logger = logger
+	replica, err := replication.NewReplica(config, replicaManager)
+	if err != nil {
+		t.Fatalf("Failed to create replica: %v", err)
+	}
+	replicaServer.SetReplica(replica)
+	replicaHTTP := httptest.NewServer(replicaServer.Handler())
+	defer replicaHTTP.Close()
+
+	// The first sync bootstraps the replica from a snapshot
+	if _, err := replica.Sync(); err != nil {
+		t.Fatalf("Failed to bootstrap replica: %v", err)
+	}
+	if status := replica.Status(); status.Bootstraps != 1 || status.State != replication.StateStreaming {
+		t.Fatalf("Expected a bootstrapped replica, got %+v", status)
+	}
+	if count, _ := replicaDB.GetEntityCount("replicated_users"); count != 2 {
+		t.Fatalf("Expected 2 users after the bootstrap, got %d", count)
+	}
+
+	// Later writes are streamed from the WAL in batches
+	for _, name := range []string{"Charlie", "Dave", "Eve"} {
+		resp, body := makeRequest(t, primary, "POST", "/api/v1/entities/replicated_users",
+			createEntityRequest(map[string]interface{}{"name": name}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create user: %d - %s", resp.StatusCode, string(body))
+		}
+	}
+	resp, body = makeRequest(t, primary, "DELETE", "/api/v1/entities/replicated_users/1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to delete user: %d - %s", resp.StatusCode, string(body))
+	}
+
+	caughtUp, err := replica.Sync()
+	if err != nil {
+		t.Fatalf("Failed to sync replica: %v", err)
+	}
+	if caughtUp || replica.Status().LagEntries == 0 {
+		t.Fatalf("Expected the replica to lag after one batch, got %+v", replica.Status())
+	}
+	for i := 0; !caughtUp; i++ {
+		if i == 10 {
+			t.Fatal("Replica did not catch up")
+		}
+		if caughtUp, err = replica.Sync(); err != nil {
+			t.Fatalf("Failed to sync replica: %v", err)
+		}
+	}
+
+	// Reads are served by the replica
+	resp, body = makeRequest(t, replicaHTTP, "POST", "/api/v1/query", map[string]interface{}{"entityType": "replicated_users"})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to query the replica: %d - %s", resp.StatusCode, string(body))
+	}
+	var queryResponse struct {
+		Total int `json:"total"`
+	}
+	if err := json.Unmarshal(body, &queryResponse); err != nil || queryResponse.Total != 4 {
+		t.Fatalf("Expected 4 users on the replica, got %s", string(body))
+	}
+	resp, _ = makeRequest(t, replicaHTTP, "GET", "/api/v1/entities/replicated_users/1", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected the replicated delete, got status %d", resp.StatusCode)
+	}
+
+	// Writes are rejected
+	resp, body = makeRequest(t, replicaHTTP, "POST", "/api/v1/entities/replicated_users",
+		createEntityRequest(map[string]interface{}{"name": "Mallory"}))
+	var errorResponse ErrorResponse
+	json.Unmarshal(body, &errorResponse)
+	if resp.StatusCode != http.StatusForbidden || errorResponse.DBCode != errors.ErrCodeReadOnlyReplica {
+		t.Errorf("Expected 403 with SY406 for a write to the replica, got %d - %s", resp.StatusCode, string(body))
+	}
+
+	// A position from another history is out of sync
+	resp, body = makeRequest(t, primary, "GET", "/api/v1/replication/wal?history=unknown&after=1", nil)
+	json.Unmarshal(body, &errorResponse)
+	if resp.StatusCode != http.StatusConflict || errorResponse.DBCode != errors.ErrCodeReplicaOutOfSync {
+		t.Errorf("Expected 409 with SY407 for an unknown history, got %d - %s", resp.StatusCode, string(body))
+	}
+
+	// Both sides report the replication in the diagnostics
+	var diagnostics struct {
+		Replication struct {
+			Role     string                   `json:"role"`
+			Replica  common.ReplicationStatus `json:"replica"`
+			Replicas []struct {
+				ID         string `json:"id"`
+				LagEntries uint64 `json:"lag_entries"`
+			} `json:"replicas"`
+		} `json:"replication"`
+	}
+	_, body = makeRequest(t, replicaHTTP, "GET", "/api/v1/diagnostics", nil)
+	if err := json.Unmarshal(body, &diagnostics); err != nil {
+		t.Fatalf("Failed to decode diagnostics: %v", err)
+	}
+	if diagnostics.Replication.Role != "replica" || diagnostics.Replication.Replica.LagEntries != 0 ||
+		diagnostics.Replication.Replica.AppliedSequence == 0 {
+		t.Errorf("Unexpected replica diagnostics: %+v", diagnostics.Replication)
+	}
+
+	_, body = makeRequest(t, primary, "GET", "/api/v1/diagnostics", nil)
+	if err := json.Unmarshal(body, &diagnostics); err != nil {
+		t.Fatalf("Failed to decode diagnostics: %v", err)
+	}
+	if diagnostics.Replication.Role != "primary" || len(diagnostics.Replication.Replicas) == 0 {
+		t.Errorf("Unexpected primary diagnostics: %+v", diagnostics.Replication)
+	}
+}
+
+func TestAPICluster(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	type clusterMember struct {
+		node *cluster.Node
+		db   *datastore.Engine
+		http *httptest.Server
+	}
+
+	var transports []*raft.InmemTransport
+	newMember := func(id string, bootstrap bool) *clusterMember {
+		persistenceManager, err := persistence.NewManager(persistence.Config{
+			Path:             t.TempDir(),
+			CacheSize:        1000,
+			SnapshotInterval: 1 * time.Minute,
+			Logger:           logger,
+			Durability:       common.DurabilityAsync,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		t.Cleanup(func() { persistenceManager.Close() })
+
+		// Followers forward writes to the API address the leader announces
+		httpServer := httptest.NewUnstartedServer(nil)
+		t.Cleanup(httpServer.Close)
+
+		_, transport := raft.NewInmemTransport("")
+		for _, other := range transports {
+			transport.Connect(other.LocalAddr(), other)
+			other.Connect(transport.LocalAddr(), transport)
+		}
+		transports = append(transports, transport)
+
+		config := cluster.DefaultConfig()
+		config.NodeID = id
+		config.APIAddress = "http://" + httpServer.Listener.Addr().String()
+		config.DataDir = t.TempDir()
+		config.Bootstrap = bootstrap
+		config.ElectionTimeout = 300 * time.Millisecond
+		config.Transport = transport
+		config.Logger = logger
+
+		node, err := cluster.NewNode(config, persistenceManager)
+		if err != nil {
+			t.Fatalf("Failed to create cluster node: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       node.Provider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+		node.SetEngine(db)
+		if err := node.Start(); err != nil {
+			t.Fatalf("Failed to start cluster node: %v", err)
+		}
+		t.Cleanup(func() { node.Shutdown() })
+
+		apiServer := NewServer(node.Engine(), datastore.NewQueryService(db), ServerConfig{
+			Port:         8080,
+			ReadTimeout:  15 * time.Second,
+			WriteTimeout: 15 * time.Second,
+			IdleTimeout:  60 * time.Second,
+			LogLevel:     logrus.ErrorLevel,
+			RateLimit:    1000,
+			RateWindow:   time.Minute,
+			DebugMode:    true,
+		})
+		apiServer.SetCluster(node)
+		httpServer.Config.Handler = apiServer.Handler()
+		httpServer.Start()
+
+		return &clusterMember{node: node, db: db, http: httpServer}
+	}
+
+	waitFor := func(condition func() bool, message string) {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for !condition() {
+			if time.Now().After(deadline) {
+				t.Fatal(message)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	first := newMember("node-1", true)
+	waitFor(first.node.IsLeader, "Bootstrapped node did not become the leader")
+
+	second := newMember("node-2", false)
+	third := newMember("node-3", false)
+	members := []*clusterMember{first, second, third}
+
+	// Joins are forwarded to the leader by members
+	resp, body := makeRequest(t, first.http, "POST", "/api/v1/admin/cluster/nodes", map[string]string{
+		"id": "node-2", "raft_address": string(transports[1].LocalAddr()), "api_address": second.http.URL,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to add node-2: %d - %s", resp.StatusCode, string(body))
+	}
+	waitFor(func() bool { _, api := second.node.Leader(); return api == first.http.URL }, "node-2 did not learn the leader")
+
+	resp, body = makeRequest(t, second.http, "POST", "/api/v1/admin/cluster/nodes", map[string]string{
+		"id": "node-3", "raft_address": string(transports[2].LocalAddr()), "api_address": third.http.URL,
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to add node-3 through a follower: %d - %s", resp.StatusCode, string(body))
+	}
+
+	var status common.ClusterStatus
+	_, body = makeRequest(t, second.http, "GET", "/api/v1/admin/cluster", nil)
+	if err := json.Unmarshal(body, &status); err != nil {
+		t.Fatalf("Failed to decode cluster status: %v", err)
+	}
+	if status.NodeID != "node-2" || status.LeaderID != "node-1" || len(status.Members) != 3 {
+		t.Fatalf("Unexpected cluster status: %+v", status)
+	}
+
+	// Writes to followers are forwarded to the leader and replicated to every node
+	waitFor(func() bool { _, api := third.node.Leader(); return api == first.http.URL }, "node-3 did not learn the leader")
+	resp, body = makeRequest(t, third.http, "POST", "/api/v1/entity-types", common.EntityDefinition{
+		Name:        "clustered_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema through a follower: %d - %s", resp.StatusCode, string(body))
+	}
+	for i, name := range []string{"Alice", "Bob", "Charlie"} {
+		resp, body := makeRequest(t, members[i].http, "POST", "/api/v1/entities/clustered_users",
+			createEntityRequest(map[string]interface{}{"name": name}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create user through %s: %d - %s", members[i].node.Status().NodeID, resp.StatusCode, string(body))
+		}
+	}
+	resp, body = makeRequest(t, second.http, "DELETE", "/api/v1/entities/clustered_users/2", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to delete user: %d - %s", resp.StatusCode, string(body))
+	}
+
+	for _, member := range members {
+		waitFor(func() bool {
+			count, _ := member.db.GetEntityCount("clustered_users")
+			return count == 2
+		}, "Writes were not replicated to every node")
+		if _, err := member.db.GetByType("3", "clustered_users"); err != nil {
+			t.Errorf("Expected every node to use the leader's IDs: %v", err)
+		}
+	}
+
+	// The leader applies a write from the cluster log before it acknowledges it
+	resp, body = makeRequest(t, first.http, "PUT", "/api/v1/entities/clustered_users/1",
+		createEntityRequest(map[string]interface{}{"name": "Alicia"}))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to update user: %d - %s", resp.StatusCode, string(body))
+	}
+	if entity, err := first.db.GetByType("1", "clustered_users"); err != nil || entity.Fields["name"] != "Alicia" {
+		t.Fatalf("Expected the acknowledged update on the leader, got %v, %v", entity, err)
+	}
+
+	// Writes the datastore rejects report their error and change no node
+	resp, _ = makeRequest(t, second.http, "POST", "/api/v1/entities/clustered_users",
+		createEntityRequest(map[string]interface{}{}))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected an invalid write to be rejected, got %d", resp.StatusCode)
+	}
+	resp, body = makeRequest(t, first.http, "POST", "/api/v1/entities/clustered_users",
+		createEntityRequest(map[string]interface{}{"name": "Charles"}, "3"))
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(string(body), "SY201") {
+		t.Errorf("Expected a duplicate ID to be rejected, got %d - %s", resp.StatusCode, string(body))
+	}
+	for _, member := range members {
+		waitFor(func() bool {
+			entity, err := member.db.GetByType("1", "clustered_users")
+			return err == nil && entity.Fields["name"] == "Alicia"
+		}, "The update was not replicated to every node")
+		leaderEntity, _ := first.db.GetByType("1", "clustered_users")
+		entity, _ := member.db.GetByType("1", "clustered_users")
+		if updatedAt, ok := entity.Fields["_updated_at"].(time.Time); !ok || !updatedAt.Equal(leaderEntity.Fields["_updated_at"].(time.Time)) {
+			t.Errorf("Expected every node to store the leader's update time, got %v and %v",
+				entity.Fields["_updated_at"], leaderEntity.Fields["_updated_at"])
+		}
+		if count, _ := member.db.GetEntityCount("clustered_users"); count != 2 {
+			t.Errorf("Expected rejected writes to change no node, got %d users", count)
+		}
+		if entity, _ := member.db.GetByType("3", "clustered_users"); entity.Fields["name"] != "Charlie" {
+			t.Errorf("Expected the duplicate insert to leave user 3 unchanged, got %v", entity.Fields)
+		}
+	}
+
+	// The fields stamped for the cluster log are stamped on a copy of the caller's data
+	data := map[string]interface{}{"name": "Erin"}
+	if err := first.node.Engine().Insert("clustered_users", "", data); err != nil {
+		t.Fatalf("Failed to insert user through the engine: %v", err)
+	}
+	if err := first.node.Engine().Update("clustered_users", "1", data); err != nil {
+		t.Fatalf("Failed to update user through the engine: %v", err)
+	}
+	if len(data) != 1 {
+		t.Errorf("Expected the caller's data to be left unchanged, got %v", data)
+	}
+	for _, member := range members {
+		waitFor(func() bool {
+			count, _ := member.db.GetEntityCount("clustered_users")
+			return count == 3
+		}, "The engine insert was not replicated to every node")
+	}
+
+	// Restores would bypass the cluster log
+	resp, _ = makeRequest(t, second.http, "POST", "/api/v1/admin/restore", nil)
+	if resp.StatusCode != http.StatusNotImplemented {
+		t.Errorf("Expected restores to be rejected in cluster mode, got %d", resp.StatusCode)
+	}
+
+	// The remaining nodes elect a new leader when the leader fails
+	first.node.Shutdown()
+	first.http.Close()
+
+	var leader, follower *clusterMember
+	waitFor(func() bool {
+		for _, member := range []*clusterMember{second, third} {
+			if member.node.IsLeader() {
+				leader = member
+			}
+		}
+		return leader != nil
+	}, "No new leader was elected")
+	follower = second
+	if leader == second {
+		follower = third
+	}
+	waitFor(func() bool { _, api := follower.node.Leader(); return api == leader.http.URL }, "Follower did not learn the new leader")
+
+	resp, body = makeRequest(t, follower.http, "POST", "/api/v1/entities/clustered_users",
+		createEntityRequest(map[string]interface{}{"name": "Dave"}))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to write after the failover: %d - %s", resp.StatusCode, string(body))
+	}
+	for _, member := range []*clusterMember{leader, follower} {
+		waitFor(func() bool {
+			count, _ := member.db.GetEntityCount("clustered_users")
+			return count == 4
+		}, "Writes after the failover were not replicated")
+	}
+
+	// The failed node is removed from the cluster
+	resp, body = makeRequest(t, follower.http, "DELETE", "/api/v1/admin/cluster/nodes/node-1", nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Failed to remove node-1: %d - %s", resp.StatusCode, string(body))
+	}
+	if status := leader.node.Status(); len(status.Members) != 2 || status.LeaderID != leader.node.Status().NodeID {
+		t.Errorf("Unexpected cluster status after the removal: %+v", status)
+	}
+
+	resp, body = makeRequest(t, follower.http, "DELETE", "/api/v1/admin/cluster/nodes/unknown", nil)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		t.Errorf("Unexpected status removing an unknown node: %d - %s", resp.StatusCode, string(body))
+	}
+}
+
+func TestAPIMetrics(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", common.EntityDefinition{
+		Name:        "metered_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		resp, body := makeRequest(t, server, "POST", "/api/v1/entities/metered_users",
+			createEntityRequest(map[string]interface{}{"name": name}))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to create user: %d - %s", resp.StatusCode, string(body))
+		}
+	}
+	makeRequest(t, server, "GET", "/api/v1/entities/metered_users/1", nil)
+	makeRequest(t, server, "GET", "/api/v1/entities/metered_users/404", nil)
+	makeRequest(t, server, "POST", "/api/v1/query", map[string]interface{}{
+		"entityType": "metered_users",
+		"filters":    []map[string]interface{}{{"field": "name", "operator": "eq", "value": "Alice"}},
+	})
+
+	resp, err := http.Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain") {
+		t.Fatalf("Unexpected metrics response: %d %s", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	scrape, _ := io.ReadAll(resp.Body)
+	exposition := string(scrape)
+
+	// Requests are recorded by route template, not by the requested path. The collectors are
+	// shared by every server of the process, so the counts include the other tests
+	for _, expected := range []string{
+		`syncopatedb_http_requests_total{code="201",method="POST",route="/api/v1/entities/{type}"}`,
+		`syncopatedb_http_requests_total{code="200",method="GET",route="/api/v1/entities/{type}/{id}"}`,
+		`syncopatedb_http_requests_total{code="404",method="GET",route="/api/v1/entities/{type}/{id}"}`,
+		`syncopatedb_http_request_duration_seconds_count{code="201",method="POST",route="/api/v1/entities/{type}"}`,
+		`syncopatedb_query_duration_seconds_count{entity_type="metered_users",operator="eq"}`,
+		`syncopatedb_entities{entity_type="metered_users"} 2`,
+		`syncopatedb_wal_write_duration_seconds_count`,
+		`syncopatedb_badger_lsm_size_bytes`,
+		`syncopatedb_badger_vlog_size_bytes`,
+		`syncopatedb_rate_limit_rejections_total`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(exposition, expected) {
+			t.Errorf("Expected %s in the metrics", expected)
+		}
+	}
+	if strings.Contains(exposition, "/api/v1/entities/metered_users/1") {
+		t.Error("Expected no metrics labelled with request paths")
+	}
+}
+
+func TestAPITracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	defer otel.SetTracerProvider(previous)
+	if _, err := tracing.Setup(context.Background(), tracing.Options{}); err != nil {
+		t.Fatalf("Failed to set up tracing: %v", err)
+	}
+
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", common.EntityDefinition{
+		Name:        "traced_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+			{Name: "age", Type: "integer"},
+		},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+
+	// Requests carrying a W3C trace context continue the caller's trace
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const parentID = "00f067aa0ba902b7"
+	tracedRequest := func(method, path string, payload interface{}) {
+		data, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(method, server.URL+path, bytes.NewReader(data))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("traceparent", "00-"+traceID+"-"+parentID+"-01")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= http.StatusBadRequest {
+			t.Fatalf("Unexpected status for %s %s: %d - %s", method, path, resp.StatusCode, string(body))
+		}
+	}
+	tracedRequest("POST", "/api/v1/entities/traced_users", createEntityRequest(map[string]interface{}{"name": "Alice", "age": 30}))
+	tracedRequest("POST", "/api/v1/query", map[string]interface{}{
+		"entityType": "traced_users",
+		"filters":    []map[string]interface{}{{"field": "age", "operator": "gt", "value": 18}},
+		"orderBy":    "name",
+	})
+
+	spans := make(map[string]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID().String() == traceID {
+			spans[span.Name()] = span
+		}
+	}
+
+	for _, name := range []string{
+		"POST /api/v1/entities/{type}",
+		"POST /api/v1/query",
+		"persistence.insert",
+		"datastore.query",
+		"datastore.filter",
+		"datastore.sort",
+	} {
+		if _, exists := spans[name]; !exists {
+			t.Errorf("Expected a %s span in the caller's trace", name)
+		}
+	}
+
+	if span, exists := spans["POST /api/v1/query"]; exists {
+		if span.Parent().SpanID().String() != parentID || !span.Parent().IsRemote() {
+			t.Errorf("Expected the request span to continue the remote parent %s, got %s", parentID, span.Parent().SpanID())
+		}
+		if span.SpanKind() != trace.SpanKindServer {
+			t.Errorf("Expected a server span, got %s", span.SpanKind())
+		}
+		if query, exists := spans["datastore.query"]; exists && query.Parent().SpanID() != span.SpanContext().SpanID() {
+			t.Error("Expected the query span to be a child of the request span")
+		}
+	}
+}
+
+func TestAPIQueryExplain(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", common.EntityDefinition{
+		Name:        "explained_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true, Indexed: true}},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		makeRequest(t, server, "POST", "/api/v1/entities/explained_users",
+			createEntityRequest(map[string]interface{}{"name": name}))
+	}
+
+	resp, body = makeRequest(t, server, "POST", "/api/v1/query", map[string]interface{}{
+		"entityType": "explained_users",
+		"filters":    []map[string]interface{}{{"field": "name", "operator": "eq", "value": "Alice"}},
+		"explain":    map[string]interface{}{"timings": true},
+	})
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Explain failed: %d - %s", resp.StatusCode, string(body))
+	}
+
+	var plan map[string]interface{}
+	if err := json.Unmarshal(body, &plan); err != nil {
+		t.Fatalf("Failed to parse the plan: %v", err)
+	}
+	if _, exists := plan["data"]; exists {
+		t.Error("Expected no data in an explained query")
+	}
+	filters, _ := plan["filters"].([]interface{})
+	if len(filters) != 1 || filters[0].(map[string]interface{})["strategy"] != "index" {
+		t.Errorf("Expected the filter to use the index, got %v", plan["filters"])
+	}
+	if plan["matches"] != float64(1) || plan["duration"] == nil {
+		t.Errorf("Unexpected plan: %s", string(body))
+	}
+}
+
+// TestAPIQueryTimeout tests the X-Query-Timeout header of queries
+func TestAPIQueryTimeout(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", common.EntityDefinition{
+		Name:        "timed_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+	})
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+	}
+	makeRequest(t, server, "POST", "/api/v1/entities/timed_users",
+		createEntityRequest(map[string]interface{}{"name": "Alice"}))
+
+	query := func(timeout string) (int, ErrorResponse) {
+		reqBody, _ := json.Marshal(map[string]interface{}{"entityType": "timed_users"})
+		req, err := http.NewRequest("POST", server.URL+"/api/v1/query", bytes.NewBuffer(reqBody))
+		if err != nil {
+			t.Fatalf("Failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Query-Timeout", timeout)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("Failed to make request: %v", err)
+		}
+		defer resp.Body.Close()
+
+		var errorResponse ErrorResponse
+		json.NewDecoder(resp.Body).Decode(&errorResponse)
+		return resp.StatusCode, errorResponse
+	}
+
+	if status, _ := query("5s"); status != http.StatusOK {
+		t.Errorf("Expected 200 for a query within its timeout, got %d", status)
+	}
+	for _, timeout := range []string{"soon", "-1s", "0"} {
+		if status, errorResponse := query(timeout); status != http.StatusBadRequest || errorResponse.DBCode != errors.ErrCodeInvalidRequest {
+			t.Errorf("Expected 400 %s for timeout %q, got %d %s", errors.ErrCodeInvalidRequest, timeout, status, errorResponse.DBCode)
+		}
+	}
+}
+
+// TestAPIIncludeRelations tests queries including declared relations
+func TestAPIIncludeRelations(t *testing.T) {
+	server, cleanup := setupTestServer(t)
+	defer cleanup()
+
+	schemas := []common.EntityDefinition{
+		{
+			Name:        "related_customers",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+			Relations: []common.RelationDefinition{
+				{Name: "orders", EntityType: "related_orders", Type: common.RelationMany, ForeignField: "customer_id"},
+			},
+		},
+		{
+			Name:        "related_orders",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "customer_id", Type: "integer", Required: true}},
+			Relations: []common.RelationDefinition{
+				{Name: "customer", EntityType: "related_customers", Type: common.RelationOne, LocalField: "customer_id"},
+			},
+		},
+	}
+	for _, schema := range schemas {
+		resp, body := makeRequest(t, server, "POST", "/api/v1/entity-types", schema)
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("Failed to register schema: %d - %s", resp.StatusCode, string(body))
+		}
+	}
+	makeRequest(t, server, "POST", "/api/v1/entities/related_customers",
+		createEntityRequest(map[string]interface{}{"name": "Alice"}))
+	makeRequest(t, server, "POST", "/api/v1/entities/related_orders",
+		createEntityRequest(map[string]interface{}{"customer_id": 1}))
+
+	resp, body := makeRequest(t, server, "GET", "/api/v1/entity-types/related_orders", nil)
+	var def common.EntityDefinition
+	if err := json.Unmarshal(body, &def); err != nil || resp.StatusCode != http.StatusOK || len(def.Relations) != 1 {
+		t.Errorf("Expected the relation in the entity type, got %d - %s", resp.StatusCode, string(body))
+	}
+
+	for _, path := range []string{"/api/v1/query", "/api/v1/query/join"} {
+		resp, body = makeRequest(t, server, "POST", path, map[string]interface{}{
+			"entityType": "related_orders",
+			"include":    []string{"customer.orders"},
+		})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Query with includes on %s failed: %d - %s", path, resp.StatusCode, string(body))
+		}
+
+		var response struct {
+			Data []map[string]interface{} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &response); err != nil || len(response.Data) != 1 {
+			t.Fatalf("Failed to parse the response of %s: %s", path, string(body))
+		}
+		order, _ := response.Data[0]["fields"].(map[string]interface{})
+		customer, _ := order["customer"].(map[string]interface{})
+		if orders, _ := customer["orders"].([]interface{}); customer["name"] != "Alice" || len(orders) != 1 {
+			t.Errorf("Expected Alice with 1 order on %s, got %v", path, order["customer"])
+		}
+	}
+
+	resp, body = makeRequest(t, server, "POST", "/api/v1/query", map[string]interface{}{
+		"entityType": "related_orders",
+		"include":    []string{"invoices"},
+	})
+	var errorResponse ErrorResponse
+	json.Unmarshal(body, &errorResponse)
+	if resp.StatusCode != http.StatusBadRequest || errorResponse.DBCode != errors.ErrCodeInvalidJoin {
+		t.Errorf("Expected 400 %s for an unknown relation, got %d - %s", errors.ErrCodeInvalidJoin, resp.StatusCode, string(body))
+	}
+}
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"github.com/klauspost/compress/zstd"
+	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/errors"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
 	"github.com/sirupsen/logrus"
 	"io"
@@ -68,6 +70,7 @@ func (s *Server) authMiddleware(next http.Handler) http.Handler {
 }
 
 // requestIDMiddleware adds a unique request ID to each request
+// The ID is also carried by the request context, so the datastore can refer to it
 func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Add request ID header if not present
@@ -76,7 +79,8 @@ func (s *Server) requestIDMiddleware(next http.Handler) http.Handler {
 			r.Header.Set("X-Request-ID", requestID)
 			w.Header().Set("X-Request-ID", requestID)
 		}
-		next.ServeHTTP(w, r)
+		ctx := common.WithRequestID(r.Context(), r.Header.Get("X-Request-ID"))
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
@@ -148,6 +152,7 @@ func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
 
 		// Check if the request exceeds the rate limit
 		if limiter.Check(ip) {
+			metrics.RateLimitRejections.Inc()
 			s.respondWithError(w, http.StatusTooManyRequests, "Rate limit exceeded",
 				errors.NewError(errors.ErrCodeTooManyRequests, "Rate limit exceeded, try again later"))
 			return
@@ -195,6 +200,11 @@ type compressWriter struct {
 	buf           bytes.Buffer
 }
 
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can reach it
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
 // WriteHeader captures the status code and writes headers
 func (cw *compressWriter) WriteHeader(code int) {
 	if cw.headerWritten {
@@ -13,12 +13,21 @@ import (
 	"time"
 
 	"github.com/klauspost/compress/zstd"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
 	"github.com/phillarmonic/syncopate-db/internal/monitoring"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
 
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/datastore"
@@ -61,16 +70,30 @@ func DefaultServerConfig() ServerConfig {
 
 // Server represents the REST API server
 type Server struct {
-	router        *mux.Router
-	config        ServerConfig
-	server        *http.Server
-	engine        common.DatastoreEngine
-	queryService  *datastore.QueryService
-	logger        *logrus.Logger
-	rateLimiter   *RateLimiter
-	memoryMonitor *monitoring.MemoryMonitor
-	compressor    *zstd.Encoder // Add this field for response compression
-	mu            sync.RWMutex  // Protect response writers in concurrent handlers
+	router         *mux.Router
+	config         ServerConfig
+	server         *http.Server
+	engine         common.DatastoreEngine
+	queryService   *datastore.QueryService
+	logger         *logrus.Logger
+	rateLimiter    *RateLimiter
+	memoryMonitor  *monitoring.MemoryMonitor
+	compressor     *zstd.Encoder // Add this field for response compression
+	mu             sync.RWMutex  // Protect response writers in concurrent handlers
+	backupProvider BackupProvider
+	restoreGate    sync.RWMutex // Held exclusively while a restore replaces the database
+	streamsMu      sync.Mutex   // Guards streams and replacing
+	streams        int          // Backups streaming from the database outside the restore gate
+	replacing      bool         // A restore or recovery replaces the database
+
+	replicationSource ReplicationSource     // Set on a primary that ships its WAL to replicas
+	replica           ReplicaStatusProvider // Set when the server is a read-only replica
+	replicasMu        sync.Mutex
+	replicas          map[string]*connectedReplica // Replicas that pulled from this server, by ID
+
+	cluster ClusterNode // Set when the server is a cluster member
+
+	metricsRegistry *prometheus.Registry // Metrics served at /metrics
 }
 
 // NewServer creates a new REST API server
@@ -118,6 +141,9 @@ func NewServer(engine common.DatastoreEngine, queryService *datastore.QueryServi
 		compressor:    compressor, // Set the compressor
 	}
 
+	server.metricsRegistry = metrics.NewRegistry()
+	server.metricsRegistry.MustRegister(metrics.NewEntityCollector(engine))
+
 	server.setupRoutes()
 	return server
 }
@@ -132,15 +158,27 @@ func (s *Server) setupRoutes() {
 	// Root path - SyncopateDB welcome
 	s.router.HandleFunc("/", s.handleWelcome).Methods(http.MethodGet)
 	s.router.HandleFunc("/settings", s.handleSettings).Methods(http.MethodGet)
+	s.router.Handle("/metrics", promhttp.HandlerFor(s.metricsRegistry, promhttp.HandlerOpts{})).Methods(http.MethodGet)
+	s.router.Use(s.tracingMiddleware)
+	s.router.Use(s.metricsMiddleware)
 
 	// API version prefix
 	api := s.router.PathPrefix("/api/v1").Subrouter()
+	api.Use(s.restoreGateMiddleware)
+	api.Use(s.replicaReadOnlyMiddleware)
+	api.Use(s.clusterMiddleware)
 
 	// Entity types
 	api.HandleFunc("/entity-types", s.handleGetEntityTypes).Methods(http.MethodGet)
 	api.HandleFunc("/entity-types", s.handleCreateEntityType).Methods(http.MethodPost)
 	api.HandleFunc("/entity-types/{name}", s.handleGetEntityType).Methods(http.MethodGet)
 	api.HandleFunc("/entity-types/{name}", s.handleUpdateEntityType).Methods(http.MethodPut)
+	api.HandleFunc("/entity-types/{name}", s.handleDeleteEntityType).Methods(http.MethodDelete)
+	api.HandleFunc("/entity-types/{name}/rename", s.handleRenameEntityType).Methods(http.MethodPost)
+	api.HandleFunc("/entity-types/{name}/clone", s.handleCloneEntityType).Methods(http.MethodPost)
+	// Schema version history
+	api.HandleFunc("/entity-types/{name}/versions", s.handleGetEntityTypeVersions).Methods(http.MethodGet)
+	api.HandleFunc("/entity-types/{name}/rollback", s.handleRollbackEntityType).Methods(http.MethodPost)
 	// Truncate entities of a specific table
 	api.HandleFunc("/entities/{type}/truncate", s.handleTruncateEntityType).Methods(http.MethodPost)
 	// Truncate all entities in the database
@@ -176,6 +214,25 @@ func (s *Server) setupRoutes() {
 	api.HandleFunc("/memory/sample", s.handleForceSample).Methods(http.MethodPost)
 	api.HandleFunc("/memory/config", s.handleMemoryConfig).Methods(http.MethodGet, http.MethodPost)
 
+	// Backup and restore
+	api.HandleFunc("/admin/backup", s.handleBackup).Methods(http.MethodGet)
+	api.HandleFunc("/admin/restore", s.handleRestore).Methods(http.MethodPost)
+	api.HandleFunc("/admin/recover", s.handleRecover).Methods(http.MethodPost)
+	api.HandleFunc("/admin/wal", s.handleListWAL).Methods(http.MethodGet)
+
+	// Slow query log
+	api.HandleFunc("/admin/slow-queries", s.handleListSlowQueries).Methods(http.MethodGet)
+	api.HandleFunc("/admin/slow-queries", s.handleClearSlowQueries).Methods(http.MethodDelete)
+
+	// Replication, replicas pull the WAL and snapshots of the primary
+	api.HandleFunc("/replication/wal", s.handleReplicationWAL).Methods(http.MethodGet)
+	api.HandleFunc("/replication/snapshot", s.handleReplicationSnapshot).Methods(http.MethodGet)
+
+	// Cluster membership, changes are forwarded to the leader
+	api.HandleFunc("/admin/cluster", s.handleClusterStatus).Methods(http.MethodGet)
+	api.HandleFunc("/admin/cluster/nodes", s.handleClusterJoin).Methods(http.MethodPost)
+	api.HandleFunc("/admin/cluster/nodes/{id}", s.handleClusterRemove).Methods(http.MethodDelete)
+
 	// Diagnostics route
 	api.HandleFunc("/diagnostics", s.handleDiagnostics).Methods(http.MethodGet)
 	api.HandleFunc("/compression", s.compressionInfoHandler).Methods(http.MethodGet)
@@ -212,7 +269,7 @@ func (s *Server) Start() error {
 	c := cors.New(cors.Options{
 		AllowedOrigins:   []string{"*"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization"},
+		AllowedHeaders:   []string{"Accept", "Content-Type", "Content-Length", "Accept-Encoding", "X-CSRF-Token", "Authorization", "traceparent", "tracestate", "X-Query-Timeout"},
 		AllowCredentials: true,
 		MaxAge:           86400, // 24 hours
 	})
@@ -301,6 +358,70 @@ func (s *Server) logMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// metricsMiddleware records the count and latency of requests by route template and status code
+func (s *Server) metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rw := &responseWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+
+		next.ServeHTTP(rw, r)
+
+		// Routes are recorded by their template, so entity IDs do not create new series
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+		metrics.ObserveHTTPRequest(route, r.Method, rw.statusCode, time.Since(start))
+	})
+}
+
+// tracingMiddleware starts a server span for each request, continuing the W3C trace context of
+// its headers, and hands the span to the handlers through the request context
+func (s *Server) tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+
+		route := "unknown"
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx, span := tracing.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("http.route", route),
+				attribute.String("url.path", r.URL.Path),
+				attribute.String("http.request_id", r.Header.Get("X-Request-ID")),
+			))
+		defer span.End()
+
+		rw := &responseWriter{
+			ResponseWriter: w,
+			statusCode:     http.StatusOK,
+		}
+
+		next.ServeHTTP(rw, r.WithContext(ctx))
+
+		span.SetAttributes(attribute.Int("http.response.status_code", rw.statusCode))
+		if rw.statusCode >= http.StatusInternalServerError {
+			span.SetStatus(codes.Error, http.StatusText(rw.statusCode))
+		}
+	})
+}
+
+// SetStorageMetrics adds the on-disk sizes of the storage to the metrics
+func (s *Server) SetStorageMetrics(sizer metrics.StorageSizer) {
+	s.metricsRegistry.MustRegister(metrics.NewStorageCollector(sizer))
+}
+
 // handleDebugEntities provides a debug endpoint for inspecting entity storage
 func (s *Server) handleDebugEntities(w http.ResponseWriter, r *http.Request) {
 	// Get entity type from query parameter
@@ -376,6 +497,11 @@ func (rw *responseWriter) WriteHeader(code int) {
 	rw.ResponseWriter.WriteHeader(code)
 }
 
+// Unwrap returns the wrapped ResponseWriter, so http.ResponseController can reach it
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 // GetMemoryMonitor returns the server's memory monitor instance
 func (s *Server) GetMemoryMonitor() *monitoring.MemoryMonitor {
 	return s.memoryMonitor
@@ -0,0 +1,226 @@
+package cluster
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/persistence"
+)
+
+// idGenerator is implemented by datastores that generate the IDs of new entities ahead of their insert
+type idGenerator interface {
+	GenerateID(entityType string) (string, error)
+}
+
+// Engine is the datastore of a cluster node as its API uses it
+// Reads go to the node's datastore. Writes are committed to the cluster log first and
+// reach the datastore when the node applies the committed entry, so every node, the
+// leader included, applies them in log order
+type Engine struct {
+	common.DatastoreEngine
+	node *Node
+}
+
+// Engine returns the datastore of the node that commits writes to the cluster log
+// The datastore has to be set first
+func (n *Node) Engine() *Engine {
+	return &Engine{DatastoreEngine: n.store, node: n}
+}
+
+// RegisterEntityType commits the registration of an entity type
+func (e *Engine) RegisterEntityType(def common.EntityDefinition) error {
+	op, err := persistence.NewOperation(persistence.OpRegisterEntityType, def.Name, "", def)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.RegisterEntityType(def)
+	})
+}
+
+// Insert commits the insertion of an entity
+func (e *Engine) Insert(entityType, id string, data map[string]interface{}) error {
+	return e.InsertWithOptions(entityType, id, data, common.WriteOptions{})
+}
+
+// InsertWithOptions commits the insertion of an entity
+// The ID and timestamps are set before the write is committed, so every node stores the same ones
+func (e *Engine) InsertWithOptions(entityType, id string, data map[string]interface{}, options common.WriteOptions) error {
+	if id == "" {
+		generator, ok := e.DatastoreEngine.(idGenerator)
+		if !ok {
+			return fmt.Errorf("the datastore cannot generate IDs for cluster writes")
+		}
+		generated, err := generator.GenerateID(entityType)
+		if err != nil {
+			return err
+		}
+		id = generated
+	}
+
+	// The caller's map is left as it was, the stamped copy is what every node applies
+	data = copyData(data)
+	now := time.Now()
+	if _, exists := data["_created_at"]; !exists {
+		data["_created_at"] = now
+	}
+	if _, exists := data["_updated_at"]; !exists {
+		data["_updated_at"] = now
+	}
+
+	op, err := persistence.NewOperation(persistence.OpInsertEntity, entityType, id, data)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.InsertWithOptions(entityType, id, data, options)
+	})
+}
+
+// Update commits the update of an entity
+func (e *Engine) Update(entityType, id string, data map[string]interface{}) error {
+	return e.UpdateWithOptions(entityType, id, data, common.WriteOptions{})
+}
+
+// UpdateWithOptions commits the update of an entity
+// The update time is set before the write is committed, so every node stores the same one
+func (e *Engine) UpdateWithOptions(entityType, id string, data map[string]interface{}, options common.WriteOptions) error {
+	data = copyData(data)
+	data["_updated_at"] = time.Now()
+
+	op, err := persistence.NewOperation(persistence.OpUpdateEntity, entityType, id, data)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.UpdateWithOptions(entityType, id, data, options)
+	})
+}
+
+// Delete commits the deletion of an entity
+func (e *Engine) Delete(entityType, id string) error {
+	return e.DeleteWithOptions(entityType, id, common.WriteOptions{})
+}
+
+// DeleteWithOptions commits the deletion of an entity
+func (e *Engine) DeleteWithOptions(entityType, id string, options common.WriteOptions) error {
+	op, err := persistence.NewOperation(persistence.OpDeleteEntity, entityType, id, nil)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.DeleteWithOptions(entityType, id, options)
+	})
+}
+
+// UpdateEntityType commits the update of an entity type
+func (e *Engine) UpdateEntityType(def common.EntityDefinition) error {
+	op, err := persistence.NewOperation(persistence.OpUpdateEntityType, def.Name, "", def)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.UpdateEntityType(def)
+	})
+}
+
+// RollbackEntityType commits the rollback of an entity type to a previous version
+// Other nodes apply it as the update to the restored definition
+func (e *Engine) RollbackEntityType(entityType string, version int) error {
+	restored, ok := e.restoredDefinition(entityType, version)
+	if !ok {
+		// Let the datastore report why the version cannot be restored
+		return e.DatastoreEngine.RollbackEntityType(entityType, version)
+	}
+
+	op, err := persistence.NewOperation(persistence.OpUpdateEntityType, entityType, "", restored)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.RollbackEntityType(entityType, version)
+	})
+}
+
+// restoredDefinition returns the definition a rollback to a version restores
+func (e *Engine) restoredDefinition(entityType string, version int) (common.EntityDefinition, bool) {
+	current, err := e.DatastoreEngine.GetEntityDefinition(entityType)
+	if err != nil || current.Version == version {
+		return common.EntityDefinition{}, false
+	}
+	versions, err := e.DatastoreEngine.GetSchemaVersions(entityType)
+	if err != nil {
+		return common.EntityDefinition{}, false
+	}
+
+	for _, v := range versions {
+		if v.Version == version {
+			return common.EntityDefinition{
+				Name:        entityType,
+				Fields:      append([]common.FieldDefinition(nil), v.Definition.Fields...),
+				IDGenerator: current.IDGenerator,
+				Relations:   append([]common.RelationDefinition(nil), v.Definition.Relations...),
+			}, true
+		}
+	}
+	return common.EntityDefinition{}, false
+}
+
+// TruncateEntityType commits the removal of all entities of a type
+func (e *Engine) TruncateEntityType(entityType string) error {
+	op, err := persistence.NewOperation(persistence.OpTruncateEntityType, entityType, "", nil)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.TruncateEntityType(entityType)
+	})
+}
+
+// TruncateDatabase commits the removal of all entities
+func (e *Engine) TruncateDatabase() error {
+	op, err := persistence.NewOperation(persistence.OpTruncateDatabase, "", "", nil)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, e.DatastoreEngine.TruncateDatabase)
+}
+
+// DropEntityType commits the removal of an entity type
+func (e *Engine) DropEntityType(entityType string) error {
+	op, err := persistence.NewOperation(persistence.OpDropEntityType, entityType, "", nil)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.DropEntityType(entityType)
+	})
+}
+
+// RenameEntityType commits the renaming of an entity type
+func (e *Engine) RenameEntityType(oldName, newName string) error {
+	return e.node.propose(persistence.NewRenameOperation(oldName, newName), func() error {
+		return e.DatastoreEngine.RenameEntityType(oldName, newName)
+	})
+}
+
+// CloneEntityType commits the cloning of an entity type
+func (e *Engine) CloneEntityType(source, target string, includeData bool) error {
+	op, err := persistence.NewCloneOperation(source, target, includeData)
+	if err != nil {
+		return err
+	}
+	return e.node.propose(op, func() error {
+		return e.DatastoreEngine.CloneEntityType(source, target, includeData)
+	})
+}
+
+// copyData returns a copy of the fields of a write that can be stamped without changing the caller's map
+func copyData(data map[string]interface{}) map[string]interface{} {
+	copied := make(map[string]interface{}, len(data)+2)
+	for field, value := range data {
+		copied[field] = value
+	}
+	return copied
+}
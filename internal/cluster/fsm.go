@@ -0,0 +1,190 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/hashicorp/raft"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/persistence"
+)
+
+// Kinds of cluster log commands
+const (
+	commandWrite         = iota + 1 // A write to the datastore
+	commandSetAPIAddress            // Announces or removes the API address of a node
+)
+
+// command is an entry of the cluster log
+type command struct {
+	Kind       int
+	Origin     string // Run ID of the process that proposed a write
+	Proposal   uint64 // ID of the write within the proposing process
+	Operation  persistence.Operation
+	NodeID     string
+	APIAddress string
+}
+
+// encodeCommand encodes a command for the cluster log
+func encodeCommand(cmd command) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cmd); err != nil {
+		return nil, fmt.Errorf("failed to encode cluster command: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// snapshotHeader is the cluster state stored in front of the data of a snapshot
+type snapshotHeader struct {
+	APIAddresses map[string]string `json:"api_addresses"`
+}
+
+// fsm applies the cluster log to a node
+type fsm Node
+
+// Apply applies a committed command
+// Writes this process proposed are applied as they were made, so their proposer learns
+// about their errors. Other writes, of other leaders or of an earlier run of this node,
+// are replayed, skipping what the datastore already reflects
+func (f *fsm) Apply(log *raft.Log) interface{} {
+	n := (*Node)(f)
+
+	var cmd command
+	if err := gob.NewDecoder(bytes.NewReader(log.Data)).Decode(&cmd); err != nil {
+		n.logger.Errorf("Failed to decode cluster log entry %d: %v", log.Index, err)
+		return err
+	}
+
+	switch cmd.Kind {
+	case commandSetAPIAddress:
+		n.mu.Lock()
+		if cmd.APIAddress == "" {
+			delete(n.apiAddresses, cmd.NodeID)
+		} else {
+			n.apiAddresses[cmd.NodeID] = cmd.APIAddress
+		}
+		n.mu.Unlock()
+		return nil
+
+	case commandWrite:
+		n.applying.Store(true)
+		defer n.applying.Store(false)
+
+		if cmd.Origin == n.runID {
+			if p := n.takeProposal(cmd.Proposal); p != nil {
+				// A failed write fails the same way on every node, which leaves the data unchanged
+				err := p.apply()
+				p.done <- err
+				return err
+			}
+		}
+		return n.replay(cmd.Operation)
+
+	default:
+		return fmt.Errorf("unknown cluster command: %d", cmd.Kind)
+	}
+}
+
+// replay applies a committed write to the datastore, which also stores it locally
+func (n *Node) replay(operation persistence.Operation) error {
+	if err := persistence.ReplayOperation(n.store, n.logger, operation); err != nil {
+		n.logger.Warnf("Failed to apply cluster log entry for %s: %v", operation.EntityType, err)
+		return err
+	}
+	return nil
+}
+
+// Snapshot captures the state of the node to compact the cluster log
+// Raft applies no entries meanwhile, so the datastore is snapshotted to the local persistence
+// as of the last applied entry, and a view of the local persistence keeps that state for Persist
+func (f *fsm) Snapshot() (raft.FSMSnapshot, error) {
+	n := (*Node)(f)
+
+	if err := n.local.GetPersistenceProvider().TakeSnapshot(n.store); err != nil {
+		return nil, fmt.Errorf("failed to snapshot the datastore: %w", err)
+	}
+	view, err := n.local.ViewBackup()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cluster snapshot: %w", err)
+	}
+
+	n.mu.Lock()
+	addresses := make(map[string]string, len(n.apiAddresses))
+	for id, address := range n.apiAddresses {
+		addresses[id] = address
+	}
+	n.mu.Unlock()
+
+	return &fsmSnapshot{local: n.local, view: view, header: snapshotHeader{APIAddresses: addresses}}, nil
+}
+
+// Restore replaces the state of the node with a snapshot, for a node that fell too far behind
+func (f *fsm) Restore(snapshot io.ReadCloser) error {
+	n := (*Node)(f)
+	defer snapshot.Close()
+
+	var length uint32
+	if err := binary.Read(snapshot, binary.BigEndian, &length); err != nil {
+		return fmt.Errorf("failed to read cluster snapshot header: %w", err)
+	}
+	var header snapshotHeader
+	if err := json.NewDecoder(io.LimitReader(snapshot, int64(length))).Decode(&header); err != nil {
+		return fmt.Errorf("failed to decode cluster snapshot header: %w", err)
+	}
+
+	n.applying.Store(true)
+	defer n.applying.Store(false)
+
+	if err := n.local.Restore(snapshot, common.RestoreOptions{DiscardPrevious: true}); err != nil {
+		return fmt.Errorf("failed to restore cluster snapshot: %w", err)
+	}
+
+	n.mu.Lock()
+	n.apiAddresses = header.APIAddresses
+	if n.apiAddresses == nil {
+		n.apiAddresses = make(map[string]string)
+	}
+	n.mu.Unlock()
+
+	n.logger.Infof("Restored cluster snapshot")
+	return nil
+}
+
+// fsmSnapshot writes a snapshot of a node as the cluster state followed by a backup of the local persistence
+type fsmSnapshot struct {
+	local  Local
+	view   *persistence.BackupView // Local persistence as of the snapshot
+	header snapshotHeader
+}
+
+// Persist writes the snapshot
+func (s *fsmSnapshot) Persist(sink raft.SnapshotSink) error {
+	header, err := json.Marshal(s.header)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	if err := binary.Write(sink, binary.BigEndian, uint32(len(header))); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if _, err := sink.Write(header); err != nil {
+		sink.Cancel()
+		return err
+	}
+	if err := s.local.StreamBackupView(sink, s.view, true); err != nil {
+		sink.Cancel()
+		return fmt.Errorf("failed to write cluster snapshot: %w", err)
+	}
+	return sink.Close()
+}
+
+// Release is called when Raft is done with the snapshot
+func (s *fsmSnapshot) Release() {
+	s.view.Close()
+}
@@ -0,0 +1,186 @@
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/hashicorp/raft"
+)
+
+// Key prefixes of the Raft log store
+var (
+	logKeyPrefix    = []byte("log:")
+	stableKeyPrefix = []byte("stable:")
+)
+
+// errStableKeyNotFound is the error Raft expects for a missing stable store key
+var errStableKeyNotFound = errors.New("not found")
+
+// logStore keeps the Raft log and the Raft state of a node in a Badger database
+// It implements raft.LogStore and raft.StableStore
+type logStore struct {
+	db *badger.DB
+}
+
+// newLogStore opens the Raft log store in a directory
+// Every write is synced, Raft relies on its log being durable once stored
+func newLogStore(path string) (*logStore, error) {
+	options := badger.DefaultOptions(path).
+		WithSyncWrites(true).
+		WithLogger(nil)
+
+	db, err := badger.Open(options)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open raft log store: %w", err)
+	}
+	return &logStore{db: db}, nil
+}
+
+// logKey returns the key of a log entry, ordered by index
+func logKey(index uint64) []byte {
+	key := make([]byte, len(logKeyPrefix)+8)
+	copy(key, logKeyPrefix)
+	binary.BigEndian.PutUint64(key[len(logKeyPrefix):], index)
+	return key
+}
+
+// FirstIndex returns the index of the first stored log entry, 0 without entries
+func (s *logStore) FirstIndex() (uint64, error) {
+	return s.edgeIndex(false)
+}
+
+// LastIndex returns the index of the last stored log entry, 0 without entries
+func (s *logStore) LastIndex() (uint64, error) {
+	return s.edgeIndex(true)
+}
+
+// edgeIndex returns the index of the first or last stored log entry
+func (s *logStore) edgeIndex(last bool) (uint64, error) {
+	var index uint64
+	err := s.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Reverse = last
+		opts.Prefix = logKeyPrefix
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		seek := logKey(0)
+		if last {
+			seek = logKey(^uint64(0))
+		}
+		it.Seek(seek)
+		if it.Valid() {
+			index = binary.BigEndian.Uint64(it.Item().Key()[len(logKeyPrefix):])
+		}
+		return nil
+	})
+	return index, err
+}
+
+// GetLog reads the log entry at an index
+func (s *logStore) GetLog(index uint64, log *raft.Log) error {
+	return s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(logKey(index))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return raft.ErrLogNotFound
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return gob.NewDecoder(bytes.NewReader(val)).Decode(log)
+		})
+	})
+}
+
+// StoreLog stores a log entry
+func (s *logStore) StoreLog(log *raft.Log) error {
+	return s.StoreLogs([]*raft.Log{log})
+}
+
+// StoreLogs stores log entries in one write
+func (s *logStore) StoreLogs(logs []*raft.Log) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for _, log := range logs {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(log); err != nil {
+			return fmt.Errorf("failed to encode raft log entry %d: %w", log.Index, err)
+		}
+		if err := batch.Set(logKey(log.Index), buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	return batch.Flush()
+}
+
+// DeleteRange deletes the log entries from min to max, inclusive
+func (s *logStore) DeleteRange(min, max uint64) error {
+	batch := s.db.NewWriteBatch()
+	defer batch.Cancel()
+
+	for index := min; index <= max; index++ {
+		if err := batch.Delete(logKey(index)); err != nil {
+			return err
+		}
+		if index == max {
+			break // max can be the largest index
+		}
+	}
+	return batch.Flush()
+}
+
+// Set stores a value of the Raft state
+func (s *logStore) Set(key []byte, val []byte) error {
+	return s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(append(append([]byte{}, stableKeyPrefix...), key...), val)
+	})
+}
+
+// Get reads a value of the Raft state
+func (s *logStore) Get(key []byte) ([]byte, error) {
+	var value []byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(append(append([]byte{}, stableKeyPrefix...), key...))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return errStableKeyNotFound
+		}
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	return value, err
+}
+
+// SetUint64 stores a number of the Raft state
+func (s *logStore) SetUint64(key []byte, val uint64) error {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, val)
+	return s.Set(key, value)
+}
+
+// GetUint64 reads a number of the Raft state, 0 if it was never stored
+func (s *logStore) GetUint64(key []byte) (uint64, error) {
+	value, err := s.Get(key)
+	if errors.Is(err, errStableKeyNotFound) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(value), nil
+}
+
+// Close closes the log store
+func (s *logStore) Close() error {
+	return s.db.Close()
+}
@@ -0,0 +1,468 @@
+// Package cluster replicates the writes of a datastore between nodes through a Raft log
+// The leader commits every write to the cluster log before it is acknowledged, and every
+// node applies the committed log to its own datastore and local persistence. When the
+// leader fails, the remaining nodes elect a new one as long as a majority of them is up
+package cluster
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/persistence"
+	"github.com/sirupsen/logrus"
+)
+
+// Local is the persistence of a node, which stores the data the cluster log was applied to
+type Local interface {
+	GetPersistenceProvider() common.PersistenceProvider
+	ViewBackup() (*persistence.BackupView, error)
+	StreamBackupView(w io.Writer, view *persistence.BackupView, compress bool) error
+	Restore(r io.Reader, options common.RestoreOptions) error
+}
+
+// autoIncrementCounters is implemented by datastores that can advance their auto-increment counters past existing IDs
+type autoIncrementCounters interface {
+	EnsureAutoIncrementCounterAboveExistingIDs() error
+}
+
+// Config holds configuration for a cluster node
+type Config struct {
+	NodeID            string         // Unique name of the node in the cluster
+	RaftAddress       string         // Address the Raft transport listens on, other nodes reach the node there
+	APIAddress        string         // Base URL of the node's HTTP API, followers forward writes to the leader's
+	DataDir           string         // Directory of the Raft log and snapshots, separate from the data directory
+	Bootstrap         bool           // Start a new cluster with this node as its only member
+	ElectionTimeout   time.Duration  // Time without contact to the leader before a node starts an election
+	ApplyTimeout      time.Duration  // Maximum time a write waits to be committed
+	SnapshotThreshold uint64         // Number of log entries after which the log is compacted into a snapshot
+	Transport         raft.Transport // Replaces the TCP transport when set, e.g. with in-memory transports in tests
+	Logger            *logrus.Logger
+}
+
+// DefaultConfig returns a default cluster node configuration
+func DefaultConfig() Config {
+	return Config{
+		ElectionTimeout:   time.Second,
+		ApplyTimeout:      10 * time.Second,
+		SnapshotThreshold: 8192,
+		Logger:            logrus.New(),
+	}
+}
+
+// Node is a member of a cluster
+// Its API writes through Engine, which commits writes to the cluster log before the node
+// applies them, and its datastore uses Provider as persistence provider, which stores the
+// applied writes locally
+type Node struct {
+	config   Config
+	local    Local
+	logger   *logrus.Logger
+	runID    string // Identifies the writes this process proposed
+	provider *Provider
+	store    common.DatastoreEngine
+
+	raft      *raft.Raft
+	logStore  *logStore
+	transport raft.Transport
+
+	applying atomic.Bool // Set while the node applies the cluster log to its datastore
+	ready    atomic.Bool // Leader, with every entry of earlier terms applied
+
+	mu           sync.Mutex
+	apiAddresses map[string]string    // API addresses announced by the nodes, by node ID
+	proposals    map[uint64]*proposal // Writes of this process waiting for their commit, by proposal ID
+	nextProposal uint64
+
+	leaderNotify chan bool
+	stop         chan struct{}
+	done         chan struct{}
+}
+
+// NewNode creates a cluster node that applies the cluster log to its local persistence
+func NewNode(config Config, local Local) (*Node, error) {
+	if config.NodeID == "" {
+		return nil, fmt.Errorf("cluster node ID is required")
+	}
+	if config.DataDir == "" {
+		return nil, fmt.Errorf("cluster data directory is required")
+	}
+	if config.Transport == nil && config.RaftAddress == "" {
+		return nil, fmt.Errorf("cluster raft address is required")
+	}
+
+	defaults := DefaultConfig()
+	if config.ElectionTimeout <= 0 {
+		config.ElectionTimeout = defaults.ElectionTimeout
+	}
+	if config.ApplyTimeout <= 0 {
+		config.ApplyTimeout = defaults.ApplyTimeout
+	}
+	if config.SnapshotThreshold == 0 {
+		config.SnapshotThreshold = defaults.SnapshotThreshold
+	}
+	if config.Logger == nil {
+		config.Logger = defaults.Logger
+	}
+
+	node := &Node{
+		config:       config,
+		local:        local,
+		logger:       config.Logger,
+		runID:        uuid.New().String(),
+		apiAddresses: make(map[string]string),
+		proposals:    make(map[uint64]*proposal),
+		leaderNotify: make(chan bool, 16),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+	node.provider = &Provider{node: node, local: local.GetPersistenceProvider()}
+	return node, nil
+}
+
+// Provider returns the persistence provider the node's datastore has to use
+func (n *Node) Provider() *Provider {
+	return n.provider
+}
+
+// Config returns the configuration of the node
+func (n *Node) Config() Config {
+	return n.config
+}
+
+// SetEngine sets the datastore the node applies the cluster log to
+func (n *Node) SetEngine(store common.DatastoreEngine) {
+	n.store = store
+}
+
+// Start joins the node to the cluster
+// The datastore has to be set first, since the node applies pending log entries right away
+func (n *Node) Start() error {
+	if n.store == nil {
+		return fmt.Errorf("cannot start cluster node before the datastore engine is set")
+	}
+	if err := os.MkdirAll(n.config.DataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create cluster data directory: %w", err)
+	}
+
+	// Raft logs warnings for every unreachable peer, only errors are kept when the logger is quieter
+	raftLogLevel := hclog.Warn
+	if n.logger.GetLevel() < logrus.WarnLevel {
+		raftLogLevel = hclog.Error
+	}
+	raftLogger := hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Output: n.logger.Out,
+		Level:  raftLogLevel,
+	})
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(n.config.NodeID)
+	raftConfig.HeartbeatTimeout = n.config.ElectionTimeout
+	raftConfig.ElectionTimeout = n.config.ElectionTimeout
+	raftConfig.LeaderLeaseTimeout = n.config.ElectionTimeout / 2
+	raftConfig.SnapshotThreshold = n.config.SnapshotThreshold
+	raftConfig.NotifyCh = n.leaderNotify
+	raftConfig.Logger = raftLogger
+	// The local persistence already holds what was applied before a restart,
+	// the entries after the last snapshot are applied to it again
+	raftConfig.NoSnapshotRestoreOnStart = true
+
+	logStore, err := newLogStore(filepath.Join(n.config.DataDir, "log"))
+	if err != nil {
+		return err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStoreWithLogger(n.config.DataDir, 2, raftLogger)
+	if err != nil {
+		logStore.Close()
+		return fmt.Errorf("failed to open cluster snapshot store: %w", err)
+	}
+
+	transport := n.config.Transport
+	if transport == nil {
+		transport, err = raft.NewTCPTransportWithLogger(n.config.RaftAddress, nil, 3, 10*time.Second, raftLogger)
+		if err != nil {
+			logStore.Close()
+			return fmt.Errorf("failed to listen on %s: %w", n.config.RaftAddress, err)
+		}
+	}
+
+	if n.config.Bootstrap {
+		hasState, err := raft.HasExistingState(logStore, logStore, snapshots)
+		if err != nil {
+			logStore.Close()
+			return fmt.Errorf("failed to read cluster state: %w", err)
+		}
+		if !hasState {
+			configuration := raft.Configuration{Servers: []raft.Server{{
+				ID:      raftConfig.LocalID,
+				Address: transport.LocalAddr(),
+			}}}
+			if err := raft.BootstrapCluster(raftConfig, logStore, logStore, snapshots, transport, configuration); err != nil {
+				logStore.Close()
+				return fmt.Errorf("failed to bootstrap cluster: %w", err)
+			}
+		}
+	}
+
+	r, err := raft.NewRaft(raftConfig, (*fsm)(n), logStore, logStore, snapshots, transport)
+	if err != nil {
+		logStore.Close()
+		return fmt.Errorf("failed to start raft: %w", err)
+	}
+
+	n.raft = r
+	n.logStore = logStore
+	n.transport = transport
+
+	go n.watchLeadership()
+
+	n.logger.Infof("Cluster node %s started at %s", n.config.NodeID, transport.LocalAddr())
+	return nil
+}
+
+// Shutdown stops the node, without removing it from the cluster
+func (n *Node) Shutdown() error {
+	if n.raft == nil {
+		return nil
+	}
+
+	close(n.stop)
+	<-n.done
+	n.ready.Store(false)
+
+	err := n.raft.Shutdown().Error()
+	if closer, ok := n.transport.(io.Closer); ok {
+		closer.Close()
+	}
+	if closeErr := n.logStore.Close(); err == nil {
+		err = closeErr
+	}
+	n.raft = nil
+	return err
+}
+
+// watchLeadership tracks whether the node leads the cluster and can accept writes
+// A new leader accepts writes once it has applied the entries of earlier terms,
+// and announces its API address if the cluster does not know it yet
+func (n *Node) watchLeadership() {
+	defer close(n.done)
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case leader := <-n.leaderNotify:
+			if !leader {
+				if n.ready.Swap(false) {
+					n.logger.Infof("Cluster node %s is no longer the leader", n.config.NodeID)
+				}
+				continue
+			}
+
+			if err := n.raft.Barrier(n.config.ApplyTimeout).Error(); err != nil {
+				n.logger.Warnf("Failed to apply the cluster log as new leader: %v", err)
+				continue
+			}
+			// Replayed inserts carry their IDs, the counters only follow them here
+			if counters, ok := n.store.(autoIncrementCounters); ok {
+				if err := counters.EnsureAutoIncrementCounterAboveExistingIDs(); err != nil {
+					n.logger.Warnf("Failed to advance auto-increment counters: %v", err)
+				}
+			}
+			n.ready.Store(true)
+			n.logger.Infof("Cluster node %s is the leader", n.config.NodeID)
+
+			if n.config.APIAddress != "" && n.apiAddress(n.config.NodeID) != n.config.APIAddress {
+				if err := n.announce(n.config.NodeID, n.config.APIAddress); err != nil {
+					n.logger.Warnf("Failed to announce API address: %v", err)
+				}
+			}
+		}
+	}
+}
+
+// IsLeader reports whether the node leads the cluster and accepts writes
+func (n *Node) IsLeader() bool {
+	return n.ready.Load()
+}
+
+// Leader returns the ID and API address of the cluster leader, empty while there is none
+func (n *Node) Leader() (string, string) {
+	if n.raft == nil {
+		return "", ""
+	}
+	_, id := n.raft.LeaderWithID()
+	if id == "" {
+		return "", ""
+	}
+	return string(id), n.apiAddress(string(id))
+}
+
+// WaitForLeader waits until the cluster has a leader
+func (n *Node) WaitForLeader(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if id, _ := n.Leader(); id != "" {
+			return nil
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return fmt.Errorf("no cluster leader elected within %s", timeout)
+}
+
+// Join adds a node to the cluster as a voting member, on the leader
+func (n *Node) Join(id, raftAddress, apiAddress string) error {
+	if id == "" || raftAddress == "" {
+		return fmt.Errorf("node ID and raft address are required")
+	}
+	if !n.ready.Load() {
+		return common.ErrNotClusterLeader
+	}
+
+	if err := n.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(raftAddress), 0, n.config.ApplyTimeout).Error(); err != nil {
+		return n.leaderError("failed to add node "+id, err)
+	}
+	n.logger.Infof("Node %s at %s joined the cluster", id, raftAddress)
+
+	if apiAddress != "" {
+		return n.announce(id, apiAddress)
+	}
+	return nil
+}
+
+// Remove removes a node from the cluster, on the leader
+func (n *Node) Remove(id string) error {
+	if !n.ready.Load() {
+		return common.ErrNotClusterLeader
+	}
+
+	if err := n.raft.RemoveServer(raft.ServerID(id), 0, n.config.ApplyTimeout).Error(); err != nil {
+		return n.leaderError("failed to remove node "+id, err)
+	}
+	n.logger.Infof("Node %s left the cluster", id)
+
+	if id == n.config.NodeID {
+		// The node stepped down and cannot commit anymore
+		return nil
+	}
+	return n.announce(id, "")
+}
+
+// Status describes the cluster as the node sees it
+func (n *Node) Status() common.ClusterStatus {
+	status := common.ClusterStatus{NodeID: n.config.NodeID, State: raft.Shutdown.String(), Members: []common.ClusterMember{}}
+	if n.raft == nil {
+		return status
+	}
+
+	status.State = n.raft.State().String()
+	status.LeaderID, status.LeaderAPI = n.Leader()
+	status.Term = n.raft.CurrentTerm()
+	status.AppliedIndex = n.raft.AppliedIndex()
+	status.CommitIndex, _ = strconv.ParseUint(n.raft.Stats()["commit_index"], 10, 64)
+
+	future := n.raft.GetConfiguration()
+	if err := future.Error(); err != nil {
+		n.logger.Warnf("Failed to read cluster configuration: %v", err)
+		return status
+	}
+	for _, server := range future.Configuration().Servers {
+		status.Members = append(status.Members, common.ClusterMember{
+			ID:          string(server.ID),
+			RaftAddress: string(server.Address),
+			APIAddress:  n.apiAddress(string(server.ID)),
+			Voter:       server.Suffrage == raft.Voter,
+			Leader:      string(server.ID) == status.LeaderID,
+		})
+	}
+	return status
+}
+
+// apiAddress returns the API address a node announced
+func (n *Node) apiAddress(id string) string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.apiAddresses[id]
+}
+
+// announce commits the API address of a node, an empty address removes it
+func (n *Node) announce(id, apiAddress string) error {
+	return n.apply(command{Kind: commandSetAPIAddress, NodeID: id, APIAddress: apiAddress})
+}
+
+// proposal is a write of this process waiting for its commit
+type proposal struct {
+	apply func() error // Applies the write to the datastore
+	done  chan error   // Receives the result of apply
+}
+
+// propose commits a write to the cluster log and waits until the node applied it
+// The node applies its own writes with apply, so errors of the write reach the caller
+func (n *Node) propose(operation persistence.Operation, apply func() error) error {
+	if !n.ready.Load() {
+		return common.ErrNotClusterLeader
+	}
+
+	p := &proposal{apply: apply, done: make(chan error, 1)}
+	n.mu.Lock()
+	n.nextProposal++
+	id := n.nextProposal
+	n.proposals[id] = p
+	n.mu.Unlock()
+
+	err := n.apply(command{Kind: commandWrite, Origin: n.runID, Proposal: id, Operation: operation})
+
+	// A proposal that is gone was committed and is being applied, even if the leader
+	// lost its leadership before it learned about the commit
+	if n.takeProposal(id) == nil {
+		return <-p.done
+	}
+	return err
+}
+
+// takeProposal removes a write of this process waiting for its commit and returns it
+func (n *Node) takeProposal(id uint64) *proposal {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	p := n.proposals[id]
+	delete(n.proposals, id)
+	return p
+}
+
+// apply commits a command to the cluster log and waits until the node applied it
+func (n *Node) apply(cmd command) error {
+	data, err := encodeCommand(cmd)
+	if err != nil {
+		return err
+	}
+
+	future := n.raft.Apply(data, n.config.ApplyTimeout)
+	if err := future.Error(); err != nil {
+		return n.leaderError("failed to commit to the cluster log", err)
+	}
+	if err, ok := future.Response().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// leaderError wraps an error of a leader operation, marking lost leadership as common.ErrNotClusterLeader
+func (n *Node) leaderError(message string, err error) error {
+	if errors.Is(err, raft.ErrNotLeader) || errors.Is(err, raft.ErrLeadershipLost) || errors.Is(err, raft.ErrLeadershipTransferInProgress) {
+		return fmt.Errorf("%s: %w", message, common.ErrNotClusterLeader)
+	}
+	return fmt.Errorf("%s: %w", message, err)
+}
@@ -0,0 +1,222 @@
+package cluster
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// errUncommittedWrite is returned for writes to the datastore of a cluster node that do not come from the cluster log
+var errUncommittedWrite = errors.New("writes to a cluster node have to be committed to the cluster log first")
+
+// Provider is the persistence provider of a cluster node's datastore
+// Writes reach the datastore when the node applies the cluster log, and are stored in the
+// local persistence from there. Everything else goes to the local persistence directly
+type Provider struct {
+	node  *Node
+	local common.PersistenceProvider
+}
+
+// write stores a write locally while the node applies the cluster log, and rejects it otherwise
+func (p *Provider) write(persist func() error) error {
+	if !p.node.applying.Load() {
+		return errUncommittedWrite
+	}
+	return persist()
+}
+
+// RegisterEntityType stores the registration of an entity type locally
+func (p *Provider) RegisterEntityType(store common.DatastoreEngine, def common.EntityDefinition) error {
+	return p.write(func() error {
+		return p.local.RegisterEntityType(store, def)
+	})
+}
+
+// Insert stores the insertion of an entity locally
+func (p *Provider) Insert(store common.DatastoreEngine, entityType, entityID string, data map[string]interface{}) error {
+	return p.InsertWithOptions(store, entityType, entityID, data, common.WriteOptions{})
+}
+
+// InsertWithOptions stores the insertion of an entity locally with the given durability
+func (p *Provider) InsertWithOptions(store common.DatastoreEngine, entityType, entityID string, data map[string]interface{}, options common.WriteOptions) error {
+	return p.write(func() error {
+		if local, ok := p.local.(common.PersistenceWithWriteOptions); ok {
+			return local.InsertWithOptions(store, entityType, entityID, data, options)
+		}
+		return p.local.Insert(store, entityType, entityID, data)
+	})
+}
+
+// Update stores the update of an entity locally
+func (p *Provider) Update(store common.DatastoreEngine, entityType string, entityID string, data map[string]interface{}) error {
+	return p.UpdateWithOptions(store, entityType, entityID, data, common.WriteOptions{})
+}
+
+// UpdateWithOptions stores the update of an entity locally with the given durability
+func (p *Provider) UpdateWithOptions(store common.DatastoreEngine, entityType string, entityID string, data map[string]interface{}, options common.WriteOptions) error {
+	return p.write(func() error {
+		if local, ok := p.local.(common.PersistenceWithWriteOptions); ok {
+			return local.UpdateWithOptions(store, entityType, entityID, data, options)
+		}
+		return p.local.Update(store, entityType, entityID, data)
+	})
+}
+
+// Delete stores the deletion of an entity locally
+func (p *Provider) Delete(store common.DatastoreEngine, entityID string, entityType string) error {
+	return p.DeleteWithOptions(store, entityID, entityType, common.WriteOptions{})
+}
+
+// DeleteWithOptions stores the deletion of an entity locally with the given durability
+func (p *Provider) DeleteWithOptions(store common.DatastoreEngine, entityID string, entityType string, options common.WriteOptions) error {
+	return p.write(func() error {
+		if local, ok := p.local.(common.PersistenceWithWriteOptions); ok {
+			return local.DeleteWithOptions(store, entityID, entityType, options)
+		}
+		return p.local.Delete(store, entityID, entityType)
+	})
+}
+
+// UpdateEntityType stores the update of an entity type locally
+func (p *Provider) UpdateEntityType(store common.DatastoreEngine, def common.EntityDefinition) error {
+	return p.write(func() error {
+		return p.local.UpdateEntityType(store, def)
+	})
+}
+
+// TruncateEntityType stores the removal of all entities of a type locally
+func (p *Provider) TruncateEntityType(store common.DatastoreEngine, entityType string) error {
+	return p.write(func() error {
+		return p.local.TruncateEntityType(store, entityType)
+	})
+}
+
+// TruncateDatabase stores the removal of all entities locally
+func (p *Provider) TruncateDatabase(store common.DatastoreEngine) error {
+	return p.write(func() error {
+		return p.local.TruncateDatabase(store)
+	})
+}
+
+// DropEntityType stores the removal of an entity type locally
+func (p *Provider) DropEntityType(store common.DatastoreEngine, entityType string) error {
+	return p.write(func() error {
+		return p.local.DropEntityType(store, entityType)
+	})
+}
+
+// RenameEntityType stores the renaming of an entity type locally
+func (p *Provider) RenameEntityType(store common.DatastoreEngine, oldName, newName string) error {
+	return p.write(func() error {
+		return p.local.RenameEntityType(store, oldName, newName)
+	})
+}
+
+// CloneEntityType stores the cloning of an entity type locally
+func (p *Provider) CloneEntityType(store common.DatastoreEngine, source, target string, includeData bool) error {
+	return p.write(func() error {
+		return p.local.CloneEntityType(store, source, target, includeData)
+	})
+}
+
+// TakeSnapshot takes a snapshot of the local persistence
+func (p *Provider) TakeSnapshot(store common.DatastoreEngine) error {
+	return p.local.TakeSnapshot(store)
+}
+
+// LoadLatestSnapshot loads the latest snapshot of the local persistence
+func (p *Provider) LoadLatestSnapshot(store common.DatastoreEngine) error {
+	return p.local.LoadLatestSnapshot(store)
+}
+
+// LoadWAL replays the WAL of the local persistence
+func (p *Provider) LoadWAL(store common.DatastoreEngine) error {
+	return p.local.LoadWAL(store)
+}
+
+// Close closes the local persistence
+func (p *Provider) Close() error {
+	return p.local.Close()
+}
+
+// LoadCounters loads the auto-increment counters from the local persistence
+func (p *Provider) LoadCounters(store common.DatastoreEngine) error {
+	if local, ok := p.local.(common.PersistenceWithCounters); ok {
+		return local.LoadCounters(store)
+	}
+	return nil
+}
+
+// SaveCounter stores an auto-increment counter locally
+// Counters follow from the replicated writes, so they are not committed
+func (p *Provider) SaveCounter(entityType string, counter uint64) error {
+	if local, ok := p.local.(common.PersistenceWithCounters); ok {
+		return local.SaveCounter(entityType, counter)
+	}
+	return nil
+}
+
+// LoadDeletedIDs loads the deleted IDs from the local persistence
+func (p *Provider) LoadDeletedIDs(store common.DatastoreEngine) error {
+	if local, ok := p.local.(common.PersistenceWithDeletedIDs); ok {
+		return local.LoadDeletedIDs(store)
+	}
+	return nil
+}
+
+// SaveDeletedIDs stores the deleted IDs of an entity type locally
+func (p *Provider) SaveDeletedIDs(entityType string, deletedIDs map[string]bool) error {
+	if local, ok := p.local.(common.PersistenceWithDeletedIDs); ok {
+		return local.SaveDeletedIDs(entityType, deletedIDs)
+	}
+	return nil
+}
+
+// LoadSchemaVersions loads the schema history from the local persistence
+func (p *Provider) LoadSchemaVersions(store common.DatastoreEngine) error {
+	if local, ok := p.local.(common.PersistenceWithSchemaVersions); ok {
+		return local.LoadSchemaVersions(store)
+	}
+	return nil
+}
+
+// SaveSchemaVersion stores a schema version locally
+func (p *Provider) SaveSchemaVersion(entityType string, version common.EntityDefinitionVersion) error {
+	if local, ok := p.local.(common.PersistenceWithSchemaVersions); ok {
+		return local.SaveSchemaVersion(entityType, version)
+	}
+	return nil
+}
+
+// ReadEntityBodies reads entity bodies from the local persistence
+func (p *Provider) ReadEntityBodies(entityType string, ids []string) ([]common.Entity, error) {
+	if local, ok := p.local.(common.EntityBodyStore); ok {
+		return local.ReadEntityBodies(entityType, ids)
+	}
+	return nil, fmt.Errorf("local persistence does not store entity bodies")
+}
+
+// WriteEntityBodies stores entity bodies locally
+func (p *Provider) WriteEntityBodies(stored []common.Entity, removed []common.Entity) error {
+	if local, ok := p.local.(common.EntityBodyStore); ok {
+		return local.WriteEntityBodies(stored, removed)
+	}
+	return fmt.Errorf("local persistence does not store entity bodies")
+}
+
+// PruneEntityBodies removes entity bodies stored locally
+func (p *Provider) PruneEntityBodies(keep func(entityType, id string) bool) error {
+	if local, ok := p.local.(common.EntityBodyStore); ok {
+		return local.PruneEntityBodies(keep)
+	}
+	return fmt.Errorf("local persistence does not store entity bodies")
+}
+
+// ViewEntityBodies returns a view of the entity bodies stored locally
+func (p *Provider) ViewEntityBodies() (common.EntityBodyView, error) {
+	if local, ok := p.local.(common.EntityBodyStore); ok {
+		return local.ViewEntityBodies()
+	}
+	return nil, fmt.Errorf("local persistence does not store entity bodies")
+}
@@ -1,8 +1,10 @@
 package common
 
 import (
+	"context"
 	"errors"
 	"strconv"
+	"time"
 )
 
 // PersistenceProvider defines the interface for storage backends
@@ -17,6 +19,9 @@ type PersistenceProvider interface {
 
 	TruncateEntityType(store DatastoreEngine, entityType string) error
 	TruncateDatabase(store DatastoreEngine) error
+	DropEntityType(store DatastoreEngine, entityType string) error
+	RenameEntityType(store DatastoreEngine, oldName, newName string) error
+	CloneEntityType(store DatastoreEngine, source, target string, includeData bool) error
 
 	// Snapshot and recovery operations
 	TakeSnapshot(store DatastoreEngine) error
@@ -47,8 +52,13 @@ type DatastoreEngine interface {
 	Insert(entityType, id string, data map[string]interface{}) error
 	Update(entityType string, id string, data map[string]interface{}) error // Updated signature
 	Delete(entityType string, id string) error
+	InsertWithOptions(entityType, id string, data map[string]interface{}, options WriteOptions) error
+	UpdateWithOptions(entityType string, id string, data map[string]interface{}, options WriteOptions) error
+	DeleteWithOptions(entityType string, id string, options WriteOptions) error
 	Get(id string) (Entity, error)
+	GetByType(id string, entityType string) (Entity, error)
 	GetEntityCount(entityType string) (int, error)
+	EntityCounts() map[string]int // Entity counts of all entity types, read at once
 	GetAllEntitiesOfType(entityType string) ([]Entity, error)
 
 	UpdateEntityType(updatedDef EntityDefinition) error
@@ -59,6 +69,39 @@ type DatastoreEngine interface {
 	LoadDeletedIDs(entityType string, deletedIDs map[string]bool) error
 	TruncateEntityType(entityType string) error
 	TruncateDatabase() error
+	DropEntityType(entityType string) error
+	RenameEntityType(oldName, newName string) error
+	CloneEntityType(source, target string, includeData bool) error
+
+	GetSchemaVersions(entityType string) ([]EntityDefinitionVersion, error)
+	LoadSchemaVersions(entityType string, versions []EntityDefinitionVersion) error
+	RollbackEntityType(entityType string, version int) error
+
+	Reload() error
+
+	// StreamSnapshot passes every entity type and its entities, as of a single point in time,
+	// to a snapshot writer in batches of at most batchSize entities
+	// atPoint, if not nil, runs at that point while writes are blocked
+	StreamSnapshot(atPoint func(), batchSize int, writer SnapshotWriter) error
+
+	// CheckIntegrity verifies unique constraints and index consistency of the loaded data
+	CheckIntegrity() []error
+}
+
+// SnapshotWriter receives the entity types and entities of a snapshot as they are read
+// Entity types arrive in name order, each followed by the batches of its entities
+type SnapshotWriter interface {
+	// WriteEntityType starts an entity type
+	WriteEntityType(def EntityDefinition) error
+	// WriteEntities writes a batch of entities of the last started entity type
+	// The batch is only valid during the call
+	WriteEntities(entities []Entity) error
+}
+
+// EntityTypeSnapshot is a copy of an entity type and all of its entities
+type EntityTypeSnapshot struct {
+	Definition EntityDefinition
+	Entities   []Entity
 }
 
 // Entity represents a concrete instance with data
@@ -77,13 +120,44 @@ type FieldDefinition struct {
 	Nullable bool   `json:"nullable,omitempty"`
 	Internal bool   `json:"internal,omitempty"`
 	Unique   bool   `json:"unique,omitempty"`
+	FullText bool   `json:"fullText,omitempty"` // Maintain a full-text index for string and text fields
+	Trigram  bool   `json:"trigram,omitempty"`  // Maintain a trigram index for substring and fuzzy filters
 }
 
 // EntityDefinition defines an entity's structure with fields
 type EntityDefinition struct {
-	Name        string            `json:"name"`
-	Fields      []FieldDefinition `json:"fields"`
-	IDGenerator IDGenerationType  `json:"idGenerator"`
+	Name        string               `json:"name"`
+	Fields      []FieldDefinition    `json:"fields"`
+	Relations   []RelationDefinition `json:"relations,omitempty"`
+	IDGenerator IDGenerationType     `json:"idGenerator"`
+	Version     int                  `json:"version,omitempty"` // Schema version, assigned by the engine
+}
+
+// RelationDefinition declares how the entities of a type relate to the entities of another type,
+// so queries can include related entities by the name of the relation
+type RelationDefinition struct {
+	Name         string       `json:"name"`                   // Name of the relation, and of the field holding the related entities
+	EntityType   string       `json:"entityType"`             // The related entity type
+	Type         RelationType `json:"type"`                   // "one" or "many"
+	LocalField   string       `json:"localField,omitempty"`   // Field of this entity type, defaults to "id" for a many relation
+	ForeignField string       `json:"foreignField,omitempty"` // Field of the related entity type, defaults to "id" for a one relation
+}
+
+// RelationType defines how many related entities a relation holds
+type RelationType string
+
+// Relation types
+const (
+	RelationOne  RelationType = "one"  // The entity refers to one related entity, e.g. an order to its customer
+	RelationMany RelationType = "many" // Related entities refer to the entity, e.g. a customer to its orders
+)
+
+// EntityDefinitionVersion represents a numbered revision of an entity definition
+type EntityDefinitionVersion struct {
+	Version    int              `json:"version"`
+	Definition EntityDefinition `json:"definition"`
+	CreatedAt  time.Time        `json:"createdAt"`
+	RollbackOf int              `json:"rollbackOf,omitempty"` // Version this revision was restored from
 }
 
 // IDGenerationType defines the type of ID generation strategy
@@ -156,3 +230,207 @@ type PersistenceWithDeletedIDs interface {
 	LoadDeletedIDs(store DatastoreEngine) error
 	SaveDeletedIDs(entityType string, deletedIDs map[string]bool) error
 }
+
+// PersistenceWithSchemaVersions extends PersistenceProvider with schema history operations
+type PersistenceWithSchemaVersions interface {
+	PersistenceProvider
+
+	// Schema version operations
+	LoadSchemaVersions(store DatastoreEngine) error
+	SaveSchemaVersion(entityType string, version EntityDefinitionVersion) error
+}
+
+// Durability selects when a write is acknowledged
+type Durability string
+
+const (
+	DurabilitySync  Durability = "sync"  // Acknowledged once the write is synced to disk
+	DurabilityGroup Durability = "group" // Acknowledged once the group commit containing the write is synced to disk
+	DurabilityAsync Durability = "async" // Acknowledged at once and synced with the next group commit
+)
+
+// IsValid reports whether d is a known durability
+func (d Durability) IsValid() bool {
+	switch d {
+	case DurabilitySync, DurabilityGroup, DurabilityAsync:
+		return true
+	default:
+		return false
+	}
+}
+
+// WriteOptions controls how a single write is persisted
+type WriteOptions struct {
+	Durability Durability      // Overrides the default durability of the provider, empty keeps it
+	Context    context.Context // Carries the trace of the request making the write, nil when there is none
+}
+
+// PersistenceWithWriteOptions extends PersistenceProvider with per-write options for entity writes
+type PersistenceWithWriteOptions interface {
+	PersistenceProvider
+
+	InsertWithOptions(store DatastoreEngine, entityType, entityID string, data map[string]interface{}, options WriteOptions) error
+	UpdateWithOptions(store DatastoreEngine, entityType string, entityID string, data map[string]interface{}, options WriteOptions) error
+	DeleteWithOptions(store DatastoreEngine, entityID string, entityType string, options WriteOptions) error
+}
+
+// EntityBodyStore keeps entity bodies outside of memory for the lazy entity storage mode
+// The stored bodies are derived data, the datastore reconciles them with the loaded data whenever it loads
+type EntityBodyStore interface {
+	// ReadEntityBodies reads the bodies of entities of one type, skipping IDs that are not stored
+	ReadEntityBodies(entityType string, ids []string) ([]Entity, error)
+	// WriteEntityBodies stores entity bodies and removes the bodies of removed entities
+	// Removed entities only need their type and ID
+	WriteEntityBodies(stored []Entity, removed []Entity) error
+	// PruneEntityBodies removes the stored bodies of the entities keep rejects
+	PruneEntityBodies(keep func(entityType, id string) bool) error
+	// ViewEntityBodies returns a read-only view of the entity bodies stored at this point
+	ViewEntityBodies() (EntityBodyView, error)
+}
+
+// EntityBodyView reads the entity bodies stored at a single point in time
+type EntityBodyView interface {
+	// ForEachEntityBody passes the stored bodies of an entity type to fn in batches of at most batchSize
+	ForEachEntityBody(entityType string, batchSize int, fn func(entities []Entity) error) error
+	// Close releases the view
+	Close()
+}
+
+// BackupOptions controls how a backup is streamed
+type BackupOptions struct {
+	Compress bool   // Compress the backup with zstd
+	Since    uint64 // Only include changes made after this backup version, 0 for a full backup
+}
+
+// RestoreOptions controls how a backup is restored
+type RestoreOptions struct {
+	Incremental bool            // Apply the backup on top of the current data instead of replacing it
+	Target      *RecoveryTarget // Rewind to this point after loading the backup, nil keeps everything
+	// DiscardPrevious removes the replaced data once the restore succeeded instead of keeping a copy,
+	// for restores the server runs itself, such as replica bootstraps and cluster snapshot installs
+	DiscardPrevious bool
+}
+
+// RecoveryTarget selects the point in the write-ahead log a database is recovered to
+// Entries written after it are not replayed. Sequence takes precedence over Time when both are set
+type RecoveryTarget struct {
+	Time     time.Time
+	Sequence uint64
+}
+
+// Includes reports whether a WAL entry was written at or before the target
+func (t RecoveryTarget) Includes(sequence uint64, timestamp int64) bool {
+	if t.Sequence > 0 {
+		return sequence <= t.Sequence
+	}
+	return timestamp <= t.Time.UnixNano()
+}
+
+// String describes the target for logs and messages
+func (t RecoveryTarget) String() string {
+	if t.Sequence > 0 {
+		return "sequence " + strconv.FormatUint(t.Sequence, 10)
+	}
+	return t.Time.Format(time.RFC3339Nano)
+}
+
+// ParseRecoveryTarget builds a recovery target from an RFC 3339 time or a WAL sequence number
+// It returns nil if both are empty
+func ParseRecoveryTarget(until, untilSequence string) (*RecoveryTarget, error) {
+	switch {
+	case until != "" && untilSequence != "":
+		return nil, errors.New("use either a recovery time or a sequence number, not both")
+	case until != "":
+		t, err := time.Parse(time.RFC3339Nano, until)
+		if err != nil {
+			return nil, errors.New("recovery time must be in RFC 3339 format, e.g. 2024-05-01T14:03:00Z")
+		}
+		return &RecoveryTarget{Time: t}, nil
+	case untilSequence != "":
+		sequence, err := strconv.ParseUint(untilSequence, 10, 64)
+		if err != nil || sequence == 0 {
+			return nil, errors.New("recovery sequence must be a positive integer")
+		}
+		return &RecoveryTarget{Sequence: sequence}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// WALRecord describes an entry of the write-ahead log
+type WALRecord struct {
+	SequenceNum uint64    `json:"sequence"`
+	Timestamp   time.Time `json:"timestamp"`
+	Operation   string    `json:"operation"`
+	EntityType  string    `json:"entity_type,omitempty"`
+	EntityID    string    `json:"entity_id,omitempty"`
+	Archived    bool      `json:"archived"`
+}
+
+// ErrReplicaSnapshotRequired is returned to a replica whose position is no longer in the
+// WAL history of its primary, because the entries it needs were pruned or the primary was
+// restored or recovered. The replica has to bootstrap from a snapshot again
+var ErrReplicaSnapshotRequired = errors.New("replica must be bootstrapped from a snapshot")
+
+// ReplicationPosition identifies a point in the WAL history of a primary
+// The history ID changes whenever the primary's history is rewritten by a restore or recovery
+type ReplicationPosition struct {
+	HistoryID string `json:"history_id"`
+	Sequence  uint64 `json:"sequence"`
+}
+
+// ReplicationEntry is a WAL entry shipped from a primary to its replicas, with its data uncompressed
+type ReplicationEntry struct {
+	SequenceNum uint64 `json:"sequence"`
+	Timestamp   int64  `json:"timestamp"`
+	Operation   int    `json:"operation"`
+	EntityType  string `json:"entity_type,omitempty"`
+	EntityID    string `json:"entity_id,omitempty"`
+	Data        []byte `json:"data,omitempty"`
+}
+
+// ReplicationBatch holds the WAL entries a primary ships after a position, oldest first
+// Position is the primary's latest durable position, so replicas can tell how far behind they are
+type ReplicationBatch struct {
+	Position ReplicationPosition `json:"position"`
+	Entries  []ReplicationEntry  `json:"entries"`
+}
+
+// ReplicationStatus describes the replication state of a replica
+type ReplicationStatus struct {
+	Primary         string    `json:"primary"`
+	State           string    `json:"state"` // bootstrapping, streaming or error
+	HistoryID       string    `json:"history_id"`
+	AppliedSequence uint64    `json:"applied_sequence"`
+	PrimarySequence uint64    `json:"primary_sequence"`
+	LagEntries      uint64    `json:"lag_entries"`
+	LagSeconds      float64   `json:"lag_seconds"` // Time since the replica was last caught up, 0 while it is
+	LastContact     time.Time `json:"last_contact,omitempty"`
+	LastError       string    `json:"last_error,omitempty"`
+	Bootstraps      int       `json:"bootstraps"`
+}
+
+// ErrNotClusterLeader is returned for writes to a cluster node that is not the leader
+// Writes have to be sent to the leader, which commits them to the cluster log
+var ErrNotClusterLeader = errors.New("this node is not the cluster leader")
+
+// ClusterMember is a node of a cluster
+type ClusterMember struct {
+	ID          string `json:"id"`
+	RaftAddress string `json:"raft_address"`
+	APIAddress  string `json:"api_address,omitempty"` // Base URL of the node's HTTP API, if it announced one
+	Voter       bool   `json:"voter"`
+	Leader      bool   `json:"leader"`
+}
+
+// ClusterStatus describes a cluster as one of its nodes sees it
+type ClusterStatus struct {
+	NodeID       string          `json:"node_id"`
+	State        string          `json:"state"` // Leader, Follower, Candidate or Shutdown
+	LeaderID     string          `json:"leader_id,omitempty"`
+	LeaderAPI    string          `json:"leader_api,omitempty"`
+	Term         uint64          `json:"term"`
+	CommitIndex  uint64          `json:"commit_index"`
+	AppliedIndex uint64          `json:"applied_index"`
+	Members      []ClusterMember `json:"members"`
+}
@@ -0,0 +1,79 @@
+package datastore
+
+import "github.com/phillarmonic/syncopate-db/internal/common"
+
+// DropEntityType removes an entity type definition together with all of its entities,
+// indices, ID generator state and schema history
+func (dse *Engine) DropEntityType(entityType string) error {
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
+	// Acquire write lock for the whole in-memory removal
+	dse.mu.Lock()
+
+	def, exists := dse.definitions[entityType]
+	if !exists {
+		dse.mu.Unlock()
+		return entityTypeNotFoundError(entityType)
+	}
+
+	// Keep copies of everything we remove so a failed persistence call can be rolled back
+	removedEntities := make(map[string]common.Entity)
+	err := dse.entities.forEachOfType(entityType, func(key string, entity common.Entity) bool {
+		removedEntities[key] = entity
+		dse.entities.remove(key)
+		return true
+	})
+	if err != nil {
+		for key, entity := range removedEntities {
+			dse.entities.put(key, entity)
+		}
+		dse.mu.Unlock()
+		return err
+	}
+
+	removedIndices := dse.indices[entityType]
+	removedUniqueIndices := dse.uniqueIndices[entityType]
+	removedVersions := dse.schemaVersions[entityType]
+	removedFullTextIndices := dse.fullTextIndices[entityType]
+	removedTrigramIndices := dse.trigramIndices[entityType]
+
+	delete(dse.definitions, entityType)
+	delete(dse.indices, entityType)
+	delete(dse.indexEntries, entityType)
+	delete(dse.uniqueIndices, entityType)
+	delete(dse.schemaVersions, entityType)
+	delete(dse.fullTextIndices, entityType)
+	delete(dse.trigramIndices, entityType)
+
+	// Store reference to persistence provider and release lock
+	persistenceProvider := dse.persistence
+	dse.mu.Unlock()
+
+	if persistenceProvider != nil {
+		if err := persistenceProvider.DropEntityType(dse, entityType); err != nil {
+			// If persistence fails, restore the in-memory state
+			dse.mu.Lock()
+			dse.definitions[entityType] = def
+			dse.indices[entityType] = removedIndices
+			dse.recountIndexEntries(entityType)
+			dse.uniqueIndices[entityType] = removedUniqueIndices
+			dse.fullTextIndices[entityType] = removedFullTextIndices
+			dse.trigramIndices[entityType] = removedTrigramIndices
+			if removedVersions != nil {
+				dse.schemaVersions[entityType] = removedVersions
+			}
+			for key, entity := range removedEntities {
+				dse.entities.put(key, entity)
+			}
+			dse.mu.Unlock()
+
+			return persistenceFailedError(err)
+		}
+	}
+
+	// Forget the ID generator state last, so a failed drop keeps counters intact
+	dse.idGeneratorMgr.UnregisterEntityType(entityType)
+
+	return nil
+}
@@ -16,19 +16,28 @@ import (
 // Engine provides the core functionality for storing and retrieving data
 // and implements the common.DatastoreEngine interface
 type Engine struct {
-	definitions    map[string]common.EntityDefinition
-	entities       map[string]common.Entity // Key format: "entityType:entityID"
-	indices        map[string]map[string]map[string][]string
-	uniqueIndices  map[string]map[string]map[string]string
-	persistence    common.PersistenceProvider
-	idGeneratorMgr *IDGeneratorManager
-	mu             sync.RWMutex
+	definitions     map[string]common.EntityDefinition
+	entities        entityStore // Key format: "entityType:entityID"
+	indices         map[string]map[string]map[string][]string
+	indexEntries    map[string]map[string]int // Key format: entityType -> field, IDs held by the field index
+	uniqueIndices   map[string]map[string]map[string]string
+	schemaVersions  map[string]map[int]common.EntityDefinitionVersion // Key format: entityType -> version
+	fullTextIndices map[string]map[string]*FullTextIndex              // Key format: entityType -> field
+	trigramIndices  map[string]map[string]*TrigramIndex               // Key format: entityType -> field
+	persistence     common.PersistenceProvider
+	entityBodies    common.EntityBodyStore // Set in lazy entity storage mode
+	idGeneratorMgr  *IDGeneratorManager
+	mu              sync.RWMutex
+	writes          sync.RWMutex // Held shared by writes until they are persisted or rolled back
 }
 
 // EngineConfig holds configuration for the data store engine
 type EngineConfig struct {
 	Persistence       common.PersistenceProvider
 	EnablePersistence bool
+	// LazyEntities keeps entity bodies on disk and only IDs, indices and recently used
+	// bodies in memory. It needs a persistence provider that implements common.EntityBodyStore
+	LazyEntities bool
 }
 
 // createEntityKey creates a composite key from an entity type and ID
@@ -48,12 +57,25 @@ func parseEntityKey(key string) (string, string) {
 // NewDataStoreEngine creates a new data store engine instance
 func NewDataStoreEngine(config ...EngineConfig) *Engine {
 	engine := &Engine{
-		definitions:    make(map[string]common.EntityDefinition),
-		entities:       make(map[string]common.Entity),
-		indices:        make(map[string]map[string]map[string][]string),
-		uniqueIndices:  make(map[string]map[string]map[string]string),
-		idGeneratorMgr: NewIDGeneratorManager(),
+		definitions:     make(map[string]common.EntityDefinition),
+		indices:         make(map[string]map[string]map[string][]string),
+		indexEntries:    make(map[string]map[string]int),
+		uniqueIndices:   make(map[string]map[string]map[string]string),
+		schemaVersions:  make(map[string]map[int]common.EntityDefinitionVersion),
+		fullTextIndices: make(map[string]map[string]*FullTextIndex),
+		trigramIndices:  make(map[string]map[string]*TrigramIndex),
+		idGeneratorMgr:  NewIDGeneratorManager(),
+	}
+
+	// Entity bodies stay on disk in lazy mode, if the persistence provider can store them
+	if len(config) > 0 && config[0].LazyEntities && config[0].EnablePersistence {
+		if bodies, ok := config[0].Persistence.(common.EntityBodyStore); ok {
+			engine.entityBodies = bodies
+		} else {
+			fmt.Printf("Lazy entity storage needs a persistence provider that stores entity bodies, keeping entities in memory\n")
+		}
 	}
+	engine.entities = engine.newEntityStore()
 
 	// Apply configuration if provided
 	if len(config) > 0 {
@@ -62,38 +84,94 @@ func NewDataStoreEngine(config ...EngineConfig) *Engine {
 
 			// Load data from persistence - this happens before the server starts
 			// handling requests, so we don't need to worry about concurrency yet
-			if err := engine.persistence.LoadLatestSnapshot(engine); err != nil {
-				// Log error but continue
-				fmt.Printf("Error loading snapshot: %v\n", err)
-			}
+			engine.loadFromPersistence()
+		}
+	}
 
-			// Apply any WAL entries after the snapshot
-			if err := engine.persistence.LoadWAL(engine); err != nil {
-				// Log error but continue
-				fmt.Printf("Error loading WAL: %v\n", err)
-			}
+	engine.EnsureAutoIncrementCounterAboveExistingIDs()
 
-			// Load auto-increment counters
-			if persistenceWithCounters, ok := engine.persistence.(common.PersistenceWithCounters); ok {
-				if err := persistenceWithCounters.LoadCounters(engine); err != nil {
-					// Log error but continue
-					fmt.Printf("Error loading auto-increment counters: %v\n", err)
-				}
-			}
+	return engine
+}
 
-			// Load deleted IDs for auto-increment generators
-			if persistenceWithDeletedIDs, ok := engine.persistence.(common.PersistenceWithDeletedIDs); ok {
-				if err := persistenceWithDeletedIDs.LoadDeletedIDs(engine); err != nil {
-					// Log error but continue
-					fmt.Printf("Error loading deleted IDs: %v\n", err)
-				}
-			}
+// loadFromPersistence loads definitions, entities and ID generator state from the persistence provider
+// Load errors are logged and skipped, so a partially readable store still starts
+func (dse *Engine) loadFromPersistence() {
+	// Replayed operations are already stored, so the provider is detached while
+	// they run to keep them from being written to the WAL a second time
+	provider := dse.persistence
+	dse.persistence = nil
+	defer func() { dse.persistence = provider }()
+
+	// Load the schema history first, so replayed definitions keep their
+	// recorded versions instead of being recorded again
+	if persistenceWithVersions, ok := provider.(common.PersistenceWithSchemaVersions); ok {
+		if err := persistenceWithVersions.LoadSchemaVersions(dse); err != nil {
+			// Log error but continue
+			fmt.Printf("Error loading schema versions: %v\n", err)
 		}
 	}
 
-	engine.EnsureAutoIncrementCounterAboveExistingIDs()
+	if err := provider.LoadLatestSnapshot(dse); err != nil {
+		// Log error but continue
+		fmt.Printf("Error loading snapshot: %v\n", err)
+	}
 
-	return engine
+	// Apply any WAL entries after the snapshot
+	if err := provider.LoadWAL(dse); err != nil {
+		// Log error but continue
+		fmt.Printf("Error loading WAL: %v\n", err)
+	}
+
+	// Load auto-increment counters
+	if persistenceWithCounters, ok := provider.(common.PersistenceWithCounters); ok {
+		if err := persistenceWithCounters.LoadCounters(dse); err != nil {
+			// Log error but continue
+			fmt.Printf("Error loading auto-increment counters: %v\n", err)
+		}
+	}
+
+	// Load deleted IDs for auto-increment generators
+	if persistenceWithDeletedIDs, ok := provider.(common.PersistenceWithDeletedIDs); ok {
+		if err := persistenceWithDeletedIDs.LoadDeletedIDs(dse); err != nil {
+			// Log error but continue
+			fmt.Printf("Error loading deleted IDs: %v\n", err)
+		}
+	}
+
+	// Write the entity bodies that changed since the last start and remove those of missing entities
+	dse.mu.Lock()
+	if lazy, ok := dse.entities.(*lazyEntityStore); ok {
+		if err := lazy.finishLoad(); err != nil {
+			// Log error but continue, snapshots then read entities under the lock
+			fmt.Printf("Error removing stale entity bodies: %v\n", err)
+		}
+	}
+	dse.mu.Unlock()
+}
+
+// Reload discards all in-memory state and loads it again from the persistence provider
+// It is used after the underlying storage was replaced, e.g. by a restore. Callers must
+// make sure no other operations run on the engine while it reloads
+func (dse *Engine) Reload() error {
+	if dse.persistence == nil {
+		return persistenceFailedError(fmt.Errorf("engine has no persistence provider to reload from"))
+	}
+
+	dse.mu.Lock()
+	dse.definitions = make(map[string]common.EntityDefinition)
+	dse.entities = dse.newEntityStore()
+	dse.indices = make(map[string]map[string]map[string][]string)
+	dse.indexEntries = make(map[string]map[string]int)
+	dse.uniqueIndices = make(map[string]map[string]map[string]string)
+	dse.schemaVersions = make(map[string]map[int]common.EntityDefinitionVersion)
+	dse.fullTextIndices = make(map[string]map[string]*FullTextIndex)
+	dse.trigramIndices = make(map[string]map[string]*TrigramIndex)
+	dse.idGeneratorMgr = NewIDGeneratorManager()
+	dse.mu.Unlock()
+
+	dse.loadFromPersistence()
+
+	return dse.EnsureAutoIncrementCounterAboveExistingIDs()
 }
 
 // Close properly shuts down the engine
@@ -126,6 +204,9 @@ func (dse *Engine) Close() error {
 
 // RegisterEntityType registers a new entity type with the data store engine
 func (dse *Engine) RegisterEntityType(def common.EntityDefinition) error {
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
 	// First check if entity type already exists without modifying state
 	dse.mu.RLock()
 	_, exists := dse.definitions[def.Name]
@@ -140,6 +221,9 @@ func (dse *Engine) RegisterEntityType(def common.EntityDefinition) error {
 	if err := ValidateEntityTypeFields(def.Fields, true); err != nil {
 		return err
 	}
+	if err := ValidateEntityTypeRelations(def); err != nil {
+		return err
+	}
 
 	// Add internal fields to the definition
 	dse.addInternalFieldDefinitions(&def)
@@ -149,6 +233,11 @@ func (dse *Engine) RegisterEntityType(def common.EntityDefinition) error {
 		def.IDGenerator = common.IDTypeAutoIncrement
 	}
 
+	// New entity types start at version 1, replayed definitions keep their version
+	if def.Version <= 0 {
+		def.Version = 1
+	}
+
 	// Now acquire write lock for modification
 	dse.mu.Lock()
 
@@ -163,28 +252,10 @@ func (dse *Engine) RegisterEntityType(def common.EntityDefinition) error {
 
 	// Update in-memory state
 	dse.definitions[def.Name] = def
-	dse.indices[def.Name] = make(map[string]map[string][]string)
-
-	// Initialize unique indices for unique fields
-	dse.uniqueIndices[def.Name] = make(map[string]map[string]string)
-
-	// Initialize indices for indexed fields and unique indices for unique fields
-	for _, field := range def.Fields {
-		if field.Indexed {
-			dse.indices[def.Name][field.Name] = make(map[string][]string)
-		}
+	dse.initializeIndices(def)
 
-		if field.Unique {
-			// Unique fields should also be indexed for performance
-			if !field.Indexed {
-				field.Indexed = true
-				dse.indices[def.Name][field.Name] = make(map[string][]string)
-			}
-
-			// Initialize the unique index map
-			dse.uniqueIndices[def.Name][field.Name] = make(map[string]string)
-		}
-	}
+	// Record the initial schema version
+	versionRecord, recorded := dse.recordSchemaVersion(def, 0)
 
 	// Release lock before persistence operation
 	dse.mu.Unlock()
@@ -199,16 +270,66 @@ func (dse *Engine) RegisterEntityType(def common.EntityDefinition) error {
 			dse.mu.Lock()
 			delete(dse.definitions, def.Name)
 			delete(dse.indices, def.Name)
+			delete(dse.indexEntries, def.Name)
 			delete(dse.uniqueIndices, def.Name)
+			delete(dse.fullTextIndices, def.Name)
+			delete(dse.trigramIndices, def.Name)
+			if recorded {
+				delete(dse.schemaVersions[def.Name], def.Version)
+			}
 			dse.mu.Unlock()
 
 			return persistenceFailedError(persistErr)
 		}
+
+		if recorded {
+			dse.persistSchemaVersion(dse.persistence, versionRecord)
+		}
 	}
 
 	return nil
 }
 
+// initializeIndices creates empty indices and unique indices for an entity definition
+// This function requires that the caller holds a write lock
+func (dse *Engine) initializeIndices(def common.EntityDefinition) {
+	dse.indices[def.Name] = make(map[string]map[string][]string)
+	dse.indexEntries[def.Name] = make(map[string]int)
+
+	// Initialize unique indices for unique fields
+	dse.uniqueIndices[def.Name] = make(map[string]map[string]string)
+
+	// Initialize indices for indexed fields and unique indices for unique fields
+	for _, field := range def.Fields {
+		if field.Indexed {
+			dse.indices[def.Name][field.Name] = make(map[string][]string)
+		}
+
+		if field.Unique {
+			// Unique fields should also be indexed for performance
+			if !field.Indexed {
+				dse.indices[def.Name][field.Name] = make(map[string][]string)
+			}
+
+			// Initialize the unique index map
+			dse.uniqueIndices[def.Name][field.Name] = make(map[string]string)
+		}
+	}
+
+	dse.initializeFullTextIndices(def)
+	dse.initializeTrigramIndices(def)
+}
+
+// rebuildIndices recreates all indices of an entity type from its entities
+// This function requires that the caller holds a write lock
+func (dse *Engine) rebuildIndices(def common.EntityDefinition) error {
+	dse.initializeIndices(def)
+	return dse.entities.forEachOfType(def.Name, func(_ string, entity common.Entity) bool {
+		dse.updateIndices(entity, true)
+		return true
+	})
+}
+
 // GetEntityDefinition returns the definition for a specific entity type
 func (dse *Engine) GetEntityDefinition(entityType string) (common.EntityDefinition, error) {
 	dse.mu.RLock()
@@ -250,7 +371,7 @@ func (dse *Engine) prepareEntityForInsert(entityType string, id string, data map
 
 	// Check if ID already exists using the composite key
 	entityKey := createEntityKey(entityType, id)
-	if _, exists := dse.entities[entityKey]; exists {
+	if dse.entities.contains(entityKey) {
 		return common.Entity{}, entityAlreadyExistsError(entityType, id)
 	}
 
@@ -264,6 +385,14 @@ func (dse *Engine) prepareEntityForInsert(entityType string, id string, data map
 
 // Insert adds a new entity to the data store engine with support for ID generation
 func (dse *Engine) Insert(entityType string, id string, data map[string]interface{}) error {
+	return dse.InsertWithOptions(entityType, id, data, common.WriteOptions{})
+}
+
+// InsertWithOptions adds a new entity, persisting it as the write options require
+func (dse *Engine) InsertWithOptions(entityType string, id string, data map[string]interface{}, options common.WriteOptions) error {
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
 	// Check if entity type exists
 	dse.mu.RLock()
 	_, exists := dse.definitions[entityType]
@@ -319,7 +448,7 @@ func (dse *Engine) Insert(entityType string, id string, data map[string]interfac
 		return entityTypeNotFoundError(entityType)
 	}
 
-	if _, exists := dse.entities[entityKey]; exists {
+	if dse.entities.contains(entityKey) {
 		dse.mu.Unlock()
 		if generatedID {
 			// If we generated the ID and there's still a collision, something is wrong with our ID generator
@@ -338,7 +467,7 @@ func (dse *Engine) Insert(entityType string, id string, data map[string]interfac
 	}
 
 	// Store the entity and update indices
-	dse.entities[entityKey] = entity
+	dse.entities.put(entityKey, entity)
 	dse.updateIndices(entity, true)
 
 	// Store reference to persistence provider and release lock
@@ -347,14 +476,11 @@ func (dse *Engine) Insert(entityType string, id string, data map[string]interfac
 
 	// Persist entity if persistence is enabled
 	if persistenceProvider != nil {
-		if err := persistenceProvider.Insert(dse, entityType, id, data); err != nil {
+		if err := dse.persistInsert(persistenceProvider, entityType, id, data, options); err != nil {
 			// If persistence fails, we need to remove the entity from memory
 			dse.mu.Lock()
-			delete(dse.entities, entityKey)
-			// Update indices needs the entity to still be in entities, so we add it back temporarily
-			dse.entities[entityKey] = entity
 			dse.updateIndices(entity, false)
-			delete(dse.entities, entityKey)
+			dse.entities.remove(entityKey)
 			dse.mu.Unlock()
 
 			return persistenceFailedError(err)
@@ -379,34 +505,49 @@ func (dse *Engine) Insert(entityType string, id string, data map[string]interfac
 
 // Update updates an existing entity in the data store engine
 func (dse *Engine) Update(entityType string, id string, data map[string]interface{}) error {
+	return dse.UpdateWithOptions(entityType, id, data, common.WriteOptions{})
+}
+
+// UpdateWithOptions updates an existing entity, persisting the change as the write options require
+func (dse *Engine) UpdateWithOptions(entityType string, id string, data map[string]interface{}, options common.WriteOptions) error {
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
 	// First, read the current state without write lock
 	dse.mu.RLock()
 
 	// Try to find the entity using the composite key format
 	entityKey := createEntityKey(entityType, id)
-	entity, exists := dse.entities[entityKey]
+	entity, exists, err := dse.entities.get(entityKey)
 
 	// If not found by composite key, try backward compatibility approach
-	if !exists {
+	if !exists && err == nil {
 		// Try to find an entity with matching ID and type through iteration
-		for key, e := range dse.entities {
+		err = dse.entities.forEachOfType(entityType, func(key string, e common.Entity) bool {
 			_, entityID := parseEntityKey(key)
-			if entityID == id && e.Type == entityType {
+			if entityID == id {
 				entity = e
 				entityKey = key
 				exists = true
-				break
+				return false
 			}
-		}
+			return true
+		})
 	}
 
+	if err != nil {
+		dse.mu.RUnlock()
+		return err
+	}
 	if !exists {
 		dse.mu.RUnlock()
 		return fmt.Errorf("entity with ID %s and type %s not found", id, entityType)
 	}
 
-	// Update internal fields
-	data["_updated_at"] = time.Now()
+	// Update internal fields, keeping the update time a cluster leader set for every node
+	if _, exists := data["_updated_at"]; !exists {
+		data["_updated_at"] = time.Now()
+	}
 
 	// Ensure _created_at is not modified
 	delete(data, "_created_at")
@@ -434,7 +575,11 @@ func (dse *Engine) Update(entityType string, id string, data map[string]interfac
 	dse.mu.Lock()
 
 	// Check again if the entity exists under write lock
-	entity, exists = dse.entities[entityKey]
+	entity, exists, err = dse.entities.get(entityKey)
+	if err != nil {
+		dse.mu.Unlock()
+		return err
+	}
 	if !exists {
 		dse.mu.Unlock()
 		return fmt.Errorf("entity with ID %s and type %s not found", id, entityType)
@@ -462,7 +607,7 @@ func (dse *Engine) Update(entityType string, id string, data map[string]interfac
 	for k, v := range data {
 		entity.Fields[k] = v
 	}
-	dse.entities[entityKey] = entity
+	dse.entities.put(entityKey, entity)
 
 	// Add new index entries
 	dse.updateIndices(entity, true)
@@ -473,15 +618,17 @@ func (dse *Engine) Update(entityType string, id string, data map[string]interfac
 
 	// Persist update if persistence is enabled
 	if persistenceProvider != nil {
-		if err := persistenceProvider.Update(dse, entityType, id, data); err != nil {
+		if err := dse.persistUpdate(persistenceProvider, entityType, id, data, options); err != nil {
 			// Rollback in-memory state on error
 			dse.mu.Lock()
 			// Remove updated indices
-			entity = dse.entities[entityKey]
+			if current, exists, _ := dse.entities.get(entityKey); exists {
+				entity = current
+			}
 			dse.updateIndices(entity, false)
 
 			// Restore original entity
-			dse.entities[entityKey] = originalEntity
+			dse.entities.put(entityKey, originalEntity)
 			dse.updateIndices(originalEntity, true)
 			dse.mu.Unlock()
 
@@ -494,6 +641,14 @@ func (dse *Engine) Update(entityType string, id string, data map[string]interfac
 
 // Delete removes an entity from the data store engine
 func (dse *Engine) Delete(entityTypeToDelete string, id string) error {
+	return dse.DeleteWithOptions(entityTypeToDelete, id, common.WriteOptions{})
+}
+
+// DeleteWithOptions removes an entity, persisting the deletion as the write options require
+func (dse *Engine) DeleteWithOptions(entityTypeToDelete string, id string, options common.WriteOptions) error {
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
 	// First read the current state without write lock
 	dse.mu.RLock()
 
@@ -503,33 +658,39 @@ func (dse *Engine) Delete(entityTypeToDelete string, id string) error {
 
 	// Priority 1: Try with the precise composite key "{entityTypeToDelete}:{id}"
 	preciseKey := createEntityKey(entityTypeToDelete, id)
-	if e, ok := dse.entities[preciseKey]; ok {
+	e, ok, err := dse.entities.get(preciseKey)
+	if ok {
 		entityToProcess = e
 		actualEntityKey = preciseKey
 		entityFound = true
 	}
 
 	// Priority 2: Fallback for potential legacy keys or general search if preciseKey fails.
-	if !entityFound {
+	if !entityFound && err == nil {
 		// Check if `id` itself is a key (legacy) and if its type matches.
-		if e, ok := dse.entities[id]; ok && e.Type == entityTypeToDelete {
+		if e, ok, err = dse.entities.get(id); ok && e.Type == entityTypeToDelete {
 			entityToProcess = e
 			actualEntityKey = id // id here is the key
 			entityFound = true
-		} else {
+		} else if err == nil {
 			// Iterate to find a composite key that matches ID and Type.
-			for keyInMap, e := range dse.entities {
+			err = dse.entities.forEachOfType(entityTypeToDelete, func(keyInMap string, e common.Entity) bool {
 				_, idFromKey := parseEntityKey(keyInMap)
-				if idFromKey == id && e.Type == entityTypeToDelete {
+				if idFromKey == id {
 					entityToProcess = e
 					actualEntityKey = keyInMap
 					entityFound = true
-					break // Found the correct entity matching ID and Type
+					return false // Found the correct entity matching ID and Type
 				}
-			}
+				return true
+			})
 		}
 	}
 
+	if err != nil {
+		dse.mu.RUnlock()
+		return err
+	}
 	if !entityFound {
 		dse.mu.RUnlock()
 		return fmt.Errorf("entity with ID %s and type %s not found", id, entityTypeToDelete)
@@ -578,7 +739,11 @@ func (dse *Engine) Delete(entityTypeToDelete string, id string) error {
 	dse.mu.Lock()
 
 	// Check again if the entity exists
-	currentEntityInMap, currentExists := dse.entities[actualEntityKey]
+	currentEntityInMap, currentExists, err := dse.entities.get(actualEntityKey)
+	if err != nil {
+		dse.mu.Unlock()
+		return err
+	}
 	if !currentExists {
 		dse.mu.Unlock()
 		return fmt.Errorf("entity with ID %s and type %s not found (disappeared before write lock)", id, entityTypeToDelete)
@@ -594,7 +759,7 @@ func (dse *Engine) Delete(entityTypeToDelete string, id string) error {
 	dse.updateIndices(currentEntityInMap, false)
 
 	// Delete the entity
-	delete(dse.entities, actualEntityKey)
+	dse.entities.remove(actualEntityKey)
 
 	// Store reference to persistence provider and release lock
 	persistenceProvider := dse.persistence
@@ -603,10 +768,10 @@ func (dse *Engine) Delete(entityTypeToDelete string, id string) error {
 	// Persist deletion if persistence is enabled
 	if persistenceProvider != nil {
 		// Pass the simple `id` and `entityTypeForPersistence`
-		if err := persistenceProvider.Delete(dse, id, entityTypeForPersistence); err != nil {
+		if err := dse.persistDelete(persistenceProvider, id, entityTypeForPersistence, options); err != nil {
 			// Rollback in-memory state on error
 			dse.mu.Lock()
-			dse.entities[actualEntityKey] = originalEntity
+			dse.entities.put(actualEntityKey, originalEntity)
 			dse.updateIndices(originalEntity, true)
 			dse.mu.Unlock()
 
@@ -623,7 +788,10 @@ func (dse *Engine) Get(id string) (common.Entity, error) {
 	defer dse.mu.RUnlock()
 
 	// Try direct lookup first (backward compatibility)
-	entity, exists := dse.entities[id]
+	entity, exists, err := dse.entities.get(id)
+	if err != nil {
+		return common.Entity{}, err
+	}
 	if exists {
 		return entity, nil
 	}
@@ -633,11 +801,20 @@ func (dse *Engine) Get(id string) (common.Entity, error) {
 	// but we need to be more careful than before
 
 	// First, look for composite keys (type:id format)
-	for key, entity := range dse.entities {
+	err = dse.entities.forEach(func(key string, e common.Entity) bool {
 		_, entityID := parseEntityKey(key)
 		if entityID == id {
-			return entity, nil
+			entity = e
+			exists = true
+			return false
 		}
+		return true
+	})
+	if err != nil {
+		return common.Entity{}, err
+	}
+	if exists {
+		return entity, nil
 	}
 
 	return common.Entity{}, fmt.Errorf("entity with ID %s not found", id)
@@ -649,13 +826,16 @@ func (dse *Engine) GetByType(id string, entityType string) (common.Entity, error
 
 	// Try the composite key first
 	entityKey := createEntityKey(entityType, id)
-	entity, exists := dse.entities[entityKey]
+	entity, exists, err := dse.entities.get(entityKey)
+	if err != nil {
+		return common.Entity{}, err
+	}
 	if exists {
 		return entity, nil
 	}
 
 	// For backward compatibility, try just the ID but then verify the type
-	entity, err := dse.Get(id)
+	entity, err = dse.Get(id)
 	if err == nil && entity.Type == entityType {
 		return entity, nil
 	}
@@ -663,6 +843,30 @@ func (dse *Engine) GetByType(id string, entityType string) (common.Entity, error
 	return common.Entity{}, fmt.Errorf("entity with ID %s and type %s not found", id, entityType)
 }
 
+// persistInsert persists an insert, passing the write options on if the provider supports them
+func (dse *Engine) persistInsert(provider common.PersistenceProvider, entityType, id string, data map[string]interface{}, options common.WriteOptions) error {
+	if withOptions, ok := provider.(common.PersistenceWithWriteOptions); ok {
+		return withOptions.InsertWithOptions(dse, entityType, id, data, options)
+	}
+	return provider.Insert(dse, entityType, id, data)
+}
+
+// persistUpdate persists an update, passing the write options on if the provider supports them
+func (dse *Engine) persistUpdate(provider common.PersistenceProvider, entityType, id string, data map[string]interface{}, options common.WriteOptions) error {
+	if withOptions, ok := provider.(common.PersistenceWithWriteOptions); ok {
+		return withOptions.UpdateWithOptions(dse, entityType, id, data, options)
+	}
+	return provider.Update(dse, entityType, id, data)
+}
+
+// persistDelete persists a deletion, passing the write options on if the provider supports them
+func (dse *Engine) persistDelete(provider common.PersistenceProvider, id, entityType string, options common.WriteOptions) error {
+	if withOptions, ok := provider.(common.PersistenceWithWriteOptions); ok {
+		return withOptions.DeleteWithOptions(dse, id, entityType, options)
+	}
+	return provider.Delete(dse, id, entityType)
+}
+
 // ForceSnapshot immediately creates a snapshot of the current state
 func (dse *Engine) ForceSnapshot() error {
 	if dse.persistence == nil {
@@ -681,14 +885,19 @@ func (dse *Engine) GetEntityCount(entityType string) (int, error) {
 		return 0, fmt.Errorf("entity type %s not registered", entityType)
 	}
 
-	count := 0
-	for _, entity := range dse.entities {
-		if entity.Type == entityType {
-			count++
-		}
-	}
+	return dse.entities.countOfType(entityType), nil
+}
+
+// EntityCounts returns the count of entities of every entity type
+func (dse *Engine) EntityCounts() map[string]int {
+	dse.mu.RLock()
+	defer dse.mu.RUnlock()
 
-	return count, nil
+	counts := make(map[string]int, len(dse.definitions))
+	for entityType := range dse.definitions {
+		counts[entityType] = dse.entities.countOfType(entityType)
+	}
+	return counts
 }
 
 // GetAllEntitiesOfType retrieves all entities of a specific type
@@ -702,17 +911,113 @@ func (dse *Engine) GetAllEntitiesOfType(entityType string) ([]common.Entity, err
 
 	entities := make([]common.Entity, 0)
 
-	// Iterate through all entities and filter by type
+	// Iterate through all entities of the type
 	// For both legacy and new composite keys
-	for _, entity := range dse.entities {
-		if entity.Type == entityType {
-			entities = append(entities, entity)
-		}
+	err := dse.entities.forEachOfType(entityType, func(_ string, entity common.Entity) bool {
+		entities = append(entities, entity)
+		return true
+	})
+	if err != nil {
+		return nil, err
 	}
 
 	return entities, nil
 }
 
+// StreamSnapshot passes every entity type and its entities to a snapshot writer, per type and in batches
+// Entities are not copied, so writes are blocked until the whole snapshot is written, which keeps it
+// consistent without holding a second copy of the data in memory. In lazy mode, entity bodies are
+// read from a view of the body store instead, and writes are only blocked while the view is taken.
+// Writes applied in memory are rolled back if they fail to persist, so the snapshot point waits
+// until the writes in flight are persisted or rolled back, and never captures a failed write
+func (dse *Engine) StreamSnapshot(atPoint func(), batchSize int, writer common.SnapshotWriter) error {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
+	dse.writes.Lock()
+	dse.mu.RLock()
+	dse.writes.Unlock() // Holding the read lock is enough to block writes from here on
+	if lazy, ok := dse.entities.(*lazyEntityStore); ok && lazy.pruned {
+		return dse.streamLazySnapshot(lazy, atPoint, batchSize, writer)
+	}
+	defer dse.mu.RUnlock()
+
+	if atPoint != nil {
+		atPoint()
+	}
+
+	typeNames := make([]string, 0, len(dse.definitions))
+	for name := range dse.definitions {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+
+	for _, name := range typeNames {
+		if err := writer.WriteEntityType(dse.definitions[name]); err != nil {
+			return err
+		}
+
+		var err error
+		batch := make([]common.Entity, 0, batchSize)
+		storeErr := dse.entities.forEachOfType(name, func(_ string, entity common.Entity) bool {
+			batch = append(batch, entity)
+			if len(batch) < batchSize {
+				return true
+			}
+			err = writer.WriteEntities(batch)
+			batch = batch[:0]
+			return err == nil
+		})
+		if storeErr != nil {
+			return storeErr
+		}
+		if err != nil {
+			return err
+		}
+		if len(batch) > 0 {
+			if err := writer.WriteEntities(batch); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// streamLazySnapshot streams a snapshot of a lazy entity store from a view of its body store
+// This function requires that the caller holds a read lock, which it releases once the view is taken
+func (dse *Engine) streamLazySnapshot(lazy *lazyEntityStore, atPoint func(), batchSize int, writer common.SnapshotWriter) error {
+	view, err := lazy.snapshot()
+	if err != nil {
+		dse.mu.RUnlock()
+		return persistenceFailedError(err)
+	}
+	defer view.close()
+
+	if atPoint != nil {
+		atPoint()
+	}
+
+	defs := make([]common.EntityDefinition, 0, len(dse.definitions))
+	for _, def := range dse.definitions {
+		defs = append(defs, def)
+	}
+	dse.mu.RUnlock()
+
+	sort.Slice(defs, func(i, j int) bool { return defs[i].Name < defs[j].Name })
+	for _, def := range defs {
+		if err := writer.WriteEntityType(def); err != nil {
+			return err
+		}
+		if err := view.forEachOfType(def.Name, batchSize, writer.WriteEntities); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 // updateIndices adds or removes index entries for an entity
 func (dse *Engine) updateIndices(entity common.Entity, add bool) {
 	// Original index update logic
@@ -728,12 +1033,14 @@ func (dse *Engine) updateIndices(entity common.Entity, add bool) {
 						dse.indices[entity.Type][fieldDef.Name] = make(map[string][]string)
 					}
 					dse.indices[entity.Type][fieldDef.Name][strValue] = append(dse.indices[entity.Type][fieldDef.Name][strValue], entity.ID)
+					dse.countIndexEntry(entity.Type, fieldDef.Name, 1)
 				} else {
 					// Remove from index
 					ids := dse.indices[entity.Type][fieldDef.Name][strValue]
 					for i, id := range ids {
 						if id == entity.ID {
 							dse.indices[entity.Type][fieldDef.Name][strValue] = append(ids[:i], ids[i+1:]...)
+							dse.countIndexEntry(entity.Type, fieldDef.Name, -1)
 							break
 						}
 					}
@@ -749,6 +1056,10 @@ func (dse *Engine) updateIndices(entity common.Entity, add bool) {
 
 	// Also update unique indices
 	dse.updateUniqueIndices(entity, add)
+
+	// And full-text and trigram indices
+	dse.updateFullTextIndices(entity, add)
+	dse.updateTrigramIndices(entity, add)
 }
 
 // getIndexableValue converts a value to a string for indexing
@@ -789,8 +1100,10 @@ func (dse *Engine) addInternalFields(entityType string, data map[string]interfac
 		data["_created_at"] = time.Now()
 	}
 
-	// Add updated_at timestamp
-	data["_updated_at"] = time.Now()
+	// Add updated_at timestamp, keeping the one of entities loaded from snapshots and the WAL
+	if _, exists := data["_updated_at"]; !exists {
+		data["_updated_at"] = time.Now()
+	}
 }
 
 // addInternalFieldDefinitions adds internal field definitions to an entity type
@@ -840,9 +1153,12 @@ func (dse *Engine) DebugInspectEntities(inspector func(map[string]common.Entity)
 	defer dse.mu.RUnlock()
 
 	// Create a copy of the map to avoid exposing the internal map directly
-	entitiesCopy := make(map[string]common.Entity, len(dse.entities))
-	for k, v := range dse.entities {
+	entitiesCopy := make(map[string]common.Entity, dse.entities.len())
+	if err := dse.entities.forEach(func(k string, v common.Entity) bool {
 		entitiesCopy[k] = v
+		return true
+	}); err != nil {
+		fmt.Printf("Error reading entities: %v\n", err)
 	}
 
 	inspector(entitiesCopy)
@@ -916,24 +1232,24 @@ func (dse *Engine) MigrateToCompositeKeys() {
 	dse.mu.Lock()
 	defer dse.mu.Unlock()
 
-	// Create a temp map to hold migrated entities
-	migratedEntities := make(map[string]common.Entity)
-
-	// Process all entities
-	for key, entity := range dse.entities {
+	// Collect the entities stored under old-style keys
+	legacyEntities := make(map[string]common.Entity)
+	if err := dse.entities.forEach(func(key string, entity common.Entity) bool {
 		// Check if this is already a composite key
-		if strings.Contains(key, ":") {
-			migratedEntities[key] = entity
-			continue
+		if !strings.Contains(key, ":") {
+			legacyEntities[key] = entity
 		}
-
-		// This is an old-style key, create a composite key
-		newKey := createEntityKey(entity.Type, entity.ID)
-		migratedEntities[newKey] = entity
+		return true
+	}); err != nil {
+		fmt.Printf("Error reading entities to migrate: %v\n", err)
+		return
 	}
 
-	// Replace the old map with the migrated one
-	dse.entities = migratedEntities
+	// Move them to composite keys
+	for key, entity := range legacyEntities {
+		dse.entities.remove(key)
+		dse.entities.put(createEntityKey(entity.Type, entity.ID), entity)
+	}
 }
 
 // Add this function to validate uniqueness constraints
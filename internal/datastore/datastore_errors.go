@@ -36,6 +36,13 @@ func idGeneratorChangeError() error {
 	)
 }
 
+func schemaVersionNotFoundError(entityType string, version int) error {
+	return errors.NewError(
+		errors.ErrCodeSchemaVersionNotFound,
+		fmt.Sprintf("version %d of entity type '%s' not found", version, entityType),
+	)
+}
+
 // Common error transformations for entity operations
 func EntityNotFoundError(entityType, id string) error {
 	return errors.NewError(
@@ -124,6 +131,21 @@ func joinTargetNotFoundError(entityType string) error {
 	)
 }
 
+func queryTimeoutError(err error, message string) error {
+	return errors.WrapError(
+		err,
+		errors.ErrCodeQueryTimeout,
+		message,
+	)
+}
+
+func queryTooComplexError(message string) error {
+	return errors.NewError(
+		errors.ErrCodeQueryTooComplex,
+		message,
+	)
+}
+
 // Persistence errors
 func persistenceFailedError(err error) error {
 	return errors.WrapError(
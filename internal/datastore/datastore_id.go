@@ -83,6 +83,50 @@ func (g *AutoIncrementGenerator) MarkIDDeleted(entityType string, id string) {
 	g.deletedIDs[entityType][id] = true
 }
 
+// RemoveEntityType discards the counter and deleted IDs of an entity type
+func (g *AutoIncrementGenerator) RemoveEntityType(entityType string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.counters, entityType)
+	delete(g.deletedIDs, entityType)
+}
+
+// RenameEntityType moves the counter and deleted IDs of an entity type to a new name
+func (g *AutoIncrementGenerator) RenameEntityType(oldName, newName string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if counter, exists := g.counters[oldName]; exists {
+		g.counters[newName] = counter
+		delete(g.counters, oldName)
+	}
+
+	if deletedMap, exists := g.deletedIDs[oldName]; exists {
+		g.deletedIDs[newName] = deletedMap
+		delete(g.deletedIDs, oldName)
+	}
+}
+
+// CopyEntityType copies the counter and deleted IDs of an entity type to another entity type
+func (g *AutoIncrementGenerator) CopyEntityType(source, target string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if counter, exists := g.counters[source]; exists {
+		value := atomic.LoadUint64(counter)
+		g.counters[target] = &value
+	}
+
+	if deletedMap, exists := g.deletedIDs[source]; exists {
+		copied := make(map[string]bool, len(deletedMap))
+		for id, val := range deletedMap {
+			copied[id] = val
+		}
+		g.deletedIDs[target] = copied
+	}
+}
+
 // ValidateID validates if an ID is a valid auto-increment ID
 func (g *AutoIncrementGenerator) ValidateID(id string) bool {
 	_, err := strconv.ParseUint(id, 10, 64)
@@ -243,6 +287,27 @@ func (m *IDGeneratorManager) RegisterEntityType(entityType string, generatorType
 	m.entityGenerators[entityType] = generatorType
 }
 
+// UnregisterEntityType removes an entity type and any auto-increment state kept for it
+func (m *IDGeneratorManager) UnregisterEntityType(entityType string) {
+	m.mu.Lock()
+	delete(m.entityGenerators, entityType)
+	m.mu.Unlock()
+
+	m.autoIncrement.RemoveEntityType(entityType)
+}
+
+// RenameEntityType moves the ID generation strategy and state of an entity type to a new name
+func (m *IDGeneratorManager) RenameEntityType(oldName, newName string) {
+	m.mu.Lock()
+	if generatorType, exists := m.entityGenerators[oldName]; exists {
+		m.entityGenerators[newName] = generatorType
+		delete(m.entityGenerators, oldName)
+	}
+	m.mu.Unlock()
+
+	m.autoIncrement.RenameEntityType(oldName, newName)
+}
+
 // GetGenerator returns the appropriate ID generator for an entity type
 func (m *IDGeneratorManager) GetGenerator(entityType string) (common.IDGenerator, error) {
 	m.mu.RLock()
@@ -382,6 +447,23 @@ func (dse *Engine) GetIDGeneratorType(entityType string) (common.IDGenerationTyp
 	return def.IDGenerator, nil
 }
 
+// GenerateID generates the ID of a new entity, as an insert without an ID does
+func (dse *Engine) GenerateID(entityType string) (string, error) {
+	dse.mu.RLock()
+	_, exists := dse.definitions[entityType]
+	dse.mu.RUnlock()
+
+	if !exists {
+		return "", entityTypeNotFoundError(entityType)
+	}
+
+	id, err := dse.idGeneratorMgr.GenerateID(entityType)
+	if err != nil {
+		return "", idGenerationFailedError(err)
+	}
+	return id, nil
+}
+
 // SaveDeletedIDs serializes the deleted IDs for persistence
 func (g *AutoIncrementGenerator) SaveDeletedIDs(entityType string) map[string]bool {
 	g.mu.RLock()
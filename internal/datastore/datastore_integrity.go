@@ -0,0 +1,142 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// CheckIntegrity verifies that the loaded entities satisfy their unique constraints and
+// that the field and unique indices match the entities
+// Every inconsistency is returned as an SY403 error
+func (dse *Engine) CheckIntegrity() []error {
+	dse.mu.RLock()
+	defer dse.mu.RUnlock()
+
+	var issues []error
+	report := func(format string, args ...interface{}) {
+		issues = append(issues, errors.NewError(errors.ErrCodeDatabaseCorruption, fmt.Sprintf(format, args...)))
+	}
+
+	typeNames := make([]string, 0, len(dse.definitions))
+	for name := range dse.definitions {
+		typeNames = append(typeNames, name)
+	}
+	sort.Strings(typeNames)
+
+	entitiesByType := make(map[string]map[string]map[string]interface{}, len(typeNames))
+	err := dse.entities.forEach(func(key string, entity common.Entity) bool {
+		if _, exists := dse.definitions[entity.Type]; !exists {
+			report("entity %s belongs to entity type %s, which is not registered", key, entity.Type)
+			return true
+		}
+		if key != createEntityKey(entity.Type, entity.ID) {
+			report("entity %s of type %s is stored under key %s", entity.ID, entity.Type, key)
+		}
+		if entitiesByType[entity.Type] == nil {
+			entitiesByType[entity.Type] = make(map[string]map[string]interface{})
+		}
+		entitiesByType[entity.Type][entity.ID] = entity.Fields
+		return true
+	})
+	if err != nil {
+		// Constraints cannot be verified without every entity
+		return append(issues, err)
+	}
+
+	for _, typeName := range typeNames {
+		entities := entitiesByType[typeName]
+
+		ids := make([]string, 0, len(entities))
+		for id := range entities {
+			ids = append(ids, id)
+		}
+		sort.Strings(ids)
+
+		for _, fieldDef := range dse.definitions[typeName].Fields {
+			if fieldDef.Unique {
+				owners := make(map[string]string)
+				for _, id := range ids {
+					value, exists := entities[id][fieldDef.Name]
+					if !exists || value == nil {
+						continue
+					}
+
+					indexValue := uniqueIndexKey(value)
+					if owner, taken := owners[indexValue]; taken {
+						report("entities %s and %s of type %s share the value %q of unique field %s",
+							owner, id, typeName, indexValue, fieldDef.Name)
+						continue
+					}
+					owners[indexValue] = id
+
+					if indexed := dse.uniqueIndices[typeName][fieldDef.Name][indexValue]; indexed != id {
+						report("unique index %s.%s maps %q to %q instead of entity %s",
+							typeName, fieldDef.Name, indexValue, indexed, id)
+					}
+				}
+
+				for indexValue, id := range dse.uniqueIndices[typeName][fieldDef.Name] {
+					if owners[indexValue] == "" {
+						report("unique index %s.%s maps %q to entity %s, which does not hold that value",
+							typeName, fieldDef.Name, indexValue, id)
+					}
+				}
+			}
+
+			if fieldDef.Indexed {
+				expected := make(map[string]map[string]bool)
+				for _, id := range ids {
+					value, exists := entities[id][fieldDef.Name]
+					if !exists || value == nil {
+						continue
+					}
+
+					indexValue := dse.getIndexableValue(value)
+					if expected[indexValue] == nil {
+						expected[indexValue] = make(map[string]bool)
+					}
+					expected[indexValue][id] = true
+				}
+
+				index := dse.indices[typeName][fieldDef.Name]
+				for indexValue, entityIDs := range expected {
+					found := make(map[string]bool, len(index[indexValue]))
+					for _, id := range index[indexValue] {
+						found[id] = true
+					}
+					for id := range entityIDs {
+						if !found[id] {
+							report("index %s.%s is missing entity %s under %q", typeName, fieldDef.Name, id, indexValue)
+						}
+					}
+				}
+
+				entries := 0
+				for indexValue, entityIDs := range index {
+					entries += len(entityIDs)
+					seen := make(map[string]bool, len(entityIDs))
+					for _, id := range entityIDs {
+						if seen[id] {
+							report("index %s.%s lists entity %s more than once under %q", typeName, fieldDef.Name, id, indexValue)
+						}
+						seen[id] = true
+
+						if !expected[indexValue][id] {
+							report("index %s.%s lists entity %s under %q, which does not hold that value",
+								typeName, fieldDef.Name, id, indexValue)
+						}
+					}
+				}
+
+				if counted := dse.indexEntries[typeName][fieldDef.Name]; counted != entries {
+					report("statistics of index %s.%s count %d entries, the index holds %d", typeName, fieldDef.Name, counted, entries)
+				}
+			}
+		}
+	}
+
+	return issues
+}
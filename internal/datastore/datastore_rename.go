@@ -0,0 +1,310 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// RenameEntityType renames an entity type, moving its entities, indices,
+// ID generator state and schema history to the new name
+// Relations to the entity type are pointed at the new name as well
+func (dse *Engine) RenameEntityType(oldName, newName string) error {
+	if err := validateNewEntityTypeName(newName); err != nil {
+		return err
+	}
+
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
+	dse.mu.Lock()
+
+	if _, exists := dse.definitions[oldName]; !exists {
+		dse.mu.Unlock()
+		return entityTypeNotFoundError(oldName)
+	}
+
+	if _, exists := dse.definitions[newName]; exists {
+		dse.mu.Unlock()
+		return entityTypeExistsError(newName)
+	}
+
+	referencing := dse.renameRelations(oldName, newName)
+	if err := dse.renameInMemory(oldName, newName); err != nil {
+		// Move the entities that were already re-keyed back
+		if rollbackErr := dse.renameInMemory(newName, oldName); rollbackErr != nil {
+			fmt.Printf("Error moving entities back to entity type %s: %v\n", oldName, rollbackErr)
+		}
+		dse.restoreDefinitions(referencing)
+		dse.mu.Unlock()
+		return err
+	}
+
+	// Store reference to persistence provider and release lock
+	persistenceProvider := dse.persistence
+	dse.mu.Unlock()
+
+	if persistenceProvider != nil {
+		if err := persistenceProvider.RenameEntityType(dse, oldName, newName); err != nil {
+			// If persistence fails, move everything back
+			dse.mu.Lock()
+			if rollbackErr := dse.renameInMemory(newName, oldName); rollbackErr != nil {
+				fmt.Printf("Error moving entities back to entity type %s: %v\n", oldName, rollbackErr)
+			}
+			dse.restoreDefinitions(referencing)
+			dse.mu.Unlock()
+
+			return persistenceFailedError(err)
+		}
+
+		// Counters, deleted IDs and schema history are stored per entity type name
+		dse.persistIDGeneratorState(persistenceProvider, newName)
+
+		versions, _ := dse.GetSchemaVersions(newName)
+		for _, version := range versions {
+			dse.persistSchemaVersion(persistenceProvider, version)
+		}
+	}
+
+	return nil
+}
+
+// CloneEntityType creates a new entity type with the schema of an existing one
+// If includeData is true, all entities are copied as well, keeping their IDs
+func (dse *Engine) CloneEntityType(source, target string, includeData bool) error {
+	if err := validateNewEntityTypeName(target); err != nil {
+		return err
+	}
+
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
+	dse.mu.Lock()
+
+	sourceDef, exists := dse.definitions[source]
+	if !exists {
+		dse.mu.Unlock()
+		return entityTypeNotFoundError(source)
+	}
+
+	if _, exists := dse.definitions[target]; exists {
+		dse.mu.Unlock()
+		return entityTypeExistsError(target)
+	}
+
+	// The clone starts its own schema history
+	targetDef := common.EntityDefinition{
+		Name:        target,
+		Fields:      make([]common.FieldDefinition, len(sourceDef.Fields)),
+		IDGenerator: sourceDef.IDGenerator,
+		Version:     1,
+	}
+	copy(targetDef.Fields, sourceDef.Fields)
+	targetDef.Relations = append([]common.RelationDefinition(nil), sourceDef.Relations...)
+
+	dse.idGeneratorMgr.RegisterEntityType(target, targetDef.IDGenerator)
+	dse.definitions[target] = targetDef
+	dse.initializeIndices(targetDef)
+
+	if includeData {
+		err := dse.entities.forEachOfType(source, func(_ string, entity common.Entity) bool {
+			clone := common.Entity{
+				ID:     entity.ID,
+				Type:   target,
+				Fields: make(map[string]interface{}, len(entity.Fields)),
+			}
+			for k, v := range entity.Fields {
+				clone.Fields[k] = v
+			}
+
+			dse.entities.put(createEntityKey(target, clone.ID), clone)
+			dse.updateIndices(clone, true)
+			return true
+		})
+		if err != nil {
+			dse.discardClone(target)
+			dse.mu.Unlock()
+			dse.idGeneratorMgr.UnregisterEntityType(target)
+			return err
+		}
+
+		// Copied IDs must never be generated again for the clone
+		dse.idGeneratorMgr.autoIncrement.CopyEntityType(source, target)
+	}
+
+	versionRecord, recorded := dse.recordSchemaVersion(targetDef, 0)
+
+	// Store reference to persistence provider and release lock
+	persistenceProvider := dse.persistence
+	dse.mu.Unlock()
+
+	if persistenceProvider != nil {
+		if err := persistenceProvider.CloneEntityType(dse, source, target, includeData); err != nil {
+			// If persistence fails, remove the clone again
+			dse.mu.Lock()
+			dse.discardClone(target)
+			dse.mu.Unlock()
+			dse.idGeneratorMgr.UnregisterEntityType(target)
+
+			return persistenceFailedError(err)
+		}
+
+		if recorded {
+			dse.persistSchemaVersion(persistenceProvider, versionRecord)
+		}
+
+		if includeData {
+			dse.persistIDGeneratorState(persistenceProvider, target)
+		}
+	}
+
+	return nil
+}
+
+// discardClone removes the in-memory state of a cloned entity type
+// This function requires that the caller holds a write lock
+func (dse *Engine) discardClone(target string) {
+	keys := make([]string, 0, dse.entities.countOfType(target))
+	if err := dse.entities.forEachOfType(target, func(key string, _ common.Entity) bool {
+		keys = append(keys, key)
+		return true
+	}); err != nil {
+		fmt.Printf("Error reading entities of entity type %s: %v\n", target, err)
+	}
+	for _, key := range keys {
+		dse.entities.remove(key)
+	}
+
+	delete(dse.definitions, target)
+	delete(dse.indices, target)
+	delete(dse.indexEntries, target)
+	delete(dse.uniqueIndices, target)
+	delete(dse.fullTextIndices, target)
+	delete(dse.trigramIndices, target)
+	delete(dse.schemaVersions, target)
+}
+
+// renameInMemory moves all in-memory state of an entity type to a new name
+// If entities cannot be read, the rest of the state is still moved and the error returned,
+// so that renaming back restores the entity type
+// This function requires that the caller holds a write lock
+func (dse *Engine) renameInMemory(oldName, newName string) error {
+	def := dse.definitions[oldName]
+	def.Name = newName
+	dse.definitions[newName] = def
+	delete(dse.definitions, oldName)
+
+	// Indices only hold entity IDs, so they can be moved as they are
+	dse.indices[newName] = dse.indices[oldName]
+	delete(dse.indices, oldName)
+	dse.indexEntries[newName] = dse.indexEntries[oldName]
+	delete(dse.indexEntries, oldName)
+	dse.uniqueIndices[newName] = dse.uniqueIndices[oldName]
+	delete(dse.uniqueIndices, oldName)
+	dse.fullTextIndices[newName] = dse.fullTextIndices[oldName]
+	delete(dse.fullTextIndices, oldName)
+	dse.trigramIndices[newName] = dse.trigramIndices[oldName]
+	delete(dse.trigramIndices, oldName)
+
+	// Re-key all entities so lookups and joins find them under the new name
+	err := dse.entities.forEachOfType(oldName, func(key string, entity common.Entity) bool {
+		dse.entities.remove(key)
+		entity.Type = newName
+		dse.entities.put(createEntityKey(newName, entity.ID), entity)
+		return true
+	})
+
+	// Move the schema history, keeping versions already known under the new name
+	if versions, exists := dse.schemaVersions[oldName]; exists {
+		if dse.schemaVersions[newName] == nil {
+			dse.schemaVersions[newName] = make(map[int]common.EntityDefinitionVersion)
+		}
+		for number, version := range versions {
+			if _, known := dse.schemaVersions[newName][number]; known {
+				continue
+			}
+			version.Definition.Name = newName
+			dse.schemaVersions[newName][number] = version
+		}
+		delete(dse.schemaVersions, oldName)
+	}
+
+	dse.idGeneratorMgr.RenameEntityType(oldName, newName)
+	return err
+}
+
+// renameRelations points the relations to an entity type at its new name
+// It returns the definitions that referenced the old name as they were, so a failed rename can restore them
+// This function requires that the caller holds a write lock
+func (dse *Engine) renameRelations(oldName, newName string) []common.EntityDefinition {
+	var referencing []common.EntityDefinition
+	for name, def := range dse.definitions {
+		relations := make([]common.RelationDefinition, len(def.Relations))
+		renamed := false
+		for i, relation := range def.Relations {
+			if relation.EntityType == oldName {
+				relation.EntityType = newName
+				renamed = true
+			}
+			relations[i] = relation
+		}
+		if !renamed {
+			continue
+		}
+
+		referencing = append(referencing, def)
+		def.Relations = relations
+		dse.definitions[name] = def
+	}
+	return referencing
+}
+
+// restoreDefinitions puts back definitions replaced during a failed operation
+// This function requires that the caller holds a write lock
+func (dse *Engine) restoreDefinitions(defs []common.EntityDefinition) {
+	for _, def := range defs {
+		dse.definitions[def.Name] = def
+	}
+}
+
+// persistIDGeneratorState saves the auto-increment counter and deleted IDs of an entity type
+// if the persistence provider supports it
+func (dse *Engine) persistIDGeneratorState(persistenceProvider common.PersistenceProvider, entityType string) {
+	idGeneratorType, err := dse.GetIDGeneratorType(entityType)
+	if err != nil || idGeneratorType != common.IDTypeAutoIncrement {
+		return
+	}
+
+	if persistenceWithCounters, ok := persistenceProvider.(common.PersistenceWithCounters); ok {
+		if counter, err := dse.GetAutoIncrementCounter(entityType); err == nil {
+			if err := persistenceWithCounters.SaveCounter(entityType, counter); err != nil {
+				// Just log the error, the entity type itself is already persisted
+				fmt.Printf("Error saving auto-increment counter: %v\n", err)
+			}
+		}
+	}
+
+	if persistenceWithDeletedIDs, ok := persistenceProvider.(common.PersistenceWithDeletedIDs); ok {
+		deletedIDs := dse.idGeneratorMgr.autoIncrement.SaveDeletedIDs(entityType)
+		if err := persistenceWithDeletedIDs.SaveDeletedIDs(entityType, deletedIDs); err != nil {
+			// Just log the error, the entity type itself is already persisted
+			fmt.Printf("Error saving deleted IDs: %v\n", err)
+		}
+	}
+}
+
+// validateNewEntityTypeName checks that a name can be used for a new entity type
+func validateNewEntityTypeName(name string) error {
+	if strings.TrimSpace(name) == "" {
+		return errors.NewError(errors.ErrCodeInvalidEntityType, "entity type name cannot be empty")
+	}
+
+	if strings.Contains(name, ":") {
+		return errors.NewError(errors.ErrCodeInvalidEntityType,
+			fmt.Sprintf("entity type name '%s' cannot contain ':'", name))
+	}
+
+	return nil
+}
@@ -7,6 +7,15 @@ import (
 
 // UpdateEntityType updates an existing entity definition
 func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
+	return dse.updateEntityType(updatedDef, 0)
+}
+
+// updateEntityType migrates an entity type to a new definition and records it as a new schema version
+// rollbackOf holds the restored version when the update is a rollback, 0 otherwise
+func (dse *Engine) updateEntityType(updatedDef common.EntityDefinition, rollbackOf int) error {
+	dse.writes.RLock()
+	defer dse.writes.RUnlock()
+
 	// First check if entity type exists
 	dse.mu.RLock()
 	originalDef, exists := dse.definitions[updatedDef.Name]
@@ -20,6 +29,9 @@ func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
 	if err := ValidateEntityTypeFields(updatedDef.Fields, true); err != nil {
 		return err
 	}
+	if err := ValidateEntityTypeRelations(updatedDef); err != nil {
+		return err
+	}
 
 	// Check for changes in unique constraints
 	oldUniqueFields := make(map[string]bool)
@@ -56,6 +68,11 @@ func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
 	// Keep the original ID generator - don't allow changing it
 	updatedDef.IDGenerator = originalDef.IDGenerator
 
+	// Assign the next schema version, unless a newer one is already set (WAL replay)
+	if updatedDef.Version <= originalDef.Version {
+		updatedDef.Version = originalDef.Version + 1
+	}
+
 	// Now acquire write lock for the update
 	dse.mu.Lock()
 
@@ -69,10 +86,21 @@ func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
 	dse.definitions[updatedDef.Name] = updatedDef
 
 	// Update indices for new indexed fields
-	dse.updateIndicesForSchemaChange(originalDef, updatedDef)
+	indexErr := dse.updateIndicesForSchemaChange(originalDef, updatedDef)
+
+	// Rebuild full-text and trigram indices, as fields may have been added, removed or converted
+	if indexErr == nil {
+		indexErr = dse.rebuildFullTextIndices(updatedDef)
+	}
+	if indexErr == nil {
+		indexErr = dse.rebuildTrigramIndices(updatedDef)
+	}
 
 	// Initialize or update unique indices
 	for _, field := range updatedDef.Fields {
+		if indexErr != nil {
+			break
+		}
 		if field.Unique {
 			// If this field is newly marked as unique, initialize its unique index
 			if !oldUniqueFields[field.Name] {
@@ -82,14 +110,13 @@ func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
 				dse.uniqueIndices[updatedDef.Name][field.Name] = make(map[string]string)
 
 				// Populate the unique index with existing data
-				for _, entity := range dse.entities {
-					if entity.Type == updatedDef.Name {
-						if value, exists := entity.Fields[field.Name]; exists && value != nil {
-							indexValue := uniqueIndexKey(value)
-							dse.uniqueIndices[updatedDef.Name][field.Name][indexValue] = entity.ID
-						}
+				indexErr = dse.entities.forEachOfType(updatedDef.Name, func(_ string, entity common.Entity) bool {
+					if value, exists := entity.Fields[field.Name]; exists && value != nil {
+						indexValue := uniqueIndexKey(value)
+						dse.uniqueIndices[updatedDef.Name][field.Name][indexValue] = entity.ID
 					}
-				}
+					return true
+				})
 			}
 		} else {
 			// If this field is no longer unique, remove its unique index
@@ -101,6 +128,19 @@ func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
 		}
 	}
 
+	// Restore the indices of the original definition if the entities could not be read
+	if indexErr != nil {
+		dse.definitions[updatedDef.Name] = originalDef
+		if err := dse.rebuildIndices(originalDef); err != nil {
+			fmt.Printf("Error restoring the indices of entity type %s: %v\n", updatedDef.Name, err)
+		}
+		dse.mu.Unlock()
+		return fmt.Errorf("failed to update the indices of entity type %s: %w", updatedDef.Name, indexErr)
+	}
+
+	// Record the new schema version
+	versionRecord, recorded := dse.recordSchemaVersion(updatedDef, rollbackOf)
+
 	// Store reference to persistence provider and release lock
 	persistenceProvider := dse.persistence
 	dse.mu.Unlock()
@@ -111,10 +151,23 @@ func (dse *Engine) UpdateEntityType(updatedDef common.EntityDefinition) error {
 			// If persistence fails, we need to roll back the in-memory changes
 			dse.mu.Lock()
 			dse.definitions[updatedDef.Name] = originalDef
+			if err := dse.rebuildFullTextIndices(originalDef); err != nil {
+				fmt.Printf("Error restoring the full-text indices of entity type %s: %v\n", updatedDef.Name, err)
+			}
+			if err := dse.rebuildTrigramIndices(originalDef); err != nil {
+				fmt.Printf("Error restoring the trigram indices of entity type %s: %v\n", updatedDef.Name, err)
+			}
+			if recorded {
+				delete(dse.schemaVersions[updatedDef.Name], updatedDef.Version)
+			}
 			dse.mu.Unlock()
 
 			return fmt.Errorf("failed to persist entity type update: %w", err)
 		}
+
+		if recorded {
+			dse.persistSchemaVersion(persistenceProvider, versionRecord)
+		}
 	}
 
 	return nil
@@ -239,12 +292,12 @@ func (dse *Engine) executeMigrationPlan(plan *MigrationPlan, originalDef, update
 	// Get all entities of this type
 	entitiesToUpdate := make([]common.Entity, 0)
 
-	for key, entity := range dse.entities {
-		if entity.Type == plan.EntityType {
-			// Use the key variable to avoid the "declared and not used" error
-			_ = key
-			entitiesToUpdate = append(entitiesToUpdate, entity)
-		}
+	err := dse.entities.forEachOfType(plan.EntityType, func(_ string, entity common.Entity) bool {
+		entitiesToUpdate = append(entitiesToUpdate, entity)
+		return true
+	})
+	if err != nil {
+		return err
 	}
 
 	// Process each entity
@@ -252,7 +305,7 @@ func (dse *Engine) executeMigrationPlan(plan *MigrationPlan, originalDef, update
 		entityKey := createEntityKey(entity.Type, entity.ID)
 
 		// Skip already removed entities
-		if _, exists := dse.entities[entityKey]; !exists {
+		if !dse.entities.contains(entityKey) {
 			continue
 		}
 
@@ -275,7 +328,7 @@ func (dse *Engine) executeMigrationPlan(plan *MigrationPlan, originalDef, update
 		}
 
 		// Update the entity
-		dse.entities[entityKey] = entity
+		dse.entities.put(entityKey, entity)
 
 		// Add new index entries
 		dse.updateIndices(entity, true)
@@ -285,7 +338,7 @@ func (dse *Engine) executeMigrationPlan(plan *MigrationPlan, originalDef, update
 }
 
 // updateIndicesForSchemaChange updates the index structures for changed field definitions
-func (dse *Engine) updateIndicesForSchemaChange(originalDef, updatedDef common.EntityDefinition) {
+func (dse *Engine) updateIndicesForSchemaChange(originalDef, updatedDef common.EntityDefinition) error {
 	// Map for quick lookup of original indexed status
 	originalIndexed := make(map[string]bool)
 	for _, field := range originalDef.Fields {
@@ -306,15 +359,17 @@ func (dse *Engine) updateIndicesForSchemaChange(originalDef, updatedDef common.E
 			dse.indices[updatedDef.Name][field.Name] = make(map[string][]string)
 
 			// Populate the index with existing data
-			for _, entity := range dse.entities {
-				if entity.Type == updatedDef.Name {
-					if value, exists := entity.Fields[field.Name]; exists && value != nil {
-						strValue := dse.getIndexableValue(value)
-						dse.indices[entity.Type][field.Name][strValue] = append(
-							dse.indices[entity.Type][field.Name][strValue],
-							entity.ID)
-					}
+			err := dse.entities.forEachOfType(updatedDef.Name, func(_ string, entity common.Entity) bool {
+				if value, exists := entity.Fields[field.Name]; exists && value != nil {
+					strValue := dse.getIndexableValue(value)
+					dse.indices[entity.Type][field.Name][strValue] = append(
+						dse.indices[entity.Type][field.Name][strValue],
+						entity.ID)
 				}
+				return true
+			})
+			if err != nil {
+				return err
 			}
 		}
 
@@ -325,6 +380,9 @@ func (dse *Engine) updateIndicesForSchemaChange(originalDef, updatedDef common.E
 			}
 		}
 	}
+
+	dse.recountIndexEntries(updatedDef.Name)
+	return nil
 }
 
 // isCompatibleTypeChange determines if a type change can be performed safely
@@ -382,15 +440,12 @@ func (dse *Engine) verifyUniqueConstraintCanBeAdded(entityType string, fieldName
 	seenValues := make(map[string]string) // value -> entityID
 
 	// Check all entities of this type
-	for _, entity := range dse.entities {
-		if entity.Type != entityType {
-			continue
-		}
-
+	var duplicateErr error
+	err := dse.entities.forEachOfType(entityType, func(_ string, entity common.Entity) bool {
 		// Check if this entity has the field
 		value, exists := entity.Fields[fieldName]
 		if !exists || value == nil {
-			continue
+			return true
 		}
 
 		// Convert value to string for comparison
@@ -398,14 +453,19 @@ func (dse *Engine) verifyUniqueConstraintCanBeAdded(entityType string, fieldName
 
 		// Check if we've seen this value before
 		if existingID, found := seenValues[strValue]; found {
-			return fmt.Errorf("cannot add unique constraint to field '%s': duplicate value '%v' found in entities with IDs '%s' and '%s'",
+			duplicateErr = fmt.Errorf("cannot add unique constraint to field '%s': duplicate value '%v' found in entities with IDs '%s' and '%s'",
 				fieldName, value, existingID, entity.ID)
+			return false
 		}
 
 		// Record this value
 		seenValues[strValue] = entity.ID
+		return true
+	})
+	if err != nil {
+		return err
 	}
 
-	// No duplicates found, constraint can be added
-	return nil
+	// Without duplicates the constraint can be added
+	return duplicateErr
 }
@@ -0,0 +1,118 @@
+package datastore
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+)
+
+// GetSchemaVersions returns the recorded definition history of an entity type, oldest first
+func (dse *Engine) GetSchemaVersions(entityType string) ([]common.EntityDefinitionVersion, error) {
+	dse.mu.RLock()
+	defer dse.mu.RUnlock()
+
+	if _, exists := dse.definitions[entityType]; !exists {
+		return nil, entityTypeNotFoundError(entityType)
+	}
+
+	versions := make([]common.EntityDefinitionVersion, 0, len(dse.schemaVersions[entityType]))
+	for _, version := range dse.schemaVersions[entityType] {
+		versions = append(versions, version)
+	}
+
+	sort.Slice(versions, func(i, j int) bool {
+		return versions[i].Version < versions[j].Version
+	})
+
+	return versions, nil
+}
+
+// LoadSchemaVersions merges persisted schema versions into the in-memory history
+// Versions that are already known are left untouched
+func (dse *Engine) LoadSchemaVersions(entityType string, versions []common.EntityDefinitionVersion) error {
+	dse.mu.Lock()
+	defer dse.mu.Unlock()
+
+	if dse.schemaVersions[entityType] == nil {
+		dse.schemaVersions[entityType] = make(map[int]common.EntityDefinitionVersion)
+	}
+
+	for _, version := range versions {
+		if _, exists := dse.schemaVersions[entityType][version.Version]; !exists {
+			dse.schemaVersions[entityType][version.Version] = version
+		}
+	}
+
+	return nil
+}
+
+// RollbackEntityType restores a previous version of an entity definition
+// The rollback goes through the regular schema migration and is recorded as a new version
+func (dse *Engine) RollbackEntityType(entityType string, version int) error {
+	dse.mu.RLock()
+	currentDef, exists := dse.definitions[entityType]
+	target, found := dse.schemaVersions[entityType][version]
+	dse.mu.RUnlock()
+
+	if !exists {
+		return entityTypeNotFoundError(entityType)
+	}
+
+	if !found {
+		return schemaVersionNotFoundError(entityType, version)
+	}
+
+	if version == currentDef.Version {
+		return errors.NewError(
+			errors.ErrCodeEntityTypeValidation,
+			fmt.Sprintf("entity type '%s' is already at version %d", entityType, version),
+		)
+	}
+
+	// Copy the historical definition so the stored record is never modified
+	restoredDef := common.EntityDefinition{
+		Name:        entityType,
+		Fields:      make([]common.FieldDefinition, len(target.Definition.Fields)),
+		IDGenerator: currentDef.IDGenerator,
+	}
+	copy(restoredDef.Fields, target.Definition.Fields)
+	restoredDef.Relations = append([]common.RelationDefinition(nil), target.Definition.Relations...)
+
+	return dse.updateEntityType(restoredDef, version)
+}
+
+// recordSchemaVersion adds a definition to the version history
+// It returns false if this version was already recorded (e.g. during WAL replay)
+// This function requires that the caller holds a write lock
+func (dse *Engine) recordSchemaVersion(def common.EntityDefinition, rollbackOf int) (common.EntityDefinitionVersion, bool) {
+	if dse.schemaVersions[def.Name] == nil {
+		dse.schemaVersions[def.Name] = make(map[int]common.EntityDefinitionVersion)
+	}
+
+	if existing, exists := dse.schemaVersions[def.Name][def.Version]; exists {
+		return existing, false
+	}
+
+	version := common.EntityDefinitionVersion{
+		Version:    def.Version,
+		Definition: def,
+		CreatedAt:  time.Now(),
+		RollbackOf: rollbackOf,
+	}
+	dse.schemaVersions[def.Name][def.Version] = version
+
+	return version, true
+}
+
+// persistSchemaVersion saves a recorded schema version if the persistence provider supports it
+func (dse *Engine) persistSchemaVersion(persistenceProvider common.PersistenceProvider, version common.EntityDefinitionVersion) {
+	if persistenceWithVersions, ok := persistenceProvider.(common.PersistenceWithSchemaVersions); ok {
+		if err := persistenceWithVersions.SaveSchemaVersion(version.Definition.Name, version); err != nil {
+			// Just log the error, the definition itself is already persisted
+			fmt.Printf("Error saving schema version: %v\n", err)
+		}
+	}
+}
@@ -21,12 +21,14 @@ func (dse *Engine) TruncateEntityType(entityType string) error {
 	entitiesRemoved := 0
 
 	// Find all entities of the specified type
-	entitiesToRemove := make([]string, 0) // Store keys to remove
-	for key, entity := range dse.entities {
-		if entity.Type == entityType {
-			entitiesToRemove = append(entitiesToRemove, key)
-			entitiesRemoved++
-		}
+	entitiesToRemove := make([]common.Entity, 0) // Store entities to remove
+	err := dse.entities.forEachOfType(entityType, func(_ string, entity common.Entity) bool {
+		entitiesToRemove = append(entitiesToRemove, entity)
+		entitiesRemoved++
+		return true
+	})
+	if err != nil {
+		return err
 	}
 
 	// If there are no entities to remove, just return success
@@ -35,12 +37,11 @@ func (dse *Engine) TruncateEntityType(entityType string) error {
 	}
 
 	// Remove index entries for all entities
-	for _, entityKey := range entitiesToRemove {
-		entity := dse.entities[entityKey]
+	for _, entity := range entitiesToRemove {
 		// Remove the entity from indices
 		dse.updateIndices(entity, false)
 		// Remove the entity itself
-		delete(dse.entities, entityKey)
+		dse.entities.remove(createEntityKey(entity.Type, entity.ID))
 	}
 
 	// Store reference to persistence provider to use outside the lock
@@ -69,28 +70,19 @@ func (dse *Engine) TruncateDatabase() error {
 	dse.mu.Lock()
 	defer dse.mu.Unlock()
 
-	// Count how many entities of each type will be removed
-	entityTypeCounts := make(map[string]int)
-	totalEntities := 0
-
-	// Count all entities by type for logging
-	for _, entity := range dse.entities {
-		entityTypeCounts[entity.Type]++
-		totalEntities++
-	}
-
 	// If there are no entities, just return success
-	if totalEntities == 0 {
+	if dse.entities.len() == 0 {
 		return nil
 	}
 
 	// Clear all entities (but keep entity type definitions)
-	dse.entities = make(map[string]common.Entity)
+	dse.entities = dse.newEntityStore()
 
 	// Clear all indices
 	for entityType := range dse.indices {
 		// Initialize the indices for each entity type
 		dse.indices[entityType] = make(map[string]map[string][]string)
+		dse.indexEntries[entityType] = make(map[string]int)
 
 		// Get the entity definition to reinitialize indices
 		def, exists := dse.definitions[entityType]
@@ -125,6 +117,12 @@ func (dse *Engine) TruncateDatabase() error {
 		}
 	}
 
+	// Clear all full-text and trigram indices
+	for _, def := range dse.definitions {
+		dse.initializeFullTextIndices(def)
+		dse.initializeTrigramIndices(def)
+	}
+
 	// Store reference to persistence provider
 	persistenceProvider := dse.persistence
 
@@ -1,12 +1,15 @@
 package datastore
 
 import (
+	stderrors "errors"
 	"sort"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
 	"github.com/phillarmonic/syncopate-db/internal/persistence"
 	"github.com/sirupsen/logrus"
 )
@@ -840,6 +843,11 @@ func TestSchemaEvolution(t *testing.T) {
 		t.Errorf("Expected 2 entities, got %d", len(entities))
 	}
 
+	// Entities are returned in map order, sort them by ID to match insertion order
+	sort.Slice(entities, func(i, j int) bool {
+		return entities[i].ID < entities[j].ID
+	})
+
 	// Verify first entity doesn't have phone field
 	firstEntity := entities[0]
 	if _, hasPhone := firstEntity.Fields["phone"]; hasPhone {
@@ -852,3 +860,503 @@ func TestSchemaEvolution(t *testing.T) {
 		t.Errorf("Second entity should have phone field with value '123-456-7890', got %v", phone)
 	}
 }
+
+// TestSchemaVersionRollback tests schema version history and rollback
+func TestSchemaVersionRollback(t *testing.T) {
+	// Create in-memory database
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	initialSchema := common.EntityDefinition{
+		Name:        "versioned_entities",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+		},
+	}
+
+	if err := db.RegisterEntityType(initialSchema); err != nil {
+		t.Fatalf("Failed to register initial schema: %v", err)
+	}
+
+	updatedSchema := common.EntityDefinition{
+		Name:        "versioned_entities",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+			{Name: "phone", Type: "string", Required: false},
+		},
+	}
+
+	if err := db.UpdateEntityType(updatedSchema); err != nil {
+		t.Fatalf("Failed to update schema: %v", err)
+	}
+
+	// Verify the version history
+	versions, err := db.GetSchemaVersions("versioned_entities")
+	if err != nil {
+		t.Fatalf("Failed to get schema versions: %v", err)
+	}
+
+	if len(versions) != 2 || versions[0].Version != 1 || versions[1].Version != 2 {
+		t.Fatalf("Expected versions [1 2], got %v", versions)
+	}
+
+	// Roll back to the initial schema
+	if err := db.RollbackEntityType("versioned_entities", 1); err != nil {
+		t.Fatalf("Failed to roll back schema: %v", err)
+	}
+
+	def, err := db.GetEntityDefinition("versioned_entities")
+	if err != nil {
+		t.Fatalf("Failed to get entity definition: %v", err)
+	}
+
+	if def.Version != 3 {
+		t.Errorf("Expected rollback to create version 3, got %d", def.Version)
+	}
+
+	for _, field := range def.Fields {
+		if field.Name == "phone" {
+			t.Error("Expected phone field to be removed by rollback")
+		}
+	}
+
+	versions, err = db.GetSchemaVersions("versioned_entities")
+	if err != nil {
+		t.Fatalf("Failed to get schema versions: %v", err)
+	}
+
+	if len(versions) != 3 || versions[2].RollbackOf != 1 {
+		t.Errorf("Expected version 3 to record a rollback of version 1, got %v", versions)
+	}
+
+	// Rolling back to an unknown version should fail
+	if err := db.RollbackEntityType("versioned_entities", 42); err == nil {
+		t.Error("Expected error when rolling back to an unknown version")
+	}
+}
+
+// TestDropEntityType tests removing an entity type and registering it again
+func TestDropEntityType(t *testing.T) {
+	// Create in-memory database
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	schema := common.EntityDefinition{
+		Name:        "droppable_entities",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true, Indexed: true},
+			{Name: "email", Type: "string", Required: true, Unique: true},
+		},
+	}
+
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+
+	for _, name := range []string{"Alice", "Bob"} {
+		data := map[string]interface{}{"name": name, "email": name + "@example.com"}
+		if err := db.Insert("droppable_entities", "", data); err != nil {
+			t.Fatalf("Failed to insert entity: %v", err)
+		}
+	}
+
+	if err := db.DropEntityType("droppable_entities"); err != nil {
+		t.Fatalf("Failed to drop entity type: %v", err)
+	}
+
+	if _, err := db.GetEntityDefinition("droppable_entities"); err == nil {
+		t.Error("Expected entity type to be removed")
+	}
+
+	if err := db.DropEntityType("droppable_entities"); err == nil {
+		t.Error("Expected error when dropping an unknown entity type")
+	}
+
+	// The type can be registered again from scratch
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema again: %v", err)
+	}
+
+	data := map[string]interface{}{"name": "Alice", "email": "Alice@example.com"}
+	if err := db.Insert("droppable_entities", "", data); err != nil {
+		t.Fatalf("Expected unique index to be cleared, got error: %v", err)
+	}
+
+	entities, err := db.GetAllEntitiesOfType("droppable_entities")
+	if err != nil {
+		t.Fatalf("Failed to get entities: %v", err)
+	}
+
+	if len(entities) != 1 || entities[0].ID != "1" {
+		t.Errorf("Expected a single entity with ID '1', got %v", entities)
+	}
+
+	versions, err := db.GetSchemaVersions("droppable_entities")
+	if err != nil {
+		t.Fatalf("Failed to get schema versions: %v", err)
+	}
+
+	if len(versions) != 1 {
+		t.Errorf("Expected schema history to restart, got %d versions", len(versions))
+	}
+}
+
+// TestRenameAndCloneEntityType tests renaming and cloning entity types
+func TestRenameAndCloneEntityType(t *testing.T) {
+	// Create in-memory database
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	schema := common.EntityDefinition{
+		Name:        "client",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true, Indexed: true},
+			{Name: "email", Type: "string", Required: true, Unique: true},
+		},
+	}
+
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+
+	for _, name := range []string{"Alice", "Bob", "Charlie"} {
+		data := map[string]interface{}{"name": name, "email": name + "@example.com"}
+		if err := db.Insert("client", "", data); err != nil {
+			t.Fatalf("Failed to insert entity: %v", err)
+		}
+	}
+
+	if err := db.Delete("client", "3"); err != nil {
+		t.Fatalf("Failed to delete entity: %v", err)
+	}
+
+	// Rename client to customer
+	if err := db.RenameEntityType("client", "customer"); err != nil {
+		t.Fatalf("Failed to rename entity type: %v", err)
+	}
+
+	if _, err := db.GetEntityDefinition("client"); err == nil {
+		t.Error("Expected old entity type name to be gone")
+	}
+
+	entity, err := db.GetByType("1", "customer")
+	if err != nil {
+		t.Fatalf("Failed to get renamed entity: %v", err)
+	}
+	if entity.Type != "customer" || entity.Fields["name"] != "Alice" {
+		t.Errorf("Expected renamed entity Alice of type customer, got %v", entity)
+	}
+
+	// Indexed queries must work under the new name
+	queryService := NewQueryService(db)
+	result, err := queryService.Query(QueryOptions{
+		EntityType: "customer",
+		Filters:    []Filter{{Field: "name", Operator: FilterEq, Value: "Bob"}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to query renamed entity type: %v", err)
+	}
+	if len(result) != 1 {
+		t.Errorf("Expected 1 result for Bob, got %d", len(result))
+	}
+
+	// The counter moves with the entity type, so deleted IDs are not reused
+	if err := db.Insert("customer", "", map[string]interface{}{"name": "Diana", "email": "diana@example.com"}); err != nil {
+		t.Fatalf("Failed to insert entity after rename: %v", err)
+	}
+	if _, err := db.GetByType("4", "customer"); err != nil {
+		t.Errorf("Expected new entity to get ID 4 after rename: %v", err)
+	}
+
+	// Clone only the schema
+	if err := db.CloneEntityType("customer", "customer_empty", false); err != nil {
+		t.Fatalf("Failed to clone entity type: %v", err)
+	}
+	if count, _ := db.GetEntityCount("customer_empty"); count != 0 {
+		t.Errorf("Expected empty clone, got %d entities", count)
+	}
+
+	// Clone schema and data
+	if err := db.CloneEntityType("customer", "customer_copy", true); err != nil {
+		t.Fatalf("Failed to clone entity type with data: %v", err)
+	}
+	if count, _ := db.GetEntityCount("customer_copy"); count != 3 {
+		t.Errorf("Expected 3 cloned entities, got %d", count)
+	}
+
+	// The cloned counter continues after the copied IDs
+	if err := db.Insert("customer_copy", "", map[string]interface{}{"name": "Eve", "email": "eve@example.com"}); err != nil {
+		t.Fatalf("Failed to insert into cloned entity type: %v", err)
+	}
+	if _, err := db.GetByType("5", "customer_copy"); err != nil {
+		t.Errorf("Expected cloned counter to continue at ID 5: %v", err)
+	}
+
+	// Unique constraints are copied with the data
+	if err := db.Insert("customer_copy", "", map[string]interface{}{"name": "Frank", "email": "Alice@example.com"}); err == nil {
+		t.Error("Expected unique constraint violation in the cloned entity type")
+	}
+
+	// Changes to the clone don't affect the original
+	if count, _ := db.GetEntityCount("customer"); count != 3 {
+		t.Errorf("Expected original to keep 3 entities, got %d", count)
+	}
+
+	if err := db.RenameEntityType("customer", "customer_copy"); err == nil {
+		t.Error("Expected error when renaming to an existing entity type")
+	}
+}
+
+// TestCheckIntegrity tests that broken unique constraints and indices are reported
+func TestCheckIntegrity(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	schema := common.EntityDefinition{
+		Name:        "accounts",
+		IDGenerator: common.IDTypeCustom,
+		Fields: []common.FieldDefinition{
+			{Name: "email", Type: "string", Unique: true},
+			{Name: "team", Type: "string", Indexed: true},
+		},
+	}
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+
+	for _, id := range []string{"a", "b"} {
+		if err := db.Insert("accounts", id, map[string]interface{}{"email": id + "@example.com", "team": "core"}); err != nil {
+			t.Fatalf("Failed to insert account: %v", err)
+		}
+	}
+
+	if issues := db.CheckIntegrity(); len(issues) != 0 {
+		t.Fatalf("Expected no issues, got %v", issues)
+	}
+
+	// Break the data behind the engine's back, as a faulty replay could
+	db.mu.Lock()
+	entity, _, _ := db.entities.get(createEntityKey("accounts", "b"))
+	entity.Fields["email"] = "a@example.com"
+	db.indices["accounts"]["team"]["core"] = []string{"a"}
+	db.mu.Unlock()
+
+	issues := db.CheckIntegrity()
+	var messages []string
+	for _, issue := range issues {
+		if !errors.IsErrorCode(issue, errors.ErrCodeDatabaseCorruption) {
+			t.Errorf("Expected an SY403 issue, got %v", issue)
+		}
+		messages = append(messages, issue.Error())
+	}
+
+	report := strings.Join(messages, "\n")
+	for _, expected := range []string{"share the value", "is missing entity b", "does not hold that value"} {
+		if !strings.Contains(report, expected) {
+			t.Errorf("Expected an issue containing %q, got:\n%s", expected, report)
+		}
+	}
+}
+
+// TestLazyEntitySchemaOperations tests schema operations on entities whose bodies are stored on disk
+func TestLazyEntitySchemaOperations(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	persistenceManager, err := persistence.NewManager(persistence.Config{
+		Path:         t.TempDir(),
+		CacheSize:    10,
+		SyncWrites:   false,
+		Logger:       logger,
+		EnableAutoGC: false,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create persistence manager: %v", err)
+	}
+	defer persistenceManager.Close()
+
+	db := NewDataStoreEngine(EngineConfig{
+		Persistence:       persistenceManager.GetPersistenceProvider(),
+		EnablePersistence: true,
+		LazyEntities:      true,
+	})
+	if _, lazy := db.entities.(*lazyEntityStore); !lazy {
+		t.Fatalf("Expected a lazy entity store, got %T", db.entities)
+	}
+
+	if err := db.RegisterEntityType(common.EntityDefinition{
+		Name:        "notes",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "title", Type: "string"}},
+	}); err != nil {
+		t.Fatalf("Failed to register entity type: %v", err)
+	}
+
+	// More entities than the write buffer holds, so most bodies are read back from disk
+	const total = lazyWriteBufferSize + 200
+	for i := 0; i < total; i++ {
+		if err := db.Insert("notes", "", map[string]interface{}{"title": "note-" + strconv.Itoa(i%100)}); err != nil {
+			t.Fatalf("Failed to insert note: %v", err)
+		}
+	}
+
+	// Adding an index and a unique constraint reads every body
+	titleDefinition := func(field common.FieldDefinition) common.EntityDefinition {
+		return common.EntityDefinition{Name: "notes", IDGenerator: common.IDTypeAutoIncrement, Fields: []common.FieldDefinition{field}}
+	}
+	if err := db.UpdateEntityType(titleDefinition(common.FieldDefinition{Name: "title", Type: "string", Indexed: true})); err != nil {
+		t.Fatalf("Failed to index title: %v", err)
+	}
+	if got := len(db.indices["notes"]["title"]["note-7"]); got != total/100 {
+		t.Errorf("Expected %d indexed notes titled note-7, got %d", total/100, got)
+	}
+	if err := db.UpdateEntityType(titleDefinition(common.FieldDefinition{Name: "title", Type: "string", Indexed: true, Unique: true})); err == nil {
+		t.Error("Expected duplicate titles to prevent a unique constraint")
+	}
+
+	if err := db.CloneEntityType("notes", "drafts", true); err != nil {
+		t.Fatalf("Failed to clone entity type: %v", err)
+	}
+	if err := db.RenameEntityType("notes", "memos"); err != nil {
+		t.Fatalf("Failed to rename entity type: %v", err)
+	}
+
+	for _, entityType := range []string{"memos", "drafts"} {
+		count, err := db.GetEntityCount(entityType)
+		if err != nil || count != total {
+			t.Fatalf("Expected %d %s, got %d, %v", total, entityType, count, err)
+		}
+		entity, err := db.GetByType("1000", entityType)
+		if err != nil || entity.Type != entityType || entity.Fields["title"] != "note-99" {
+			t.Fatalf("Expected %s 1000 titled note-99, got %v, %v", entityType, entity, err)
+		}
+	}
+	if _, err := db.GetByType("1", "notes"); err == nil {
+		t.Error("Expected no notes after the rename")
+	}
+
+	if err := db.TruncateEntityType("drafts"); err != nil {
+		t.Fatalf("Failed to truncate entity type: %v", err)
+	}
+	if count, _ := db.GetEntityCount("drafts"); count != 0 {
+		t.Errorf("Expected no drafts after truncating, got %d", count)
+	}
+	if err := db.DropEntityType("memos"); err != nil {
+		t.Fatalf("Failed to drop entity type: %v", err)
+	}
+	if db.entities.len() != 0 {
+		t.Errorf("Expected no entities left, got %d", db.entities.len())
+	}
+}
+
+// errDiskRead is returned by failingBodyStore once reads fail
+var errDiskRead = stderrors.New("disk read failed")
+
+// failingBodyStore keeps entity bodies in memory and fails every read once failReads is set
+type failingBodyStore struct {
+	bodies    map[string]common.Entity
+	failReads bool
+}
+
+func (s *failingBodyStore) ReadEntityBodies(entityType string, ids []string) ([]common.Entity, error) {
+	if s.failReads {
+		return nil, errDiskRead
+	}
+	entities := make([]common.Entity, 0, len(ids))
+	for _, id := range ids {
+		if entity, exists := s.bodies[createEntityKey(entityType, id)]; exists {
+			entities = append(entities, entity)
+		}
+	}
+	return entities, nil
+}
+
+func (s *failingBodyStore) WriteEntityBodies(stored []common.Entity, removed []common.Entity) error {
+	for _, entity := range stored {
+		s.bodies[createEntityKey(entity.Type, entity.ID)] = entity
+	}
+	for _, entity := range removed {
+		delete(s.bodies, createEntityKey(entity.Type, entity.ID))
+	}
+	return nil
+}
+
+func (s *failingBodyStore) PruneEntityBodies(keep func(entityType, id string) bool) error {
+	for key := range s.bodies {
+		if entityType, id := parseEntityKey(key); !keep(entityType, id) {
+			delete(s.bodies, key)
+		}
+	}
+	return nil
+}
+
+func (s *failingBodyStore) ViewEntityBodies() (common.EntityBodyView, error) {
+	return nil, stderrors.New("views are not supported")
+}
+
+// TestLazyEntityReadErrors tests that failed reads of entity bodies are returned instead of
+// treating the entities as missing
+func TestLazyEntityReadErrors(t *testing.T) {
+	bodies := &failingBodyStore{bodies: make(map[string]common.Entity)}
+	db := NewDataStoreEngine()
+	db.entityBodies = bodies
+	db.entities = db.newEntityStore()
+	if err := db.entities.(*lazyEntityStore).finishLoad(); err != nil {
+		t.Fatalf("Failed to finish loading: %v", err)
+	}
+
+	if err := db.RegisterEntityType(common.EntityDefinition{
+		Name:        "notes",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "title", Type: "string"}},
+	}); err != nil {
+		t.Fatalf("Failed to register entity type: %v", err)
+	}
+
+	// The first bodies leave the write buffer and are read from the body store
+	for i := 0; i < lazyWriteBufferSize+10; i++ {
+		if err := db.Insert("notes", "", map[string]interface{}{"title": "note-" + strconv.Itoa(i)}); err != nil {
+			t.Fatalf("Failed to insert note: %v", err)
+		}
+	}
+	if _, err := db.GetByType("1", "notes"); err != nil {
+		t.Fatalf("Expected note 1 to be read from the body store: %v", err)
+	}
+
+	bodies.failReads = true
+	isReadError := func(err error) bool {
+		return errors.IsErrorCode(err, errors.ErrCodePersistenceFailed) && stderrors.Is(err, errDiskRead)
+	}
+
+	if _, err := db.GetByType("1", "notes"); !isReadError(err) {
+		t.Errorf("Expected a read error from Get, got %v", err)
+	}
+	if err := db.Update("notes", "1", map[string]interface{}{"title": "changed"}); !isReadError(err) {
+		t.Errorf("Expected a read error from Update, got %v", err)
+	}
+	if err := db.Delete("notes", "1"); !isReadError(err) {
+		t.Errorf("Expected a read error from Delete, got %v", err)
+	}
+	if _, err := NewQueryService(db).Query(QueryOptions{EntityType: "notes"}); !isReadError(err) {
+		t.Errorf("Expected a read error from Query, got %v", err)
+	}
+	if err := db.DropEntityType("notes"); !isReadError(err) {
+		t.Errorf("Expected a read error from DropEntityType, got %v", err)
+	}
+	if issues := db.CheckIntegrity(); len(issues) != 1 || !isReadError(issues[0]) {
+		t.Errorf("Expected the read error as the only integrity issue, got %v", issues)
+	}
+
+	// Nothing was removed by the failed operations
+	bodies.failReads = false
+	if count, _ := db.GetEntityCount("notes"); count != lazyWriteBufferSize+10 {
+		t.Errorf("Expected %d notes, got %d", lazyWriteBufferSize+10, count)
+	}
+	if entity, err := db.GetByType("1", "notes"); err != nil || entity.Fields["title"] != "note-0" {
+		t.Errorf("Expected note 1 to be unchanged, got %v, %v", entity, err)
+	}
+}
@@ -0,0 +1,439 @@
+package datastore
+
+import (
+	"fmt"
+	"reflect"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+const (
+	// lazyWriteBufferSize is the number of changed entity bodies buffered before they are written out
+	lazyWriteBufferSize = 1000
+
+	// lazyReadBatchSize is the number of entity bodies read at once while iterating an entity type
+	lazyReadBatchSize = 256
+)
+
+// entityStore holds the entities of an engine by their composite key
+// Reads require that the caller holds the engine's read lock, writes its write lock.
+// Callbacks of the iteration methods may modify the store. Reads return the errors of
+// the storage entity bodies are read from, wrapped as persistence errors
+type entityStore interface {
+	contains(key string) bool
+	get(key string) (common.Entity, bool, error)
+	put(key string, entity common.Entity)
+	remove(key string)
+	forEach(fn func(key string, entity common.Entity) bool) error
+	forEachOfType(entityType string, fn func(key string, entity common.Entity) bool) error
+	// countOfType returns the number of entities of a type without reading them,
+	// the query and join planners call it for every query and join
+	countOfType(entityType string) int
+	len() int
+}
+
+// newEntityStore creates an empty entity store for the engine's storage mode
+func (dse *Engine) newEntityStore() entityStore {
+	if dse.entityBodies != nil {
+		return newLazyEntityStore(dse.entityBodies)
+	}
+	return newMemoryEntityStore()
+}
+
+// memoryEntityStore keeps every entity in memory
+// The number of entities of each type is maintained, so the query planner can read it for free
+type memoryEntityStore struct {
+	entities map[string]common.Entity
+	counts   map[string]int // Entity type -> number of entities
+}
+
+// newMemoryEntityStore creates an empty in-memory entity store
+func newMemoryEntityStore() *memoryEntityStore {
+	return &memoryEntityStore{
+		entities: make(map[string]common.Entity),
+		counts:   make(map[string]int),
+	}
+}
+
+func (s *memoryEntityStore) contains(key string) bool {
+	_, exists := s.entities[key]
+	return exists
+}
+
+func (s *memoryEntityStore) get(key string) (common.Entity, bool, error) {
+	entity, exists := s.entities[key]
+	return entity, exists, nil
+}
+
+func (s *memoryEntityStore) put(key string, entity common.Entity) {
+	if previous, exists := s.entities[key]; exists {
+		s.uncount(previous.Type)
+	}
+	s.entities[key] = entity
+	s.counts[entity.Type]++
+}
+
+func (s *memoryEntityStore) remove(key string) {
+	previous, exists := s.entities[key]
+	if !exists {
+		return
+	}
+	delete(s.entities, key)
+	s.uncount(previous.Type)
+}
+
+// uncount decrements the number of entities of a type
+func (s *memoryEntityStore) uncount(entityType string) {
+	s.counts[entityType]--
+	if s.counts[entityType] <= 0 {
+		delete(s.counts, entityType)
+	}
+}
+
+func (s *memoryEntityStore) forEach(fn func(key string, entity common.Entity) bool) error {
+	for key, entity := range s.entities {
+		if !fn(key, entity) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memoryEntityStore) forEachOfType(entityType string, fn func(key string, entity common.Entity) bool) error {
+	for key, entity := range s.entities {
+		if entity.Type == entityType && !fn(key, entity) {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (s *memoryEntityStore) countOfType(entityType string) int {
+	return s.counts[entityType]
+}
+
+func (s *memoryEntityStore) len() int {
+	return len(s.entities)
+}
+
+// lazyEntityStore keeps only entity IDs in memory and reads entity bodies on demand
+// Changed bodies are buffered and written out in batches. The body store is not the
+// source of truth, bodies are reconciled with snapshots and the WAL whenever the engine
+// loads, so a failed write only costs memory until it succeeds
+type lazyEntityStore struct {
+	bodies  common.EntityBodyStore
+	ids     map[string]map[string]struct{} // Entity type -> IDs
+	count   int
+	pending map[string]*common.Entity // Buffered bodies by key, nil for removed entities
+	loading bool                      // Unchanged bodies are not written again while the engine loads
+	pruned  bool                      // The body store holds no body of an entity missing from the store
+}
+
+// newLazyEntityStore creates an empty lazy entity store on top of the bodies of a previous one
+// The stored bodies are kept while the engine loads, and only the bodies that changed are written
+func newLazyEntityStore(bodies common.EntityBodyStore) *lazyEntityStore {
+	return &lazyEntityStore{
+		bodies:  bodies,
+		ids:     make(map[string]map[string]struct{}),
+		pending: make(map[string]*common.Entity),
+		loading: true,
+	}
+}
+
+// finishLoad writes the bodies changed while the engine loaded and removes the stored
+// bodies of entities that no longer exist
+func (s *lazyEntityStore) finishLoad() error {
+	s.flush()
+	s.loading = false
+
+	err := s.bodies.PruneEntityBodies(s.hasID)
+	s.pruned = err == nil
+	return err
+}
+
+func (s *lazyEntityStore) hasID(entityType, id string) bool {
+	_, exists := s.ids[entityType][id]
+	return exists
+}
+
+func (s *lazyEntityStore) contains(key string) bool {
+	return s.hasID(parseEntityKey(key))
+}
+
+func (s *lazyEntityStore) get(key string) (common.Entity, bool, error) {
+	entityType, id := parseEntityKey(key)
+	if !s.hasID(entityType, id) {
+		return common.Entity{}, false, nil
+	}
+
+	if entity, buffered := s.pending[key]; buffered {
+		if entity == nil {
+			return common.Entity{}, false, nil
+		}
+		return *entity, true, nil
+	}
+
+	entities, err := s.bodies.ReadEntityBodies(entityType, []string{id})
+	if err != nil {
+		return common.Entity{}, false, persistenceFailedError(fmt.Errorf("failed to read entity %s: %w", key, err))
+	}
+	if len(entities) == 0 {
+		return common.Entity{}, false, nil
+	}
+	return entities[0], true, nil
+}
+
+func (s *lazyEntityStore) put(key string, entity common.Entity) {
+	entityType, id := parseEntityKey(key)
+	if s.ids[entityType] == nil {
+		s.ids[entityType] = make(map[string]struct{})
+	}
+	if !s.hasID(entityType, id) {
+		s.ids[entityType][id] = struct{}{}
+		s.count++
+	}
+
+	s.pending[key] = &entity
+	s.flushIfFull()
+}
+
+func (s *lazyEntityStore) remove(key string) {
+	entityType, id := parseEntityKey(key)
+	if !s.hasID(entityType, id) {
+		return
+	}
+
+	delete(s.ids[entityType], id)
+	if len(s.ids[entityType]) == 0 {
+		delete(s.ids, entityType)
+	}
+	s.count--
+
+	s.pending[key] = nil
+	s.flushIfFull()
+}
+
+// flushIfFull writes the buffered bodies once the buffer is full
+func (s *lazyEntityStore) flushIfFull() {
+	if len(s.pending) >= lazyWriteBufferSize {
+		s.flush()
+	}
+}
+
+// flush writes the buffered bodies, skipping those already stored while the engine loads
+// Bodies stay buffered if the write fails, so no change is lost
+func (s *lazyEntityStore) flush() {
+	if len(s.pending) == 0 {
+		return
+	}
+
+	var stored, removed []common.Entity
+	for key, entity := range s.pending {
+		if entity != nil {
+			stored = append(stored, *entity)
+			continue
+		}
+		entityType, id := parseEntityKey(key)
+		removed = append(removed, common.Entity{ID: id, Type: entityType})
+	}
+
+	if s.loading {
+		stored = s.changedBodies(stored)
+	}
+
+	if err := s.bodies.WriteEntityBodies(stored, removed); err != nil {
+		fmt.Printf("Error writing entity bodies: %v\n", err)
+		return
+	}
+	s.pending = make(map[string]*common.Entity)
+}
+
+// changedBodies returns the entities whose stored body differs from the entity
+// Entities whose stored body cannot be read are treated as changed
+func (s *lazyEntityStore) changedBodies(entities []common.Entity) []common.Entity {
+	idsByType := make(map[string][]string)
+	for _, entity := range entities {
+		idsByType[entity.Type] = append(idsByType[entity.Type], entity.ID)
+	}
+
+	storedBodies := make(map[string]common.Entity, len(entities))
+	for entityType, ids := range idsByType {
+		bodies, err := s.bodies.ReadEntityBodies(entityType, ids)
+		if err != nil {
+			continue
+		}
+		for _, body := range bodies {
+			storedBodies[createEntityKey(entityType, body.ID)] = body
+		}
+	}
+
+	changed := entities[:0]
+	for _, entity := range entities {
+		body, exists := storedBodies[createEntityKey(entity.Type, entity.ID)]
+		if !exists || !reflect.DeepEqual(body.Fields, entity.Fields) {
+			changed = append(changed, entity)
+		}
+	}
+	return changed
+}
+
+func (s *lazyEntityStore) forEach(fn func(key string, entity common.Entity) bool) error {
+	entityTypes := make([]string, 0, len(s.ids))
+	for entityType := range s.ids {
+		entityTypes = append(entityTypes, entityType)
+	}
+
+	for _, entityType := range entityTypes {
+		stopped := false
+		err := s.forEachOfType(entityType, func(key string, entity common.Entity) bool {
+			if !fn(key, entity) {
+				stopped = true
+				return false
+			}
+			return true
+		})
+		if err != nil || stopped {
+			return err
+		}
+	}
+	return nil
+}
+
+// forEachOfType iterates over a copy of the IDs of an entity type and reads their bodies in batches
+func (s *lazyEntityStore) forEachOfType(entityType string, fn func(key string, entity common.Entity) bool) error {
+	ids := make([]string, 0, len(s.ids[entityType]))
+	for id := range s.ids[entityType] {
+		ids = append(ids, id)
+	}
+
+	for start := 0; start < len(ids); start += lazyReadBatchSize {
+		end := start + lazyReadBatchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		batch := make([]common.Entity, 0, end-start)
+		var unbuffered []string
+		for _, id := range ids[start:end] {
+			entity, buffered := s.pending[createEntityKey(entityType, id)]
+			if !buffered {
+				unbuffered = append(unbuffered, id)
+			} else if entity != nil {
+				batch = append(batch, *entity)
+			}
+		}
+
+		if len(unbuffered) > 0 {
+			entities, err := s.bodies.ReadEntityBodies(entityType, unbuffered)
+			if err != nil {
+				return persistenceFailedError(fmt.Errorf("failed to read entities of type %s: %w", entityType, err))
+			}
+			batch = append(batch, entities...)
+		}
+
+		for _, entity := range batch {
+			// Skip entities the callback removed, and pass on changes it made
+			key := createEntityKey(entityType, entity.ID)
+			if !s.hasID(entityType, entity.ID) {
+				continue
+			}
+			if changed, buffered := s.pending[key]; buffered && changed != nil {
+				entity = *changed
+			}
+			if !fn(key, entity) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// snapshot returns a view of the entities of the store at this point, which stays valid after the lock is released
+// This function requires that the caller holds the engine's read lock
+func (s *lazyEntityStore) snapshot() (*lazyStoreSnapshot, error) {
+	bodies, err := s.bodies.ViewEntityBodies()
+	if err != nil {
+		return nil, err
+	}
+
+	// Updates modify buffered field maps in place, so they are copied
+	pending := make(map[string]map[string]*common.Entity)
+	for key, entity := range s.pending {
+		entityType, id := parseEntityKey(key)
+		if pending[entityType] == nil {
+			pending[entityType] = make(map[string]*common.Entity)
+		}
+		if entity == nil {
+			pending[entityType][id] = nil
+			continue
+		}
+
+		fields := make(map[string]interface{}, len(entity.Fields))
+		for k, v := range entity.Fields {
+			fields[k] = v
+		}
+		pending[entityType][id] = &common.Entity{ID: entity.ID, Type: entity.Type, Fields: fields}
+	}
+
+	return &lazyStoreSnapshot{bodies: bodies, pending: pending}, nil
+}
+
+// lazyStoreSnapshot holds the entities of a lazy entity store at a single point: the stored
+// bodies as seen by a view of the body store, and copies of the bodies buffered at that point
+type lazyStoreSnapshot struct {
+	bodies  common.EntityBodyView
+	pending map[string]map[string]*common.Entity // Entity type -> ID -> buffered body, nil for removed entities
+}
+
+// forEachOfType passes the entities of a type to fn in batches of at most batchSize
+func (v *lazyStoreSnapshot) forEachOfType(entityType string, batchSize int, fn func(entities []common.Entity) error) error {
+	pending := v.pending[entityType]
+
+	err := v.bodies.ForEachEntityBody(entityType, batchSize, func(entities []common.Entity) error {
+		// Buffered bodies replace the stored ones
+		stored := entities[:0]
+		for _, entity := range entities {
+			if _, buffered := pending[entity.ID]; !buffered {
+				stored = append(stored, entity)
+			}
+		}
+		if len(stored) == 0 {
+			return nil
+		}
+		return fn(stored)
+	})
+	if err != nil {
+		return persistenceFailedError(err)
+	}
+
+	batch := make([]common.Entity, 0, batchSize)
+	for _, entity := range pending {
+		if entity == nil {
+			continue
+		}
+		batch = append(batch, *entity)
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+// close releases the view of the body store
+func (v *lazyStoreSnapshot) close() {
+	v.bodies.Close()
+}
+
+func (s *lazyEntityStore) countOfType(entityType string) int {
+	return len(s.ids[entityType])
+}
+
+func (s *lazyEntityStore) len() int {
+	return s.count
+}
@@ -0,0 +1,404 @@
+package datastore
+
+import (
+	"html"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// BM25 ranking parameters
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// Default tags used to highlight matched terms
+const (
+	DefaultHighlightPreTag  = "<em>"
+	DefaultHighlightPostTag = "</em>"
+)
+
+// stopWords are common English words that are not indexed
+var stopWords = map[string]bool{
+	"a": true, "an": true, "and": true, "are": true, "as": true, "at": true, "be": true,
+	"but": true, "by": true, "for": true, "if": true, "in": true, "into": true, "is": true,
+	"it": true, "no": true, "not": true, "of": true, "on": true, "or": true, "such": true,
+	"that": true, "the": true, "their": true, "then": true, "there": true, "these": true,
+	"they": true, "this": true, "to": true, "was": true, "will": true, "with": true,
+}
+
+// FullTextIndex is an inverted index over the terms of a text field
+type FullTextIndex struct {
+	postings    map[string]map[string]int // Key format: term -> entityID -> term frequency
+	docTerms    map[string]map[string]int // Key format: entityID -> term -> term frequency
+	docLengths  map[string]int            // Key format: entityID -> number of terms
+	totalLength int                       // Sum of the number of terms over all documents
+}
+
+// textToken is a word found in a text, with its byte offsets in the original text
+type textToken struct {
+	word  string
+	start int
+	end   int
+}
+
+// newFullTextIndex creates an empty full-text index
+func newFullTextIndex() *FullTextIndex {
+	return &FullTextIndex{
+		postings:   make(map[string]map[string]int),
+		docTerms:   make(map[string]map[string]int),
+		docLengths: make(map[string]int),
+	}
+}
+
+// add indexes the text of an entity, replacing any previously indexed text
+func (idx *FullTextIndex) add(entityID, text string) {
+	idx.remove(entityID)
+
+	terms := analyzeText(text)
+	if len(terms) == 0 {
+		return
+	}
+
+	frequencies := make(map[string]int)
+	for _, term := range terms {
+		frequencies[term]++
+	}
+
+	for term, freq := range frequencies {
+		if idx.postings[term] == nil {
+			idx.postings[term] = make(map[string]int)
+		}
+		idx.postings[term][entityID] = freq
+	}
+
+	idx.docTerms[entityID] = frequencies
+	idx.docLengths[entityID] = len(terms)
+	idx.totalLength += len(terms)
+}
+
+// remove drops an entity from the index
+func (idx *FullTextIndex) remove(entityID string) {
+	frequencies, exists := idx.docTerms[entityID]
+	if !exists {
+		return
+	}
+
+	for term := range frequencies {
+		delete(idx.postings[term], entityID)
+		if len(idx.postings[term]) == 0 {
+			delete(idx.postings, term)
+		}
+	}
+
+	idx.totalLength -= idx.docLengths[entityID]
+	delete(idx.docTerms, entityID)
+	delete(idx.docLengths, entityID)
+}
+
+// score returns the BM25 relevance of every entity matching at least one of the terms
+func (idx *FullTextIndex) score(terms []string) map[string]float64 {
+	scores := make(map[string]float64)
+
+	docCount := len(idx.docTerms)
+	if docCount == 0 {
+		return scores
+	}
+	avgLength := float64(idx.totalLength) / float64(docCount)
+
+	for _, term := range uniqueStrings(terms) {
+		postings := idx.postings[term]
+		if len(postings) == 0 {
+			continue
+		}
+
+		df := float64(len(postings))
+		idf := math.Log(1 + (float64(docCount)-df+0.5)/(df+0.5))
+
+		for entityID, freq := range postings {
+			tf := float64(freq)
+			docLength := float64(idx.docLengths[entityID])
+			scores[entityID] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*(1-bm25B+bm25B*docLength/avgLength))
+		}
+	}
+
+	return scores
+}
+
+// tokenizeText splits a text into words made of letters and digits
+func tokenizeText(text string) []textToken {
+	tokens := make([]textToken, 0)
+	start := -1
+
+	for i, r := range text {
+		isWordRune := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordRune && start < 0 {
+			start = i
+		} else if !isWordRune && start >= 0 {
+			tokens = append(tokens, textToken{word: text[start:i], start: start, end: i})
+			start = -1
+		}
+	}
+
+	if start >= 0 {
+		tokens = append(tokens, textToken{word: text[start:], start: start, end: len(text)})
+	}
+
+	return tokens
+}
+
+// analyzeText turns a text into the list of terms used for indexing and searching
+// Words are lowercased, stop words are dropped and the remaining words are stemmed
+func analyzeText(text string) []string {
+	terms := make([]string, 0)
+	for _, token := range tokenizeText(text) {
+		if term, ok := analyzeWord(token.word); ok {
+			terms = append(terms, term)
+		}
+	}
+	return terms
+}
+
+// analyzeWord normalizes a single word, returning false if it should not be indexed
+func analyzeWord(word string) (string, bool) {
+	word = strings.ToLower(word)
+	if stopWords[word] {
+		return "", false
+	}
+	return stemWord(word), true
+}
+
+// stemWord applies a light English stemmer that strips common inflectional suffixes
+func stemWord(word string) string {
+	if utf8.RuneCountInString(word) <= 3 {
+		return word
+	}
+
+	// Plurals
+	switch {
+	case strings.HasSuffix(word, "sses"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "ies") && len(word) > 4:
+		word = word[:len(word)-3] + "y"
+	case strings.HasSuffix(word, "xes"), strings.HasSuffix(word, "ches"), strings.HasSuffix(word, "shes"):
+		word = word[:len(word)-2]
+	case strings.HasSuffix(word, "s") && !strings.HasSuffix(word, "ss") &&
+		!strings.HasSuffix(word, "us") && !strings.HasSuffix(word, "is"):
+		word = word[:len(word)-1]
+	}
+
+	// Verb and adverb endings, keeping a stem of at least three letters
+	switch {
+	case strings.HasSuffix(word, "ing") && len(word) >= 6:
+		word = undoubleConsonant(word[:len(word)-3])
+	case strings.HasSuffix(word, "ed") && len(word) >= 5:
+		word = undoubleConsonant(word[:len(word)-2])
+	case strings.HasSuffix(word, "ly") && len(word) >= 6:
+		word = word[:len(word)-2]
+	}
+
+	// A trailing e is dropped so "create", "created" and "creating" share a stem
+	if strings.HasSuffix(word, "e") && len(word) > 4 {
+		word = word[:len(word)-1]
+	}
+
+	return word
+}
+
+// undoubleConsonant turns "runn" into "run" and "stopp" into "stop"
+func undoubleConsonant(word string) string {
+	n := len(word)
+	if n < 2 || word[n-1] != word[n-2] {
+		return word
+	}
+
+	switch word[n-1] {
+	case 'a', 'e', 'i', 'o', 'u', 'l', 's', 'z':
+		return word
+	}
+
+	return word[:n-1]
+}
+
+// highlightText wraps every word of the text that matches one of the terms in the given tags
+// The text is HTML-escaped, the tags are not. It returns false if no word matched
+func highlightText(text string, terms map[string]bool, preTag, postTag string) (string, bool) {
+	var builder strings.Builder
+	last := 0
+	matched := false
+
+	for _, token := range tokenizeText(text) {
+		term, ok := analyzeWord(token.word)
+		if !ok || !terms[term] {
+			continue
+		}
+
+		builder.WriteString(html.EscapeString(text[last:token.start]))
+		builder.WriteString(preTag)
+		builder.WriteString(html.EscapeString(text[token.start:token.end]))
+		builder.WriteString(postTag)
+		last = token.end
+		matched = true
+	}
+
+	builder.WriteString(html.EscapeString(text[last:]))
+	return builder.String(), matched
+}
+
+// uniqueStrings returns the distinct values of a slice, keeping their order
+func uniqueStrings(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	result := make([]string, 0, len(values))
+	for _, value := range values {
+		if !seen[value] {
+			seen[value] = true
+			result = append(result, value)
+		}
+	}
+	return result
+}
+
+// initializeFullTextIndices creates empty full-text indices for an entity definition
+// This function requires that the caller holds a write lock
+func (dse *Engine) initializeFullTextIndices(def common.EntityDefinition) {
+	indices := make(map[string]*FullTextIndex)
+	for _, field := range def.Fields {
+		if field.FullText {
+			indices[field.Name] = newFullTextIndex()
+		}
+	}
+	dse.fullTextIndices[def.Name] = indices
+}
+
+// rebuildFullTextIndices recreates the full-text indices of an entity type from its entities
+// This function requires that the caller holds a write lock
+func (dse *Engine) rebuildFullTextIndices(def common.EntityDefinition) error {
+	dse.initializeFullTextIndices(def)
+	if len(dse.fullTextIndices[def.Name]) == 0 {
+		return nil
+	}
+
+	return dse.entities.forEachOfType(def.Name, func(_ string, entity common.Entity) bool {
+		dse.updateFullTextIndices(entity, true)
+		return true
+	})
+}
+
+// updateFullTextIndices adds or removes the full-text index entries of an entity
+// This function requires that the caller holds a write lock
+func (dse *Engine) updateFullTextIndices(entity common.Entity, add bool) {
+	for fieldName, index := range dse.fullTextIndices[entity.Type] {
+		if !add {
+			index.remove(entity.ID)
+			continue
+		}
+
+		if text, ok := entity.Fields[fieldName].(string); ok {
+			index.add(entity.ID, text)
+		} else {
+			index.remove(entity.ID)
+		}
+	}
+}
+
+// searchScores scores the candidates of a search filter
+// The full-text index of the field is used when available, otherwise the candidates are analyzed on the fly
+// This function requires that the caller holds a read lock
+func (qs *QueryService) searchScores(entityType, field, search string, candidates []common.Entity) map[string]float64 {
+	terms := analyzeText(search)
+	if len(terms) == 0 {
+		return map[string]float64{}
+	}
+
+	if index := qs.engine.fullTextIndices[entityType][field]; index != nil {
+		return index.score(terms)
+	}
+
+	index := newFullTextIndex()
+	for _, entity := range candidates {
+		if text, ok := entity.Fields[field].(string); ok {
+			index.add(entity.ID, text)
+		}
+	}
+	return index.score(terms)
+}
+
+// buildSearchMatches collects scores and highlights for the entities returned by a search query
+func (qs *QueryService) buildSearchMatches(entities []common.Entity, scores map[string]float64, options QueryOptions) map[string]SearchMatch {
+	if !hasSearchFilter(options.Filters) {
+		return nil
+	}
+
+	preTag, postTag := DefaultHighlightPreTag, DefaultHighlightPostTag
+	if options.Highlight != nil {
+		if options.Highlight.PreTag != "" {
+			preTag = options.Highlight.PreTag
+		}
+		if options.Highlight.PostTag != "" {
+			postTag = options.Highlight.PostTag
+		}
+	}
+
+	// Collect the search terms of every searched field
+	fieldTerms := make(map[string]map[string]bool)
+	for _, f := range options.Filters {
+		search, ok := f.Value.(string)
+		if f.Operator != FilterSearch || !ok {
+			continue
+		}
+		if fieldTerms[f.Field] == nil {
+			fieldTerms[f.Field] = make(map[string]bool)
+		}
+		for _, term := range analyzeText(search) {
+			fieldTerms[f.Field][term] = true
+		}
+	}
+
+	matches := make(map[string]SearchMatch, len(entities))
+	for _, entity := range entities {
+		match := SearchMatch{Score: scores[entity.ID]}
+
+		if options.Highlight != nil {
+			match.Highlights = make(map[string]string)
+			for field, terms := range fieldTerms {
+				text, ok := entity.Fields[field].(string)
+				if !ok {
+					continue
+				}
+				if highlighted, matched := highlightText(text, terms, preTag, postTag); matched {
+					match.Highlights[field] = highlighted
+				}
+			}
+		}
+
+		matches[entity.ID] = match
+	}
+
+	return matches
+}
+
+// hasSearchFilter reports whether a list of filters contains a full-text search
+func hasSearchFilter(filters []Filter) bool {
+	for _, f := range filters {
+		if f.Operator == FilterSearch {
+			return true
+		}
+	}
+	return false
+}
+
+// sortByScore orders entities by descending relevance, then by ID for stable results
+func sortByScore(entities []common.Entity, scores map[string]float64) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		scoreI, scoreJ := scores[entities[i].ID], scores[entities[j].ID]
+		if scoreI != scoreJ {
+			return scoreI > scoreJ
+		}
+		return entities[i].ID < entities[j].ID
+	})
+}
@@ -1,6 +1,7 @@
 package datastore
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"reflect"
@@ -11,11 +12,17 @@ import (
 	"github.com/phillarmonic/syncopate-db/internal/settings"
 
 	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // QueryService handles the querying logic for the data store
 type QueryService struct {
-	engine *Engine
+	engine      *Engine
+	slowQueries *SlowQueryLog // Records queries exceeding its threshold, nil when disabled
+	limits      QueryLimits   // Bounds the work of every query
 }
 
 // NewQueryService creates a new query service
@@ -25,8 +32,68 @@ func NewQueryService(engine *Engine) *QueryService {
 	}
 }
 
+// knownFilterOperators are the operators queries are recorded under, others are recorded as "other"
+var knownFilterOperators = map[string]bool{
+	FilterEq: true, FilterNeq: true, FilterGt: true, FilterGte: true, FilterLt: true, FilterLte: true,
+	FilterContains: true, FilterStartsWith: true, FilterEndsWith: true, FilterIn: true, FilterFuzzy: true,
+	FilterArrayContains: true, FilterArrayContainsAny: true, FilterArrayContainsAll: true, FilterSearch: true,
+}
+
+// observeQuery records the latency of a query by its entity type and filter operators
+func observeQuery(options QueryOptions, start time.Time) {
+	operators := make([]string, 0, len(options.Filters))
+	for _, filter := range options.Filters {
+		if knownFilterOperators[filter.Operator] {
+			operators = append(operators, filter.Operator)
+		} else {
+			operators = append(operators, "other")
+		}
+	}
+	metrics.ObserveQuery(options.EntityType, operators, time.Since(start))
+}
+
 // Query executes a query against the data store
 func (qs *QueryService) Query(options QueryOptions) ([]common.Entity, error) {
+	return qs.QueryContext(options.Context, options)
+}
+
+// QueryContext executes a query against the data store, stopping when ctx is done
+func (qs *QueryService) QueryContext(ctx context.Context, options QueryOptions) ([]common.Entity, error) {
+	options, cancel, err := qs.startQuery(ctx, options)
+	defer cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	entities, err := qs.query(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := qs.checkResultSize(len(entities)); err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+// query executes a query without checking it against the limits
+func (qs *QueryService) query(options QueryOptions) ([]common.Entity, error) {
+	entities, _, err := qs.executeQuery(options)
+	options.plan.recordResults(len(entities), len(entities))
+	return entities, err
+}
+
+// executeQuery runs a query and also returns the relevance scores of search filters by entity ID
+// Results of queries with search filters and no explicit order are ranked by score
+func (qs *QueryService) executeQuery(options QueryOptions) (results []common.Entity, scores map[string]float64, err error) {
+	ctx, span := tracing.Start(options.Context, "datastore.query", trace.WithAttributes(
+		attribute.String("db.collection.name", options.EntityType),
+		attribute.Int("syncopatedb.query.filters", len(options.Filters)),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("syncopatedb.query.results", len(results)))
+		tracing.End(span, err)
+	}()
+
 	qs.engine.mu.RLock()
 	defer qs.engine.mu.RUnlock()
 
@@ -35,19 +102,73 @@ func (qs *QueryService) Query(options QueryOptions) ([]common.Entity, error) {
 
 	// Verify an entity type exists
 	if _, exists := qs.engine.definitions[entityTypeName]; !exists {
-		return nil, fmt.Errorf("entity type '%s' not registered", entityTypeName)
+		return nil, nil, fmt.Errorf("entity type '%s' not registered", entityTypeName)
 	}
+	defer observeQuery(options, time.Now())
+
+	// Relevance scores of search filters, summed over all search filters
+	scores = make(map[string]float64)
 
-	// Start with all entities of the specified type
+	// Start with the entities the chosen index lookups match, the candidates of trigram indices
+	// if substring or fuzzy filters can use them, or all entities of the specified type
+	scanStart := time.Now()
+	scan := ScanFull
 	matchingEntities := make([]common.Entity, 0)
-	for _, entity := range qs.engine.entities {
-		if entity.Type == options.EntityType {
+	access := qs.planAccess(options.EntityType, options.Filters)
+	candidateIDs, narrowed := qs.trigramCandidates(options.EntityType, options.Filters, options.FuzzyOpts)
+	span.SetAttributes(
+		attribute.Int("syncopatedb.query.index_lookups", len(access.lookups)),
+		attribute.Bool("syncopatedb.query.trigram_candidates", narrowed),
+	)
+	if len(access.lookups) > 0 {
+		scan = ScanIndex
+		candidateIDs = qs.lookupCandidates(options.EntityType, access, candidateIDs, options.plan)
+	} else if narrowed {
+		scan = ScanTrigram
+	}
+	if scan != ScanFull {
+		checked := 0
+		for id := range candidateIDs {
+			if err = queryInterrupted(ctx, checked); err != nil {
+				return nil, nil, err
+			}
+			checked++
+			entity, exists, err := qs.engine.entities.get(createEntityKey(options.EntityType, id))
+			if err != nil {
+				return nil, nil, err
+			}
+			if exists {
+				matchingEntities = append(matchingEntities, entity)
+			}
+		}
+	} else {
+		storeErr := qs.engine.entities.forEachOfType(options.EntityType, func(_ string, entity common.Entity) bool {
+			if err = queryInterrupted(ctx, len(matchingEntities)); err != nil {
+				return false
+			}
 			matchingEntities = append(matchingEntities, entity)
+			return true
+		})
+		if storeErr != nil {
+			err = storeErr
+		}
+		if err != nil {
+			return nil, nil, err
 		}
 	}
+	options.plan.recordScan(scan, access.entities, len(matchingEntities), time.Since(scanStart))
+
+	// Apply the filters the index lookups did not
+	for _, f := range access.residual {
+		filterStart := time.Now()
+		candidatesBefore := len(matchingEntities)
+		strategy := FilterStrategyScan
+		_, filterSpan := tracing.Start(ctx, "datastore.filter", trace.WithAttributes(
+			attribute.String("syncopatedb.filter.field", f.Field),
+			attribute.String("syncopatedb.filter.operator", f.Operator),
+			attribute.Int("syncopatedb.filter.candidates", len(matchingEntities)),
+		))
 
-	// Apply filters
-	for _, f := range options.Filters {
 		// Check if we can use an index for this filter
 		def := qs.engine.definitions[options.EntityType]
 		isIndexed := false
@@ -58,7 +179,10 @@ func (qs *QueryService) Query(options QueryOptions) ([]common.Entity, error) {
 			}
 		}
 
+		filterSpan.SetAttributes(attribute.Bool("syncopatedb.filter.indexed", isIndexed && f.Operator == FilterEq))
 		if isIndexed && f.Operator == FilterEq {
+			strategy = FilterStrategyIndex
+
 			// Use index for equality checks
 			strValue := qs.engine.getIndexableValue(f.Value)
 			indexedIDs := qs.engine.indices[options.EntityType][f.Field][strValue]
@@ -71,29 +195,37 @@ func (qs *QueryService) Query(options QueryOptions) ([]common.Entity, error) {
 
 			// Filter entities using the index
 			filteredEntities := make([]common.Entity, 0)
-			for _, entity := range matchingEntities {
+			for i, entity := range matchingEntities {
+				if err = queryInterrupted(ctx, i); err != nil {
+					tracing.End(filterSpan, err)
+					return nil, nil, err
+				}
 				if idMap[entity.ID] {
 					filteredEntities = append(filteredEntities, entity)
 				}
 			}
 			matchingEntities = filteredEntities
 		} else if f.Operator == FilterFuzzy {
+			if options.plan != nil && qs.trigramNarrows(options.EntityType, f, options.FuzzyOpts) {
+				strategy = FilterStrategyTrigram
+			}
+
 			// Handle fuzzy search separately
 			filteredEntities := make([]common.Entity, 0)
-			threshold := 0.7 // Default threshold
-			maxDistance := 3 // Default max distance
-
-			if options.FuzzyOpts != nil {
-				threshold = options.FuzzyOpts.Threshold
-				maxDistance = options.FuzzyOpts.MaxDistance
-			}
+			threshold, maxDistance := fuzzyLimits(options.FuzzyOpts)
 
 			searchStr, ok := f.Value.(string)
 			if !ok {
-				return nil, errors.New("fuzzy search value must be a string")
+				err = errors.New("fuzzy search value must be a string")
+				tracing.End(filterSpan, err)
+				return nil, nil, err
 			}
 
-			for _, entity := range matchingEntities {
+			for i, entity := range matchingEntities {
+				if err = queryInterrupted(ctx, i); err != nil {
+					tracing.End(filterSpan, err)
+					return nil, nil, err
+				}
 				value, exists := entity.Fields[f.Field]
 				if !exists {
 					continue
@@ -110,36 +242,86 @@ func (qs *QueryService) Query(options QueryOptions) ([]common.Entity, error) {
 				}
 			}
 
+			matchingEntities = filteredEntities
+		} else if f.Operator == FilterSearch {
+			// Full-text search, ranked by relevance
+			searchStr, ok := f.Value.(string)
+			if !ok {
+				err = errors.New("search value must be a string")
+				tracing.End(filterSpan, err)
+				return nil, nil, err
+			}
+
+			if qs.engine.fullTextIndices[options.EntityType][f.Field] != nil {
+				strategy = FilterStrategyFullText
+			}
+			filterScores := qs.searchScores(options.EntityType, f.Field, searchStr, matchingEntities)
+			if err = checkQueryContext(ctx); err != nil {
+				tracing.End(filterSpan, err)
+				return nil, nil, err
+			}
+
+			filteredEntities := make([]common.Entity, 0)
+			for _, entity := range matchingEntities {
+				if score, matched := filterScores[entity.ID]; matched {
+					filteredEntities = append(filteredEntities, entity)
+					scores[entity.ID] += score
+				}
+			}
+
 			matchingEntities = filteredEntities
 		} else {
+			if options.plan != nil && qs.trigramNarrows(options.EntityType, f, options.FuzzyOpts) {
+				strategy = FilterStrategyTrigram
+			}
+
 			// No index or non-equality operator, filter manually
 			filteredEntities := make([]common.Entity, 0)
 
-			for _, entity := range matchingEntities {
+			for i, entity := range matchingEntities {
+				if err = queryInterrupted(ctx, i); err != nil {
+					tracing.End(filterSpan, err)
+					return nil, nil, err
+				}
 				value, exists := entity.Fields[f.Field]
 
 				if !exists {
 					continue
 				}
 
-				if qs.matchesFilter(value, f.Operator, f.Value) {
+				if qs.matchesFieldFilter(options.EntityType, value, f) {
 					filteredEntities = append(filteredEntities, entity)
 				}
 			}
 
 			matchingEntities = filteredEntities
 		}
+
+		options.plan.recordFilter(f, strategy, candidatesBefore, len(matchingEntities), time.Since(filterStart))
+		filterSpan.SetAttributes(attribute.Int("syncopatedb.filter.matches", len(matchingEntities)))
+		filterSpan.End()
+	}
+
+	// Sorting is not interrupted, stop before it when the query is done
+	if err = checkQueryContext(ctx); err != nil {
+		return nil, nil, err
 	}
 
 	// Sort results if needed
+	sortStart := time.Now()
 	if options.OrderBy != "" {
 		// Sort the entities
-		qs.sortEntities(matchingEntities, options.OrderBy, options.OrderDesc)
+		qs.sortEntities(ctx, matchingEntities, options.OrderBy, options.OrderDesc)
+		options.plan.recordSort(options.OrderBy, options.OrderDesc, false, len(matchingEntities), time.Since(sortStart))
+	} else if hasSearchFilter(options.Filters) {
+		// Rank search results by relevance
+		sortByScore(matchingEntities, scores)
+		options.plan.recordSort("", true, true, len(matchingEntities), time.Since(sortStart))
 	}
 
 	// Apply offset and limit
 	if options.Offset >= len(matchingEntities) {
-		return []common.Entity{}, nil
+		return []common.Entity{}, scores, nil
 	}
 
 	end := len(matchingEntities)
@@ -147,7 +329,7 @@ func (qs *QueryService) Query(options QueryOptions) ([]common.Entity, error) {
 		end = options.Offset + options.Limit
 	}
 
-	return matchingEntities[options.Offset:end], nil
+	return matchingEntities[options.Offset:end], scores, nil
 }
 
 // Levenshtein calculates the Levenshtein distance between two strings
@@ -211,6 +393,15 @@ func max(a, b int) int {
 	return b
 }
 
+// fuzzyLimits returns the similarity threshold and maximum edit distance of fuzzy filters,
+// 0.7 and 3 unless options are given
+func fuzzyLimits(opts *FuzzySearchOptions) (threshold float64, maxDistance int) {
+	if opts == nil {
+		return 0.7, 3
+	}
+	return opts.Threshold, opts.MaxDistance
+}
+
 // fuzzyMatch determines if two strings match within a threshold using Levenshtein distance
 func (qs *QueryService) fuzzyMatch(s1, s2 string, threshold float64, maxDistance int) bool {
 	s1 = strings.ToLower(s1)
@@ -404,6 +595,25 @@ func (qs *QueryService) matchesFilter(value interface{}, operator string, filter
 		}
 		return true // All values were found
 
+	case FilterSearch:
+		// Match if the text shares at least one term with the search
+		strValue, ok1 := value.(string)
+		strFilter, ok2 := filterValue.(string)
+		if !ok1 || !ok2 {
+			return false
+		}
+
+		searchTerms := make(map[string]bool)
+		for _, term := range analyzeText(strFilter) {
+			searchTerms[term] = true
+		}
+		for _, term := range analyzeText(strValue) {
+			if searchTerms[term] {
+				return true
+			}
+		}
+		return false
+
 	default:
 		return false
 	}
@@ -520,7 +730,13 @@ func (qs *QueryService) compareValues(left interface{}, operator string, right i
 }
 
 // sortEntities sorts a slice of entities by the specified field
-func (qs *QueryService) sortEntities(entities []common.Entity, field string, descending bool) {
+func (qs *QueryService) sortEntities(ctx context.Context, entities []common.Entity, field string, descending bool) {
+	_, span := tracing.Start(ctx, "datastore.sort", trace.WithAttributes(
+		attribute.String("syncopatedb.sort.field", field),
+		attribute.Int("syncopatedb.sort.entities", len(entities)),
+	))
+	defer span.End()
+
 	sort.Slice(entities, func(i, j int) bool {
 		valI, existsI := entities[i].Fields[field]
 		valJ, existsJ := entities[j].Fields[field]
@@ -616,8 +832,35 @@ func (qs *QueryService) sortEntities(entities []common.Entity, field string, des
 
 // ExecutePaginatedQuery executes a query and returns a paginated response
 func (qs *QueryService) ExecutePaginatedQuery(options QueryOptions) (*PaginatedResponse, error) {
+	return qs.ExecutePaginatedQueryContext(options.Context, options)
+}
+
+// ExecutePaginatedQueryContext executes a query and returns a paginated response, stopping when ctx is done
+func (qs *QueryService) ExecutePaginatedQueryContext(ctx context.Context, options QueryOptions) (*PaginatedResponse, error) {
+	options, cancel, err := qs.startQuery(ctx, options)
+	defer cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := qs.executePaginatedQuery(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := qs.checkResultSize(response.Count); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// executePaginatedQuery executes a paginated query without checking it against the limits
+func (qs *QueryService) executePaginatedQuery(options QueryOptions) (response *PaginatedResponse, err error) {
+	tracker := qs.trackSlowQuery(SlowQueryKindQuery, &options)
+	defer func() { tracker.finish(response, err) }()
+
 	// Set the default sort (internal) field if none is specified
-	if options.OrderBy == "" {
+	// Search queries are ranked by relevance instead
+	if options.OrderBy == "" && !hasSearchFilter(options.Filters) {
 		options.OrderBy = "_created_at"
 		// Default to ascending order (oldest first)
 		options.OrderDesc = false
@@ -630,7 +873,7 @@ func (qs *QueryService) ExecutePaginatedQuery(options QueryOptions) (*PaginatedR
 	queryOptionsForCount.Limit = 0   // No limit to get all matches for counting
 	queryOptionsForCount.Joins = nil // Remove joins for the count query
 
-	allMatchingResults, err := qs.Query(queryOptionsForCount)
+	allMatchingResults, scores, err := qs.executeQuery(queryOptionsForCount)
 	if err != nil {
 		return nil, err
 	}
@@ -650,6 +893,7 @@ func (qs *QueryService) ExecutePaginatedQuery(options QueryOptions) (*PaginatedR
 	if startIndex > 0 || endIndex < len(allMatchingResults) {
 		results = allMatchingResults[startIndex:endIndex]
 	}
+	options.plan.recordResults(len(allMatchingResults), len(results))
 
 	// Make copies of the entities before processing joins
 	if len(options.Joins) > 0 {
@@ -671,7 +915,7 @@ func (qs *QueryService) ExecutePaginatedQuery(options QueryOptions) (*PaginatedR
 		// Process joins on the copies
 		for _, join := range options.Joins {
 			var err error
-			resultCopies, err = qs.executeJoin(resultCopies, join)
+			resultCopies, err = qs.executeJoin(options.Context, resultCopies, join, options.plan)
 			if err != nil {
 				return nil, fmt.Errorf("join error: %w", err)
 			}
@@ -692,6 +936,7 @@ func (qs *QueryService) ExecutePaginatedQuery(options QueryOptions) (*PaginatedR
 		Offset:     options.Offset,
 		HasMore:    options.Offset+len(results) < totalFilteredCount,
 		EntityType: options.EntityType,
+		Search:     qs.buildSearchMatches(results, scores, options),
 	}, nil
 }
 
@@ -729,9 +974,37 @@ func (qs *QueryService) filterInternalFields(entity common.Entity) common.Entity
 	return filteredEntity
 }
 
+// ExecuteQueryWithJoins executes a query and applies its joins to copies of the entities
 func (qs *QueryService) ExecuteQueryWithJoins(options QueryOptions) (*PaginatedResponse, error) {
+	return qs.ExecuteQueryWithJoinsContext(options.Context, options)
+}
+
+// ExecuteQueryWithJoinsContext executes a query and applies its joins to copies of the entities,
+// stopping when ctx is done
+func (qs *QueryService) ExecuteQueryWithJoinsContext(ctx context.Context, options QueryOptions) (*PaginatedResponse, error) {
+	options, cancel, err := qs.startQuery(ctx, options)
+	defer cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := qs.executeQueryWithJoins(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := qs.checkResultSize(response.Count); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// executeQueryWithJoins executes a query with joins without checking it against the limits
+func (qs *QueryService) executeQueryWithJoins(options QueryOptions) (response *PaginatedResponse, err error) {
+	tracker := qs.trackSlowQuery(SlowQueryKindJoin, &options)
+	defer func() { tracker.finish(response, err) }()
+
 	// Start with the base query execution
-	baseResponse, err := qs.ExecutePaginatedQuery(options)
+	baseResponse, err := qs.executePaginatedQuery(options)
 	if err != nil {
 		return nil, err
 	}
@@ -760,7 +1033,7 @@ func (qs *QueryService) ExecuteQueryWithJoins(options QueryOptions) (*PaginatedR
 	// Process joins on the copied entities
 	for _, join := range options.Joins {
 		var err error
-		copiedEntities, err = qs.executeJoin(copiedEntities, join)
+		copiedEntities, err = qs.executeJoin(options.Context, copiedEntities, join, options.plan)
 		if err != nil {
 			return nil, fmt.Errorf("join error: %w", err)
 		}
@@ -775,6 +1048,7 @@ func (qs *QueryService) ExecuteQueryWithJoins(options QueryOptions) (*PaginatedR
 		HasMore:    baseResponse.HasMore,
 		EntityType: baseResponse.EntityType,
 		Data:       copiedEntities,
+		Search:     baseResponse.Search,
 	}
 
 	return joinedResponse, nil
@@ -783,6 +1057,20 @@ func (qs *QueryService) ExecuteQueryWithJoins(options QueryOptions) (*PaginatedR
 // ExecuteCountQuery executes an auto-optimizing count query that intelligently
 // chooses the most efficient counting strategy based on the query and dataset
 func (qs *QueryService) ExecuteCountQuery(options QueryOptions) (int, error) {
+	return qs.ExecuteCountQueryContext(options.Context, options)
+}
+
+// ExecuteCountQueryContext executes a count query, stopping when ctx is done
+// The result size limit does not apply, no entities are returned
+func (qs *QueryService) ExecuteCountQueryContext(ctx context.Context, options QueryOptions) (int, error) {
+	// Included relations are left joins, which do not change the count
+	options.Include = nil
+	options, cancel, err := qs.startQuery(ctx, options)
+	defer cancel()
+	if err != nil {
+		return 0, err
+	}
+
 	qs.engine.mu.RLock()
 	defer qs.engine.mu.RUnlock()
 
@@ -798,48 +1086,36 @@ func (qs *QueryService) ExecuteCountQuery(options QueryOptions) (int, error) {
 		joinQueryOpts.Offset = 0
 		joinQueryOpts.Limit = 0
 
-		response, err := qs.ExecuteQueryWithJoins(joinQueryOpts)
+		response, err := qs.executeQueryWithJoins(joinQueryOpts)
 		if err != nil {
 			return 0, err
 		}
 		return response.Total, nil
 	}
 
-	// Optimization path 1: Index-based counting for equality filters on indexed fields
+	// Optimization path 1: Index lookups chosen by the planner, the filters they resolve
+	// are not evaluated again
 	optimizationPath := "full-scan" // Default
 
-	// Check if we can use an indexed field for the count
-	def := qs.engine.definitions[options.EntityType]
+	access := qs.planAccess(options.EntityType, options.Filters)
+	candidateIDs, narrowed := qs.trigramCandidates(options.EntityType, options.Filters, options.FuzzyOpts)
+	if len(access.lookups) > 0 {
+		optimizationPath = "index-lookup"
+		candidateIDs = qs.lookupCandidates(options.EntityType, access, candidateIDs, nil)
 
-	// For single equality filter on an indexed field
-	if len(options.Filters) == 1 {
-		filter := options.Filters[0]
-		if filter.Operator == FilterEq {
-			for _, fieldDef := range def.Fields {
-				if fieldDef.Name == filter.Field && fieldDef.Indexed {
-					// We can use the index for direct lookup!
-					optimizationPath = "index-lookup"
-					indexValue := qs.engine.getIndexableValue(filter.Value)
-
-					// Get the IDs directly from the index
-					indexedIDs := qs.engine.indices[options.EntityType][filter.Field][indexValue]
-					return len(indexedIDs), nil
-				}
-			}
+		// Every filter was resolved by the index, the candidates are the matches
+		if len(access.residual) == 0 {
+			return len(candidateIDs), nil
 		}
-	}
-
-	// Optimization path 2: Type-based counting for any indexed field
-	if len(options.Filters) > 0 {
-		// Check if any filter uses an indexed field with any operator
+	} else if narrowed {
+		// Optimization path 2: Trigram candidates for substring and fuzzy filters
+		optimizationPath = "trigram-lookup"
+	} else if len(access.residual) > 0 {
+		// Optimization path 3: Indexed fields the planner did not choose are still noted for logging
+		def := qs.engine.definitions[options.EntityType]
 		for _, filter := range options.Filters {
 			for _, fieldDef := range def.Fields {
 				if fieldDef.Name == filter.Field && fieldDef.Indexed {
-					// We have an indexed field in the filter - this is a clue
-					// that we have a more selective query that could benefit from
-					// type-specific optimizations
-
-					// We're still using full scan, but we note this for logging
 					optimizationPath = "indexed-field-scan"
 					break
 				}
@@ -847,36 +1123,28 @@ func (qs *QueryService) ExecuteCountQuery(options QueryOptions) (int, error) {
 		}
 	}
 
-	// Optimization path 3: Dataset size based optimization
-	// Get a rough count of the entity type to decide if we should optimize further
-	totalEntitiesOfType := 0
-	for _, entity := range qs.engine.entities {
-		if entity.Type == options.EntityType {
-			totalEntitiesOfType++
-
-			// Early exit: If we're counting more than 1000 entities,
-			// we know this is a large dataset and should use optimized counting
-			if totalEntitiesOfType > 1000 && optimizationPath == "full-scan" {
-				optimizationPath = "large-dataset-scan"
-				break
+	if optimizationPath == "index-lookup" || optimizationPath == "trigram-lookup" {
+		count := 0
+		checked := 0
+		for id := range candidateIDs {
+			if err := queryInterrupted(options.Context, checked); err != nil {
+				return 0, err
 			}
-		}
-	}
+			checked++
 
-	// For all other cases, use an optimized full scan that counts without materializing entities
-	count := 0
-	for _, entity := range qs.engine.entities {
-		if entity.Type == options.EntityType {
-			// Check if entity matches all filters
+			entity, exists, err := qs.engine.entities.get(createEntityKey(options.EntityType, id))
+			if err != nil {
+				return 0, err
+			}
+			if !exists {
+				continue
+			}
+
+			// Candidates still have to match the filters the index lookups did not resolve
 			matches := true
-			for _, filter := range options.Filters {
+			for _, filter := range access.residual {
 				value, exists := entity.Fields[filter.Field]
-				if !exists {
-					matches = false
-					break
-				}
-
-				if !qs.matchesFilter(value, filter.Operator, filter.Value) {
+				if !exists || !qs.matchesFieldFilter(options.EntityType, value, filter) {
 					matches = false
 					break
 				}
@@ -886,6 +1154,52 @@ func (qs *QueryService) ExecuteCountQuery(options QueryOptions) (int, error) {
 				count++
 			}
 		}
+
+		if settings.Config.Debug {
+			fmt.Printf("[DEBUG] Count query for '%s' used optimization path: %s\n",
+				options.EntityType, optimizationPath)
+		}
+
+		return count, nil
+	}
+
+	// Optimization path 4: Dataset size based optimization
+	// Get a rough count of the entity type to decide if we should optimize further
+	// Early exit: If there are more than 1000 entities,
+	// we know this is a large dataset and should use optimized counting
+	if qs.engine.entities.countOfType(options.EntityType) > 1000 && optimizationPath == "full-scan" {
+		optimizationPath = "large-dataset-scan"
+	}
+
+	// For all other cases, use an optimized full scan that counts without materializing entities
+	count := 0
+	checked := 0
+	storeErr := qs.engine.entities.forEachOfType(options.EntityType, func(_ string, entity common.Entity) bool {
+		if err = queryInterrupted(options.Context, checked); err != nil {
+			return false
+		}
+		checked++
+
+		// Check if entity matches all filters
+		for _, filter := range options.Filters {
+			value, exists := entity.Fields[filter.Field]
+			if !exists {
+				return true
+			}
+
+			if !qs.matchesFieldFilter(options.EntityType, value, filter) {
+				return true
+			}
+		}
+
+		count++
+		return true
+	})
+	if storeErr != nil {
+		err = storeErr
+	}
+	if err != nil {
+		return 0, err
 	}
 
 	// Debug logging for optimization paths
@@ -1,9 +1,17 @@
 package datastore
 
 import (
+	"context"
+	stderrors "errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
 )
 
 // TestFilterOperators tests all filter operators
@@ -798,3 +806,1301 @@ func TestFuzzySearch(t *testing.T) {
 		}
 	})
 }
+
+// TestFullTextSearch tests the search operator with ranking and highlighting
+func TestFullTextSearch(t *testing.T) {
+	// Create in-memory database
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	// Define schema with a full-text indexed field
+	schema := common.EntityDefinition{
+		Name:        "articles",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "title", Type: "string", Required: true},
+			{Name: "body", Type: "text", Required: true, FullText: true},
+		},
+	}
+
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+
+	testData := []map[string]interface{}{
+		{"title": "Databases", "body": "An introduction to embedded databases and how they store data."},
+		{"title": "Indexing", "body": "Indexes make database queries fast. Indexing databases is an art."},
+		{"title": "Cooking", "body": "A recipe for a quick tomato soup."},
+	}
+
+	for _, data := range testData {
+		if err := db.Insert("articles", "", data); err != nil {
+			t.Fatalf("Failed to insert test data: %v", err)
+		}
+	}
+
+	t.Run("SearchRanking", func(t *testing.T) {
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "articles",
+			Filters: []Filter{
+				{Field: "body", Operator: FilterSearch, Value: "the databases indexing"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Search query failed: %v", err)
+		}
+
+		if response.Count != 2 {
+			t.Fatalf("Expected 2 search results, got %d", response.Count)
+		}
+
+		// The article matching both terms ranks first
+		if response.Data[0].Fields["title"] != "Indexing" {
+			t.Errorf("Expected 'Indexing' to rank first, got %v", response.Data[0].Fields["title"])
+		}
+
+		first := response.Search[response.Data[0].ID]
+		second := response.Search[response.Data[1].ID]
+		if first.Score <= second.Score || second.Score <= 0 {
+			t.Errorf("Expected descending positive scores, got %f and %f", first.Score, second.Score)
+		}
+	})
+
+	t.Run("SearchStemming", func(t *testing.T) {
+		count, err := queryService.ExecuteCountQuery(QueryOptions{
+			EntityType: "articles",
+			Filters: []Filter{
+				{Field: "body", Operator: FilterSearch, Value: "stored"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Count query failed: %v", err)
+		}
+
+		if count != 1 {
+			t.Errorf("Expected 'stored' to match 'store', got %d results", count)
+		}
+	})
+
+	t.Run("SearchHighlighting", func(t *testing.T) {
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "articles",
+			Filters: []Filter{
+				{Field: "body", Operator: FilterSearch, Value: "soup"},
+			},
+			Highlight: &HighlightOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Search query failed: %v", err)
+		}
+
+		if response.Count != 1 {
+			t.Fatalf("Expected 1 search result, got %d", response.Count)
+		}
+
+		expected := "A recipe for a quick tomato <em>soup</em>."
+		if highlighted := response.Search[response.Data[0].ID].Highlights["body"]; highlighted != expected {
+			t.Errorf("Expected highlight %q, got %q", expected, highlighted)
+		}
+
+		// The text is escaped, so a highlight is safe to render as HTML
+		expected = "&lt;b&gt;<mark>soup</mark>&lt;/b&gt; &amp; bread"
+		if highlighted, _ := highlightText("<b>soup</b> & bread", map[string]bool{"soup": true}, "<mark>", "</mark>"); highlighted != expected {
+			t.Errorf("Expected escaped highlight %q, got %q", expected, highlighted)
+		}
+	})
+
+	t.Run("SearchWithoutIndex", func(t *testing.T) {
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "articles",
+			Filters: []Filter{
+				{Field: "title", Operator: FilterSearch, Value: "cooking"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Search query failed: %v", err)
+		}
+
+		if response.Count != 1 {
+			t.Errorf("Expected 1 result when searching a field without index, got %d", response.Count)
+		}
+	})
+
+	t.Run("IndexFollowsUpdatesAndDeletes", func(t *testing.T) {
+		if err := db.Update("articles", "3", map[string]interface{}{"body": "A guide to database backups."}); err != nil {
+			t.Fatalf("Failed to update entity: %v", err)
+		}
+		if err := db.Delete("articles", "1"); err != nil {
+			t.Fatalf("Failed to delete entity: %v", err)
+		}
+
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "articles",
+			Filters: []Filter{
+				{Field: "body", Operator: FilterSearch, Value: "database"},
+			},
+		})
+		if err != nil {
+			t.Fatalf("Search query failed: %v", err)
+		}
+
+		if response.Count != 2 {
+			t.Errorf("Expected 2 results after update and delete, got %d", response.Count)
+		}
+		for _, entity := range response.Data {
+			if entity.ID == "1" {
+				t.Error("Deleted entity should not be found by search")
+			}
+		}
+	})
+
+	t.Run("FullTextOnlyForTextFields", func(t *testing.T) {
+		err := db.RegisterEntityType(common.EntityDefinition{
+			Name: "invalid_full_text",
+			Fields: []common.FieldDefinition{
+				{Name: "count", Type: "integer", FullText: true},
+			},
+		})
+		if err == nil {
+			t.Error("Expected error when enabling full-text index on an integer field")
+		}
+	})
+}
+
+// TestTrigramIndex tests that trigram indices return the same results as full scans
+func TestTrigramIndex(t *testing.T) {
+	// Create in-memory database
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	// Register the same schema with and without a trigram index
+	for _, name := range []string{"products_scan", "products_trigram"} {
+		schema := common.EntityDefinition{
+			Name:        name,
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "name", Type: "string", Required: true, Trigram: name == "products_trigram"},
+			},
+		}
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+	}
+
+	testData := []map[string]interface{}{
+		{"name": "Ergonomic Keyboard"},
+		{"name": "Wireless Mouse"},
+		{"name": "Mechanical Keyboard Pro"},
+		{"name": "USB Hub"},
+		{"name": "Monitor Stand"},
+		{"name": "Keyboard Wrist Rest"},
+		{"name": "TV"},
+	}
+
+	for _, data := range testData {
+		for _, name := range []string{"products_scan", "products_trigram"} {
+			if err := db.Insert(name, "", data); err != nil {
+				t.Fatalf("Failed to insert test data: %v", err)
+			}
+		}
+	}
+
+	defaultFuzzyOpts := &FuzzySearchOptions{Threshold: 0.7, MaxDistance: 2}
+	queryIDs := func(entityType string, filters []Filter, fuzzyOpts *FuzzySearchOptions) []string {
+		results, err := queryService.Query(QueryOptions{
+			EntityType: entityType,
+			Filters:    filters,
+			FuzzyOpts:  fuzzyOpts,
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		ids := make([]string, len(results))
+		for i, entity := range results {
+			ids[i] = entity.ID
+		}
+		sort.Strings(ids)
+		return ids
+	}
+
+	compareWith := func(t *testing.T, fuzzyOpts *FuzzySearchOptions, filters []Filter, expected int) {
+		scanIDs := queryIDs("products_scan", filters, fuzzyOpts)
+		trigramIDs := queryIDs("products_trigram", filters, fuzzyOpts)
+
+		if !reflect.DeepEqual(scanIDs, trigramIDs) {
+			t.Errorf("Trigram results %v differ from scan results %v", trigramIDs, scanIDs)
+		}
+		if len(trigramIDs) != expected {
+			t.Errorf("Expected %d results, got %d: %v", expected, len(trigramIDs), trigramIDs)
+		}
+	}
+	compare := func(t *testing.T, filters []Filter, expected int) {
+		compareWith(t, defaultFuzzyOpts, filters, expected)
+	}
+
+	t.Run("Contains", func(t *testing.T) {
+		compare(t, []Filter{{Field: "name", Operator: FilterContains, Value: "KEYBOARD"}}, 3)
+		compare(t, []Filter{{Field: "name", Operator: FilterContains, Value: "board pro"}}, 1)
+		compare(t, []Filter{{Field: "name", Operator: FilterContains, Value: "zzz"}}, 0)
+	})
+
+	t.Run("ShortSubstringFallsBackToScan", func(t *testing.T) {
+		compare(t, []Filter{{Field: "name", Operator: FilterContains, Value: "tv"}}, 1)
+	})
+
+	t.Run("EndsWith", func(t *testing.T) {
+		compare(t, []Filter{{Field: "name", Operator: FilterEndsWith, Value: "keyboard"}}, 1)
+	})
+
+	t.Run("Fuzzy", func(t *testing.T) {
+		compare(t, []Filter{{Field: "name", Operator: FilterFuzzy, Value: "Keybaord"}}, 3)
+		compare(t, []Filter{{Field: "name", Operator: FilterFuzzy, Value: "Wireles Mose"}}, 1)
+	})
+
+	t.Run("FuzzyBelowTrigramThreshold", func(t *testing.T) {
+		// "xuby" is two edits from "hub" but shares no trigram with "USB Hub", a low threshold scans
+		lowThreshold := &FuzzySearchOptions{Threshold: 0.5, MaxDistance: 3}
+		compareWith(t, lowThreshold, []Filter{{Field: "name", Operator: FilterFuzzy, Value: "xuby"}}, 1)
+
+		plan, err := queryService.ExplainQuery(QueryOptions{
+			EntityType: "products_trigram",
+			Filters:    []Filter{{Field: "name", Operator: FilterFuzzy, Value: "xuby"}},
+			FuzzyOpts:  lowThreshold,
+			Explain:    &ExplainOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+		if plan.Scan != ScanFull || plan.Filters[0].Strategy != FilterStrategyScan {
+			t.Errorf("Expected a full scan below the trigram threshold, got %s with %s", plan.Scan, plan.Filters[0].Strategy)
+		}
+	})
+
+	t.Run("CombinedFilters", func(t *testing.T) {
+		compare(t, []Filter{
+			{Field: "name", Operator: FilterContains, Value: "keyboard"},
+			{Field: "name", Operator: FilterStartsWith, Value: "mech"},
+		}, 1)
+	})
+
+	t.Run("CountQuery", func(t *testing.T) {
+		count, err := queryService.ExecuteCountQuery(QueryOptions{
+			EntityType: "products_trigram",
+			Filters:    []Filter{{Field: "name", Operator: FilterContains, Value: "keyboard"}},
+		})
+		if err != nil {
+			t.Fatalf("Count query failed: %v", err)
+		}
+		if count != 3 {
+			t.Errorf("Expected count 3, got %d", count)
+		}
+	})
+
+	t.Run("IndexFollowsUpdatesAndDeletes", func(t *testing.T) {
+		if err := db.Update("products_trigram", "2", map[string]interface{}{"name": "Wireless Keyboard"}); err != nil {
+			t.Fatalf("Failed to update entity: %v", err)
+		}
+		if err := db.Delete("products_trigram", "1"); err != nil {
+			t.Fatalf("Failed to delete entity: %v", err)
+		}
+
+		ids := queryIDs("products_trigram", []Filter{{Field: "name", Operator: FilterContains, Value: "keyboard"}}, nil)
+		expected := []string{"2", "3", "6"}
+		if !reflect.DeepEqual(ids, expected) {
+			t.Errorf("Expected %v after update and delete, got %v", expected, ids)
+		}
+	})
+
+	t.Run("TrigramOnlyForTextFields", func(t *testing.T) {
+		err := db.RegisterEntityType(common.EntityDefinition{
+			Name: "invalid_trigram",
+			Fields: []common.FieldDefinition{
+				{Name: "price", Type: "float", Trigram: true},
+			},
+		})
+		if err == nil {
+			t.Error("Expected error when enabling trigram index on a float field")
+		}
+	})
+}
+
+// TestExplainQuery tests the plans of explained queries
+func TestExplainQuery(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	schemas := []common.EntityDefinition{
+		{
+			Name:        "explain_authors",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "name", Type: "string", Required: true, Trigram: true},
+				{Name: "country", Type: "string", Required: true, Indexed: true},
+			},
+		},
+		{
+			Name:        "explain_books",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "title", Type: "string", Required: true},
+				{Name: "author_id", Type: "integer", Required: true},
+			},
+		},
+	}
+	for _, schema := range schemas {
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+	}
+
+	authors := []map[string]interface{}{
+		{"name": "Ursula Le Guin", "country": "US"},
+		{"name": "Stanislaw Lem", "country": "PL"},
+		{"name": "Octavia Butler", "country": "US"},
+	}
+	for _, author := range authors {
+		if err := db.Insert("explain_authors", "", author); err != nil {
+			t.Fatalf("Failed to insert author: %v", err)
+		}
+	}
+	books := []map[string]interface{}{
+		{"title": "The Dispossessed", "author_id": 1},
+		{"title": "The Left Hand of Darkness", "author_id": 1},
+		{"title": "Solaris", "author_id": 2},
+		{"title": "Kindred", "author_id": 3},
+	}
+	for _, book := range books {
+		if err := db.Insert("explain_books", "", book); err != nil {
+			t.Fatalf("Failed to insert book: %v", err)
+		}
+	}
+
+	t.Run("Filters", func(t *testing.T) {
+		plan, err := queryService.ExplainQuery(QueryOptions{
+			EntityType: "explain_authors",
+			Filters: []Filter{
+				{Field: "name", Operator: FilterContains, Value: "butler"},
+				{Field: "country", Operator: FilterEq, Value: "US"},
+			},
+			OrderBy: "name",
+			Explain: &ExplainOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+
+		// The index lookup drives the query and is intersected with the trigram candidates
+		if plan.Scan != ScanIndex || plan.Entities != 3 || plan.Candidates != 1 {
+			t.Errorf("Expected an index scan of 1 of 3 entities, got %s of %d of %d", plan.Scan, plan.Candidates, plan.Entities)
+		}
+		if len(plan.Filters) != 2 {
+			t.Fatalf("Expected 2 filter plans, got %d", len(plan.Filters))
+		}
+		if plan.Filters[0].Strategy != FilterStrategyIndex || plan.Filters[1].Strategy != FilterStrategyTrigram {
+			t.Errorf("Expected the index and trigram strategies, got %s and %s", plan.Filters[0].Strategy, plan.Filters[1].Strategy)
+		}
+		if plan.Filters[0].Field != "country" || plan.Filters[0].Estimated != 2 ||
+			plan.Filters[0].CandidatesBefore != 3 || plan.Filters[0].CandidatesAfter != 2 {
+			t.Errorf("Unexpected candidates of the index lookup: %+v", plan.Filters[0])
+		}
+		if plan.Filters[1].CandidatesBefore != 1 || plan.Filters[1].CandidatesAfter != 1 {
+			t.Errorf("Unexpected candidates of the trigram filter: %+v", plan.Filters[1])
+		}
+		if plan.Sort == nil || plan.Sort.Field != "name" || plan.Sort.Entities != 1 {
+			t.Errorf("Unexpected sort plan: %+v", plan.Sort)
+		}
+		if plan.Matches != 1 || plan.Returned != 1 {
+			t.Errorf("Expected 1 match, got %d matches and %d returned", plan.Matches, plan.Returned)
+		}
+		if plan.Duration != "" || plan.Filters[0].Duration != "" {
+			t.Error("Expected no timings unless requested")
+		}
+	})
+
+	t.Run("Join", func(t *testing.T) {
+		plan, err := queryService.ExplainQuery(QueryOptions{
+			EntityType: "explain_authors",
+			Limit:      2,
+			Joins: []JoinOptions{{
+				EntityType:     "explain_books",
+				LocalField:     "id",
+				ForeignField:   "author_id",
+				As:             "books",
+				SelectStrategy: "all",
+			}},
+			Explain: &ExplainOptions{Timings: true},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+
+		if plan.Scan != ScanFull || plan.Matches != 3 || plan.Returned != 2 {
+			t.Errorf("Unexpected plan: scan %s, %d matches, %d returned", plan.Scan, plan.Matches, plan.Returned)
+		}
+		if plan.Sort == nil || plan.Sort.Field != "_created_at" {
+			t.Errorf("Expected the default sort by creation time, got %+v", plan.Sort)
+		}
+		if len(plan.Joins) != 1 {
+			t.Fatalf("Expected 1 join plan, got %d", len(plan.Joins))
+		}
+		join := plan.Joins[0]
+		if join.Strategy != JoinStrategyHash || join.Entities != 2 || join.Matched != 2 || join.Keys != 3 {
+			t.Errorf("Unexpected join plan: %+v", join)
+		}
+		if join.MaxFanOut != 2 || join.FanOut != 1.5 {
+			t.Errorf("Expected a fan-out of 1.5 and at most 2, got %v and %d", join.FanOut, join.MaxFanOut)
+		}
+		if join.Target == nil || join.Target.Candidates != 4 || join.Target.Returned != 4 {
+			t.Errorf("Unexpected plan of the joined entities: %+v", join.Target)
+		}
+		if plan.Duration == "" || plan.ScanDuration == "" || join.Duration == "" {
+			t.Error("Expected the timings of each stage")
+		}
+	})
+}
+
+// TestSlowQueryLog tests the recording of slow queries
+func TestSlowQueryLog(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+	slowQueries := NewSlowQueryLog(SlowQueryLogConfig{Size: 2, SampleRatio: 1})
+	queryService.SetSlowQueryLog(slowQueries)
+
+	schema := common.EntityDefinition{
+		Name:        "slow_query_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true, Indexed: true},
+		},
+	}
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob", "Carol"} {
+		if err := db.Insert("slow_query_users", "", map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	// Every query is slow with a zero threshold, the log keeps the two most recent ones
+	for i, name := range []string{"Alice", "Bob", "Carol"} {
+		_, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "slow_query_users",
+			Filters:    []Filter{{Field: "name", Operator: FilterEq, Value: name}},
+			Context:    common.WithRequestID(context.Background(), fmt.Sprintf("request-%d", i)),
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+	}
+
+	queries := slowQueries.Queries()
+	if len(queries) != 2 {
+		t.Fatalf("Expected 2 slow queries, got %d", len(queries))
+	}
+	latest := queries[0]
+	if latest.RequestID != "request-2" || queries[1].RequestID != "request-1" {
+		t.Errorf("Expected the most recent queries first, got %s and %s", latest.RequestID, queries[1].RequestID)
+	}
+	if latest.Kind != SlowQueryKindQuery || latest.EntityType != "slow_query_users" || latest.Matches != 1 || latest.Returned != 1 {
+		t.Errorf("Unexpected slow query: %+v", latest)
+	}
+	if latest.Options.Context != nil || latest.Options.Filters[0].Value != "Carol" {
+		t.Errorf("Expected the options of the query without its context, got %+v", latest.Options)
+	}
+	if latest.Plan != "index scan 1 > name eq index 1 > sort _created_at 1" {
+		t.Errorf("Unexpected plan summary: %s", latest.Plan)
+	}
+	if slow, recorded := slowQueries.Stats(); slow != 3 || recorded != 3 {
+		t.Errorf("Expected 3 slow and recorded queries, got %d and %d", slow, recorded)
+	}
+
+	// Unsampled slow queries are counted but not kept
+	unsampled := NewSlowQueryLog(SlowQueryLogConfig{Size: 10, SampleRatio: 0})
+	queryService.SetSlowQueryLog(unsampled)
+	if _, err := queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "slow_query_users"}); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if slow, recorded := unsampled.Stats(); slow != 1 || recorded != 0 || len(unsampled.Queries()) != 0 {
+		t.Errorf("Expected 1 unsampled slow query, got %d slow and %d recorded", slow, recorded)
+	}
+
+	// Queries faster than the threshold are not slow
+	fast := NewSlowQueryLog(SlowQueryLogConfig{Threshold: time.Hour, Size: 10, SampleRatio: 1})
+	queryService.SetSlowQueryLog(fast)
+	if _, err := queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "slow_query_users"}); err != nil {
+		t.Fatalf("Query failed: %v", err)
+	}
+	if slow, _ := fast.Stats(); slow != 0 {
+		t.Errorf("Expected no slow queries, got %d", slow)
+	}
+}
+
+// TestQueryLimits tests query timeouts, cancellation and complexity limits
+func TestQueryLimits(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	schema := common.EntityDefinition{
+		Name:        "limited_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+			{Name: "age", Type: "integer"},
+		},
+	}
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+	for i := 0; i < 3000; i++ {
+		if err := db.Insert("limited_users", "", map[string]interface{}{"name": fmt.Sprintf("user-%d", i), "age": i % 90}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	// Canceled queries and queries past their deadline fail with a query timeout
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := queryService.ExecutePaginatedQueryContext(canceled, QueryOptions{EntityType: "limited_users"})
+	if !errors.IsErrorCode(err, errors.ErrCodeQueryTimeout) || !stderrors.Is(err, context.Canceled) {
+		t.Errorf("Expected a query timeout for a canceled query, got %v", err)
+	}
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+	_, err = queryService.ExecuteCountQueryContext(expired, QueryOptions{
+		EntityType: "limited_users",
+		Filters:    []Filter{{Field: "age", Operator: FilterGt, Value: 10}},
+	})
+	if !errors.IsErrorCode(err, errors.ErrCodeQueryTimeout) || !stderrors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected a query timeout for an expired count query, got %v", err)
+	}
+
+	// Queries stop scanning once their context is done
+	scanning, cancelScan := context.WithCancel(context.Background())
+	options := QueryOptions{
+		EntityType: "limited_users",
+		Filters:    []Filter{{Field: "name", Operator: FilterFuzzy, Value: "user-1"}},
+		Context:    scanning,
+	}
+	cancelScan()
+	if _, _, err := queryService.executeQuery(options); !errors.IsErrorCode(err, errors.ErrCodeQueryTimeout) {
+		t.Errorf("Expected the scan to stop, got %v", err)
+	}
+
+	// A query shorter than the server-wide timeout completes
+	queryService.SetQueryLimits(QueryLimits{Timeout: time.Minute})
+	if users, err := queryService.Query(QueryOptions{EntityType: "limited_users"}); err != nil || len(users) != 3000 {
+		t.Errorf("Expected 3000 users within the timeout, got %d: %v", len(users), err)
+	}
+
+	// Queries with too many joins, filters or results are too complex
+	queryService.SetQueryLimits(QueryLimits{MaxJoins: 1, MaxFilters: 2, MaxResults: 100})
+	join := JoinOptions{EntityType: "limited_users", LocalField: "id", ForeignField: "id", JoinType: JoinTypeLeft, ResultField: "self"}
+
+	_, err = queryService.ExecuteQueryWithJoins(QueryOptions{EntityType: "limited_users", Limit: 10, Joins: []JoinOptions{join, join}})
+	if !errors.IsErrorCode(err, errors.ErrCodeQueryTooComplex) {
+		t.Errorf("Expected too many joins to be too complex, got %v", err)
+	}
+
+	join.Filters = []Filter{{Field: "age", Operator: FilterLt, Value: 5}, {Field: "age", Operator: FilterGt, Value: 1}}
+	_, err = queryService.ExecuteQueryWithJoins(QueryOptions{
+		EntityType: "limited_users",
+		Filters:    []Filter{{Field: "age", Operator: FilterEq, Value: 3}},
+		Limit:      10,
+		Joins:      []JoinOptions{join},
+	})
+	if !errors.IsErrorCode(err, errors.ErrCodeQueryTooComplex) {
+		t.Errorf("Expected the filters of joins to count, got %v", err)
+	}
+
+	if _, err := queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "limited_users"}); !errors.IsErrorCode(err, errors.ErrCodeQueryTooComplex) {
+		t.Errorf("Expected an unlimited query to return too many entities, got %v", err)
+	}
+	response, err := queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "limited_users", Limit: 100})
+	if err != nil || response.Count != 100 {
+		t.Errorf("Expected a query within the limits to return 100 entities, got %v", err)
+	}
+
+	// Counts return no entities, the result size limit does not apply to them
+	count, err := queryService.ExecuteCountQuery(QueryOptions{EntityType: "limited_users"})
+	if err != nil || count != 3000 {
+		t.Errorf("Expected to count 3000 entities, got %d: %v", count, err)
+	}
+}
+
+// TestQueryPlanner tests index statistics and the choice and intersection of index lookups
+func TestQueryPlanner(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	schema := common.EntityDefinition{
+		Name:        "planned_products",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+			{Name: "category", Type: "string", Required: true, Indexed: true},
+			{Name: "price", Type: "float", Required: true, Indexed: true},
+			{Name: "active", Type: "boolean", Required: true, Indexed: true},
+		},
+	}
+	if err := db.RegisterEntityType(schema); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+
+	// 200 products in 4 categories, priced 0 to 199, all of them active
+	categories := []string{"books", "games", "music", "tools"}
+	for i := 0; i < 200; i++ {
+		err := db.Insert("planned_products", "", map[string]interface{}{
+			"name":     fmt.Sprintf("product-%d", i),
+			"category": categories[i%4],
+			"price":    float64(i),
+			"active":   true,
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert product: %v", err)
+		}
+	}
+
+	t.Run("Statistics", func(t *testing.T) {
+		if stats, ok := db.IndexStats("planned_products", "category"); !ok || stats.Entries != 200 || stats.Distinct != 4 {
+			t.Errorf("Expected 200 entries of 4 categories, got %+v", stats)
+		}
+		if _, ok := db.IndexStats("planned_products", "name"); ok {
+			t.Error("Expected no statistics for a field without an index")
+		}
+
+		if err := db.Update("planned_products", "1", map[string]interface{}{"category": "toys"}); err != nil {
+			t.Fatalf("Failed to update product: %v", err)
+		}
+		if err := db.Delete("planned_products", "2"); err != nil {
+			t.Fatalf("Failed to delete product: %v", err)
+		}
+		if stats, _ := db.IndexStats("planned_products", "category"); stats.Entries != 199 || stats.Distinct != 5 {
+			t.Errorf("Expected 199 entries of 5 categories after the changes, got %+v", stats)
+		}
+		if stats, _ := db.IndexStats("planned_products", "price"); stats.Entries != 199 || stats.Distinct != 199 {
+			t.Errorf("Expected 199 distinct prices, got %+v", stats)
+		}
+	})
+
+	t.Run("MostSelectiveLookupDrives", func(t *testing.T) {
+		plan, err := queryService.ExplainQuery(QueryOptions{
+			EntityType: "planned_products",
+			Filters: []Filter{
+				{Field: "active", Operator: FilterEq, Value: true},
+				{Field: "price", Operator: FilterLt, Value: 40},
+				{Field: "category", Operator: FilterIn, Value: []interface{}{"games", "music"}},
+				{Field: "name", Operator: FilterEndsWith, Value: "5"},
+			},
+			Explain: &ExplainOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+
+		if plan.Scan != ScanIndex {
+			t.Fatalf("Expected an index scan, got %s", plan.Scan)
+		}
+		if len(plan.Filters) != 4 {
+			t.Fatalf("Expected 4 filter plans, got %d", len(plan.Filters))
+		}
+
+		// The range is estimated at a third of the prices, the categories at half of the products
+		driving := plan.Filters[0]
+		if driving.Field != "price" || driving.Strategy != FilterStrategyIndex || driving.Estimated != 66 ||
+			driving.CandidatesBefore != 199 || driving.CandidatesAfter != 39 {
+			t.Errorf("Expected the price range to drive the query, got %+v", driving)
+		}
+		if intersected := plan.Filters[1]; intersected.Field != "category" || intersected.Estimated != 99 ||
+			intersected.CandidatesBefore != 39 || intersected.CandidatesAfter != 19 {
+			t.Errorf("Expected the categories to be intersected with the prices, got %+v", intersected)
+		}
+
+		// Every product is active, checking the candidates costs less than looking all of them up
+		if residual := plan.Filters[2]; residual.Field != "active" || residual.Estimated != 0 ||
+			residual.CandidatesBefore != 19 || residual.CandidatesAfter != 19 {
+			t.Errorf("Expected the active filter to be evaluated on the candidates, got %+v", residual)
+		}
+		if residual := plan.Filters[3]; residual.Field != "name" || residual.Strategy != FilterStrategyScan || residual.CandidatesAfter != 2 {
+			t.Errorf("Expected the name filter to be evaluated last, got %+v", residual)
+		}
+		if plan.Candidates != 19 || plan.Matches != 2 {
+			t.Errorf("Expected 19 candidates and 2 matches, got %d and %d", plan.Candidates, plan.Matches)
+		}
+	})
+
+	t.Run("ResultsMatchAFullScan", func(t *testing.T) {
+		filters := []Filter{
+			{Field: "category", Operator: FilterEq, Value: "books"},
+			{Field: "price", Operator: FilterGte, Value: 100},
+			{Field: "price", Operator: FilterLte, Value: 120},
+		}
+		entities, err := queryService.Query(QueryOptions{EntityType: "planned_products", Filters: filters, OrderBy: "price"})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		var prices []float64
+		for _, entity := range entities {
+			prices = append(prices, entity.Fields["price"].(float64))
+		}
+		if expected := []float64{100, 104, 108, 112, 116, 120}; !reflect.DeepEqual(prices, expected) {
+			t.Errorf("Expected prices %v, got %v", expected, prices)
+		}
+
+		count, err := queryService.ExecuteCountQuery(QueryOptions{EntityType: "planned_products", Filters: filters})
+		if err != nil || count != 6 {
+			t.Errorf("Expected to count 6 products, got %d: %v", count, err)
+		}
+	})
+
+	t.Run("InMatchesLikeItsLookup", func(t *testing.T) {
+		// The values are strings, the prices floats: the index matches them by their keys
+		in := Filter{Field: "price", Operator: FilterIn, Value: []interface{}{"4", "8", "12"}}
+		queries := map[string][]Filter{
+			"driving":  {in},
+			"residual": {{Field: "price", Operator: FilterEq, Value: 4}, in},
+		}
+		expected := map[string][]string{"driving": {"13", "5", "9"}, "residual": {"5"}}
+
+		for name, filters := range queries {
+			plan, err := queryService.ExplainQuery(QueryOptions{EntityType: "planned_products", Filters: filters, Explain: &ExplainOptions{}})
+			if err != nil {
+				t.Fatalf("Explain failed: %v", err)
+			}
+			strategy := FilterStrategyIndex
+			if name == "residual" {
+				strategy = FilterStrategyScan
+			}
+			if inPlan := plan.Filters[len(plan.Filters)-1]; inPlan.Operator != FilterIn || inPlan.Strategy != strategy {
+				t.Errorf("Expected the %s in filter to use %s, got %+v", name, strategy, inPlan)
+			}
+
+			entities, err := queryService.Query(QueryOptions{EntityType: "planned_products", Filters: filters})
+			if err != nil {
+				t.Fatalf("Query failed: %v", err)
+			}
+			var ids []string
+			for _, entity := range entities {
+				ids = append(ids, entity.ID)
+			}
+			sort.Strings(ids)
+			if !reflect.DeepEqual(ids, expected[name]) {
+				t.Errorf("Expected the %s in filter to match %v, got %v", name, expected[name], ids)
+			}
+
+			count, err := queryService.ExecuteCountQuery(QueryOptions{EntityType: "planned_products", Filters: filters})
+			if err != nil || count != len(expected[name]) {
+				t.Errorf("Expected to count %d products with the %s in filter, got %d: %v", len(expected[name]), name, count, err)
+			}
+		}
+	})
+
+	t.Run("EmptyLookupsAndUnindexedFilters", func(t *testing.T) {
+		plan, err := queryService.ExplainQuery(QueryOptions{
+			EntityType: "planned_products",
+			Filters:    []Filter{{Field: "active", Operator: FilterEq, Value: false}, {Field: "name", Operator: FilterEq, Value: "product-7"}},
+			Explain:    &ExplainOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+		if plan.Scan != ScanIndex || plan.Candidates != 0 {
+			t.Errorf("Expected an empty lookup to drive the query, got %s of %d", plan.Scan, plan.Candidates)
+		}
+
+		plan, err = queryService.ExplainQuery(QueryOptions{
+			EntityType: "planned_products",
+			Filters:    []Filter{{Field: "name", Operator: FilterStartsWith, Value: "product-1"}},
+			Explain:    &ExplainOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+		if plan.Scan != ScanFull || plan.Candidates != 199 {
+			t.Errorf("Expected a full scan without indexed filters, got %s of %d", plan.Scan, plan.Candidates)
+		}
+	})
+}
+
+// TestJoinStrategies tests the choice between hash and index joins, and that both join the same entities
+func TestJoinStrategies(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	schemas := []common.EntityDefinition{
+		{
+			Name:        "strategy_customers",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "code", Type: "string", Required: true, Unique: true},
+				{Name: "region", Type: "string", Required: true, Indexed: true},
+			},
+		},
+		{
+			Name:        "strategy_orders",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "number", Type: "integer", Required: true},
+				{Name: "customer_id", Type: "integer", Required: true, Indexed: true},
+				{Name: "customer_code", Type: "string", Required: true},
+			},
+		},
+	}
+	for _, schema := range schemas {
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+	}
+
+	// 300 customers in 3 regions, and 600 orders, 2 per customer but those referencing a missing customer
+	regions := []string{"north", "south", "west"}
+	for i := 0; i < 300; i++ {
+		err := db.Insert("strategy_customers", "", map[string]interface{}{
+			"code":   fmt.Sprintf("C%03d", i+1),
+			"region": regions[i%3],
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert customer: %v", err)
+		}
+	}
+	customerOf := func(number int) int {
+		if number%50 == 49 {
+			return 999
+		}
+		return number%300 + 1
+	}
+	for i := 0; i < 600; i++ {
+		err := db.Insert("strategy_orders", "", map[string]interface{}{
+			"number":        i,
+			"customer_id":   customerOf(i),
+			"customer_code": fmt.Sprintf("C%03d", customerOf(i)),
+		})
+		if err != nil {
+			t.Fatalf("Failed to insert order: %v", err)
+		}
+	}
+
+	ordersWithCustomers := func(t *testing.T, limit int, join JoinOptions) ([]common.Entity, JoinPlan) {
+		options := QueryOptions{EntityType: "strategy_orders", OrderBy: "number", Limit: limit, Joins: []JoinOptions{join}}
+		response, err := queryService.ExecuteQueryWithJoins(options)
+		if err != nil {
+			t.Fatalf("Join query failed: %v", err)
+		}
+		options.Explain = &ExplainOptions{}
+		plan, err := queryService.ExplainQuery(options)
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+		if len(plan.Joins) != 1 {
+			t.Fatalf("Expected 1 join plan, got %d", len(plan.Joins))
+		}
+		return response.Data, plan.Joins[0]
+	}
+	joinedCustomer := func(order common.Entity) interface{} {
+		customer, ok := order.Fields["customer"].(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		return customer["id"]
+	}
+
+	t.Run("LookupByID", func(t *testing.T) {
+		orders, plan := ordersWithCustomers(t, 60, JoinOptions{
+			EntityType:   "strategy_customers",
+			LocalField:   "customer_id",
+			ForeignField: "id",
+			JoinType:     JoinTypeLeft,
+			As:           "customer",
+		})
+
+		if plan.Strategy != JoinStrategyIndex || plan.Target != nil {
+			t.Errorf("Expected an index join without a query of the customers, got %+v", plan)
+		}
+		if plan.IndexCost >= plan.HashCost || plan.Keys != 60 || plan.Matched != 59 {
+			t.Errorf("Unexpected join plan: %+v", plan)
+		}
+		for i, order := range orders {
+			want := interface{}(customerOf(i))
+			if customerOf(i) == 999 {
+				want = nil
+			}
+			if got := joinedCustomer(order); got != want {
+				t.Errorf("Expected customer %v for order %d, got %v", want, i, got)
+			}
+		}
+	})
+
+	t.Run("LookupByUniqueField", func(t *testing.T) {
+		orders, plan := ordersWithCustomers(t, 60, JoinOptions{
+			EntityType:   "strategy_customers",
+			LocalField:   "customer_code",
+			ForeignField: "code",
+			JoinType:     JoinTypeInner,
+			As:           "customer",
+		})
+
+		if plan.Strategy != JoinStrategyIndex {
+			t.Errorf("Expected an index join, got %s", plan.Strategy)
+		}
+		if len(orders) != 59 {
+			t.Fatalf("Expected 59 orders with a customer, got %d", len(orders))
+		}
+		for _, order := range orders {
+			number := order.Fields["number"].(int)
+			if got := joinedCustomer(order); got != customerOf(number) {
+				t.Errorf("Expected customer %d for order %d, got %v", customerOf(number), number, got)
+			}
+		}
+	})
+
+	t.Run("LookupByIndexedField", func(t *testing.T) {
+		response, err := queryService.ExecuteQueryWithJoins(QueryOptions{
+			EntityType: "strategy_customers",
+			Filters:    []Filter{{Field: "code", Operator: FilterIn, Value: []interface{}{"C001", "C050", "C120"}}},
+			Joins: []JoinOptions{{
+				EntityType:     "strategy_orders",
+				LocalField:     "id",
+				ForeignField:   "customer_id",
+				JoinType:       JoinTypeInner,
+				As:             "orders",
+				SelectStrategy: "all",
+				Filters:        []Filter{{Field: "number", Operator: FilterLt, Value: 300}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Join query failed: %v", err)
+		}
+
+		// The orders of customer 50 reference a missing customer
+		if response.Count != 2 {
+			t.Fatalf("Expected 2 customers with orders, got %d", response.Count)
+		}
+		for _, customer := range response.Data {
+			orders, ok := customer.Fields["orders"].([]map[string]interface{})
+			if !ok || len(orders) != 1 {
+				t.Errorf("Expected 1 order numbered below 300 for customer %s, got %v", customer.ID, customer.Fields["orders"])
+			}
+		}
+	})
+
+	t.Run("HashJoinOfManyEntities", func(t *testing.T) {
+		join := JoinOptions{
+			EntityType:   "strategy_customers",
+			LocalField:   "customer_id",
+			ForeignField: "id",
+			JoinType:     JoinTypeInner,
+			As:           "customer",
+			Filters:      []Filter{{Field: "region", Operator: FilterEq, Value: "north"}},
+		}
+		hashed, plan := ordersWithCustomers(t, 600, join)
+		if plan.Strategy != JoinStrategyHash || plan.Target == nil {
+			t.Errorf("Expected a hash join with a query of the customers, got %+v", plan)
+		}
+		looked, plan := ordersWithCustomers(t, 20, join)
+		if plan.Strategy != JoinStrategyIndex {
+			t.Errorf("Expected an index join, got %s", plan.Strategy)
+		}
+
+		// Both strategies join the same customers of the north region
+		if len(looked) == 0 || len(looked) > len(hashed) {
+			t.Fatalf("Expected some of the %d orders of the hash join, got %d", len(hashed), len(looked))
+		}
+		for i, order := range looked {
+			if order.ID != hashed[i].ID || joinedCustomer(order) != joinedCustomer(hashed[i]) {
+				t.Errorf("Expected order %s with customer %v, got order %s with customer %v",
+					hashed[i].ID, joinedCustomer(hashed[i]), order.ID, joinedCustomer(order))
+			}
+		}
+	})
+}
+
+// TestRelations tests declared relations, included by path, and nested joins
+func TestRelations(t *testing.T) {
+	db := NewDataStoreEngine()
+	defer db.Close()
+
+	queryService := NewQueryService(db)
+
+	schemas := []common.EntityDefinition{
+		{
+			Name:        "rel_companies",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+		},
+		{
+			Name:        "rel_customers",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "name", Type: "string", Required: true},
+				{Name: "company_id", Type: "integer", Nullable: true},
+			},
+			Relations: []common.RelationDefinition{
+				{Name: "company", EntityType: "rel_companies", Type: common.RelationOne, LocalField: "company_id"},
+				{Name: "orders", EntityType: "rel_orders", Type: common.RelationMany, ForeignField: "customer_id"},
+			},
+		},
+		{
+			Name:        "rel_orders",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "number", Type: "integer", Required: true},
+				{Name: "customer_id", Type: "integer", Required: true, Indexed: true},
+			},
+			Relations: []common.RelationDefinition{
+				{Name: "customer", EntityType: "rel_customers", Type: common.RelationOne, LocalField: "customer_id"},
+				{Name: "lineItems", EntityType: "rel_line_items", Type: common.RelationMany, ForeignField: "order_id"},
+			},
+		},
+		{
+			Name:        "rel_line_items",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "sku", Type: "string", Required: true},
+				{Name: "order_id", Type: "integer", Required: true, Indexed: true},
+			},
+		},
+	}
+	for _, schema := range schemas {
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+	}
+
+	inserts := []struct {
+		entityType string
+		data       map[string]interface{}
+	}{
+		{"rel_companies", map[string]interface{}{"name": "Acme"}},
+		{"rel_customers", map[string]interface{}{"name": "Alice", "company_id": 1}},
+		{"rel_customers", map[string]interface{}{"name": "Bob", "company_id": nil}},
+		{"rel_orders", map[string]interface{}{"number": 1, "customer_id": 1}},
+		{"rel_orders", map[string]interface{}{"number": 2, "customer_id": 2}},
+		{"rel_orders", map[string]interface{}{"number": 3, "customer_id": 1}},
+		{"rel_line_items", map[string]interface{}{"sku": "anvil", "order_id": 1}},
+		{"rel_line_items", map[string]interface{}{"sku": "rocket", "order_id": 1}},
+		{"rel_line_items", map[string]interface{}{"sku": "magnet", "order_id": 2}},
+	}
+	for _, insert := range inserts {
+		if err := db.Insert(insert.entityType, "", insert.data); err != nil {
+			t.Fatalf("Failed to insert %s: %v", insert.entityType, err)
+		}
+	}
+
+	t.Run("Validation", func(t *testing.T) {
+		invalid := map[string]common.RelationDefinition{
+			"missing type":        {Name: "owner", EntityType: "rel_customers", LocalField: "customer_id"},
+			"unknown local field": {Name: "owner", EntityType: "rel_customers", Type: common.RelationOne, LocalField: "owner_id"},
+			"field name":          {Name: "customer_id", EntityType: "rel_customers", Type: common.RelationOne, LocalField: "customer_id"},
+			"no foreign field":    {Name: "notes", EntityType: "rel_notes", Type: common.RelationMany},
+			"dotted name":         {Name: "owner.company", EntityType: "rel_customers", Type: common.RelationOne, LocalField: "customer_id"},
+		}
+		for name, relation := range invalid {
+			err := db.RegisterEntityType(common.EntityDefinition{
+				Name:      "rel_invalid",
+				Fields:    []common.FieldDefinition{{Name: "customer_id", Type: "integer"}},
+				Relations: []common.RelationDefinition{relation},
+			})
+			if err == nil {
+				t.Errorf("Expected a relation with %s to be rejected", name)
+			}
+		}
+	})
+
+	t.Run("IncludeNestedAndMany", func(t *testing.T) {
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "rel_orders",
+			OrderBy:    "number",
+			Include:    []string{"customer", "customer.company", "lineItems"},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if response.Count != 3 {
+			t.Fatalf("Expected 3 orders, got %d", response.Count)
+		}
+
+		customer, ok := response.Data[0].Fields["customer"].(map[string]interface{})
+		if !ok || customer["name"] != "Alice" {
+			t.Fatalf("Expected Alice as the customer of order 1, got %v", response.Data[0].Fields["customer"])
+		}
+		company, ok := customer["company"].(map[string]interface{})
+		if !ok || company["name"] != "Acme" {
+			t.Errorf("Expected Acme as the company of Alice, got %v", customer["company"])
+		}
+		if items, ok := response.Data[0].Fields["lineItems"].([]map[string]interface{}); !ok || len(items) != 2 {
+			t.Errorf("Expected 2 line items for order 1, got %v", response.Data[0].Fields["lineItems"])
+		}
+
+		// Bob has no company, and order 3 no line items: included relations are left joins
+		customer, _ = response.Data[1].Fields["customer"].(map[string]interface{})
+		if _, exists := customer["company"]; customer == nil || exists {
+			t.Errorf("Expected Bob without a company, got %v", response.Data[1].Fields["customer"])
+		}
+		if _, exists := response.Data[2].Fields["lineItems"]; exists {
+			t.Errorf("Expected no line items for order 3, got %v", response.Data[2].Fields["lineItems"])
+		}
+	})
+
+	t.Run("ReverseRelation", func(t *testing.T) {
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "rel_customers",
+			OrderBy:    "name",
+			Include:    []string{"orders.lineItems"},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		orders, ok := response.Data[0].Fields["orders"].([]map[string]interface{})
+		if !ok || len(orders) != 2 {
+			t.Fatalf("Expected 2 orders for Alice, got %v", response.Data[0].Fields["orders"])
+		}
+		items := 0
+		for _, order := range orders {
+			lineItems, _ := order["lineItems"].([]map[string]interface{})
+			items += len(lineItems)
+		}
+		if items != 2 {
+			t.Errorf("Expected 2 line items over the orders of Alice, got %d", items)
+		}
+	})
+
+	t.Run("InnerNestedJoin", func(t *testing.T) {
+		response, err := queryService.ExecuteQueryWithJoins(QueryOptions{
+			EntityType: "rel_orders",
+			OrderBy:    "number",
+			Joins: []JoinOptions{{
+				EntityType:    "rel_customers",
+				LocalField:    "customer_id",
+				ForeignField:  "id",
+				JoinType:      JoinTypeInner,
+				ResultField:   "customer",
+				IncludeFields: []string{"name"},
+				Joins: []JoinOptions{{
+					EntityType:   "rel_companies",
+					LocalField:   "company_id",
+					ForeignField: "id",
+					JoinType:     JoinTypeInner,
+					ResultField:  "company",
+				}},
+			}},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+
+		// Only the orders of Alice have a customer with a company
+		if response.Count != 2 {
+			t.Fatalf("Expected 2 orders, got %d", response.Count)
+		}
+		customer, _ := response.Data[0].Fields["customer"].(map[string]interface{})
+		if _, exists := customer["company"]; !exists {
+			t.Errorf("Expected the nested join result to be kept with the included fields, got %v", customer)
+		}
+		if _, exists := customer["company_id"]; exists {
+			t.Errorf("Expected only the included fields, got %v", customer)
+		}
+	})
+
+	t.Run("Explain", func(t *testing.T) {
+		plan, err := queryService.ExplainQuery(QueryOptions{
+			EntityType: "rel_orders",
+			Include:    []string{"customer.company"},
+			Explain:    &ExplainOptions{},
+		})
+		if err != nil {
+			t.Fatalf("Explain failed: %v", err)
+		}
+		if len(plan.Joins) != 1 || plan.Joins[0].EntityType != "rel_customers" {
+			t.Fatalf("Expected the join of the customers, got %+v", plan.Joins)
+		}
+		nested := plan.Joins[0].Joins
+		if len(nested) != 1 || nested[0].EntityType != "rel_companies" || nested[0].Entities != 2 || nested[0].Matched != 1 {
+			t.Errorf("Expected the nested join of the companies of 2 customers, got %+v", nested)
+		}
+		if summary := plan.Summary(); !strings.Contains(summary, "join rel_companies fan-out 1.0 > hash join rel_customers") {
+			t.Errorf("Expected the nested join before its parent in the summary, got %q", summary)
+		}
+	})
+
+	t.Run("Errors", func(t *testing.T) {
+		_, err := queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "rel_orders", Include: []string{"customer.owner"}})
+		if !errors.IsErrorCode(err, errors.ErrCodeInvalidJoin) {
+			t.Errorf("Expected %s for an unknown relation, got %v", errors.ErrCodeInvalidJoin, err)
+		}
+		_, err = queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "rel_orders", Include: []string{"customer."}})
+		if !errors.IsErrorCode(err, errors.ErrCodeInvalidJoin) {
+			t.Errorf("Expected %s for an empty relation name, got %v", errors.ErrCodeInvalidJoin, err)
+		}
+
+		queryService.SetQueryLimits(QueryLimits{MaxJoins: 1})
+		defer queryService.SetQueryLimits(QueryLimits{})
+		_, err = queryService.ExecutePaginatedQuery(QueryOptions{EntityType: "rel_orders", Include: []string{"customer.company"}})
+		if !errors.IsErrorCode(err, errors.ErrCodeQueryTooComplex) {
+			t.Errorf("Expected nested joins to count towards the join limit, got %v", err)
+		}
+		count, err := queryService.ExecuteCountQuery(QueryOptions{EntityType: "rel_orders", Include: []string{"customer.company"}})
+		if err != nil || count != 3 {
+			t.Errorf("Expected includes not to change the count of 3, got %d, %v", count, err)
+		}
+	})
+
+	t.Run("RenameRelatedType", func(t *testing.T) {
+		if err := db.RenameEntityType("rel_customers", "rel_clients"); err != nil {
+			t.Fatalf("Failed to rename entity type: %v", err)
+		}
+
+		def, err := db.GetEntityDefinition("rel_orders")
+		if err != nil {
+			t.Fatalf("Failed to get definition: %v", err)
+		}
+		if def.Relations[0].EntityType != "rel_clients" {
+			t.Errorf("Expected the customer relation to refer to rel_clients, got %s", def.Relations[0].EntityType)
+		}
+
+		response, err := queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "rel_orders",
+			OrderBy:    "number",
+			Include:    []string{"customer.company"},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		customer, ok := response.Data[0].Fields["customer"].(map[string]interface{})
+		if !ok || customer["name"] != "Alice" {
+			t.Fatalf("Expected Alice as the customer of order 1 after the rename, got %v", response.Data[0].Fields["customer"])
+		}
+		if company, ok := customer["company"].(map[string]interface{}); !ok || company["name"] != "Acme" {
+			t.Errorf("Expected Acme as the company of Alice after the rename, got %v", customer["company"])
+		}
+
+		response, err = queryService.ExecutePaginatedQuery(QueryOptions{
+			EntityType: "rel_clients",
+			OrderBy:    "name",
+			Include:    []string{"orders"},
+		})
+		if err != nil {
+			t.Fatalf("Query failed: %v", err)
+		}
+		if orders, ok := response.Data[0].Fields["orders"].([]map[string]interface{}); !ok || len(orders) != 2 {
+			t.Errorf("Expected 2 orders for Alice after the rename, got %v", response.Data[0].Fields["orders"])
+		}
+	})
+}
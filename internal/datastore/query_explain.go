@@ -0,0 +1,212 @@
+package datastore
+
+import (
+	"context"
+	"math"
+	"time"
+)
+
+// Scans of the candidates a query starts from
+const (
+	ScanFull    = "full"    // Every entity of the type
+	ScanIndex   = "index"   // Entities the intersected field index lookups matched
+	ScanTrigram = "trigram" // Entities the trigram indices of substring and fuzzy filters matched
+)
+
+// Strategies of query filters
+const (
+	FilterStrategyIndex    = "index"    // Lookup in the field index, intersected with the candidates
+	FilterStrategyTrigram  = "trigram"  // Candidates narrowed by the trigram index, then verified value by value
+	FilterStrategyFullText = "fulltext" // Scored with the full-text index of the field
+	FilterStrategyScan     = "scan"     // Every candidate is compared with the filter value
+)
+
+// Strategies of a join
+const (
+	// JoinStrategyHash builds a hash table of the joined entities keyed by the foreign field
+	// and probes it with the local field of each entity
+	JoinStrategyHash = "hash"
+	// JoinStrategyIndex looks up the local field of each entity in the index of the foreign field
+	JoinStrategyIndex = "index"
+)
+
+// QueryPlan describes how a query was executed
+// Durations are only set when timings were requested
+type QueryPlan struct {
+	EntityType   string       `json:"entityType"`
+	Scan         string       `json:"scan"`       // How the candidates of the filters were found, full, index or trigram
+	Entities     int          `json:"entities"`   // Entities of the type
+	Candidates   int          `json:"candidates"` // Entities the filters started from
+	ScanDuration string       `json:"scanDuration,omitempty"`
+	Filters      []FilterPlan `json:"filters"`
+	Sort         *SortPlan    `json:"sort,omitempty"`
+	Matches      int          `json:"matches"`  // Entities matching every filter
+	Returned     int          `json:"returned"` // Entities left after the offset and limit
+	Joins        []JoinPlan   `json:"joins,omitempty"`
+	Duration     string       `json:"duration,omitempty"`
+
+	timings bool
+}
+
+// FilterPlan describes how one filter of a query was applied
+type FilterPlan struct {
+	Field            string `json:"field"`
+	Operator         string `json:"operator"`
+	Strategy         string `json:"strategy"`
+	Estimated        int    `json:"estimated,omitempty"` // Entities the planner estimated an index lookup to match
+	CandidatesBefore int    `json:"candidatesBefore"`
+	CandidatesAfter  int    `json:"candidatesAfter"`
+	Duration         string `json:"duration,omitempty"`
+}
+
+// SortPlan describes how the results of a query were ordered
+type SortPlan struct {
+	Field       string `json:"field,omitempty"` // Empty when ranked by relevance
+	Descending  bool   `json:"descending"`
+	Relevance   bool   `json:"relevance,omitempty"` // Ranked by the scores of search filters
+	Entities    int    `json:"entities"`
+	Comparisons int    `json:"comparisons"` // Estimated as n log2 n
+	Duration    string `json:"duration,omitempty"`
+}
+
+// JoinPlan describes how one join of a query was executed
+type JoinPlan struct {
+	EntityType string     `json:"entityType"`
+	JoinType   string     `json:"joinType"`
+	Strategy   string     `json:"strategy"`
+	Target     *QueryPlan `json:"target"`   // Query of the joined entities, nil for an index join
+	Keys       int        `json:"keys"`     // Distinct values in the hash table, the local values looked up for an index join
+	Entities   int        `json:"entities"` // Entities the join was applied to
+	Matched    int        `json:"matched"`  // Entities with at least one joined entity
+	FanOut     float64    `json:"fanOut"`   // Average joined entities per matched entity
+	MaxFanOut  int        `json:"maxFanOut"`
+	Results    int        `json:"results"` // Entities left after the join
+	HashCost   float64    `json:"hashCost"`
+	IndexCost  float64    `json:"indexCost,omitempty"` // Zero when the foreign field has no index
+	Joins      []JoinPlan `json:"joins,omitempty"`     // Joins applied to the joined entities
+	Duration   string     `json:"duration,omitempty"`
+}
+
+// ExplainQuery runs a query and returns its plan instead of its results
+func (qs *QueryService) ExplainQuery(options QueryOptions) (*QueryPlan, error) {
+	return qs.ExplainQueryContext(options.Context, options)
+}
+
+// ExplainQueryContext runs a query and returns its plan instead of its results, stopping when ctx is done
+// The result size limit does not apply, no entities are returned
+func (qs *QueryService) ExplainQueryContext(ctx context.Context, options QueryOptions) (*QueryPlan, error) {
+	options, cancel, err := qs.startQuery(ctx, options)
+	defer cancel()
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &QueryPlan{EntityType: options.EntityType, Filters: []FilterPlan{}}
+	if options.Explain != nil {
+		plan.timings = options.Explain.Timings
+	}
+	options.plan = plan
+
+	start := time.Now()
+	if _, err := qs.executePaginatedQuery(options); err != nil {
+		return nil, err
+	}
+	plan.Duration = plan.duration(time.Since(start))
+
+	return plan, nil
+}
+
+// newTargetPlan creates the plan of the query of a join's target, nil if the query is not explained
+func (p *QueryPlan) newTargetPlan(entityType string) *QueryPlan {
+	if p == nil {
+		return nil
+	}
+	return &QueryPlan{EntityType: entityType, Filters: []FilterPlan{}, timings: p.timings}
+}
+
+// duration formats a stage duration, or returns an empty string when timings are not recorded
+func (p *QueryPlan) duration(d time.Duration) string {
+	if p == nil || !p.timings {
+		return ""
+	}
+	return d.String()
+}
+
+// recordScan records how the candidates of the filters were found
+func (p *QueryPlan) recordScan(scan string, entities, candidates int, elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	p.Scan = scan
+	p.Entities = entities
+	p.Candidates = candidates
+	p.ScanDuration = p.duration(elapsed)
+}
+
+// recordFilter records how a filter was applied
+func (p *QueryPlan) recordFilter(f Filter, strategy string, before, after int, elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	p.Filters = append(p.Filters, FilterPlan{
+		Field:            f.Field,
+		Operator:         f.Operator,
+		Strategy:         strategy,
+		CandidatesBefore: before,
+		CandidatesAfter:  after,
+		Duration:         p.duration(elapsed),
+	})
+}
+
+// recordLookup records an index lookup the candidates were intersected with
+func (p *QueryPlan) recordLookup(lookup indexLookup, before, after int, elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	p.Filters = append(p.Filters, FilterPlan{
+		Field:            lookup.filter.Field,
+		Operator:         lookup.filter.Operator,
+		Strategy:         FilterStrategyIndex,
+		Estimated:        int(math.Round(lookup.estimate)),
+		CandidatesBefore: before,
+		CandidatesAfter:  after,
+		Duration:         p.duration(elapsed),
+	})
+}
+
+// recordSort records how the results were ordered
+func (p *QueryPlan) recordSort(field string, descending, relevance bool, entities int, elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	comparisons := 0
+	if entities > 1 {
+		comparisons = int(math.Ceil(float64(entities) * math.Log2(float64(entities))))
+	}
+	p.Sort = &SortPlan{
+		Field:       field,
+		Descending:  descending,
+		Relevance:   relevance,
+		Entities:    entities,
+		Comparisons: comparisons,
+		Duration:    p.duration(elapsed),
+	}
+}
+
+// recordResults records how many entities matched and how many were returned
+func (p *QueryPlan) recordResults(matches, returned int) {
+	if p == nil {
+		return
+	}
+	p.Matches = matches
+	p.Returned = returned
+}
+
+// recordJoin records how a join was executed
+func (p *QueryPlan) recordJoin(join JoinPlan, elapsed time.Duration) {
+	if p == nil {
+		return
+	}
+	join.Duration = p.duration(elapsed)
+	p.Joins = append(p.Joins, join)
+}
@@ -0,0 +1,196 @@
+package datastore
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// joinAccess is how the joined entities of a join are found
+type joinAccess struct {
+	strategy  string
+	index     map[string][]string // Index of the foreign field, for the index strategy
+	unique    map[string]string   // Unique index of the foreign field, for the index strategy
+	byID      bool                // The foreign field is the ID of the joined entities
+	hashCost  float64             // Estimated cost of the hash strategy
+	indexCost float64             // Estimated cost of the index strategy, zero when the foreign field has no index
+}
+
+// planJoin chooses the strategy of a join applied to a number of entities
+// A hash join reads every joined entity once, an index join looks up the local value of each
+// entity in the index of the foreign field. The index join is chosen when the foreign field is
+// the ID, unique or indexed, and looking up every entity costs less than reading the joined entities
+func (qs *QueryService) planJoin(join JoinOptions, entities int) joinAccess {
+	qs.engine.mu.RLock()
+	defer qs.engine.mu.RUnlock()
+
+	access := joinAccess{strategy: JoinStrategyHash}
+	def, exists := qs.engine.definitions[join.EntityType]
+	if !exists {
+		return access
+	}
+
+	// Fuzzy and search filters depend on options and scores of the query of the joined entities
+	for _, f := range join.Filters {
+		if f.Operator == FilterFuzzy || f.Operator == FilterSearch {
+			return access
+		}
+	}
+
+	var fieldDef *common.FieldDefinition
+	for i := range def.Fields {
+		if def.Fields[i].Name == join.ForeignField {
+			fieldDef = &def.Fields[i]
+			break
+		}
+	}
+
+	// Joined entities with a value for the foreign field, and entities a local value matches
+	// The counts are maintained by the entity store and the indices, no entity is read to plan a join
+	var targets, perKey float64
+	switch {
+	case fieldDef == nil && join.ForeignField == "id":
+		access.byID = true
+		targets = float64(qs.engine.entities.countOfType(join.EntityType))
+		perKey = 1
+	case fieldDef == nil:
+		return access
+	case fieldDef.Unique:
+		access.unique = qs.engine.uniqueIndices[join.EntityType][join.ForeignField]
+		targets = float64(len(access.unique))
+		perKey = 1
+	case fieldDef.Indexed && indexesScalars(fieldDef.Type):
+		stats, _ := qs.engine.indexStats(join.EntityType, join.ForeignField)
+		access.index = qs.engine.indices[join.EntityType][join.ForeignField]
+		targets = float64(stats.Entries)
+		if stats.Distinct > 0 {
+			perKey = float64(stats.Entries) / float64(stats.Distinct)
+		}
+	default:
+		return access
+	}
+
+	// The query of the joined entities reads no more than its most selective index lookup
+	for _, f := range join.Filters {
+		if lookup, ok := qs.estimateLookup(join.EntityType, f); ok && lookup.estimate < targets {
+			targets = lookup.estimate
+		}
+	}
+
+	access.hashCost = targets * (entityCost + idCost)
+	access.indexCost = float64(entities) * (keyCost + perKey*(idCost+entityCost))
+	if access.indexCost < access.hashCost {
+		access.strategy = JoinStrategyIndex
+	}
+
+	return access
+}
+
+// lookupJoinTargets finds the joined entities of each distinct local value of the entities
+// with the index of the foreign field, keyed like the hash table of a hash join
+func (qs *QueryService) lookupJoinTargets(ctx context.Context, entities []common.Entity, join JoinOptions, access joinAccess) (map[interface{}][]common.Entity, error) {
+	qs.engine.mu.RLock()
+	defer qs.engine.mu.RUnlock()
+
+	targetMap := make(map[interface{}][]common.Entity)
+	for i, entity := range entities {
+		if err := queryInterrupted(ctx, i); err != nil {
+			return nil, err
+		}
+
+		localValue, exists := joinLocalValue(entity, join.LocalField)
+		if !exists {
+			continue
+		}
+		key := qs.normalizeForJoinComparison(localValue)
+		if _, done := targetMap[key]; done {
+			continue
+		}
+		matches, err := qs.lookupJoinKey(join, access, localValue, key)
+		if err != nil {
+			return nil, err
+		}
+		targetMap[key] = matches
+	}
+
+	return targetMap, nil
+}
+
+// lookupJoinKey returns the joined entities whose normalized foreign value is key
+// Index keys are not normalized, a numeric value is looked up as an integer and as a float
+// This function requires that the caller holds a read lock
+func (qs *QueryService) lookupJoinKey(join JoinOptions, access joinAccess, localValue, key interface{}) ([]common.Entity, error) {
+	probes := []string{qs.engine.getIndexableValue(localValue)}
+	if number, ok := key.(int); ok {
+		for _, probe := range []string{strconv.Itoa(number), qs.engine.getIndexableValue(float64(number))} {
+			if !containsString(probes, probe) {
+				probes = append(probes, probe)
+			}
+		}
+	}
+
+	var matches []common.Entity
+	seen := make(map[string]bool)
+	for _, probe := range probes {
+		var ids []string
+		switch {
+		case access.byID:
+			ids = []string{probe}
+		case access.unique != nil:
+			if id, exists := access.unique[probe]; exists {
+				ids = []string{id}
+			}
+		default:
+			ids = access.index[probe]
+		}
+
+		for _, id := range ids {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			entity, exists, err := qs.engine.entities.get(createEntityKey(join.EntityType, id))
+			if err != nil {
+				return nil, err
+			}
+			if !exists {
+				continue
+			}
+			foreignValue := interface{}(entity.ID)
+			if !access.byID {
+				if foreignValue, exists = entity.Fields[join.ForeignField]; !exists {
+					continue
+				}
+			}
+			if qs.normalizeForJoinComparison(foreignValue) != key || !qs.matchesJoinFilters(join.EntityType, entity, join.Filters) {
+				continue
+			}
+			matches = append(matches, entity)
+		}
+	}
+
+	return matches, nil
+}
+
+// matchesJoinFilters evaluates the filters of a join on a joined entity found with an index
+// This function requires that the caller holds a read lock
+func (qs *QueryService) matchesJoinFilters(entityType string, entity common.Entity, filters []Filter) bool {
+	for _, f := range filters {
+		value, exists := entity.Fields[f.Field]
+		if !exists || !qs.matchesFieldFilter(entityType, value, f) {
+			return false
+		}
+	}
+	return true
+}
+
+// joinLocalValue returns the value of the local field of a join, the ID when the field is "id"
+func joinLocalValue(entity common.Entity, field string) (interface{}, bool) {
+	if field == "id" {
+		return entity.ID, true
+	}
+	value, exists := entity.Fields[field]
+	return value, exists
+}
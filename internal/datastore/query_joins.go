@@ -1,13 +1,18 @@
 package datastore
 
 import (
+	"context"
 	"fmt"
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // normalizeForJoinComparison normalizes values for consistent comparison in joins
@@ -94,7 +99,14 @@ func (qs *QueryService) normalizeForJoinComparison(value interface{}) interface{
 }
 
 // executeJoin performs a join operation between the main entities and a target entity type
-func (qs *QueryService) executeJoin(entities []common.Entity, join JoinOptions) ([]common.Entity, error) {
+// The join is recorded in plan when it is not nil
+func (qs *QueryService) executeJoin(ctx context.Context, entities []common.Entity, join JoinOptions, plan *QueryPlan) (_ []common.Entity, err error) {
+	ctx, span := tracing.Start(ctx, "datastore.join", trace.WithAttributes(
+		attribute.String("db.collection.name", join.EntityType),
+		attribute.Int("syncopatedb.join.entities", len(entities)),
+	))
+	defer func() { tracing.End(span, err) }()
+
 	// Use proper debug logging that respects the global debug setting
 	logDebug := func(format string, args ...interface{}) {
 		// Only log if debug mode is enabled in settings
@@ -112,60 +124,59 @@ func (qs *QueryService) executeJoin(entities []common.Entity, join JoinOptions)
 		joinType = JoinTypeInner // Default to inner join
 	}
 
-	resultField := join.ResultField
-	if resultField == "" {
-		resultField = join.As // Legacy field
-	}
-	if resultField == "" {
-		resultField = join.EntityType // Default to entity type name
-	}
+	resultField := joinResultField(join)
 
 	// Default select strategy is "first" if not specified
 	if join.SelectStrategy == "" {
 		join.SelectStrategy = "first"
 	}
 
+	span.SetAttributes(attribute.String("syncopatedb.join.type", joinType))
+
 	logDebug("Starting join: %s -> %s (local: %s, foreign: %s, result: %s, type: %s)",
 		join.EntityType, join.ForeignField, join.LocalField, resultField, joinType)
 
-	// Execute a query to get the target entities
-	targetOpts := QueryOptions{
-		EntityType: join.EntityType,
-		Filters:    join.Filters,
-		Limit:      0, // No limit for joins
+	// Find the target entities of each local value with the index of the foreign field,
+	// or build a hash table of all target entities
+	joinStart := time.Now()
+	access := qs.planJoin(join, len(entities))
+	span.SetAttributes(attribute.String("syncopatedb.join.strategy", access.strategy))
+	logDebug("Using the %s join strategy (estimated costs: hash %.0f, index %.0f)", access.strategy, access.hashCost, access.indexCost)
+
+	var targetMap map[interface{}][]common.Entity
+	var targetPlan *QueryPlan
+	if access.strategy == JoinStrategyIndex {
+		targetMap, err = qs.lookupJoinTargets(ctx, entities, join, access)
+	} else {
+		targetPlan = plan.newTargetPlan(join.EntityType)
+		targetMap, err = qs.hashJoinTargets(ctx, join, targetPlan)
 	}
-
-	logDebug("Executing query for target entities of type: %s", join.EntityType)
-	targetEntities, err := qs.Query(targetOpts)
 	if err != nil {
-		logDebug("Error querying join target entities: %v", err)
-		return entities, fmt.Errorf("error querying join target entities: %w", err)
+		return entities, err
 	}
-	logDebug("Found %d target entities", len(targetEntities))
 
-	// Create a map for quick lookups
-	targetMap := make(map[interface{}][]common.Entity)
-	for _, entity := range targetEntities {
-		foreignValue, exists := entity.Fields[join.ForeignField]
-		if !exists {
-			// If ForeignField is "id", try using the entity ID directly
-			if join.ForeignField == "id" {
-				foreignValue = entity.ID
-				logDebug("Using entity ID as foreign field for entity %s", entity.ID)
-			} else {
-				logDebug("Foreign field '%s' not found in entity %s", join.ForeignField, entity.ID)
-				continue
+	logDebug("Built target map with %d unique keys", len(targetMap))
+
+	// Apply the nested joins to the target entities the entities match, and keep their results
+	// in the joined entities even when only some fields are included
+	var nestedPlans []JoinPlan
+	includeFields := join.IncludeFields
+	if len(join.Joins) > 0 {
+		nestedPlan := plan.newTargetPlan(join.EntityType)
+		if targetMap, err = qs.executeNestedJoins(ctx, entities, join, targetMap, nestedPlan); err != nil {
+			return entities, err
+		}
+		if nestedPlan != nil {
+			nestedPlans = nestedPlan.Joins
+		}
+		if len(includeFields) > 0 {
+			includeFields = append([]string(nil), includeFields...)
+			for _, nested := range join.Joins {
+				includeFields = append(includeFields, joinResultField(nested))
 			}
 		}
-
-		// Normalize the foreign value for consistent comparison
-		foreignKey := qs.normalizeForJoinComparison(foreignValue)
-		logDebug("Normalized foreign key from %v to %v for entity %s", foreignValue, foreignKey, entity.ID)
-		targetMap[foreignKey] = append(targetMap[foreignKey], entity)
 	}
 
-	logDebug("Built target map with %d unique keys", len(targetMap))
-
 	// Create a temporary map to hold join results
 	joinResults := make([]map[string]interface{}, len(entities))
 	excludedEntities := make([]bool, len(entities))
@@ -174,22 +185,19 @@ func (qs *QueryService) executeJoin(entities []common.Entity, join JoinOptions)
 	matchCount := 0
 	noValueCount := 0
 	noMatchCount := 0
+	joinedCount := 0
+	maxFanOut := 0
 
 	for i := range entities {
+		if err = queryInterrupted(ctx, i); err != nil {
+			return entities, err
+		}
+
 		// Initialize the join results map for this entity
 		joinResults[i] = make(map[string]interface{})
 
-		var localValue interface{}
-		var exists bool
-
 		// Handle special case where local field is "id"
-		if join.LocalField == "id" {
-			localValue = entities[i].ID
-			exists = true
-		} else {
-			localValue, exists = entities[i].Fields[join.LocalField]
-		}
-
+		localValue, exists := joinLocalValue(entities[i], join.LocalField)
 		if !exists {
 			logDebug("Local field '%s' not found in entity %s", join.LocalField, entities[i].ID)
 			noValueCount++
@@ -227,19 +235,23 @@ func (qs *QueryService) executeJoin(entities []common.Entity, join JoinOptions)
 		logDebug("Found %d matches for entity %s with normalized local value %v",
 			len(matches), entities[i].ID, normalizedLocalValue)
 		matchCount++
+		joinedCount += len(matches)
+		if len(matches) > maxFanOut {
+			maxFanOut = len(matches)
+		}
 
 		// Process matches based on the select strategy
 		switch join.SelectStrategy {
 		case "first":
 			// Just select the first match
 			logDebug("Using 'first' strategy: selecting first match for entity %s", entities[i].ID)
-			joinResults[i][resultField] = qs.filterJoinFields(matches[0], join.IncludeFields, join.ExcludeFields)
+			joinResults[i][resultField] = qs.filterJoinFields(matches[0], includeFields, join.ExcludeFields)
 		case "all":
 			// Select all matches
 			logDebug("Using 'all' strategy: selecting all %d matches for entity %s", len(matches), entities[i].ID)
 			joinedEntities := make([]map[string]interface{}, len(matches))
 			for j, match := range matches {
-				joinedEntities[j] = qs.filterJoinFields(match, join.IncludeFields, join.ExcludeFields)
+				joinedEntities[j] = qs.filterJoinFields(match, includeFields, join.ExcludeFields)
 			}
 			joinResults[i][resultField] = joinedEntities
 		}
@@ -248,6 +260,23 @@ func (qs *QueryService) executeJoin(entities []common.Entity, join JoinOptions)
 	logDebug("Join summary: %d entities processed, %d matches found, %d with no local value, %d with no matches",
 		len(entities), matchCount, noValueCount, noMatchCount)
 
+	joinPlan := JoinPlan{
+		EntityType: join.EntityType,
+		JoinType:   joinType,
+		Strategy:   access.strategy,
+		Target:     targetPlan,
+		Keys:       len(targetMap),
+		Entities:   len(entities),
+		Matched:    matchCount,
+		MaxFanOut:  maxFanOut,
+		HashCost:   access.hashCost,
+		IndexCost:  access.indexCost,
+		Joins:      nestedPlans,
+	}
+	if matchCount > 0 {
+		joinPlan.FanOut = float64(joinedCount) / float64(matchCount)
+	}
+
 	// For inner joins, create a new filtered list
 	if joinType == JoinTypeInner {
 		initialCount := len(entities)
@@ -304,9 +333,133 @@ func (qs *QueryService) executeJoin(entities []common.Entity, join JoinOptions)
 		}
 	}
 
+	joinPlan.Results = len(entities)
+	plan.recordJoin(joinPlan, time.Since(joinStart))
+
 	return entities, nil
 }
 
+// hashJoinTargets queries the target entities of a join and builds a hash table of them,
+// keyed by the normalized value of the foreign field. The query is recorded in targetPlan
+func (qs *QueryService) hashJoinTargets(ctx context.Context, join JoinOptions, targetPlan *QueryPlan) (map[interface{}][]common.Entity, error) {
+	// Use proper debug logging that respects the global debug setting
+	logDebug := func(format string, args ...interface{}) {
+		if settings.Config.Debug {
+			fmt.Printf("[JOIN DEBUG] "+format+"\n", args...)
+		}
+	}
+
+	// Execute a query to get the target entities
+	targetOpts := QueryOptions{
+		EntityType: join.EntityType,
+		Filters:    join.Filters,
+		Limit:      0, // No limit for joins
+		Context:    ctx,
+		plan:       targetPlan,
+	}
+
+	logDebug("Executing query for target entities of type: %s", join.EntityType)
+	targetEntities, err := qs.query(targetOpts)
+	if err != nil {
+		logDebug("Error querying join target entities: %v", err)
+		return nil, fmt.Errorf("error querying join target entities: %w", err)
+	}
+	logDebug("Found %d target entities", len(targetEntities))
+
+	// Create a map for quick lookups
+	targetMap := make(map[interface{}][]common.Entity)
+	for i, entity := range targetEntities {
+		if err := queryInterrupted(ctx, i); err != nil {
+			return nil, err
+		}
+
+		foreignValue, exists := entity.Fields[join.ForeignField]
+		if !exists {
+			// If ForeignField is "id", try using the entity ID directly
+			if join.ForeignField == "id" {
+				foreignValue = entity.ID
+				logDebug("Using entity ID as foreign field for entity %s", entity.ID)
+			} else {
+				logDebug("Foreign field '%s' not found in entity %s", join.ForeignField, entity.ID)
+				continue
+			}
+		}
+
+		// Normalize the foreign value for consistent comparison
+		foreignKey := qs.normalizeForJoinComparison(foreignValue)
+		logDebug("Normalized foreign key from %v to %v for entity %s", foreignValue, foreignKey, entity.ID)
+		targetMap[foreignKey] = append(targetMap[foreignKey], entity)
+	}
+
+	return targetMap, nil
+}
+
+// joinResultField returns the field holding the joined entities of a join
+func joinResultField(join JoinOptions) string {
+	if join.ResultField != "" {
+		return join.ResultField
+	}
+	if join.As != "" {
+		return join.As // Legacy field
+	}
+	return join.EntityType // Default to entity type name
+}
+
+// executeNestedJoins applies the nested joins of a join to the target entities matched by the
+// local values of entities, and returns the target map with the joined copies of the targets
+// Targets an inner nested join excludes are removed from their matches
+func (qs *QueryService) executeNestedJoins(ctx context.Context, entities []common.Entity, join JoinOptions, targetMap map[interface{}][]common.Entity, plan *QueryPlan) (map[interface{}][]common.Entity, error) {
+	// Each target is joined once, however many entities match it
+	matchedMap := make(map[interface{}][]common.Entity)
+	targets := make([]common.Entity, 0)
+	seen := make(map[string]bool)
+	for i, entity := range entities {
+		if err := queryInterrupted(ctx, i); err != nil {
+			return nil, err
+		}
+
+		localValue, exists := joinLocalValue(entity, join.LocalField)
+		if !exists {
+			continue
+		}
+		key := qs.normalizeForJoinComparison(localValue)
+		matches, found := targetMap[key]
+		if !found {
+			continue
+		}
+		matchedMap[key] = matches
+		for _, target := range matches {
+			if !seen[target.ID] {
+				seen[target.ID] = true
+				targets = append(targets, target)
+			}
+		}
+	}
+
+	for _, nested := range join.Joins {
+		var err error
+		if targets, err = qs.executeJoin(ctx, targets, nested, plan); err != nil {
+			return nil, err
+		}
+	}
+
+	joined := make(map[string]common.Entity, len(targets))
+	for _, target := range targets {
+		joined[target.ID] = target
+	}
+	for key, matches := range matchedMap {
+		joinedMatches := make([]common.Entity, 0, len(matches))
+		for _, target := range matches {
+			if joinedTarget, exists := joined[target.ID]; exists {
+				joinedMatches = append(joinedMatches, joinedTarget)
+			}
+		}
+		matchedMap[key] = joinedMatches
+	}
+
+	return matchedMap, nil
+}
+
 // filterJoinFields creates a filtered map of entity fields based on include/exclude lists
 func (qs *QueryService) filterJoinFields(entity common.Entity, includeFields, excludeFields []string) map[string]interface{} {
 	result := make(map[string]interface{})
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// contextCheckInterval is the number of entities processed between two checks of the query context
+const contextCheckInterval = 1024
+
+// QueryLimits bounds the work of a single query, a zero value disables a limit
+type QueryLimits struct {
+	Timeout    time.Duration // Maximum running time of a query
+	MaxJoins   int           // Maximum joins of a query
+	MaxFilters int           // Maximum filters of a query, those of its joins included
+	MaxResults int           // Maximum entities a query returns
+}
+
+// SetQueryLimits sets the limits applied to every query
+func (qs *QueryService) SetQueryLimits(limits QueryLimits) {
+	qs.limits = limits
+}
+
+// QueryLimits returns the limits applied to every query
+func (qs *QueryService) QueryLimits() QueryLimits {
+	return qs.limits
+}
+
+// startQuery adds the joins of the relations a query includes, checks it against the limits
+// and bounds its context by the query timeout
+// The query runs with the returned options, whose cancel function must be called when it finishes
+func (qs *QueryService) startQuery(ctx context.Context, options QueryOptions) (QueryOptions, context.CancelFunc, error) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	options, err := qs.resolveIncludes(options)
+	if err != nil {
+		return options, func() {}, err
+	}
+	if err := qs.checkQueryComplexity(options); err != nil {
+		return options, func() {}, err
+	}
+	if err := checkQueryContext(ctx); err != nil {
+		return options, func() {}, err
+	}
+
+	cancel := context.CancelFunc(func() {})
+	if qs.limits.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, qs.limits.Timeout)
+	}
+	options.Context = ctx
+
+	return options, cancel, nil
+}
+
+// checkQueryComplexity returns a query too complex error when a query has more joins or filters than allowed
+// Nested joins count as joins of the query
+func (qs *QueryService) checkQueryComplexity(options QueryOptions) error {
+	joins, joinFilters := countJoins(options.Joins)
+	if limit := qs.limits.MaxJoins; limit > 0 && joins > limit {
+		return queryTooComplexError(fmt.Sprintf("query has %d joins, at most %d are allowed", joins, limit))
+	}
+
+	if limit := qs.limits.MaxFilters; limit > 0 {
+		filters := len(options.Filters) + joinFilters
+		if filters > limit {
+			return queryTooComplexError(fmt.Sprintf("query has %d filters, at most %d are allowed", filters, limit))
+		}
+	}
+
+	return nil
+}
+
+// countJoins returns the number of joins and of their filters, nested joins included
+func countJoins(joins []JoinOptions) (count, filters int) {
+	for _, join := range joins {
+		nested, nestedFilters := countJoins(join.Joins)
+		count += 1 + nested
+		filters += len(join.Filters) + nestedFilters
+	}
+	return count, filters
+}
+
+// checkResultSize returns a query too complex error when a query returns more entities than allowed
+func (qs *QueryService) checkResultSize(returned int) error {
+	if limit := qs.limits.MaxResults; limit > 0 && returned > limit {
+		return queryTooComplexError(fmt.Sprintf("query returns %d entities, at most %d are allowed: set a lower limit", returned, limit))
+	}
+	return nil
+}
+
+// checkQueryContext returns a query timeout error when the deadline of ctx passed or ctx was canceled
+func checkQueryContext(ctx context.Context) error {
+	if ctx == nil {
+		return nil
+	}
+
+	switch err := ctx.Err(); err {
+	case nil:
+		return nil
+	case context.DeadlineExceeded:
+		return queryTimeoutError(err, "query timed out")
+	default:
+		return queryTimeoutError(err, "query canceled")
+	}
+}
+
+// queryInterrupted checks the query context once every contextCheckInterval entities,
+// i being the position of the entity being processed
+func queryInterrupted(ctx context.Context, i int) error {
+	if i%contextCheckInterval != 0 {
+		return nil
+	}
+	return checkQueryContext(ctx)
+}
@@ -0,0 +1,312 @@
+package datastore
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// rangeSelectivity is the fraction of an index a range filter is estimated to match
+const rangeSelectivity = 1.0 / 3
+
+// Costs of the planner, relative to reading an entity ID from an index
+const (
+	keyCost    = 1 // Comparing an index key with the bound of a range
+	idCost     = 1 // Reading an entity ID from an index
+	entityCost = 4 // Reading an entity and evaluating a filter on it
+)
+
+// IndexStats are the cardinality statistics of a field index
+type IndexStats struct {
+	Entries  int `json:"entries"`  // Entities in the index, those without a value for the field are not indexed
+	Distinct int `json:"distinct"` // Distinct values in the index
+}
+
+// IndexStats returns the statistics of the index of a field, false if the field is not indexed
+func (dse *Engine) IndexStats(entityType, field string) (IndexStats, bool) {
+	dse.mu.RLock()
+	defer dse.mu.RUnlock()
+	return dse.indexStats(entityType, field)
+}
+
+// indexStats returns the statistics of the index of a field
+// This function requires that the caller holds a read lock
+func (dse *Engine) indexStats(entityType, field string) (IndexStats, bool) {
+	index, exists := dse.indices[entityType][field]
+	if !exists {
+		return IndexStats{}, false
+	}
+	return IndexStats{Entries: dse.indexEntries[entityType][field], Distinct: len(index)}, true
+}
+
+// countIndexEntry adjusts the number of entities in the index of a field
+// This function requires that the caller holds a write lock
+func (dse *Engine) countIndexEntry(entityType, field string, delta int) {
+	if dse.indexEntries[entityType] == nil {
+		dse.indexEntries[entityType] = make(map[string]int)
+	}
+	dse.indexEntries[entityType][field] += delta
+}
+
+// recountIndexEntries counts the entities in each field index of an entity type,
+// after its indices were rebuilt or put back
+// This function requires that the caller holds a write lock
+func (dse *Engine) recountIndexEntries(entityType string) {
+	entries := make(map[string]int, len(dse.indices[entityType]))
+	for field, index := range dse.indices[entityType] {
+		for _, ids := range index {
+			entries[field] += len(ids)
+		}
+	}
+	dse.indexEntries[entityType] = entries
+}
+
+// indexLookup is a filter resolved with the index of its field
+type indexLookup struct {
+	filter    Filter
+	fieldType string
+	position  int     // Position of the filter in the query
+	estimate  float64 // Entities the lookup is estimated to match
+	cost      float64 // Cost of the index keys and IDs the lookup reads
+}
+
+// accessPlan is how the candidates of a query are found, and which filters are left to evaluate on them
+type accessPlan struct {
+	entities int           // Entities of the type, the cost of a full scan
+	lookups  []indexLookup // Index lookups intersected to find the candidates, the most selective first
+	residual []Filter      // Filters evaluated on the candidates, in the order of the query
+}
+
+// planAccess chooses the index lookups that find the candidates of a query
+// The most selective lookup drives the query unless it costs more than a full scan. Other lookups
+// are intersected with the candidates unless they cost more than evaluating their filter on the
+// candidates, their filters are evaluated on the candidates otherwise
+// This function requires that the caller holds a read lock
+func (qs *QueryService) planAccess(entityType string, filters []Filter) accessPlan {
+	access := accessPlan{entities: qs.engine.entities.countOfType(entityType)}
+
+	lookups := make([]indexLookup, 0, len(filters))
+	residual := make([]indexLookup, 0, len(filters))
+	for i, f := range filters {
+		if lookup, ok := qs.estimateLookup(entityType, f); ok {
+			lookup.position = i
+			lookups = append(lookups, lookup)
+		} else {
+			residual = append(residual, indexLookup{filter: f, position: i})
+		}
+	}
+	sort.SliceStable(lookups, func(i, j int) bool {
+		return lookups[i].estimate < lookups[j].estimate
+	})
+
+	candidates := float64(access.entities)
+	for _, lookup := range lookups {
+		if lookup.cost > candidates*entityCost {
+			residual = append(residual, lookup)
+			continue
+		}
+
+		if len(access.lookups) == 0 {
+			candidates = lookup.estimate
+		} else {
+			// Filters are assumed to be independent
+			candidates *= lookup.estimate / float64(access.entities)
+		}
+		access.lookups = append(access.lookups, lookup)
+	}
+
+	sort.SliceStable(residual, func(i, j int) bool {
+		return residual[i].position < residual[j].position
+	})
+	for _, r := range residual {
+		access.residual = append(access.residual, r.filter)
+	}
+
+	return access
+}
+
+// estimateLookup estimates the entities the index of a filter's field matches
+// The second return value is false if the filter cannot use an index
+// This function requires that the caller holds a read lock
+func (qs *QueryService) estimateLookup(entityType string, f Filter) (indexLookup, bool) {
+	fieldDef, ok := qs.indexedField(entityType, f.Field)
+	if !ok {
+		return indexLookup{}, false
+	}
+	index := qs.engine.indices[entityType][f.Field]
+	lookup := indexLookup{filter: f, fieldType: fieldDef.Type}
+
+	switch f.Operator {
+	case FilterEq:
+		lookup.estimate = float64(len(index[qs.engine.getIndexableValue(f.Value)]))
+		lookup.cost = lookup.estimate * idCost
+
+	case FilterIn:
+		// Array fields match single elements, which the index does not hold
+		values, ok := f.Value.([]interface{})
+		if !ok || !indexesScalars(fieldDef.Type) {
+			return indexLookup{}, false
+		}
+		for _, value := range values {
+			// Entities without a value are not indexed
+			if value == nil {
+				return indexLookup{}, false
+			}
+			lookup.estimate += float64(len(index[qs.engine.getIndexableValue(value)]))
+		}
+		lookup.cost = float64(len(values))*keyCost + lookup.estimate*idCost
+
+	case FilterGt, FilterGte, FilterLt, FilterLte:
+		// Every key of the index is compared with the bound
+		if !indexesOrderedKeys(fieldDef.Type) {
+			return indexLookup{}, false
+		}
+		stats, _ := qs.engine.indexStats(entityType, f.Field)
+		lookup.estimate = float64(stats.Entries) * rangeSelectivity
+		lookup.cost = float64(stats.Distinct)*keyCost + lookup.estimate*idCost
+
+	default:
+		return indexLookup{}, false
+	}
+
+	return lookup, true
+}
+
+// matchesFieldFilter evaluates a filter on the value of a field of an entity
+// Equality and in filters an index can resolve compare index keys, so an entity matches them
+// whether the planner resolves them with the index or evaluates them on the candidates
+// This function requires that the caller holds a read lock
+func (qs *QueryService) matchesFieldFilter(entityType string, value interface{}, f Filter) bool {
+	fieldDef, indexed := qs.indexedField(entityType, f.Field)
+	if !indexed {
+		return qs.matchesFilter(value, f.Operator, f.Value)
+	}
+
+	switch f.Operator {
+	case FilterEq:
+		return qs.engine.getIndexableValue(value) == qs.engine.getIndexableValue(f.Value)
+
+	case FilterIn:
+		values, ok := f.Value.([]interface{})
+		if !ok || !indexesScalars(fieldDef.Type) || slices.Contains(values, nil) {
+			return qs.matchesFilter(value, f.Operator, f.Value)
+		}
+		key := qs.engine.getIndexableValue(value)
+		for _, v := range values {
+			if qs.engine.getIndexableValue(v) == key {
+				return true
+			}
+		}
+		return false
+
+	default:
+		return qs.matchesFilter(value, f.Operator, f.Value)
+	}
+}
+
+// indexedField returns the definition of a field if it is indexed
+// This function requires that the caller holds a read lock
+func (qs *QueryService) indexedField(entityType, field string) (common.FieldDefinition, bool) {
+	for _, fieldDef := range qs.engine.definitions[entityType].Fields {
+		if fieldDef.Name == field {
+			return fieldDef, fieldDef.Indexed
+		}
+	}
+	return common.FieldDefinition{}, false
+}
+
+// indexesScalars reports whether the index keys of a field type are single values
+func indexesScalars(fieldType string) bool {
+	switch fieldType {
+	case TypeArray, TypeObject, TypeJSON:
+		return false
+	default:
+		return true
+	}
+}
+
+// indexesOrderedKeys reports whether the index keys of a field type convert back to values
+// that compare like the field values. Date and time keys are truncated to the second
+func indexesOrderedKeys(fieldType string) bool {
+	switch fieldType {
+	case TypeInteger, TypeFloat, TypeString, TypeText:
+		return true
+	default:
+		return false
+	}
+}
+
+// lookupIndex returns the IDs of the entities the index of a filter's field matches
+// This function requires that the caller holds a read lock
+func (qs *QueryService) lookupIndex(entityType string, lookup indexLookup) []string {
+	index := qs.engine.indices[entityType][lookup.filter.Field]
+	f := lookup.filter
+
+	switch f.Operator {
+	case FilterEq:
+		return index[qs.engine.getIndexableValue(f.Value)]
+
+	case FilterIn:
+		values, _ := f.Value.([]interface{})
+		ids := make([]string, 0)
+		for _, value := range values {
+			ids = append(ids, index[qs.engine.getIndexableValue(value)]...)
+		}
+		return ids
+
+	default:
+		ids := make([]string, 0)
+		for key, keyIDs := range index {
+			var value interface{} = key
+			if lookup.fieldType == TypeInteger || lookup.fieldType == TypeFloat {
+				number, err := strconv.ParseFloat(key, 64)
+				if err != nil {
+					continue
+				}
+				value = number
+			}
+			if qs.compareValues(value, f.Operator, f.Value) {
+				ids = append(ids, keyIDs...)
+			}
+		}
+		return ids
+	}
+}
+
+// lookupCandidates intersects the index lookups of an access plan, and with the trigram
+// candidates when there are some, recording each lookup in the query plan
+// This function requires that the caller holds a read lock
+func (qs *QueryService) lookupCandidates(entityType string, access accessPlan, trigramIDs map[string]bool, plan *QueryPlan) map[string]bool {
+	var candidates map[string]bool
+	for i, lookup := range access.lookups {
+		start := time.Now()
+		before := access.entities
+
+		ids := qs.lookupIndex(entityType, lookup)
+		matched := make(map[string]bool, len(ids))
+		for _, id := range ids {
+			if i == 0 || candidates[id] {
+				matched[id] = true
+			}
+		}
+		if i > 0 {
+			before = len(candidates)
+		}
+		candidates = matched
+
+		plan.recordLookup(lookup, before, len(candidates), time.Since(start))
+	}
+
+	if trigramIDs != nil {
+		for id := range candidates {
+			if !trigramIDs[id] {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	return candidates
+}
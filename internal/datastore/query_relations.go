@@ -0,0 +1,91 @@
+package datastore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// resolveIncludes adds a join for each relation a query includes, after the joins of the query
+// Includes sharing a path share its joins, "customer" and "customer.company" join customers once
+func (qs *QueryService) resolveIncludes(options QueryOptions) (QueryOptions, error) {
+	if len(options.Include) == 0 {
+		return options, nil
+	}
+
+	var joins []JoinOptions
+	for _, path := range options.Include {
+		var err error
+		if joins, err = qs.includeRelation(joins, options.EntityType, strings.Split(path, ".")); err != nil {
+			return options, err
+		}
+	}
+	options.Joins = append(append([]JoinOptions(nil), options.Joins...), joins...)
+
+	return options, nil
+}
+
+// includeRelation adds the joins of a relation path of an entity type to joins
+func (qs *QueryService) includeRelation(joins []JoinOptions, entityType string, path []string) ([]JoinOptions, error) {
+	name := path[0]
+	if name == "" {
+		return joins, invalidJoinError("invalid include path: relation names cannot be empty")
+	}
+
+	i := 0
+	for i < len(joins) && joins[i].ResultField != name {
+		i++
+	}
+	if i == len(joins) {
+		join, err := qs.relationJoin(entityType, name)
+		if err != nil {
+			return joins, err
+		}
+		joins = append(joins, join)
+	}
+
+	if len(path) > 1 {
+		nested, err := qs.includeRelation(joins[i].Joins, joins[i].EntityType, path[1:])
+		if err != nil {
+			return joins, err
+		}
+		joins[i].Joins = nested
+	}
+
+	return joins, nil
+}
+
+// relationJoin returns the join of a relation of an entity type
+// Included relations are left joins, a one relation selects the first related entity and a many relation all of them
+func (qs *QueryService) relationJoin(entityType, name string) (JoinOptions, error) {
+	def, err := qs.engine.GetEntityDefinition(entityType)
+	if err != nil {
+		return JoinOptions{}, err
+	}
+
+	for _, relation := range def.Relations {
+		if relation.Name != name {
+			continue
+		}
+		if _, err := qs.engine.GetEntityDefinition(relation.EntityType); err != nil {
+			return JoinOptions{}, joinTargetNotFoundError(relation.EntityType)
+		}
+
+		localField, foreignField := relationFields(relation)
+		join := JoinOptions{
+			EntityType:     relation.EntityType,
+			LocalField:     localField,
+			ForeignField:   foreignField,
+			JoinType:       JoinTypeLeft,
+			ResultField:    relation.Name,
+			SelectStrategy: "first",
+		}
+		if relation.Type == common.RelationMany {
+			join.SelectStrategy = "all"
+		}
+		return join, nil
+	}
+
+	return JoinOptions{}, invalidJoinError(fmt.Sprintf("entity type '%s' has no relation '%s'", entityType, name))
+}
@@ -0,0 +1,232 @@
+package datastore
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Kinds of slow queries
+const (
+	SlowQueryKindQuery = "query" // A query, with its joins applied once
+	SlowQueryKindJoin  = "join"  // A nested join query
+)
+
+// SlowQuery is a query that ran for longer than the slow query threshold
+type SlowQuery struct {
+	Time       time.Time    `json:"time"`
+	Duration   string       `json:"duration"`
+	Kind       string       `json:"kind"`
+	RequestID  string       `json:"requestId,omitempty"`
+	EntityType string       `json:"entityType"`
+	Options    QueryOptions `json:"options"`
+	Matches    int          `json:"matches"`  // Entities matching every filter
+	Returned   int          `json:"returned"` // Entities in the response
+	Plan       string       `json:"plan"`     // Summary of the query plan
+	Error      string       `json:"error,omitempty"`
+}
+
+// SlowQueryLogConfig configures a slow query log
+type SlowQueryLogConfig struct {
+	Threshold   time.Duration  // Queries running at least this long are slow
+	Size        int            // Number of slow queries kept, the oldest are dropped first
+	SampleRatio float64        // Fraction of slow queries that are recorded
+	Logger      *logrus.Logger // Receives every recorded slow query, may be nil
+}
+
+// SlowQueryLog keeps the most recent slow queries in a bounded ring and writes them to the logger
+type SlowQueryLog struct {
+	config SlowQueryLogConfig
+
+	mu       sync.Mutex
+	entries  []SlowQuery // Ring of recorded slow queries
+	next     int         // Position of the next entry in the ring
+	slow     uint64      // Slow queries seen, recorded or not
+	recorded uint64      // Slow queries recorded
+}
+
+// NewSlowQueryLog creates a slow query log
+func NewSlowQueryLog(config SlowQueryLogConfig) *SlowQueryLog {
+	if config.Size < 1 {
+		config.Size = 1
+	}
+	return &SlowQueryLog{
+		config:  config,
+		entries: make([]SlowQuery, 0, config.Size),
+	}
+}
+
+// Threshold returns the duration from which a query is slow
+func (l *SlowQueryLog) Threshold() time.Duration {
+	return l.config.Threshold
+}
+
+// Queries returns the recorded slow queries, the most recent first
+func (l *SlowQueryLog) Queries() []SlowQuery {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	queries := make([]SlowQuery, 0, len(l.entries))
+	for i := 1; i <= len(l.entries); i++ {
+		queries = append(queries, l.entries[(l.next-i+len(l.entries))%len(l.entries)])
+	}
+	return queries
+}
+
+// Stats returns the number of slow queries seen and how many of them were recorded
+func (l *SlowQueryLog) Stats() (slow uint64, recorded uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.slow, l.recorded
+}
+
+// Clear removes the recorded slow queries
+func (l *SlowQueryLog) Clear() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.entries = l.entries[:0]
+	l.next = 0
+}
+
+// observe records a finished query if it was slow and is sampled
+func (l *SlowQueryLog) observe(entry SlowQuery, elapsed time.Duration) {
+	if elapsed < l.config.Threshold {
+		return
+	}
+
+	l.mu.Lock()
+	l.slow++
+	if l.config.SampleRatio < 1 && rand.Float64() >= l.config.SampleRatio {
+		l.mu.Unlock()
+		return
+	}
+	l.recorded++
+
+	entry.Duration = elapsed.String()
+	if len(l.entries) < l.config.Size {
+		l.entries = append(l.entries, entry)
+	} else {
+		l.entries[l.next] = entry
+	}
+	l.next = (l.next + 1) % l.config.Size
+	l.mu.Unlock()
+
+	if l.config.Logger != nil {
+		fields := logrus.Fields{
+			"kind":        entry.Kind,
+			"entity_type": entry.EntityType,
+			"duration":    entry.Duration,
+			"matches":     entry.Matches,
+			"returned":    entry.Returned,
+			"plan":        entry.Plan,
+			"options":     entry.Options,
+		}
+		if entry.RequestID != "" {
+			fields["request_id"] = entry.RequestID
+		}
+		if entry.Error != "" {
+			fields["error"] = entry.Error
+		}
+		l.config.Logger.WithFields(fields).Warn("Slow query")
+	}
+}
+
+// slowQueryTracker times a query for the slow query log
+type slowQueryTracker struct {
+	log     *SlowQueryLog
+	kind    string
+	options QueryOptions
+	start   time.Time
+}
+
+// trackSlowQuery starts timing a query when the slow query log is enabled, nil otherwise
+// The query is given a plan to summarize in the log. Queries that already carry one are
+// explained or nested in a tracked query, and are not tracked on their own
+func (qs *QueryService) trackSlowQuery(kind string, options *QueryOptions) *slowQueryTracker {
+	if qs.slowQueries == nil || options.plan != nil {
+		return nil
+	}
+
+	options.plan = &QueryPlan{EntityType: options.EntityType, Filters: []FilterPlan{}}
+	return &slowQueryTracker{
+		log:     qs.slowQueries,
+		kind:    kind,
+		options: *options,
+		start:   time.Now(),
+	}
+}
+
+// finish records the query with the counts of its response
+func (t *slowQueryTracker) finish(response *PaginatedResponse, err error) {
+	if t == nil {
+		return
+	}
+
+	// The request context is not kept, the log outlives the request
+	options := t.options
+	options.Context = nil
+
+	entry := SlowQuery{
+		Time:       t.start,
+		Kind:       t.kind,
+		RequestID:  common.RequestIDFromContext(t.options.Context),
+		EntityType: options.EntityType,
+		Options:    options,
+		Plan:       options.plan.Summary(),
+	}
+	if response != nil {
+		entry.Matches = response.Total
+		entry.Returned = response.Count
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	t.log.observe(entry, time.Since(t.start))
+}
+
+// SetSlowQueryLog enables the slow query log, nil disables it
+func (qs *QueryService) SetSlowQueryLog(log *SlowQueryLog) {
+	qs.slowQueries = log
+}
+
+// SlowQueryLog returns the slow query log, nil if it is disabled
+func (qs *QueryService) SlowQueryLog() *SlowQueryLog {
+	return qs.slowQueries
+}
+
+// Summary describes a plan on a single line, e.g.
+// "full scan 1200 > category eq index 310 > name contains scan 12 > sort price 12 > hash join books fan-out 1.5"
+func (p *QueryPlan) Summary() string {
+	if p == nil || p.Scan == "" {
+		return ""
+	}
+
+	parts := []string{fmt.Sprintf("%s scan %d", p.Scan, p.Candidates)}
+	for _, f := range p.Filters {
+		parts = append(parts, fmt.Sprintf("%s %s %s %d", f.Field, f.Operator, f.Strategy, f.CandidatesAfter))
+	}
+	if p.Sort != nil {
+		if p.Sort.Relevance {
+			parts = append(parts, fmt.Sprintf("sort relevance %d", p.Sort.Entities))
+		} else {
+			parts = append(parts, fmt.Sprintf("sort %s %d", p.Sort.Field, p.Sort.Entities))
+		}
+	}
+	parts = appendJoinSummaries(parts, p.Joins)
+	return strings.Join(parts, " > ")
+}
+
+// appendJoinSummaries describes each join after the joins applied to its joined entities
+func appendJoinSummaries(parts []string, joins []JoinPlan) []string {
+	for _, join := range joins {
+		parts = appendJoinSummaries(parts, join.Joins)
+		parts = append(parts, fmt.Sprintf("%s join %s fan-out %.1f", join.Strategy, join.EntityType, join.FanOut))
+	}
+	return parts
+}
@@ -0,0 +1,296 @@
+package datastore
+
+import (
+	"strings"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// trigramLength is the number of characters in each indexed n-gram
+const trigramLength = 3
+
+// fuzzyTrigramMinThreshold is the lowest fuzzy threshold at which trigram lookups find every match
+// Words at an edit distance d share at least n+1-3d of their padded trigrams, n being the length of
+// the longer word, which is positive for any similarity 1-d/n of at least 2/3
+const fuzzyTrigramMinThreshold = 2.0 / 3
+
+// TrigramIndex maps the trigrams of a string field to the entities containing them
+// It narrows down candidates for substring and fuzzy filters, which are still verified value by value
+// Substring lookups are exact, fuzzy lookups skip values that share no trigram with the search value,
+// which cannot match from a threshold of fuzzyTrigramMinThreshold on
+type TrigramIndex struct {
+	postings map[string]map[string]struct{} // Key format: trigram -> entityID set
+	docGrams map[string][]string            // Key format: entityID -> trigrams of the indexed value
+	short    map[string]struct{}            // Entities with values too short to produce a substring trigram
+}
+
+// newTrigramIndex creates an empty trigram index
+func newTrigramIndex() *TrigramIndex {
+	return &TrigramIndex{
+		postings: make(map[string]map[string]struct{}),
+		docGrams: make(map[string][]string),
+		short:    make(map[string]struct{}),
+	}
+}
+
+// add indexes the strings of an entity field, replacing any previously indexed value
+func (idx *TrigramIndex) add(entityID string, values []string) {
+	idx.remove(entityID)
+
+	grams := make(map[string]struct{})
+	isShort := false
+	for _, value := range values {
+		value = strings.ToLower(value)
+		substringGrams := substringTrigrams(value)
+		if len(substringGrams) == 0 {
+			isShort = true
+		}
+		for _, gram := range substringGrams {
+			grams[gram] = struct{}{}
+		}
+		for _, gram := range wordTrigrams(value) {
+			grams[gram] = struct{}{}
+		}
+	}
+
+	if isShort {
+		idx.short[entityID] = struct{}{}
+	}
+
+	if len(grams) == 0 {
+		return
+	}
+
+	docGrams := make([]string, 0, len(grams))
+	for gram := range grams {
+		if idx.postings[gram] == nil {
+			idx.postings[gram] = make(map[string]struct{})
+		}
+		idx.postings[gram][entityID] = struct{}{}
+		docGrams = append(docGrams, gram)
+	}
+	idx.docGrams[entityID] = docGrams
+}
+
+// remove deletes all trigrams of an entity from the index
+func (idx *TrigramIndex) remove(entityID string) {
+	for _, gram := range idx.docGrams[entityID] {
+		delete(idx.postings[gram], entityID)
+		if len(idx.postings[gram]) == 0 {
+			delete(idx.postings, gram)
+		}
+	}
+	delete(idx.docGrams, entityID)
+	delete(idx.short, entityID)
+}
+
+// containing returns the entities whose indexed value contains all trigrams of a substring
+// The second return value is false if the substring is too short to use the index
+func (idx *TrigramIndex) containing(substring string) (map[string]bool, bool) {
+	grams := substringTrigrams(strings.ToLower(substring))
+	if len(grams) == 0 {
+		return nil, false
+	}
+
+	// Start from the rarest trigram to keep the intersection small
+	smallest := grams[0]
+	for _, gram := range grams[1:] {
+		if len(idx.postings[gram]) < len(idx.postings[smallest]) {
+			smallest = gram
+		}
+	}
+
+	candidates := make(map[string]bool, len(idx.postings[smallest]))
+	for id := range idx.postings[smallest] {
+		candidates[id] = true
+	}
+
+	for _, gram := range grams {
+		if gram == smallest {
+			continue
+		}
+		postings := idx.postings[gram]
+		for id := range candidates {
+			if _, exists := postings[id]; !exists {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	return candidates, true
+}
+
+// similar returns the entities sharing at least one trigram with a search value,
+// along with entities whose values are too short to be compared by trigrams
+// The second return value is false if the search value is too short to use the index
+func (idx *TrigramIndex) similar(search string) (map[string]bool, bool) {
+	search = strings.ToLower(search)
+	if len([]rune(search)) < trigramLength {
+		return nil, false
+	}
+
+	candidates := make(map[string]bool)
+	for id := range idx.short {
+		candidates[id] = true
+	}
+
+	for _, grams := range [][]string{substringTrigrams(search), wordTrigrams(search)} {
+		for _, gram := range grams {
+			for id := range idx.postings[gram] {
+				candidates[id] = true
+			}
+		}
+	}
+
+	return candidates, true
+}
+
+// substringTrigrams returns the trigrams of every position of a string
+// Any substring of at least three characters shares all of its substring trigrams with the string
+func substringTrigrams(value string) []string {
+	runes := []rune(value)
+	if len(runes) < trigramLength {
+		return nil
+	}
+
+	grams := make([]string, 0, len(runes)-trigramLength+1)
+	for i := 0; i+trigramLength <= len(runes); i++ {
+		grams = append(grams, string(runes[i:i+trigramLength]))
+	}
+	return uniqueStrings(grams)
+}
+
+// wordTrigrams returns the trigrams of each word padded with blanks, so that short words
+// and words differing by a few edits still share trigrams (e.g. "  s", " sm")
+func wordTrigrams(value string) []string {
+	grams := make([]string, 0)
+	for _, word := range strings.Fields(value) {
+		grams = append(grams, substringTrigrams("  "+word+" ")...)
+	}
+	return uniqueStrings(grams)
+}
+
+// trigramValues returns the strings of a field value that are covered by a trigram index
+func trigramValues(value interface{}) []string {
+	switch v := value.(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		values := make([]string, 0, len(v))
+		for _, item := range v {
+			if str, ok := item.(string); ok {
+				values = append(values, str)
+			}
+		}
+		return values
+	default:
+		return nil
+	}
+}
+
+// initializeTrigramIndices creates empty trigram indices for an entity definition
+// This function requires that the caller holds a write lock
+func (dse *Engine) initializeTrigramIndices(def common.EntityDefinition) {
+	indices := make(map[string]*TrigramIndex)
+	for _, field := range def.Fields {
+		if field.Trigram {
+			indices[field.Name] = newTrigramIndex()
+		}
+	}
+	dse.trigramIndices[def.Name] = indices
+}
+
+// rebuildTrigramIndices recreates the trigram indices of an entity type from its entities
+// This function requires that the caller holds a write lock
+func (dse *Engine) rebuildTrigramIndices(def common.EntityDefinition) error {
+	dse.initializeTrigramIndices(def)
+	if len(dse.trigramIndices[def.Name]) == 0 {
+		return nil
+	}
+
+	return dse.entities.forEachOfType(def.Name, func(_ string, entity common.Entity) bool {
+		dse.updateTrigramIndices(entity, true)
+		return true
+	})
+}
+
+// updateTrigramIndices adds or removes the trigram index entries of an entity
+// This function requires that the caller holds a write lock
+func (dse *Engine) updateTrigramIndices(entity common.Entity, add bool) {
+	for fieldName, index := range dse.trigramIndices[entity.Type] {
+		if !add {
+			index.remove(entity.ID)
+			continue
+		}
+
+		if values := trigramValues(entity.Fields[fieldName]); len(values) > 0 {
+			index.add(entity.ID, values)
+		} else {
+			index.remove(entity.ID)
+		}
+	}
+}
+
+// trigramCandidates returns the IDs of the entities that can match all trigram-indexed filters
+// The second return value is false if none of the filters can use a trigram index
+// This function requires that the caller holds a read lock
+func (qs *QueryService) trigramCandidates(entityType string, filters []Filter, fuzzyOpts *FuzzySearchOptions) (map[string]bool, bool) {
+	var candidates map[string]bool
+	narrowed := false
+
+	for _, f := range filters {
+		filterCandidates, ok := qs.trigramFilterCandidates(entityType, f, fuzzyOpts)
+		if !ok {
+			continue
+		}
+
+		if !narrowed {
+			candidates = filterCandidates
+			narrowed = true
+			continue
+		}
+
+		for id := range candidates {
+			if !filterCandidates[id] {
+				delete(candidates, id)
+			}
+		}
+	}
+
+	return candidates, narrowed
+}
+
+// trigramNarrows reports whether a filter narrows down the candidates of a query through a trigram index
+// This function requires that the caller holds a read lock
+func (qs *QueryService) trigramNarrows(entityType string, f Filter, fuzzyOpts *FuzzySearchOptions) bool {
+	_, ok := qs.trigramFilterCandidates(entityType, f, fuzzyOpts)
+	return ok
+}
+
+// trigramFilterCandidates returns the IDs of the entities that can match a single filter
+// The second return value is false if the filter cannot use a trigram index, fuzzy filters
+// cannot below fuzzyTrigramMinThreshold
+// This function requires that the caller holds a read lock
+func (qs *QueryService) trigramFilterCandidates(entityType string, f Filter, fuzzyOpts *FuzzySearchOptions) (map[string]bool, bool) {
+	index := qs.engine.trigramIndices[entityType][f.Field]
+	if index == nil {
+		return nil, false
+	}
+
+	search, ok := f.Value.(string)
+	if !ok {
+		return nil, false
+	}
+
+	switch f.Operator {
+	case FilterContains, FilterStartsWith, FilterEndsWith:
+		return index.containing(search)
+	case FilterFuzzy:
+		if threshold, _ := fuzzyLimits(fuzzyOpts); threshold < fuzzyTrigramMinThreshold {
+			return nil, false
+		}
+		return index.similar(search)
+	default:
+		return nil, false
+	}
+}
@@ -1,6 +1,10 @@
 package datastore
 
-import "github.com/phillarmonic/syncopate-db/internal/common"
+import (
+	"context"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
 
 // Field types supported by the data store
 const (
@@ -32,6 +36,7 @@ const (
 	FilterArrayContains    = "array_contains"     // Check if array contains a specific value
 	FilterArrayContainsAny = "array_contains_any" // Check if array contains any of the specified values
 	FilterArrayContainsAll = "array_contains_all" // Check if array contains all the specified values
+	FilterSearch           = "search"             // Full-text search with relevance ranking
 )
 
 // QueryOptions defines parameters for running a query
@@ -43,7 +48,14 @@ type QueryOptions struct {
 	OrderBy    string              `json:"orderBy"`
 	OrderDesc  bool                `json:"orderDesc"`
 	FuzzyOpts  *FuzzySearchOptions `json:"fuzzyOpts,omitempty"`
+	Highlight  *HighlightOptions   `json:"highlight,omitempty"`
 	Joins      []JoinOptions       `json:"joins"`
+	Include    []string            `json:"include,omitempty"` // Relations of the entity type to join, nested ones by path, e.g. "customer.company"
+	Explain    *ExplainOptions     `json:"explain,omitempty"`
+
+	Context context.Context `json:"-"` // Carries the trace and deadline of the request running the query, nil when there is none
+
+	plan *QueryPlan // Records how the query is executed, set by ExplainQuery
 }
 
 // Filter represents a filter condition
@@ -59,15 +71,33 @@ type FuzzySearchOptions struct {
 	MaxDistance int     `json:"maxDistance"` // Maximum edit distance for Levenshtein
 }
 
+// ExplainOptions requests the plan of a query instead of its results
+type ExplainOptions struct {
+	Timings bool `json:"timings"` // Include the execution time of each stage
+}
+
+// HighlightOptions defines how matched terms of search filters are highlighted
+type HighlightOptions struct {
+	PreTag  string `json:"preTag"`  // Inserted before each match, defaults to <em>
+	PostTag string `json:"postTag"` // Inserted after each match, defaults to </em>
+}
+
+// SearchMatch holds the relevance of an entity for the search filters of a query
+type SearchMatch struct {
+	Score      float64           `json:"score"`
+	Highlights map[string]string `json:"highlights,omitempty"` // Field name -> value with matched terms highlighted
+}
+
 // PaginatedResponse represents a paginated result of entities
 type PaginatedResponse struct {
-	Total      int             `json:"total"`
-	Count      int             `json:"count"`
-	Limit      int             `json:"limit"`
-	Offset     int             `json:"offset"`
-	HasMore    bool            `json:"hasMore"`
-	EntityType string          `json:"entityType"`
-	Data       []common.Entity `json:"data"`
+	Total      int                    `json:"total"`
+	Count      int                    `json:"count"`
+	Limit      int                    `json:"limit"`
+	Offset     int                    `json:"offset"`
+	HasMore    bool                   `json:"hasMore"`
+	EntityType string                 `json:"entityType"`
+	Data       []common.Entity        `json:"data"`
+	Search     map[string]SearchMatch `json:"search,omitempty"` // Entity ID -> search relevance, only for search queries
 }
 
 // Join types
@@ -86,6 +116,8 @@ type JoinOptions struct {
 	IncludeFields []string `json:"includeFields"` // Fields to include (empty = all)
 	ExcludeFields []string `json:"excludeFields"` // Fields to exclude
 
+	Joins []JoinOptions `json:"joins,omitempty"` // Joins applied to the joined entities
+
 	// Legacy fields for backward compatibility
 	As             string `json:"as,omitempty"`             // Deprecated: use ResultField
 	Type           string `json:"type,omitempty"`           // Deprecated: use JoinType
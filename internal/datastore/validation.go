@@ -227,6 +227,80 @@ func ValidateEntityTypeFields(fields []common.FieldDefinition, skipInternal bool
 			}
 			return fmt.Errorf("field name '%s' is not allowed: names starting with underscore are reserved for internal use", field.Name)
 		}
+
+		// Full-text indexing only applies to textual fields
+		if field.FullText && field.Type != TypeString && field.Type != TypeText {
+			return fmt.Errorf("field '%s' of type '%s' cannot have a full-text index: only string and text fields are supported",
+				field.Name, field.Type)
+		}
+
+		// Trigram indexing only applies to textual fields
+		if field.Trigram && field.Type != TypeString && field.Type != TypeText {
+			return fmt.Errorf("field '%s' of type '%s' cannot have a trigram index: only string and text fields are supported",
+				field.Name, field.Type)
+		}
+	}
+	return nil
+}
+
+// ValidateEntityTypeRelations validates the relations declared by an entity type
+// The related entity types are resolved when a query includes a relation, they may be registered later
+func ValidateEntityTypeRelations(def common.EntityDefinition) error {
+	fields := make(map[string]bool, len(def.Fields))
+	for _, field := range def.Fields {
+		fields[field.Name] = true
+	}
+
+	names := make(map[string]bool, len(def.Relations))
+	for _, relation := range def.Relations {
+		if relation.Name == "" {
+			return errors.New("relation name is required")
+		}
+		if strings.HasPrefix(relation.Name, "_") || strings.Contains(relation.Name, ".") {
+			return fmt.Errorf("relation name '%s' is not allowed: names cannot start with an underscore or contain a dot", relation.Name)
+		}
+		if fields[relation.Name] {
+			return fmt.Errorf("relation '%s' has the name of a field", relation.Name)
+		}
+		if names[relation.Name] {
+			return fmt.Errorf("relation '%s' is declared more than once", relation.Name)
+		}
+		names[relation.Name] = true
+
+		if relation.EntityType == "" {
+			return fmt.Errorf("relation '%s' has no entity type", relation.Name)
+		}
+
+		localField, foreignField := relationFields(relation)
+		switch relation.Type {
+		case common.RelationOne, common.RelationMany:
+		default:
+			return fmt.Errorf("relation '%s' has an invalid type '%s': use '%s' or '%s'",
+				relation.Name, relation.Type, common.RelationOne, common.RelationMany)
+		}
+		if localField == "" || foreignField == "" {
+			return fmt.Errorf("relation '%s' of type '%s' needs a local and a foreign field", relation.Name, relation.Type)
+		}
+		if localField != "id" && !fields[localField] {
+			return fmt.Errorf("relation '%s' refers to an unknown local field '%s'", relation.Name, localField)
+		}
 	}
 	return nil
 }
+
+// relationFields returns the local and foreign fields of a relation, with their defaults
+// A one relation refers to the ID of the related entity, related entities of a many relation to the ID of the entity
+func relationFields(relation common.RelationDefinition) (localField, foreignField string) {
+	localField, foreignField = relation.LocalField, relation.ForeignField
+	switch relation.Type {
+	case common.RelationOne:
+		if foreignField == "" {
+			foreignField = "id"
+		}
+	case common.RelationMany:
+		if localField == "" {
+			localField = "id"
+		}
+	}
+	return localField, foreignField
+}
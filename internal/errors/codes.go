@@ -22,12 +22,13 @@ const (
 	ErrCodeTooManyRequests ErrorCode = "SY009"
 
 	// Entity type errors (SY100-SY199)
-	ErrCodeEntityTypeNotFound   ErrorCode = "SY100"
-	ErrCodeEntityTypeExists     ErrorCode = "SY101"
-	ErrCodeInvalidEntityType    ErrorCode = "SY102"
-	ErrCodeEntityTypeValidation ErrorCode = "SY103"
-	ErrCodeFieldNameReserved    ErrorCode = "SY104"
-	ErrCodeIDGeneratorChange    ErrorCode = "SY105"
+	ErrCodeEntityTypeNotFound    ErrorCode = "SY100"
+	ErrCodeEntityTypeExists      ErrorCode = "SY101"
+	ErrCodeInvalidEntityType     ErrorCode = "SY102"
+	ErrCodeEntityTypeValidation  ErrorCode = "SY103"
+	ErrCodeFieldNameReserved     ErrorCode = "SY104"
+	ErrCodeIDGeneratorChange     ErrorCode = "SY105"
+	ErrCodeSchemaVersionNotFound ErrorCode = "SY106"
 
 	// Entity errors (SY200-SY299)
 	ErrCodeEntityNotFound       ErrorCode = "SY200"
@@ -57,6 +58,11 @@ const (
 	ErrCodeDatabaseCorruption ErrorCode = "SY403"
 	ErrCodeBackupFailed       ErrorCode = "SY404"
 	ErrCodeRestoreFailed      ErrorCode = "SY405"
+	ErrCodeReadOnlyReplica    ErrorCode = "SY406"
+	ErrCodeReplicaOutOfSync   ErrorCode = "SY407"
+	ErrCodeNoClusterLeader    ErrorCode = "SY408"
+	ErrCodeClusterMembership  ErrorCode = "SY409"
+	ErrCodeBackupInProgress   ErrorCode = "SY410"
 )
 
 // SyncopateError represents an error with a code and message
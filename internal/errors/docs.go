@@ -119,6 +119,13 @@ var ErrorCodeDocs = map[ErrorCode]ErrorCodeDoc{
 		HTTPStatus:  400,
 		Example:     `{"error":"Bad Request","message":"Cannot change the ID generator after entity type creation","code":400,"db_code":"SY105"}`,
 	},
+	ErrCodeSchemaVersionNotFound: {
+		Code:        ErrCodeSchemaVersionNotFound,
+		Name:        "Schema Version Not Found",
+		Description: "The requested schema version does not exist for the entity type",
+		HTTPStatus:  404,
+		Example:     `{"error":"Not Found","message":"version 7 of entity type 'products' not found","code":404,"db_code":"SY106"}`,
+	},
 
 	// Entity errors (SY200-SY299)
 	ErrCodeEntityNotFound: {
@@ -286,6 +293,41 @@ var ErrorCodeDocs = map[ErrorCode]ErrorCodeDoc{
 		HTTPStatus:  500,
 		Example:     `{"error":"Internal Server Error","message":"Failed to restore database from backup","code":500,"db_code":"SY405"}`,
 	},
+	ErrCodeReadOnlyReplica: {
+		Code:        ErrCodeReadOnlyReplica,
+		Name:        "Read-Only Replica",
+		Description: "The server is a read-only replica, writes must go to the primary",
+		HTTPStatus:  403,
+		Example:     `{"error":"Forbidden","message":"This server is a read-only replica","code":403,"db_code":"SY406"}`,
+	},
+	ErrCodeReplicaOutOfSync: {
+		Code:        ErrCodeReplicaOutOfSync,
+		Name:        "Replica Out Of Sync",
+		Description: "The replica's position is no longer in the primary's WAL history and it must be bootstrapped from a snapshot",
+		HTTPStatus:  409,
+		Example:     `{"error":"Conflict","message":"replica must be bootstrapped from a snapshot","code":409,"db_code":"SY407"}`,
+	},
+	ErrCodeNoClusterLeader: {
+		Code:        ErrCodeNoClusterLeader,
+		Name:        "No Cluster Leader",
+		Description: "The cluster has no leader to accept the write, for example during an election or without a majority of its nodes",
+		HTTPStatus:  503,
+		Example:     `{"error":"Service Unavailable","message":"The cluster has no leader","code":503,"db_code":"SY408"}`,
+	},
+	ErrCodeClusterMembership: {
+		Code:        ErrCodeClusterMembership,
+		Name:        "Cluster Membership Change Failed",
+		Description: "A node could not be added to or removed from the cluster",
+		HTTPStatus:  409,
+		Example:     `{"error":"Conflict","message":"Failed to add node","code":409,"db_code":"SY409"}`,
+	},
+	ErrCodeBackupInProgress: {
+		Code:        ErrCodeBackupInProgress,
+		Name:        "Backup In Progress",
+		Description: "The database cannot be restored or recovered while a backup streams from it, or backed up while it is being replaced",
+		HTTPStatus:  409,
+		Example:     `{"error":"Conflict","message":"A backup is streaming from the database","code":409,"db_code":"SY410"}`,
+	},
 }
 
 // GetHTTPStatusForErrorCode returns the appropriate HTTP status code for a SyncopateDB error code
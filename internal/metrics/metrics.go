@@ -0,0 +1,220 @@
+// Package metrics collects the Prometheus metrics of SyncopateDB
+// The collectors are shared by all parts of the process, the API serves them at /metrics
+package metrics
+
+import (
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const namespace = "syncopatedb"
+
+var (
+	// HTTPRequests counts the handled API requests by route, method and status code
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "API requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	// HTTPRequestDuration observes the latency of API requests by route, method and status code
+	HTTPRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of API requests by route, method and status code.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	// RateLimitRejections counts the requests rejected by the rate limiter
+	RateLimitRejections = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "rate_limit_rejections_total",
+		Help:      "Requests rejected by the rate limiter.",
+	})
+
+	// QueryDuration observes the latency of queries by entity type and filter operator
+	QueryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "query_duration_seconds",
+		Help:      "Latency of queries by entity type and filter operator, a query with several operators is observed once per operator.",
+		Buckets:   []float64{.0001, .0005, .001, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5},
+	}, []string{"entity_type", "operator"})
+
+	// WALWriteDuration observes how long writes to the WAL take, including the wait for their durability
+	WALWriteDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "wal_write_duration_seconds",
+		Help:      "Latency of WAL writes, including the wait for their durability.",
+		Buckets:   []float64{.00001, .00005, .0001, .0005, .001, .005, .01, .025, .05, .1, .25, 1},
+	})
+
+	// SnapshotDuration observes how long snapshots take
+	SnapshotDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "snapshot_duration_seconds",
+		Help:      "Duration of snapshots.",
+		Buckets:   prometheus.ExponentialBuckets(.01, 4, 8),
+	})
+
+	// SnapshotSize is the stored size of the last snapshot
+	SnapshotSize = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "snapshot_size_bytes",
+		Help:      "Stored size of the last snapshot.",
+	})
+
+	// SnapshotFailures counts the snapshots that failed
+	SnapshotFailures = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "snapshot_failures_total",
+		Help:      "Snapshots that failed.",
+	})
+
+	// GCRuns counts the Badger value log garbage collection runs by result
+	GCRuns = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "badger_gc_runs_total",
+		Help:      "Badger value log garbage collection runs by result (collected, nothing, error).",
+	}, []string{"result"})
+)
+
+// StorageSizer reports the on-disk size of the Badger LSM tree and value log
+type StorageSizer interface {
+	StorageSize() (lsm int64, vlog int64)
+}
+
+// NewRegistry creates a registry with the process-wide collectors, plus the Go runtime and process metrics
+func NewRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPRequestDuration,
+		RateLimitRejections,
+		QueryDuration,
+		WALWriteDuration,
+		SnapshotDuration,
+		SnapshotSize,
+		SnapshotFailures,
+		GCRuns,
+	)
+	return registry
+}
+
+// ObserveHTTPRequest records a handled API request
+func ObserveHTTPRequest(route, method string, code int, duration time.Duration) {
+	status := strconv.Itoa(code)
+	HTTPRequests.WithLabelValues(route, method, status).Inc()
+	HTTPRequestDuration.WithLabelValues(route, method, status).Observe(duration.Seconds())
+}
+
+// ObserveQuery records a query, once for each distinct filter operator it uses
+// Queries without filters are recorded with the operator "none"
+func ObserveQuery(entityType string, operators []string, duration time.Duration) {
+	if len(operators) == 0 {
+		QueryDuration.WithLabelValues(entityType, "none").Observe(duration.Seconds())
+		return
+	}
+
+	seen := make(map[string]bool, len(operators))
+	for _, operator := range operators {
+		if seen[operator] {
+			continue
+		}
+		seen[operator] = true
+		QueryDuration.WithLabelValues(entityType, operator).Observe(duration.Seconds())
+	}
+}
+
+// ObserveSnapshot records a snapshot attempt
+func ObserveSnapshot(duration time.Duration, size int64, err error) {
+	if err != nil {
+		SnapshotFailures.Inc()
+		return
+	}
+	SnapshotDuration.Observe(duration.Seconds())
+	SnapshotSize.Set(float64(size))
+}
+
+// ObserveGC records a value log garbage collection run, whose error tells whether anything was collected
+func ObserveGC(err error, nothingToDiscard bool) {
+	switch {
+	case err == nil:
+		GCRuns.WithLabelValues("collected").Inc()
+	case nothingToDiscard:
+		GCRuns.WithLabelValues("nothing").Inc()
+	default:
+		GCRuns.WithLabelValues("error").Inc()
+	}
+}
+
+// entityCollector reports the entity count of each entity type when scraped
+type entityCollector struct {
+	engine common.DatastoreEngine
+	desc   *prometheus.Desc
+}
+
+// NewEntityCollector creates a collector of the entity counts of a datastore
+func NewEntityCollector(engine common.DatastoreEngine) prometheus.Collector {
+	return &entityCollector{
+		engine: engine,
+		desc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "entities"),
+			"Entities by entity type.", []string{"entity_type"}, nil),
+	}
+}
+
+// Describe sends the descriptor of the entity counts
+func (c *entityCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect sends the current entity counts
+// The counts are maintained by the datastore and read under a single lock, no entity is read
+func (c *entityCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := c.engine.EntityCounts()
+	entityTypes := make([]string, 0, len(counts))
+	for entityType := range counts {
+		entityTypes = append(entityTypes, entityType)
+	}
+	sort.Strings(entityTypes)
+	for _, entityType := range entityTypes {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(counts[entityType]), entityType)
+	}
+}
+
+// storageCollector reports the Badger LSM tree and value log sizes when scraped
+type storageCollector struct {
+	sizer    StorageSizer
+	lsmDesc  *prometheus.Desc
+	vlogDesc *prometheus.Desc
+}
+
+// NewStorageCollector creates a collector of the on-disk Badger sizes
+func NewStorageCollector(sizer StorageSizer) prometheus.Collector {
+	return &storageCollector{
+		sizer: sizer,
+		lsmDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "badger", "lsm_size_bytes"),
+			"Size of the Badger LSM tree.", nil, nil),
+		vlogDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "badger", "vlog_size_bytes"),
+			"Size of the Badger value log.", nil, nil),
+	}
+}
+
+// Describe sends the descriptors of the storage sizes
+func (c *storageCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.lsmDesc
+	ch <- c.vlogDesc
+}
+
+// Collect sends the current storage sizes
+func (c *storageCollector) Collect(ch chan<- prometheus.Metric) {
+	lsm, vlog := c.sizer.StorageSize()
+	ch <- prometheus.MustNewConstMetric(c.lsmDesc, prometheus.GaugeValue, float64(lsm))
+	ch <- prometheus.MustNewConstMetric(c.vlogDesc, prometheus.GaugeValue, float64(vlog))
+}
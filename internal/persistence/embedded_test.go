@@ -1,12 +1,23 @@
 package persistence
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	stderrors "errors"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/dgraph-io/badger/v4"
 	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/datastore"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+	"github.com/phillarmonic/syncopate-db/internal/persistence/persistencetest"
 	"github.com/sirupsen/logrus"
 )
 
@@ -666,3 +677,2561 @@ func TestCompressionSettings(t *testing.T) {
 		}
 	})
 }
+
+// TestSchemaVersionRecovery tests that schema version history survives a restart
+func TestSchemaVersionRecovery(t *testing.T) {
+	// Create temporary directory for test
+	tempDir := t.TempDir()
+
+	// Setup logging
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	// Configure persistence
+	persistenceConfig := Config{
+		Path:             tempDir,
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		UseCompression:   false,
+		EnableAutoGC:     false,
+	}
+
+	// First session: Register and update a schema
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+
+		persistenceManager.SetEngine(db)
+
+		schema := common.EntityDefinition{
+			Name:        "versioned_products",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "name", Type: "string", Required: true},
+			},
+		}
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+
+		schema.Fields = append(schema.Fields, common.FieldDefinition{Name: "price", Type: "float"})
+		if err := db.UpdateEntityType(schema); err != nil {
+			t.Fatalf("Failed to update schema: %v", err)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: Verify the history was recovered
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager for recovery: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+
+		persistenceManager.SetEngine(db)
+
+		def, err := db.GetEntityDefinition("versioned_products")
+		if err != nil {
+			t.Fatalf("Failed to get recovered definition: %v", err)
+		}
+
+		if def.Version != 2 {
+			t.Errorf("Expected recovered definition at version 2, got %d", def.Version)
+		}
+
+		versions, err := db.GetSchemaVersions("versioned_products")
+		if err != nil {
+			t.Fatalf("Failed to get schema versions: %v", err)
+		}
+
+		if len(versions) != 2 {
+			t.Fatalf("Expected 2 recovered schema versions, got %d", len(versions))
+		}
+
+		if len(versions[0].Definition.Fields) >= len(versions[1].Definition.Fields) {
+			t.Errorf("Expected version 1 to have fewer fields than version 2")
+		}
+	}
+}
+
+// TestDropEntityTypeRecovery tests that a dropped entity type stays dropped after a restart
+func TestDropEntityTypeRecovery(t *testing.T) {
+	// Create temporary directory for test
+	tempDir := t.TempDir()
+
+	// Setup logging
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	// Configure persistence
+	persistenceConfig := Config{
+		Path:             tempDir,
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		UseCompression:   false,
+		EnableAutoGC:     false,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "dropped_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+		},
+	}
+
+	// First session: Create, fill, drop and recreate the entity type
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+
+		for _, name := range []string{"Alice", "Bob", "Charlie"} {
+			if err := db.Insert("dropped_users", "", map[string]interface{}{"name": name}); err != nil {
+				t.Fatalf("Failed to insert user: %v", err)
+			}
+		}
+
+		if err := db.DropEntityType("dropped_users"); err != nil {
+			t.Fatalf("Failed to drop entity type: %v", err)
+		}
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema again: %v", err)
+		}
+
+		if err := db.Insert("dropped_users", "", map[string]interface{}{"name": "Diana"}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: Only the recreated entity type should be recovered
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager for recovery: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+
+		persistenceManager.SetEngine(db)
+
+		users, err := db.GetAllEntitiesOfType("dropped_users")
+		if err != nil {
+			t.Fatalf("Failed to get recovered users: %v", err)
+		}
+
+		if len(users) != 1 || users[0].Fields["name"] != "Diana" {
+			t.Fatalf("Expected only Diana after recovery, got %v", users)
+		}
+
+		if users[0].ID != "1" {
+			t.Errorf("Expected Diana's ID to be '1', got '%s'", users[0].ID)
+		}
+	}
+}
+
+// TestFailedDropEntityType tests that an entity type whose drop cannot be written to the WAL
+// is still stored, and loads with its schema history after a restart
+func TestFailedDropEntityType(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	persistenceConfig := Config{
+		Path:             t.TempDir(),
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		EnableAutoGC:     false,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "kept_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+		},
+	}
+
+	// First session: The drop fails because the WAL cannot be committed
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+		for _, name := range []string{"Alice", "Bob", "Charlie"} {
+			if err := db.Insert("kept_users", "", map[string]interface{}{"name": name}); err != nil {
+				t.Fatalf("Failed to insert user: %v", err)
+			}
+		}
+		if err := db.Delete("kept_users", "3"); err != nil {
+			t.Fatalf("Failed to delete user: %v", err)
+		}
+
+		updated := schema
+		updated.Fields = append(append([]common.FieldDefinition(nil), schema.Fields...),
+			common.FieldDefinition{Name: "email", Type: "string", Nullable: true})
+		if err := db.UpdateEntityType(updated); err != nil {
+			t.Fatalf("Failed to update schema: %v", err)
+		}
+
+		// The snapshot replaces the WAL entries, the schema history and the counter are only kept in their own keys
+		if err := persistenceManager.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		pe := persistenceManager.GetPersistenceProvider().(*Engine)
+		pe.mu.Lock()
+		pe.closed = true
+		pe.mu.Unlock()
+		if err := db.DropEntityType("kept_users"); err == nil {
+			t.Fatal("Expected the drop to fail")
+		}
+		pe.mu.Lock()
+		pe.closed = false
+		pe.mu.Unlock()
+
+		if count, err := db.GetEntityCount("kept_users"); err != nil || count != 2 {
+			t.Fatalf("Expected the failed drop to keep 2 users, got %d: %v", count, err)
+		}
+
+		// Stop without the final snapshot of a clean shutdown, as a crash would
+		pe.Close()
+	}
+
+	// Second session: The entity type and its schema history are still stored
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager for recovery: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+
+		persistenceManager.SetEngine(db)
+
+		if count, err := db.GetEntityCount("kept_users"); err != nil || count != 2 {
+			t.Fatalf("Expected 2 users after recovery, got %d: %v", count, err)
+		}
+		if versions, err := db.GetSchemaVersions("kept_users"); err != nil || len(versions) != 2 {
+			t.Errorf("Expected the schema history of 2 versions to be kept, got %v: %v", versions, err)
+		}
+
+		if err := db.Insert("kept_users", "", map[string]interface{}{"name": "Diana"}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+		if _, err := db.GetByType("4", "kept_users"); err != nil {
+			t.Errorf("Expected the counter to be kept and the new user to get ID 4: %v", err)
+		}
+	}
+}
+
+// TestRenameAndCloneRecovery tests that renamed and cloned entity types survive a restart
+func TestRenameAndCloneRecovery(t *testing.T) {
+	// Create temporary directory for test
+	tempDir := t.TempDir()
+
+	// Setup logging
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	// Configure persistence
+	persistenceConfig := Config{
+		Path:             tempDir,
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		UseCompression:   false,
+		EnableAutoGC:     false,
+	}
+
+	// First session: Rename an entity type and clone it with its data
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+
+		persistenceManager.SetEngine(db)
+
+		schema := common.EntityDefinition{
+			Name:        "client",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "name", Type: "string", Required: true},
+			},
+		}
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+
+		invoiceSchema := common.EntityDefinition{
+			Name:        "invoice",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "client_id", Type: "integer", Required: true},
+			},
+			Relations: []common.RelationDefinition{
+				{Name: "client", EntityType: "client", Type: common.RelationOne, LocalField: "client_id"},
+			},
+		}
+
+		if err := db.RegisterEntityType(invoiceSchema); err != nil {
+			t.Fatalf("Failed to register invoice schema: %v", err)
+		}
+
+		for _, name := range []string{"Alice", "Bob"} {
+			if err := db.Insert("client", "", map[string]interface{}{"name": name}); err != nil {
+				t.Fatalf("Failed to insert client: %v", err)
+			}
+		}
+
+		if err := db.RenameEntityType("client", "customer"); err != nil {
+			t.Fatalf("Failed to rename entity type: %v", err)
+		}
+
+		if err := db.Insert("customer", "", map[string]interface{}{"name": "Charlie"}); err != nil {
+			t.Fatalf("Failed to insert customer: %v", err)
+		}
+
+		if err := db.CloneEntityType("customer", "customer_archive", true); err != nil {
+			t.Fatalf("Failed to clone entity type: %v", err)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: Verify both entity types were recovered
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager for recovery: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+
+		persistenceManager.SetEngine(db)
+
+		if _, err := db.GetEntityDefinition("client"); err == nil {
+			t.Error("Expected entity type 'client' to stay renamed after recovery")
+		}
+
+		invoiceDef, err := db.GetEntityDefinition("invoice")
+		if err != nil {
+			t.Fatalf("Failed to get invoice definition: %v", err)
+		}
+		if invoiceDef.Relations[0].EntityType != "customer" {
+			t.Errorf("Expected the invoice relation to refer to 'customer' after recovery, got %s", invoiceDef.Relations[0].EntityType)
+		}
+
+		for _, entityType := range []string{"customer", "customer_archive"} {
+			count, err := db.GetEntityCount(entityType)
+			if err != nil {
+				t.Fatalf("Failed to get count for %s: %v", entityType, err)
+			}
+			if count != 3 {
+				t.Errorf("Expected 3 entities in %s after recovery, got %d", entityType, count)
+			}
+
+			counter, err := db.GetAutoIncrementCounter(entityType)
+			if err != nil {
+				t.Fatalf("Failed to get auto-increment counter for %s: %v", entityType, err)
+			}
+			if counter < 3 {
+				t.Errorf("Expected auto-increment counter >= 3 for %s, got %d", entityType, counter)
+			}
+		}
+	}
+}
+
+// TestStreamBackupAndRestore tests restoring a streamed backup into a running engine
+func TestStreamBackupAndRestore(t *testing.T) {
+	// Create temporary directory for test
+	tempDir := t.TempDir()
+
+	// Setup logging
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	// Configure persistence
+	persistenceConfig := Config{
+		Path:             tempDir,
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		UseCompression:   false,
+		EnableAutoGC:     false,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "restored_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true, Unique: true},
+		},
+	}
+
+	// First session: Back up three users, then change the data and restore the backup
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+
+		for _, name := range []string{"Alice", "Bob", "Charlie"} {
+			if err := db.Insert("restored_users", "", map[string]interface{}{"name": name}); err != nil {
+				t.Fatalf("Failed to insert user: %v", err)
+			}
+		}
+
+		var backup bytes.Buffer
+		if err := persistenceManager.StreamBackup(&backup, common.BackupOptions{Compress: true}); err != nil {
+			t.Fatalf("Failed to stream backup: %v", err)
+		}
+
+		if !bytes.HasPrefix(backup.Bytes(), zstdMagic) {
+			t.Fatal("Expected a zstd-compressed backup")
+		}
+
+		// Changes after the backup must disappear with the restore
+		if err := db.Insert("restored_users", "", map[string]interface{}{"name": "Mallory"}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+		if err := db.Delete("restored_users", "1"); err != nil {
+			t.Fatalf("Failed to delete user: %v", err)
+		}
+		if err := db.RegisterEntityType(common.EntityDefinition{
+			Name:        "temporary",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "value", Type: "string"}},
+		}); err != nil {
+			t.Fatalf("Failed to register temporary schema: %v", err)
+		}
+
+		if err := persistenceManager.Restore(&backup, common.RestoreOptions{}); err != nil {
+			t.Fatalf("Failed to restore backup: %v", err)
+		}
+
+		if _, err := db.GetEntityDefinition("temporary"); err == nil {
+			t.Error("Entity type created after the backup should be gone after the restore")
+		}
+
+		users, err := db.GetAllEntitiesOfType("restored_users")
+		if err != nil {
+			t.Fatalf("Failed to get restored users: %v", err)
+		}
+		if len(users) != 3 {
+			t.Fatalf("Expected 3 users after restore, got %d", len(users))
+		}
+
+		// Unique indices are rebuilt, so Mallory can be inserted again and Alice cannot
+		if err := db.Insert("restored_users", "", map[string]interface{}{"name": "Alice"}); err == nil {
+			t.Error("Expected unique constraint violation for Alice after restore")
+		}
+		if err := db.Insert("restored_users", "", map[string]interface{}{"name": "Diana"}); err != nil {
+			t.Fatalf("Failed to insert user after restore: %v", err)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: The restored data and later changes survive a restart
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager for recovery: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+
+		persistenceManager.SetEngine(db)
+
+		users, err := db.GetAllEntitiesOfType("restored_users")
+		if err != nil {
+			t.Fatalf("Failed to get recovered users: %v", err)
+		}
+
+		names := make(map[string]bool)
+		for _, user := range users {
+			names[user.Fields["name"].(string)] = true
+		}
+
+		for _, name := range []string{"Alice", "Bob", "Charlie", "Diana"} {
+			if !names[name] {
+				t.Errorf("Expected %s to be recovered, got %v", name, names)
+			}
+		}
+		if names["Mallory"] || len(users) != 4 {
+			t.Errorf("Expected exactly the restored users and Diana, got %v", names)
+		}
+	}
+}
+
+// TestRestoreBackupRetention tests that restores keep a bounded number of replaced data directories,
+// and that restores discarding the replaced data keep none
+func TestRestoreBackupRetention(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	dataPath := filepath.Join(t.TempDir(), "data")
+	persistenceManager, err := NewManager(Config{
+		Path:                   dataPath,
+		CacheSize:              1000,
+		SyncWrites:             true,
+		SnapshotInterval:       1 * time.Minute,
+		Logger:                 logger,
+		RestoreBackupRetention: 2,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create persistence manager: %v", err)
+	}
+	defer persistenceManager.Close()
+
+	db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       persistenceManager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+	defer db.Close()
+
+	persistenceManager.SetEngine(db)
+
+	if err := db.RegisterEntityType(common.EntityDefinition{
+		Name:        "kept_notes",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "text", Type: "string"}},
+	}); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+
+	var backup bytes.Buffer
+	if err := persistenceManager.StreamBackup(&backup, common.BackupOptions{}); err != nil {
+		t.Fatalf("Failed to stream backup: %v", err)
+	}
+
+	restore := func(options common.RestoreOptions) []string {
+		if err := persistenceManager.Restore(bytes.NewReader(backup.Bytes()), options); err != nil {
+			t.Fatalf("Failed to restore backup: %v", err)
+		}
+		previous, err := filepath.Glob(dataPath + ".bak.*")
+		if err != nil {
+			t.Fatalf("Failed to list replaced data directories: %v", err)
+		}
+		return previous
+	}
+
+	var previous []string
+	for i := 0; i < 3; i++ {
+		previous = restore(common.RestoreOptions{})
+	}
+	if len(previous) != 2 {
+		t.Fatalf("Expected 2 replaced data directories to be kept, got %v", previous)
+	}
+
+	if discarded := restore(common.RestoreOptions{DiscardPrevious: true}); fmt.Sprint(discarded) != fmt.Sprint(previous) {
+		t.Errorf("Expected a discarding restore to keep no copy, got %v instead of %v", discarded, previous)
+	}
+
+	if _, err := db.GetEntityDefinition("kept_notes"); err != nil {
+		t.Errorf("Expected the restored entity type: %v", err)
+	}
+}
+
+// TestBackupView tests that a backup view streams the data as of when it was opened
+func TestBackupView(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	open := func(dir string) (*Manager, *datastore.Engine) {
+		manager, err := NewManager(Config{
+			Path:             dir,
+			CacheSize:        1000,
+			SyncWrites:       true,
+			SnapshotInterval: 1 * time.Minute,
+			Logger:           logger,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       manager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		manager.SetEngine(db)
+		return manager, db
+	}
+
+	manager, db := open(t.TempDir())
+	defer manager.Close()
+
+	if err := db.RegisterEntityType(common.EntityDefinition{
+		Name:        "viewed_users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+	}); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := db.Insert("viewed_users", "", map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	view, err := manager.ViewBackup()
+	if err != nil {
+		t.Fatalf("Failed to open backup view: %v", err)
+	}
+
+	// Writes after the view was opened are not part of it
+	if err := db.Insert("viewed_users", "", map[string]interface{}{"name": "Mallory"}); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	if err := db.Delete("viewed_users", "1"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	var backup bytes.Buffer
+	if err := manager.StreamBackupView(&backup, view, true); err != nil {
+		t.Fatalf("Failed to stream backup view: %v", err)
+	}
+	view.Close()
+
+	restored, restoredDB := open(t.TempDir())
+	defer restored.Close()
+	if err := restored.Restore(&backup, common.RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to restore backup view: %v", err)
+	}
+
+	if count, _ := restoredDB.GetEntityCount("viewed_users"); count != 2 {
+		t.Fatalf("Expected the 2 users of the view, got %d", count)
+	}
+	if _, err := restoredDB.GetByType("1", "viewed_users"); err != nil {
+		t.Fatalf("Expected the user deleted after the view was opened: %v", err)
+	}
+}
+
+// TestIncrementalBackupRestore tests applying an incremental backup on top of a restored full backup
+func TestIncrementalBackupRestore(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	newConfig := func(path string) Config {
+		return Config{
+			Path:             path,
+			CacheSize:        1000,
+			SyncWrites:       true,
+			SnapshotInterval: 1 * time.Minute,
+			Logger:           logger,
+			EnableAutoGC:     false,
+		}
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "inventory",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "sku", Type: "string", Required: true},
+		},
+	}
+
+	var full, incremental bytes.Buffer
+
+	// Source database: a full backup, then changes captured by an incremental backup
+	{
+		persistenceManager, err := NewManager(newConfig(t.TempDir()))
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+		for _, sku := range []string{"A-1", "A-2", "A-3"} {
+			if err := db.Insert("inventory", "", map[string]interface{}{"sku": sku}); err != nil {
+				t.Fatalf("Failed to insert item: %v", err)
+			}
+		}
+
+		version := persistenceManager.BackupVersion()
+		if err := persistenceManager.StreamBackup(&full, common.BackupOptions{}); err != nil {
+			t.Fatalf("Failed to stream full backup: %v", err)
+		}
+
+		if err := db.Insert("inventory", "", map[string]interface{}{"sku": "B-1"}); err != nil {
+			t.Fatalf("Failed to insert item: %v", err)
+		}
+		if err := db.Delete("inventory", "2"); err != nil {
+			t.Fatalf("Failed to delete item: %v", err)
+		}
+
+		if err := persistenceManager.StreamBackup(&incremental, common.BackupOptions{Since: version, Compress: true}); err != nil {
+			t.Fatalf("Failed to stream incremental backup: %v", err)
+		}
+		if incremental.Len() == 0 || incremental.Len() >= full.Len() {
+			t.Errorf("Expected the incremental backup to be smaller than the full one, got %d and %d bytes",
+				incremental.Len(), full.Len())
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Target database: restore the full backup, then apply the incremental one
+	persistenceManager, err := NewManager(newConfig(t.TempDir()))
+	if err != nil {
+		t.Fatalf("Failed to create persistence manager: %v", err)
+	}
+	defer persistenceManager.Close()
+
+	db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       persistenceManager.GetPersistenceProvider(),
+		EnablePersistence: true,
+	})
+	defer db.Close()
+	persistenceManager.SetEngine(db)
+
+	if err := persistenceManager.Restore(&full, common.RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to restore full backup: %v", err)
+	}
+	if count, _ := db.GetEntityCount("inventory"); count != 3 {
+		t.Fatalf("Expected 3 items after the full restore, got %d", count)
+	}
+
+	if err := persistenceManager.Restore(&incremental, common.RestoreOptions{Incremental: true}); err != nil {
+		t.Fatalf("Failed to restore incremental backup: %v", err)
+	}
+
+	items, err := db.GetAllEntitiesOfType("inventory")
+	if err != nil {
+		t.Fatalf("Failed to get items: %v", err)
+	}
+
+	skus := make(map[string]bool)
+	for _, item := range items {
+		skus[item.Fields["sku"].(string)] = true
+	}
+	if len(items) != 3 || !skus["A-1"] || skus["A-2"] || !skus["A-3"] || !skus["B-1"] {
+		t.Errorf("Expected A-1, A-3 and B-1 after the incremental restore, got %v", skus)
+	}
+}
+
+// TestPointInTimeRecovery tests recovering to just before an accidental truncate
+func TestPointInTimeRecovery(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	persistenceConfig := Config{
+		Path:                tempDir,
+		CacheSize:           1000,
+		SyncWrites:          true,
+		SnapshotInterval:    1 * time.Minute,
+		Logger:              logger,
+		EnableAutoGC:        false,
+		WALArchiveRetention: time.Hour,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "orders",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "number", Type: "string", Required: true},
+		},
+	}
+
+	var truncateSequence uint64
+
+	// First session: snapshot, more writes, an accidental truncate, then recovery
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+		for _, number := range []string{"1001", "1002", "1003"} {
+			if err := db.Insert("orders", "", map[string]interface{}{"number": number}); err != nil {
+				t.Fatalf("Failed to insert order: %v", err)
+			}
+		}
+
+		// The snapshot prunes the WAL entries so far into the archive
+		if err := persistenceManager.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		for _, number := range []string{"1004", "1005"} {
+			if err := db.Insert("orders", "", map[string]interface{}{"number": number}); err != nil {
+				t.Fatalf("Failed to insert order: %v", err)
+			}
+		}
+
+		beforeTruncate := time.Now()
+		time.Sleep(5 * time.Millisecond)
+
+		if err := db.TruncateDatabase(); err != nil {
+			t.Fatalf("Failed to truncate database: %v", err)
+		}
+		if err := db.Insert("orders", "", map[string]interface{}{"number": "2001"}); err != nil {
+			t.Fatalf("Failed to insert order: %v", err)
+		}
+
+		// A snapshot after the accident must not stop recovery to before it
+		if err := persistenceManager.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		entries, err := persistenceManager.ListWALEntries(0, 0)
+		if err != nil {
+			t.Fatalf("Failed to list WAL entries: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.Operation == "truncate_database" {
+				truncateSequence = entry.SequenceNum
+			}
+		}
+		if truncateSequence == 0 {
+			t.Fatalf("Expected the truncate in the WAL history, got %+v", entries)
+		}
+
+		if err := persistenceManager.Recover(common.RecoveryTarget{Time: beforeTruncate}); err != nil {
+			t.Fatalf("Failed to recover to time: %v", err)
+		}
+		if count, _ := db.GetEntityCount("orders"); count != 5 {
+			t.Errorf("Expected 5 orders after recovering to before the truncate, got %d", count)
+		}
+
+		// Moving forward again replays the truncate from the archive
+		if err := persistenceManager.Recover(common.RecoveryTarget{Sequence: truncateSequence}); err != nil {
+			t.Fatalf("Failed to recover to sequence: %v", err)
+		}
+		if count, _ := db.GetEntityCount("orders"); count != 0 {
+			t.Errorf("Expected 0 orders after recovering to the truncate, got %d", count)
+		}
+
+		if err := persistenceManager.Recover(common.RecoveryTarget{Sequence: truncateSequence - 1}); err != nil {
+			t.Fatalf("Failed to recover to sequence: %v", err)
+		}
+		if count, _ := db.GetEntityCount("orders"); count != 5 {
+			t.Errorf("Expected 5 orders after recovering to before the truncate, got %d", count)
+		}
+
+		// New writes continue after the recovered state
+		if err := db.Insert("orders", "", map[string]interface{}{"number": "1006"}); err != nil {
+			t.Fatalf("Failed to insert order after recovery: %v", err)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: The recovered state survives a restart and sequence numbers stay unique
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+		persistenceManager.SetEngine(db)
+
+		orders, err := db.GetAllEntitiesOfType("orders")
+		if err != nil {
+			t.Fatalf("Failed to get orders: %v", err)
+		}
+
+		numbers := make(map[string]bool)
+		for _, order := range orders {
+			numbers[order.Fields["number"].(string)] = true
+		}
+		for _, number := range []string{"1001", "1002", "1003", "1004", "1005", "1006"} {
+			if !numbers[number] {
+				t.Errorf("Expected order %s after restart, got %v", number, numbers)
+			}
+		}
+		if numbers["2001"] || len(orders) != 6 {
+			t.Errorf("Expected exactly the recovered orders and 1006, got %v", numbers)
+		}
+
+		if err := db.Insert("orders", "", map[string]interface{}{"number": "1007"}); err != nil {
+			t.Fatalf("Failed to insert order: %v", err)
+		}
+		entries, err := persistenceManager.ListWALEntries(0, 0)
+		if err != nil {
+			t.Fatalf("Failed to list WAL entries: %v", err)
+		}
+
+		seen := make(map[uint64]bool)
+		for _, entry := range entries {
+			if seen[entry.SequenceNum] {
+				t.Errorf("Sequence number %d was used twice", entry.SequenceNum)
+			}
+			seen[entry.SequenceNum] = true
+		}
+
+		last := entries[len(entries)-1]
+		if last.Operation != "insert" || last.Archived || last.SequenceNum <= truncateSequence {
+			t.Errorf("Expected the new insert to be numbered after all earlier entries, got %+v", last)
+		}
+	}
+}
+
+// TestScheduledSnapshotsAndWALPruning tests that the snapshot routine snapshots the attached
+// engine, keeps the configured number of snapshots and prunes the WAL they contain
+func TestScheduledSnapshotsAndWALPruning(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	persistenceConfig := Config{
+		Path:              tempDir,
+		CacheSize:         1000,
+		SyncWrites:        true,
+		SnapshotInterval:  1 * time.Minute,
+		Logger:            logger,
+		EnableAutoGC:      false,
+		SnapshotRetention: 2,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "events",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "name", Type: "string", Required: true},
+		},
+	}
+
+	snapshotStats := func(stats map[string]interface{}) (map[string]interface{}, map[string]interface{}, map[string]interface{}) {
+		snapshots, _ := stats["snapshots"].(map[string]interface{})
+		wal, _ := stats["wal"].(map[string]interface{})
+		routine, _ := stats["snapshot_routine"].(map[string]interface{})
+		if snapshots == nil || wal == nil || routine == nil {
+			t.Fatalf("Expected snapshot, WAL and routine statistics, got %v", stats)
+		}
+		return snapshots, wal, routine
+	}
+
+	// First session: scheduled snapshots prune the WAL
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+
+		// Write in rounds, each followed by a scheduled snapshot
+		for round := 0; round < 3; round++ {
+			for i := 0; i < 5; i++ {
+				if err := db.Insert("events", "", map[string]interface{}{"name": fmt.Sprintf("event-%d-%d", round, i)}); err != nil {
+					t.Fatalf("Failed to insert event: %v", err)
+				}
+			}
+			persistenceManager.persistence.runScheduledSnapshot()
+		}
+
+		snapshots, wal, routine := snapshotStats(persistenceManager.GetStorageStats())
+		if routine["taken"] != 3 {
+			t.Errorf("Expected 3 scheduled snapshots, got %v", routine["taken"])
+		}
+		if snapshots["count"] != 2 {
+			t.Errorf("Expected 2 retained snapshots, got %v", snapshots["count"])
+		}
+		if routine["removed_snapshots"].(int) < 1 || routine["pruned_wal_entries"].(int) < 1 {
+			t.Errorf("Expected old snapshots and WAL entries to be removed, got %v", routine)
+		}
+
+		// The WAL holds only the entries written after the oldest retained snapshot
+		if live := wal["live_entries"].(int); live != 5 {
+			t.Errorf("Expected the 5 entries after the oldest retained snapshot in the WAL, got %d", live)
+		}
+		if wal["archived_entries"] != 0 {
+			t.Errorf("Expected no archived entries without archiving, got %v", wal["archived_entries"])
+		}
+
+		// Without changes, the routine skips snapshots
+		persistenceManager.persistence.runScheduledSnapshot()
+		_, _, routine = snapshotStats(persistenceManager.GetStorageStats())
+		if routine["skipped"].(int) == 0 {
+			t.Errorf("Expected unchanged intervals to be skipped, got %v", routine)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: the latest snapshot and the remaining WAL restore every event once
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		defer db.Close()
+		persistenceManager.SetEngine(db)
+
+		events, err := db.GetAllEntitiesOfType("events")
+		if err != nil {
+			t.Fatalf("Failed to get events: %v", err)
+		}
+		if len(events) != 15 {
+			t.Errorf("Expected 15 events after restart, got %d", len(events))
+		}
+
+		if err := db.Insert("events", "", map[string]interface{}{"name": "after-restart"}); err != nil {
+			t.Fatalf("Failed to insert event after restart: %v", err)
+		}
+		if count, _ := db.GetEntityCount("events"); count != 16 {
+			t.Errorf("Expected 16 events, got %d", count)
+		}
+	}
+}
+
+// TestChunkedSnapshots tests that snapshots are written as checksummed per-type chunks
+// while writes continue, and loaded back from them
+func TestChunkedSnapshots(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	persistenceConfig := Config{
+		Path:              tempDir,
+		CacheSize:         1000,
+		SyncWrites:        true,
+		SnapshotInterval:  1 * time.Minute,
+		Logger:            logger,
+		EnableAutoGC:      false,
+		SnapshotRetention: 1,
+		SnapshotChunkSize: 4,
+	}
+
+	schemas := []common.EntityDefinition{
+		{
+			Name:        "users",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "name", Type: "string", Required: true},
+			},
+		},
+		{
+			Name:        "tags",
+			IDGenerator: common.IDTypeUUID,
+			Fields: []common.FieldDefinition{
+				{Name: "label", Type: "string"},
+			},
+		},
+	}
+
+	countChunks := func(pe *Engine) int {
+		count := 0
+		if err := pe.db.View(func(txn *badger.Txn) error {
+			count = countKeys(txn, snapshotChunkPrefix)
+			return nil
+		}); err != nil {
+			t.Fatalf("Failed to count snapshot chunks: %v", err)
+		}
+		return count
+	}
+
+	// First session: snapshots taken while another goroutine keeps writing
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		for _, schema := range schemas {
+			if err := db.RegisterEntityType(schema); err != nil {
+				t.Fatalf("Failed to register schema: %v", err)
+			}
+		}
+		for i := 0; i < 10; i++ {
+			if err := db.Insert("users", "", map[string]interface{}{"name": fmt.Sprintf("user-%d", i)}); err != nil {
+				t.Fatalf("Failed to insert user: %v", err)
+			}
+		}
+
+		if err := persistenceManager.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		// 10 users in chunks of 4, and no chunk for the empty type
+		if chunks := countChunks(persistenceManager.persistence); chunks != 3 {
+			t.Errorf("Expected 3 snapshot chunks, got %d", chunks)
+		}
+
+		done := make(chan error)
+		go func() {
+			for i := 10; i < 60; i++ {
+				if err := db.Insert("users", "", map[string]interface{}{"name": fmt.Sprintf("user-%d", i)}); err != nil {
+					done <- err
+					return
+				}
+			}
+			done <- nil
+		}()
+
+		for i := 0; i < 5; i++ {
+			if err := persistenceManager.ForceSnapshot(); err != nil {
+				t.Fatalf("Failed to take snapshot during writes: %v", err)
+			}
+		}
+		if err := <-done; err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+
+		// Only the chunks of the retained snapshot are kept
+		if err := persistenceManager.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		if chunks := countChunks(persistenceManager.persistence); chunks != 15 {
+			t.Errorf("Expected the 15 chunks of the retained snapshot, got %d", chunks)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// Second session: every entity is loaded back from the chunks
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		if count, _ := db.GetEntityCount("users"); count != 60 {
+			t.Errorf("Expected 60 users after restart, got %d", count)
+		}
+		if _, err := db.GetEntityDefinition("tags"); err != nil {
+			t.Errorf("Expected the empty entity type to be restored: %v", err)
+		}
+
+		db.Close()
+		persistenceManager.Close()
+	}
+
+	// A corrupted chunk fails the snapshot load instead of loading partial data
+	{
+		pe, err := NewPersistenceEngine(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to open persistence engine: %v", err)
+		}
+		defer pe.Close()
+
+		err = pe.db.Update(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(snapshotChunkPrefix)
+			it := txn.NewIterator(opts)
+			it.Rewind()
+			key := it.Item().KeyCopy(nil)
+			value, err := it.Item().ValueCopy(nil)
+			it.Close()
+			if err != nil {
+				return err
+			}
+			value[len(value)-1] ^= 0xff
+			return txn.Set(key, value)
+		})
+		if err != nil {
+			t.Fatalf("Failed to corrupt snapshot chunk: %v", err)
+		}
+
+		err = pe.LoadLatestSnapshot(datastore.NewDataStoreEngine())
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("Expected a checksum error, got %v", err)
+		}
+	}
+}
+
+// TestFormatVerifyAndUpgrade tests that data written in the first on-disk format is read,
+// reported by the verification and rewritten in the current format by the upgrade
+func TestFormatVerifyAndUpgrade(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel) // Reduce noise in tests
+
+	persistenceConfig := Config{
+		Path:             tempDir,
+		CacheSize:        1000,
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		EnableAutoGC:     false,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "notes",
+		IDGenerator: common.IDTypeCustom,
+		Fields: []common.FieldDefinition{
+			{Name: "text", Type: "string"},
+		},
+	}
+
+	openStore := func() (*Manager, *datastore.Engine) {
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+		return persistenceManager, db
+	}
+
+	// Write a single-value snapshot and a bare WAL entry, as the first format did
+	{
+		pe, err := NewPersistenceEngine(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to open persistence engine: %v", err)
+		}
+
+		var snapshot bytes.Buffer
+		enc := gob.NewEncoder(&snapshot)
+		enc.Encode(1)
+		enc.Encode(schema)
+		enc.Encode(1)
+		enc.Encode(common.Entity{ID: "a", Type: "notes", Fields: map[string]interface{}{"text": "from snapshot"}})
+
+		var fields bytes.Buffer
+		gob.NewEncoder(&fields).Encode(map[string]interface{}{"text": "from WAL"})
+		var entry bytes.Buffer
+		gob.NewEncoder(&entry).Encode(WALEntry{
+			Timestamp:   time.Now().UnixNano(),
+			SequenceNum: 2,
+			Operation:   OpInsertEntity,
+			EntityType:  "notes",
+			EntityID:    "b",
+			Data:        pe.Compress(fields.Bytes()),
+		})
+
+		latest := make([]byte, 8)
+		binary.LittleEndian.PutUint64(latest, 1000)
+
+		err = pe.db.Update(func(txn *badger.Txn) error {
+			txn.Delete([]byte(formatVersionKey))
+			txn.Set([]byte("snapshot:1000"), pe.Compress(snapshot.Bytes()))
+			txn.Set([]byte(snapshotSequencePrefix+"1000"), encodeSequence(1))
+			txn.Set([]byte("latest_snapshot"), latest)
+			return txn.Set([]byte(fmt.Sprintf("wal:%020d:notes:b", 2)), entry.Bytes())
+		})
+		if err != nil {
+			t.Fatalf("Failed to write old format data: %v", err)
+		}
+		pe.Close()
+	}
+
+	checkNotes := func(db *datastore.Engine) {
+		for id, text := range map[string]string{"a": "from snapshot", "b": "from WAL"} {
+			note, err := db.GetByType(id, "notes")
+			if err != nil {
+				t.Errorf("Expected note %s to be loaded: %v", id, err)
+				continue
+			}
+			if note.Fields["text"] != text {
+				t.Errorf("Expected note %s to read %q, got %v", id, text, note.Fields["text"])
+			}
+		}
+	}
+
+	// The old format is read, reported, then upgraded
+	{
+		persistenceManager, db := openStore()
+		checkNotes(db)
+
+		report, err := persistenceManager.VerifyFormat()
+		if err != nil {
+			t.Fatalf("Failed to verify format: %v", err)
+		}
+		if !report.NeedsUpgrade() || report.DirectoryVersion != 0 || report.Snapshots[1] != 1 || report.WALEntries[1] != 1 {
+			t.Errorf("Expected one version 1 snapshot and WAL entry, got %+v", report)
+		}
+
+		applied, err := persistenceManager.UpgradeFormat()
+		if err != nil {
+			t.Fatalf("Failed to upgrade format: %v", err)
+		}
+		if len(applied) != 2 {
+			t.Errorf("Expected the snapshot and WAL migrations to run, got %v", applied)
+		}
+
+		report, err = persistenceManager.VerifyFormat()
+		if err != nil {
+			t.Fatalf("Failed to verify format: %v", err)
+		}
+		if report.NeedsUpgrade() || report.Snapshots[FormatVersion] != 1 || report.WALEntries[FormatVersion] != 1 || len(report.Problems) > 0 {
+			t.Errorf("Expected everything in format version %d after the upgrade, got %+v", FormatVersion, report)
+		}
+
+		// Running the upgrade again has nothing left to convert
+		if applied, err := persistenceManager.UpgradeFormat(); err != nil || len(applied) != 0 {
+			t.Errorf("Expected a second upgrade to do nothing, got %v, %v", applied, err)
+		}
+
+		persistenceManager.Close()
+	}
+
+	// The upgraded data loads the same
+	{
+		persistenceManager, db := openStore()
+		checkNotes(db)
+		persistenceManager.Close()
+	}
+
+	// Data written by a newer build is refused
+	{
+		pe, err := NewPersistenceEngine(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to open persistence engine: %v", err)
+		}
+		if err := pe.db.Update(func(txn *badger.Txn) error {
+			return txn.Set([]byte(formatVersionKey), encodeSequence(FormatVersion+1))
+		}); err != nil {
+			t.Fatalf("Failed to write format version: %v", err)
+		}
+		pe.Close()
+
+		if _, err := NewPersistenceEngine(persistenceConfig); err == nil || !strings.Contains(err.Error(), "format version") {
+			t.Errorf("Expected a newer format version to be refused, got %v", err)
+		}
+	}
+}
+
+// TestIntegrityCheckAndRepair tests that damage left by an interrupted write is reported
+// with SY403 codes and repaired from the last intact snapshot plus the WAL
+func TestIntegrityCheckAndRepair(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel) // The damaged snapshot is logged while loading
+
+	persistenceConfig := Config{
+		Path:              tempDir,
+		CacheSize:         1000,
+		SyncWrites:        true,
+		SnapshotInterval:  1 * time.Minute,
+		Logger:            logger,
+		EnableAutoGC:      false,
+		SnapshotRetention: 2,
+	}
+
+	schema := common.EntityDefinition{
+		Name:        "items",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields: []common.FieldDefinition{
+			{Name: "sku", Type: "string", Required: true, Unique: true, Indexed: true},
+		},
+	}
+
+	openStore := func() (*Manager, *datastore.Engine) {
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		return persistenceManager, db
+	}
+
+	insertItems := func(db *datastore.Engine, from, to int) {
+		for i := from; i <= to; i++ {
+			if err := db.Insert("items", "", map[string]interface{}{"sku": fmt.Sprintf("SKU-%d", i)}); err != nil {
+				t.Fatalf("Failed to insert item: %v", err)
+			}
+		}
+	}
+
+	// First session: two snapshots and a few more writes, then damage as a crash would leave it
+	{
+		persistenceManager, db := openStore()
+
+		if err := db.RegisterEntityType(schema); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+		insertItems(db, 1, 5)
+		if err := db.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		insertItems(db, 6, 7)
+		if err := db.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		insertItems(db, 8, 8)
+
+		pe := persistenceManager.persistence
+		snapshots, err := pe.listSnapshots()
+		if err != nil || len(snapshots) != 2 {
+			t.Fatalf("Expected 2 snapshots, got %v, %v", snapshots, err)
+		}
+		latest := snapshots[1].timestamp
+
+		var deletedIDs bytes.Buffer
+		gob.NewEncoder(&deletedIDs).Encode(map[string]bool{"7": true})
+
+		err = pe.db.Update(func(txn *badger.Txn) error {
+			// A torn write in the latest snapshot
+			item, err := txn.Get(snapshotChunkKey(latest, 0, 0))
+			if err != nil {
+				return err
+			}
+			chunk, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			chunk[len(chunk)-1] ^= 0xff
+			txn.Set(snapshotChunkKey(latest, 0, 0), chunk)
+
+			// Chunks of a snapshot whose manifest was never written
+			txn.Set(snapshotChunkKey(42, 0, 0), []byte("partial"))
+
+			// A second entry reusing the last sequence number
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte("wal:")
+			opts.Reverse = true
+			it := txn.NewIterator(opts)
+			it.Seek([]byte("wal:~"))
+			lastKey := it.Item().KeyCopy(nil)
+			lastValue, err := it.Item().ValueCopy(nil)
+			it.Close()
+			if err != nil {
+				return err
+			}
+			sequence, _ := parseWALKeySequence(lastKey, "wal:")
+			txn.Set([]byte(fmt.Sprintf("wal:%020d:items:999", sequence)), lastValue)
+
+			// A transaction that never got its last entry
+			orphan, err := encodeWALEntry(WALEntry{
+				Timestamp:     time.Now().UnixNano(),
+				SequenceNum:   sequence + 1,
+				TransactionID: "interrupted",
+				Operation:     OpDeleteEntity,
+				EntityType:    "items",
+				EntityID:      "1",
+			})
+			if err != nil {
+				return err
+			}
+			txn.Set([]byte(fmt.Sprintf("wal:%020d:items:1", sequence+1)), orphan)
+
+			// A counter and deleted IDs that were not saved after the last inserts
+			txn.Set([]byte("counter:items"), encodeSequence(3))
+			return txn.Set([]byte("deleted_ids:items"), pe.Compress(deletedIDs.Bytes()))
+		})
+		if err != nil {
+			t.Fatalf("Failed to damage data directory: %v", err)
+		}
+
+		persistenceManager.Close()
+	}
+
+	// Second session: the check reports every problem, the repair fixes them
+	{
+		persistenceManager, db := openStore()
+
+		issues, err := persistenceManager.CheckIntegrity(db)
+		if err != nil {
+			t.Fatalf("Failed to check integrity: %v", err)
+		}
+
+		var messages []string
+		for _, issue := range issues {
+			if !errors.IsErrorCode(issue, errors.ErrCodeDatabaseCorruption) {
+				t.Errorf("Expected an SY403 issue, got %v", issue)
+			}
+			messages = append(messages, issue.Error())
+		}
+		report := strings.Join(messages, "\n")
+		for _, expected := range []string{"is damaged", "snapshot 42, which does not exist", "is used by both",
+			"never completed", "below the highest ID 8", "include existing entities 7"} {
+			if !strings.Contains(report, expected) {
+				t.Errorf("Expected an issue containing %q, got:\n%s", expected, report)
+			}
+		}
+
+		actions, err := persistenceManager.Repair(db)
+		if err != nil {
+			t.Fatalf("Failed to repair: %v (%v)", err, actions)
+		}
+		if len(actions) == 0 {
+			t.Error("Expected the repair to report its changes")
+		}
+
+		issues, err = persistenceManager.CheckIntegrity(db)
+		if err != nil || len(issues) > 0 {
+			t.Errorf("Expected no issues after the repair, got %v, %v", issues, err)
+		}
+		if count, _ := db.GetEntityCount("items"); count != 8 {
+			t.Errorf("Expected 8 items after the repair, got %d", count)
+		}
+
+		persistenceManager.Close()
+	}
+
+	// Third session: the repaired directory loads cleanly and keeps numbering after the highest ID
+	{
+		persistenceManager, db := openStore()
+		defer persistenceManager.Close()
+
+		issues, err := persistenceManager.CheckIntegrity(db)
+		if err != nil || len(issues) > 0 {
+			t.Errorf("Expected no issues after reopening, got %v, %v", issues, err)
+		}
+
+		insertItems(db, 9, 9)
+		if _, err := db.GetByType("9", "items"); err != nil {
+			t.Errorf("Expected the next item to get ID 9: %v", err)
+		}
+	}
+}
+
+// TestEncryptionKeyRotation tests loading encryption keys and re-encrypting a data directory
+func TestEncryptionKeyRotation(t *testing.T) {
+	tempDir := t.TempDir()
+	dataDir := tempDir + "/data"
+
+	oldKey := bytes.Repeat([]byte{0x11}, 32)
+	newKey := bytes.Repeat([]byte{0x22}, 16)
+
+	// Keys may be hex or base64 encoded, or raw bytes
+	keyFile := tempDir + "/key.hex"
+	if err := os.WriteFile(keyFile, []byte(fmt.Sprintf("%x\n", oldKey)), 0600); err != nil {
+		t.Fatalf("Failed to write key file: %v", err)
+	}
+	key, err := LoadEncryptionKey(keyFile, "ignored")
+	if err != nil || !bytes.Equal(key, oldKey) {
+		t.Fatalf("Expected the hex key from the file, got %x, %v", key, err)
+	}
+	if key, err := LoadEncryptionKey("", "IiIiIiIiIiIiIiIiIiIiIg=="); err != nil || !bytes.Equal(key, newKey) {
+		t.Fatalf("Expected the base64 key, got %x, %v", key, err)
+	}
+	if key, err := ParseEncryptionKey(newKey); err != nil || !bytes.Equal(key, newKey) {
+		t.Fatalf("Expected the raw key, got %x, %v", key, err)
+	}
+	if key, err := LoadEncryptionKey("", ""); err != nil || key != nil {
+		t.Fatalf("Expected no key, got %x, %v", key, err)
+	}
+	if _, err := ParseEncryptionKey([]byte("too short")); err == nil {
+		t.Fatal("Expected an error for a key of invalid length")
+	}
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel) // Opening with the wrong key is logged by Badger
+
+	persistenceConfig := Config{
+		Path:          dataDir,
+		CacheSize:     100,
+		SyncWrites:    true,
+		Logger:        logger,
+		EncryptionKey: oldKey,
+	}
+
+	openStore := func(config Config) (*Manager, *datastore.Engine) {
+		persistenceManager, err := NewManager(config)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		return persistenceManager, db
+	}
+
+	{
+		persistenceManager, db := openStore(persistenceConfig)
+		if got := persistenceManager.persistence.badgerOptions.IndexCacheSize; got != DefaultIndexCacheSize {
+			t.Errorf("Expected the default index cache size for an encrypted database, got %d", got)
+		}
+
+		if err := db.RegisterEntityType(common.EntityDefinition{
+			Name:        "secrets",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "value", Type: "string"}},
+		}); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+		for i := 0; i < 3; i++ {
+			if err := db.Insert("secrets", "", map[string]interface{}{"value": fmt.Sprintf("secret-%d", i)}); err != nil {
+				t.Fatalf("Failed to insert entity: %v", err)
+			}
+		}
+		persistenceManager.Close()
+	}
+
+	if _, err := RotateEncryptionKey(dataDir, newKey, oldKey, false, logger); err == nil {
+		t.Fatal("Expected rotation with the wrong current key to fail")
+	}
+
+	// The data encrypted with the retired key is kept only when asked for
+	previousPath, err := RotateEncryptionKey(dataDir, oldKey, newKey, true, logger)
+	if err != nil {
+		t.Fatalf("Failed to rotate encryption key: %v", err)
+	}
+	if _, err := os.Stat(previousPath); err != nil {
+		t.Errorf("Expected the previous data directory to be kept: %v", err)
+	}
+	if previousPath, err = RotateEncryptionKey(dataDir, newKey, oldKey, false, logger); err != nil || previousPath != "" {
+		t.Fatalf("Failed to rotate encryption key back, got %q, %v", previousPath, err)
+	}
+	if previousPath, err = RotateEncryptionKey(dataDir, oldKey, newKey, false, logger); err != nil || previousPath != "" {
+		t.Fatalf("Failed to rotate encryption key again, got %q, %v", previousPath, err)
+	}
+	if kept, _ := filepath.Glob(filepath.Clean(dataDir) + ".bak.*"); len(kept) != 1 {
+		t.Errorf("Expected only the copy asked for to be kept, got %v", kept)
+	}
+
+	if _, err := NewManager(persistenceConfig); err == nil {
+		t.Fatal("Expected the old key to be rejected after rotation")
+	}
+
+	persistenceConfig.EncryptionKey = newKey
+	persistenceManager, db := openStore(persistenceConfig)
+	defer persistenceManager.Close()
+
+	count, err := db.GetEntityCount("secrets")
+	if err != nil || count != 3 {
+		t.Fatalf("Expected 3 entities after rotation, got %d, %v", count, err)
+	}
+	entity, err := db.GetByType("2", "secrets")
+	if err != nil || entity.Fields["value"] != "secret-1" {
+		t.Fatalf("Expected entity 2 to survive the rotation, got %v, %v", entity, err)
+	}
+}
+
+// TestLazyEntityStorage tests keeping entity bodies on disk with only a small hot set in memory
+func TestLazyEntityStorage(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	persistenceConfig := Config{
+		Path:             tempDir,
+		CacheSize:        50, // Far fewer than the stored entities
+		SyncWrites:       true,
+		SnapshotInterval: 1 * time.Minute,
+		Logger:           logger,
+		EnableAutoGC:     false,
+	}
+
+	openStore := func() (*Manager, *datastore.Engine) {
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+			LazyEntities:      true,
+		})
+		return persistenceManager, db
+	}
+
+	const total = 2500
+
+	verify := func(persistenceManager *Manager, db *datastore.Engine) {
+		t.Helper()
+
+		count, err := db.GetEntityCount("orders")
+		if err != nil || count != total-10 {
+			t.Fatalf("Expected %d orders, got %d, %v", total-10, count, err)
+		}
+
+		entity, err := db.GetByType("7", "orders")
+		if err != nil || entity.Fields["status"] != "shipped" {
+			t.Fatalf("Expected order 7 to be shipped, got %v, %v", entity, err)
+		}
+		if _, err := db.GetByType("3", "orders"); err == nil {
+			t.Error("Expected deleted order 3 to be gone")
+		}
+
+		// Unique constraints are checked against the in-memory indices
+		if err := db.Insert("orders", "", map[string]interface{}{"ref": "REF-42", "status": "new", "total": 1}); err == nil {
+			t.Error("Expected a unique constraint violation")
+		}
+
+		results, err := datastore.NewQueryService(db).Query(datastore.QueryOptions{
+			EntityType: "orders",
+			Filters:    []datastore.Filter{{Field: "status", Operator: datastore.FilterEq, Value: "shipped"}},
+			OrderBy:    "total",
+		})
+		if err != nil || len(results) != 5 {
+			t.Fatalf("Expected 5 shipped orders, got %d, %v", len(results), err)
+		}
+
+		if issues := db.CheckIntegrity(); len(issues) != 0 {
+			t.Fatalf("Expected no integrity issues, got %v", issues)
+		}
+
+		if cached := persistenceManager.persistence.entityCache.Len(); cached > persistenceConfig.CacheSize {
+			t.Errorf("Expected at most %d cached entities, got %d", persistenceConfig.CacheSize, cached)
+		}
+	}
+
+	{
+		persistenceManager, db := openStore()
+
+		if err := db.RegisterEntityType(common.EntityDefinition{
+			Name:        "orders",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields: []common.FieldDefinition{
+				{Name: "ref", Type: "string", Unique: true},
+				{Name: "status", Type: "string", Indexed: true},
+				{Name: "total", Type: "integer"},
+			},
+		}); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+
+		for i := 1; i <= total; i++ {
+			if err := db.Insert("orders", "", map[string]interface{}{
+				"ref":    fmt.Sprintf("REF-%d", i),
+				"status": "new",
+				"total":  i,
+			}); err != nil {
+				t.Fatalf("Failed to insert order: %v", err)
+			}
+		}
+		for i := 5; i <= 9; i++ {
+			if err := db.Update("orders", fmt.Sprint(i), map[string]interface{}{"status": "shipped"}); err != nil {
+				t.Fatalf("Failed to update order: %v", err)
+			}
+		}
+		for i := 1; i <= 4; i++ {
+			if err := db.Delete("orders", fmt.Sprint(i)); err != nil {
+				t.Fatalf("Failed to delete order: %v", err)
+			}
+		}
+		for i := total - 5; i <= total; i++ {
+			if err := db.Delete("orders", fmt.Sprint(i)); err != nil {
+				t.Fatalf("Failed to delete order: %v", err)
+			}
+		}
+
+		verify(persistenceManager, db)
+
+		// Bodies that left the write buffer live in Badger
+		var stored int
+		persistenceManager.persistence.db.View(func(txn *badger.Txn) error {
+			stored = countKeys(txn, entityBodyPrefix)
+			return nil
+		})
+		if stored < total-1000-10 {
+			t.Errorf("Expected most entity bodies to be stored on disk, got %d", stored)
+		}
+
+		if err := db.ForceSnapshot(); err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+		persistenceManager.Close()
+	}
+
+	bodyVersion := func(pe *Engine, entityType, id string) uint64 {
+		t.Helper()
+		var version uint64
+		if err := pe.db.View(func(txn *badger.Txn) error {
+			item, err := txn.Get([]byte(entityBodyKey(entityType, id)))
+			if err != nil {
+				return err
+			}
+			version = item.Version()
+			return nil
+		}); err != nil {
+			t.Fatalf("Failed to read the body of %s %s: %v", entityType, id, err)
+		}
+		return version
+	}
+
+	// Leave a body of an entity that does not exist behind, as a crash between writes could
+	var unchangedVersion uint64
+	{
+		pe, err := NewPersistenceEngine(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to open persistence engine: %v", err)
+		}
+		unchangedVersion = bodyVersion(pe, "orders", "100")
+		if err := pe.WriteEntityBodies([]common.Entity{{ID: "stale", Type: "orders", Fields: map[string]interface{}{}}}, nil); err != nil {
+			t.Fatalf("Failed to write a stale body: %v", err)
+		}
+		pe.Close()
+	}
+
+	// The stored bodies are reconciled with the snapshot on the next start
+	persistenceManager, db := openStore()
+	defer persistenceManager.Close()
+	verify(persistenceManager, db)
+
+	if version := bodyVersion(persistenceManager.persistence, "orders", "100"); version != unchangedVersion {
+		t.Errorf("Expected the unchanged body of order 100 to be kept, its version went from %d to %d", unchangedVersion, version)
+	}
+	persistenceManager.persistence.db.View(func(txn *badger.Txn) error {
+		if _, err := txn.Get([]byte(entityBodyKey("orders", "stale"))); err != badger.ErrKeyNotFound {
+			t.Errorf("Expected the stale body to be removed, got %v", err)
+		}
+		return nil
+	})
+
+	// Snapshots read the bodies from a view of the body store while writes go on
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 200; i++ {
+			if err := db.Update("orders", fmt.Sprint(20+i), map[string]interface{}{"total": -i}); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	if err := db.ForceSnapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot during writes: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Failed to update order: %v", err)
+	}
+
+	restored := datastore.NewDataStoreEngine()
+	if err := persistenceManager.persistence.LoadLatestSnapshot(restored); err != nil {
+		t.Fatalf("Failed to load snapshot: %v", err)
+	}
+	if count, err := restored.GetEntityCount("orders"); err != nil || count != total-10 {
+		t.Errorf("Expected %d orders in the snapshot, got %d, %v", total-10, count, err)
+	}
+	if entity, err := restored.GetByType("7", "orders"); err != nil || entity.Fields["status"] != "shipped" {
+		t.Errorf("Expected order 7 to be shipped in the snapshot, got %v, %v", entity, err)
+	}
+}
+
+// TestProviderConformance runs the shared persistence provider conformance suite against both storage backends
+func TestProviderConformance(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	t.Run("Badger", func(t *testing.T) {
+		persistencetest.Run(t, func(t *testing.T, dir string) common.PersistenceProvider {
+			engine, err := NewPersistenceEngine(Config{
+				Path:              dir,
+				CacheSize:         1000,
+				SyncWrites:        true,
+				Logger:            logger,
+				SnapshotRetention: 3,
+				SnapshotChunkSize: DefaultSnapshotChunkSize,
+			})
+			if err != nil {
+				t.Fatalf("Failed to open Badger engine: %v", err)
+			}
+			return engine
+		})
+	})
+
+	t.Run("File", func(t *testing.T) {
+		persistencetest.Run(t, func(t *testing.T, dir string) common.PersistenceProvider {
+			engine, err := NewFileEngine(FileConfig{Path: dir, SyncWrites: true, Logger: logger})
+			if err != nil {
+				t.Fatalf("Failed to open file engine: %v", err)
+			}
+			return engine
+		})
+	})
+}
+
+// TestFileEngineIncompleteRecord tests that a record cut short by a crash is dropped and the log stays writable
+func TestFileEngineIncompleteRecord(t *testing.T) {
+	tempDir := t.TempDir()
+
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	openStore := func() (*FileEngine, *datastore.Engine) {
+		engine, err := NewFileEngine(FileConfig{Path: tempDir, SyncWrites: true, Logger: logger})
+		if err != nil {
+			t.Fatalf("Failed to open file engine: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       engine,
+			EnablePersistence: true,
+		})
+		return engine, db
+	}
+
+	engine, db := openStore()
+	if err := db.RegisterEntityType(common.EntityDefinition{
+		Name:        "events",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string"}},
+	}); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+	for i := 1; i <= 3; i++ {
+		if err := db.Insert("events", "", map[string]interface{}{"name": fmt.Sprintf("event-%d", i)}); err != nil {
+			t.Fatalf("Failed to insert event: %v", err)
+		}
+	}
+	engine.Close()
+
+	// Simulate a crash in the middle of appending a record
+	segments, err := engine.listSegments()
+	if err != nil || len(segments) != 1 {
+		t.Fatalf("Expected one log segment, got %v, %v", segments, err)
+	}
+	frame, err := encodeFileRecord(fileRecord{Sequence: 1000, Operation: OpDeleteEntity, EntityType: "events", EntityID: "1"})
+	if err != nil {
+		t.Fatalf("Failed to encode record: %v", err)
+	}
+	file, err := os.OpenFile(segments[0], os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Failed to open log segment: %v", err)
+	}
+	file.Write(frame[:len(frame)-3])
+	file.Close()
+
+	engine, db = openStore()
+	if count, _ := db.GetEntityCount("events"); count != 3 {
+		t.Fatalf("Expected 3 events after dropping the incomplete record, got %d", count)
+	}
+	if err := db.Insert("events", "", map[string]interface{}{"name": "event-4"}); err != nil {
+		t.Fatalf("Failed to insert event: %v", err)
+	}
+	engine.Close()
+
+	// Records appended after the dropped one are read back
+	engine, db = openStore()
+	defer engine.Close()
+	if count, _ := db.GetEntityCount("events"); count != 4 {
+		t.Fatalf("Expected 4 events, got %d", count)
+	}
+}
+
+// TestGroupCommitter tests that concurrent writers share commits and learn about failed ones
+func TestGroupCommitter(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	var mu sync.Mutex
+	commits := 0
+	var commitErr error
+	committer := newGroupCommitter(20*time.Millisecond, func() error {
+		mu.Lock()
+		defer mu.Unlock()
+		commits++
+		return commitErr
+	}, logger)
+	defer committer.close()
+
+	// Group writers wait for the same interval and share its commit
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := committer.wait(common.DurabilityGroup); err != nil {
+				t.Errorf("Expected group commit to succeed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	mu.Lock()
+	if commits == 0 || commits >= 20 {
+		t.Fatalf("Expected 20 group writers to share commits, got %d commits", commits)
+	}
+	commits = 0
+	commitErr = fmt.Errorf("disk full")
+	mu.Unlock()
+
+	// Async writers return at once, sync writers learn about the failed commit
+	if err := committer.wait(common.DurabilityAsync); err != nil {
+		t.Fatalf("Expected async write to return without error: %v", err)
+	}
+	if err := committer.wait(common.DurabilitySync); err == nil {
+		t.Fatal("Expected sync write to report the failed commit")
+	}
+
+	// Writes after close are committed by the writer
+	committer.close()
+	mu.Lock()
+	commits = 0
+	commitErr = nil
+	mu.Unlock()
+	if err := committer.wait(common.DurabilityAsync); err != nil {
+		t.Fatalf("Expected write after close to commit: %v", err)
+	}
+	if commits != 1 {
+		t.Fatalf("Expected the write after close to commit once, got %d commits", commits)
+	}
+}
+
+// TestFailedWALCommit tests that a failed group commit keeps acknowledged async entries
+// for the next commit and drops the entries of writers that received the error
+func TestFailedWALCommit(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	pe, err := NewPersistenceEngine(Config{
+		Path:                t.TempDir(),
+		CacheSize:           1000,
+		Logger:              logger,
+		SnapshotRetention:   3,
+		SnapshotChunkSize:   DefaultSnapshotChunkSize,
+		GroupCommitInterval: time.Hour,
+	})
+	if err != nil {
+		t.Fatalf("Failed to create persistence engine: %v", err)
+	}
+	defer pe.Close()
+
+	if err := pe.writeWALEntry(OpDeleteEntity, "items", "1", nil, common.DurabilityAsync); err != nil {
+		t.Fatalf("Expected async write to return without error: %v", err)
+	}
+
+	// Fail the next commit
+	pe.mu.Lock()
+	pe.closed = true
+	pe.mu.Unlock()
+	if err := pe.writeWALEntry(OpDeleteEntity, "items", "2", nil, common.DurabilitySync); err == nil {
+		t.Fatal("Expected sync write to report the failed commit")
+	}
+	pe.mu.Lock()
+	pe.closed = false
+	pe.mu.Unlock()
+
+	if err := pe.commitWAL(); err != nil {
+		t.Fatalf("Failed to commit WAL: %v", err)
+	}
+
+	var keys []string
+	err = pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = []byte("wal:")
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, string(it.Item().Key()))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Failed to read WAL: %v", err)
+	}
+	if len(keys) != 1 || !strings.HasSuffix(keys[0], ":items:1") {
+		t.Fatalf("Expected only the async entry to be committed, got %v", keys)
+	}
+}
+
+// TestSnapshotDuringFailedCommit tests that a snapshot taken while a write waits for its
+// group commit does not contain the write when the commit fails
+func TestSnapshotDuringFailedCommit(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.FatalLevel)
+
+	persistenceConfig := Config{
+		Path:                t.TempDir(),
+		CacheSize:           1000,
+		SnapshotInterval:    1 * time.Minute,
+		Logger:              logger,
+		Durability:          common.DurabilityGroup,
+		GroupCommitInterval: 5 * time.Millisecond,
+	}
+
+	// First session: The insert is applied in memory, then its commit fails while a snapshot waits
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		if err := db.RegisterEntityType(common.EntityDefinition{
+			Name:        "pending_users",
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+		}); err != nil {
+			t.Fatalf("Failed to register schema: %v", err)
+		}
+		if err := db.InsertWithOptions("pending_users", "", map[string]interface{}{"name": "Alice"},
+			common.WriteOptions{Durability: common.DurabilitySync}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+
+		// The next group commit fails once it is released
+		pe := persistenceManager.GetPersistenceProvider().(*Engine)
+		release := make(chan struct{})
+		pe.commits.close()
+		pe.commits = newGroupCommitter(time.Hour, func() error {
+			<-release
+			pe.walSeqMutex.Lock()
+			pe.walBuffer = nil
+			pe.walSeqMutex.Unlock()
+			return fmt.Errorf("disk full")
+		}, logger)
+
+		inserted := make(chan error, 1)
+		go func() {
+			inserted <- db.InsertWithOptions("pending_users", "", map[string]interface{}{"name": "Bob"},
+				common.WriteOptions{Durability: common.DurabilitySync})
+		}()
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			if _, err := db.GetByType("2", "pending_users"); err == nil {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("The insert was not applied in memory")
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+
+		snapshotted := make(chan error, 1)
+		go func() { snapshotted <- persistenceManager.ForceSnapshot() }()
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+
+		if err := <-inserted; err == nil {
+			t.Fatal("Expected the insert to report the failed commit")
+		}
+		if err := <-snapshotted; err != nil {
+			t.Fatalf("Failed to take snapshot: %v", err)
+		}
+
+		// Stop without the final snapshot of a clean shutdown, as a crash would
+		pe.Close()
+	}
+
+	// Second session: Only the committed user is stored
+	{
+		persistenceManager, err := NewManager(persistenceConfig)
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager for recovery: %v", err)
+		}
+		defer persistenceManager.Close()
+
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       persistenceManager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		persistenceManager.SetEngine(db)
+
+		if count, err := db.GetEntityCount("pending_users"); err != nil || count != 1 {
+			t.Fatalf("Expected only the committed user after recovery, got %d: %v", count, err)
+		}
+	}
+}
+
+// TestWriteDurability tests the durability levels and per-write overrides of both storage backends
+func TestWriteDurability(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	backends := map[string]func(dir string, durability common.Durability) (common.PersistenceProvider, error){
+		"Badger": func(dir string, durability common.Durability) (common.PersistenceProvider, error) {
+			return NewPersistenceEngine(Config{
+				Path:                dir,
+				CacheSize:           1000,
+				Logger:              logger,
+				SnapshotRetention:   3,
+				SnapshotChunkSize:   DefaultSnapshotChunkSize,
+				Durability:          durability,
+				GroupCommitInterval: 5 * time.Millisecond,
+			})
+		},
+		"File": func(dir string, durability common.Durability) (common.PersistenceProvider, error) {
+			return NewFileEngine(FileConfig{
+				Path:                dir,
+				Logger:              logger,
+				Durability:          durability,
+				GroupCommitInterval: 5 * time.Millisecond,
+			})
+		},
+	}
+
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			tempDir := t.TempDir()
+
+			if _, err := open(t.TempDir(), "eventual"); err == nil {
+				t.Fatal("Expected an unknown durability to be rejected")
+			}
+
+			provider, err := open(tempDir, common.DurabilityGroup)
+			if err != nil {
+				t.Fatalf("Failed to open provider: %v", err)
+			}
+			db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+				Persistence:       provider,
+				EnablePersistence: true,
+			})
+
+			if err := db.RegisterEntityType(common.EntityDefinition{
+				Name:        "events",
+				IDGenerator: common.IDTypeAutoIncrement,
+				Fields:      []common.FieldDefinition{{Name: "name", Type: "string"}},
+			}); err != nil {
+				t.Fatalf("Failed to register schema: %v", err)
+			}
+
+			// Concurrent writers with the default group durability
+			var wg sync.WaitGroup
+			for i := 1; i <= 20; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					if err := db.Insert("events", "", map[string]interface{}{"name": fmt.Sprintf("event-%d", i)}); err != nil {
+						t.Errorf("Failed to insert event: %v", err)
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			// Writes can ask for other durabilities
+			if err := db.InsertWithOptions("events", "", map[string]interface{}{"name": "sync"},
+				common.WriteOptions{Durability: common.DurabilitySync}); err != nil {
+				t.Fatalf("Failed to insert with sync durability: %v", err)
+			}
+			if err := db.UpdateWithOptions("events", "1", map[string]interface{}{"name": "async"},
+				common.WriteOptions{Durability: common.DurabilityAsync}); err != nil {
+				t.Fatalf("Failed to update with async durability: %v", err)
+			}
+			if err := db.DeleteWithOptions("events", "2", common.WriteOptions{Durability: common.DurabilitySync}); err != nil {
+				t.Fatalf("Failed to delete with sync durability: %v", err)
+			}
+
+			// An unknown durability fails the write and leaves the store unchanged
+			if err := db.InsertWithOptions("events", "", map[string]interface{}{"name": "invalid"},
+				common.WriteOptions{Durability: "eventual"}); err == nil {
+				t.Fatal("Expected a write with an unknown durability to fail")
+			}
+			if count, _ := db.GetEntityCount("events"); count != 20 {
+				t.Fatalf("Expected 20 events, got %d", count)
+			}
+
+			// Closing commits the async write
+			if err := provider.Close(); err != nil {
+				t.Fatalf("Failed to close provider: %v", err)
+			}
+
+			provider, err = open(tempDir, common.DurabilityAsync)
+			if err != nil {
+				t.Fatalf("Failed to reopen provider: %v", err)
+			}
+			defer provider.Close()
+			db = datastore.NewDataStoreEngine(datastore.EngineConfig{
+				Persistence:       provider,
+				EnablePersistence: true,
+			})
+
+			if count, _ := db.GetEntityCount("events"); count != 20 {
+				t.Fatalf("Expected 20 events after reopening, got %d", count)
+			}
+			entity, err := db.GetByType("1", "events")
+			if err != nil || entity.Fields["name"] != "async" {
+				t.Fatalf("Expected the async update to survive a clean shutdown, got %v, %v", entity.Fields, err)
+			}
+			if _, err := db.GetByType("2", "events"); err == nil {
+				t.Fatal("Expected deleted event 2 to stay deleted")
+			}
+		})
+	}
+}
+
+func TestReplication(t *testing.T) {
+	logger := logrus.New()
+	logger.SetLevel(logrus.ErrorLevel)
+
+	open := func(dir string) (*Manager, *datastore.Engine) {
+		manager, err := NewManager(Config{
+			Path:             dir,
+			CacheSize:        1000,
+			SyncWrites:       true,
+			SnapshotInterval: 1 * time.Minute,
+			Logger:           logger,
+		})
+		if err != nil {
+			t.Fatalf("Failed to create persistence manager: %v", err)
+		}
+		db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+			Persistence:       manager.GetPersistenceProvider(),
+			EnablePersistence: true,
+		})
+		manager.SetEngine(db)
+		return manager, db
+	}
+
+	primary, primaryDB := open(t.TempDir())
+	defer primary.Close()
+	replica, replicaDB := open(t.TempDir())
+	defer replica.Close()
+
+	if err := primaryDB.RegisterEntityType(common.EntityDefinition{
+		Name:        "users",
+		IDGenerator: common.IDTypeAutoIncrement,
+		Fields:      []common.FieldDefinition{{Name: "name", Type: "string", Required: true}},
+	}); err != nil {
+		t.Fatalf("Failed to register schema: %v", err)
+	}
+	for _, name := range []string{"Alice", "Bob"} {
+		if err := primaryDB.Insert("users", "", map[string]interface{}{"name": name}); err != nil {
+			t.Fatalf("Failed to insert user: %v", err)
+		}
+	}
+
+	// A database that never followed a primary has no position
+	if position, err := replica.ReplicaPosition(); err != nil || position.HistoryID != "" {
+		t.Fatalf("Expected an empty replica position, got %+v, %v", position, err)
+	}
+
+	// Bootstrap the replica from a snapshot taken after the position was read
+	position, err := primary.ReplicationPosition()
+	if err != nil {
+		t.Fatalf("Failed to read replication position: %v", err)
+	}
+	if position.HistoryID == "" || position.Sequence == 0 {
+		t.Fatalf("Expected a history ID and sequence number, got %+v", position)
+	}
+	var snapshot bytes.Buffer
+	if err := primary.StreamBackup(&snapshot, common.BackupOptions{Compress: true}); err != nil {
+		t.Fatalf("Failed to stream snapshot: %v", err)
+	}
+	if err := replica.BootstrapReplica(&snapshot, position); err != nil {
+		t.Fatalf("Failed to bootstrap replica: %v", err)
+	}
+	if count, _ := replicaDB.GetEntityCount("users"); count != 2 {
+		t.Fatalf("Expected 2 users on the bootstrapped replica, got %d", count)
+	}
+
+	// Stream the writes made on the primary afterwards
+	if err := primaryDB.Insert("users", "", map[string]interface{}{"name": "Charlie"}); err != nil {
+		t.Fatalf("Failed to insert user: %v", err)
+	}
+	if err := primaryDB.Update("users", "1", map[string]interface{}{"name": "Alicia"}); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if err := primaryDB.Delete("users", "2"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+
+	replicaPosition, err := replica.ReplicaPosition()
+	if err != nil || replicaPosition != position {
+		t.Fatalf("Expected the replica at %+v, got %+v, %v", position, replicaPosition, err)
+	}
+
+	// Small batches, the last one is applied twice as after a crash before the position was saved
+	var batch *common.ReplicationBatch
+	for {
+		batch, err = primary.ReplicationEntries(replicaPosition, 2)
+		if err != nil {
+			t.Fatalf("Failed to read replication entries: %v", err)
+		}
+		if len(batch.Entries) == 0 {
+			break
+		}
+		if batch.Entries[0].SequenceNum != replicaPosition.Sequence+1 {
+			t.Fatalf("Expected entries after %d, got %d", replicaPosition.Sequence, batch.Entries[0].SequenceNum)
+		}
+		if err := replica.ApplyReplicationBatch(batch); err != nil {
+			t.Fatalf("Failed to apply batch: %v", err)
+		}
+		last := *batch
+		if err := replica.ApplyReplicationBatch(&last); err != nil {
+			t.Fatalf("Failed to apply batch again: %v", err)
+		}
+		if replicaPosition, err = replica.ReplicaPosition(); err != nil {
+			t.Fatalf("Failed to read replica position: %v", err)
+		}
+	}
+	if replicaPosition.Sequence != batch.Position.Sequence {
+		t.Fatalf("Expected the replica caught up at %d, got %d", batch.Position.Sequence, replicaPosition.Sequence)
+	}
+
+	if count, _ := replicaDB.GetEntityCount("users"); count != 2 {
+		t.Fatalf("Expected 2 users on the replica, got %d", count)
+	}
+	if entity, err := replicaDB.GetByType("1", "users"); err != nil || entity.Fields["name"] != "Alicia" {
+		t.Fatalf("Expected the replicated update, got %v, %v", entity, err)
+	}
+	if _, err := replicaDB.GetByType("2", "users"); err == nil {
+		t.Fatal("Expected the replicated delete")
+	}
+
+	// An entry that cannot be applied stops the batch before it and asks for a new snapshot
+	broken := &common.ReplicationBatch{
+		Position: batch.Position,
+		Entries: []common.ReplicationEntry{
+			{SequenceNum: replicaPosition.Sequence + 1, Operation: OpDeleteEntity, EntityType: "users", EntityID: "3"},
+			{SequenceNum: replicaPosition.Sequence + 2, Operation: OpInsertEntity, EntityType: "users", EntityID: "4", Data: []byte("not gob")},
+			{SequenceNum: replicaPosition.Sequence + 3, Operation: OpDeleteEntity, EntityType: "users", EntityID: "1"},
+		},
+	}
+	if err := replica.ApplyReplicationBatch(broken); !stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+		t.Fatalf("Expected a failed entry to require a snapshot, got %v", err)
+	}
+	if position, err := replica.ReplicaPosition(); err != nil || position.Sequence != replicaPosition.Sequence+1 {
+		t.Fatalf("Expected the replica position before the failed entry, got %+v, %v", position, err)
+	}
+	if _, err := replicaDB.GetByType("1", "users"); err != nil {
+		t.Fatalf("Expected the entries after the failed one to be skipped, got %v", err)
+	}
+
+	// Positions outside the current history need a new snapshot
+	if _, err := primary.ReplicationEntries(common.ReplicationPosition{HistoryID: "other", Sequence: 1}, 10); !stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+		t.Fatalf("Expected a snapshot to be required for another history, got %v", err)
+	}
+	ahead := common.ReplicationPosition{HistoryID: replicaPosition.HistoryID, Sequence: replicaPosition.Sequence + 100}
+	if _, err := primary.ReplicationEntries(ahead, 10); !stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+		t.Fatalf("Expected a snapshot to be required for a position ahead of the primary, got %v", err)
+	}
+
+	// A restore rewrites the history of the primary
+	var backup bytes.Buffer
+	if err := primary.StreamBackup(&backup, common.BackupOptions{}); err != nil {
+		t.Fatalf("Failed to stream backup: %v", err)
+	}
+	if err := primary.Restore(&backup, common.RestoreOptions{}); err != nil {
+		t.Fatalf("Failed to restore backup: %v", err)
+	}
+	if _, err := primary.ReplicationEntries(replicaPosition, 10); !stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+		t.Fatalf("Expected a snapshot to be required after a restore, got %v", err)
+	}
+}
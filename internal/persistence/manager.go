@@ -1,9 +1,13 @@
 package persistence
 
 import (
+	"fmt"
+	"io"
 	"sync"
 	"time"
 
+	"github.com/klauspost/compress/zstd"
+
 	"github.com/phillarmonic/syncopate-db/internal/common"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
 	"github.com/sirupsen/logrus"
@@ -56,6 +60,9 @@ func (m *Manager) SetEngine(engine common.DatastoreEngine) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	m.engine = engine
+
+	// The snapshot routine snapshots this engine from now on
+	m.persistence.setSnapshotStore(engine)
 }
 
 // Engine returns the datastore engine
@@ -188,6 +195,11 @@ func (m *Manager) runGarbageCollectionCycle() {
 	}
 }
 
+// StorageSize returns the size of the LSM tree and the value log in bytes
+func (m *Manager) StorageSize() (int64, int64) {
+	return m.persistence.StorageSize()
+}
+
 // SetSnapshotInterval changes the snapshot interval
 func (m *Manager) SetSnapshotInterval(interval time.Duration) {
 	m.persistence.snapshotInterval = interval
@@ -246,14 +258,118 @@ func (m *Manager) GetStorageStats() map[string]interface{} {
 		stats["value_log_files_count"] = valueLogFiles
 	}
 
+	// Add snapshot, WAL and snapshot routine statistics
+	if snapshotStats, err := m.persistence.SnapshotStats(); err == nil {
+		for key, value := range snapshotStats {
+			stats[key] = value
+		}
+	}
+
 	return stats
 }
 
-// Backup creates a backup of the database to the specified writer
+// Backup creates a backup of the database at the specified path
 func (m *Manager) Backup(path string) error {
 	return m.persistence.createBackup(path)
 }
 
+// StreamBackup writes a backup of the database to the specified writer, optionally zstd-compressed
+// A Since version limits the backup to the changes made after that version
+func (m *Manager) StreamBackup(w io.Writer, options common.BackupOptions) error {
+	return writeBackup(w, options.Compress, func(w io.Writer) error {
+		return m.persistence.StreamBackup(w, options.Since)
+	})
+}
+
+// ViewBackup opens a point-in-time view of the database, for a full backup streamed later
+// The view has to be closed, restores and closing the database wait for it
+func (m *Manager) ViewBackup() (*BackupView, error) {
+	return m.persistence.ViewBackup()
+}
+
+// StreamBackupView streams a backup view, compressed with zstd if compress is set
+func (m *Manager) StreamBackupView(w io.Writer, view *BackupView, compress bool) error {
+	return writeBackup(w, compress, view.StreamBackup)
+}
+
+// writeBackup runs a backup writer, compressing its output with zstd if compress is set
+func writeBackup(w io.Writer, compress bool, write func(w io.Writer) error) error {
+	if !compress {
+		return write(w)
+	}
+
+	encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		return fmt.Errorf("failed to create backup compressor: %w", err)
+	}
+
+	if err := write(encoder); err != nil {
+		encoder.Close()
+		return err
+	}
+
+	return encoder.Close()
+}
+
+// BackupVersion returns the version a backup started now covers, to be used as the
+// Since version of the next incremental backup
+func (m *Manager) BackupVersion() uint64 {
+	return m.persistence.BackupVersion()
+}
+
+// Restore replaces the database with a backup stream and rebuilds the in-memory state of the engine
+func (m *Manager) Restore(r io.Reader, options common.RestoreOptions) error {
+	m.mu.RLock()
+	engine := m.engine
+	m.mu.RUnlock()
+
+	if engine == nil {
+		return fmt.Errorf("cannot restore before the datastore engine is set")
+	}
+
+	return m.persistence.Restore(engine, r, options)
+}
+
+// Recover rewinds the database to a point in its WAL history and rebuilds the in-memory state of the engine
+func (m *Manager) Recover(target common.RecoveryTarget) error {
+	m.mu.RLock()
+	engine := m.engine
+	m.mu.RUnlock()
+
+	if engine == nil {
+		return fmt.Errorf("cannot recover before the datastore engine is set")
+	}
+
+	return m.persistence.RecoverToPoint(engine, target)
+}
+
+// ListWALEntries lists live and archived WAL entries after a sequence number, oldest first
+func (m *Manager) ListWALEntries(afterSequence uint64, limit int) ([]common.WALRecord, error) {
+	return m.persistence.ListWALEntries(afterSequence, limit)
+}
+
+// VerifyFormat reads every WAL entry and snapshot and reports their on-disk format versions
+func (m *Manager) VerifyFormat() (*FormatReport, error) {
+	return m.persistence.VerifyFormat()
+}
+
+// UpgradeFormat rewrites all records in the current on-disk format version
+func (m *Manager) UpgradeFormat() ([]string, error) {
+	return m.persistence.UpgradeFormat()
+}
+
+// CheckIntegrity validates the data directory and its consistency with a loaded store
+// Inconsistencies are returned as SY403 errors
+func (m *Manager) CheckIntegrity(store common.DatastoreEngine) ([]error, error) {
+	return m.persistence.CheckIntegrity(store)
+}
+
+// Repair rebuilds the data directory from the last intact snapshot plus the WAL and
+// reloads the store from it
+func (m *Manager) Repair(store common.DatastoreEngine) ([]string, error) {
+	return m.persistence.Repair(store)
+}
+
 // RunCompaction forces compaction of the LSM tree
 func (m *Manager) RunCompaction() error {
 	// In Badger v4, we can use Flatten() directly without checking for disabled compaction
@@ -264,3 +380,45 @@ func (m *Manager) RunCompaction() error {
 func (m *Manager) GetPersistenceProvider() common.PersistenceProvider {
 	return m.persistence
 }
+
+// ReplicationPosition returns the latest durable position in the WAL history, for replicas to start from
+func (m *Manager) ReplicationPosition() (common.ReplicationPosition, error) {
+	return m.persistence.ReplicationPosition()
+}
+
+// ReplicationEntries returns up to limit WAL entries after a replica's position, oldest first
+func (m *Manager) ReplicationEntries(after common.ReplicationPosition, limit int) (*common.ReplicationBatch, error) {
+	return m.persistence.ReplicationEntries(after, limit)
+}
+
+// ReplicaPosition returns the position in its primary's WAL history this database has applied
+func (m *Manager) ReplicaPosition() (common.ReplicationPosition, error) {
+	return m.persistence.ReplicaPosition()
+}
+
+// ApplyReplicationBatch applies WAL entries shipped by the primary to the engine
+// It returns common.ErrReplicaSnapshotRequired if an entry could not be applied
+func (m *Manager) ApplyReplicationBatch(batch *common.ReplicationBatch) error {
+	m.mu.RLock()
+	engine := m.engine
+	m.mu.RUnlock()
+
+	if engine == nil {
+		return fmt.Errorf("cannot replicate before the datastore engine is set")
+	}
+
+	return m.persistence.ApplyReplicationBatch(engine, batch)
+}
+
+// BootstrapReplica replaces the database with a snapshot of the primary and rebuilds the in-memory state of the engine
+func (m *Manager) BootstrapReplica(r io.Reader, position common.ReplicationPosition) error {
+	m.mu.RLock()
+	engine := m.engine
+	m.mu.RUnlock()
+
+	if engine == nil {
+		return fmt.Errorf("cannot bootstrap before the datastore engine is set")
+	}
+
+	return m.persistence.BootstrapReplica(engine, r, position)
+}
@@ -2,13 +2,14 @@ package persistence
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,13 +19,17 @@ import (
 	"github.com/dgraph-io/badger/v4"
 	"github.com/klauspost/compress/zstd"
 	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
 	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 // Engine implements disk persistence for the datastore
 type Engine struct {
 	db               *badger.DB
 	path             string
+	badgerOptions    badger.Options // Options used to (re)open the database
 	compressor       *zstd.Encoder
 	decompressor     *zstd.Decoder
 	entityCache      *LRUCache
@@ -40,6 +45,20 @@ type Engine struct {
 	currentTxns      map[string]*Transaction
 	closed           bool // Flag to track if engine is closed
 	txnMu            sync.Mutex
+	walArchiveTTL    time.Duration // How long pruned WAL entries are archived, 0 deletes them
+	restoreBackups   int           // Number of data directories replaced by restores that are kept
+
+	snapshotMu          sync.Mutex             // Serializes snapshots with restores and recoveries
+	snapshotStore       common.DatastoreEngine // Store snapshotted by the snapshot routine
+	snapshotRetention   int                    // Number of snapshots kept
+	snapshotChunkSize   int                    // Number of entities per snapshot chunk
+	replayAfterSequence uint64                 // Last WAL sequence number contained in the loaded snapshot
+	statsMu             sync.Mutex
+	stats               snapshotStats
+
+	durability common.Durability  // Durability of writes that do not request one
+	commits    *groupCommitter    // Commits buffered WAL entries
+	walBuffer  []bufferedWALEntry // WAL entries waiting for the next commit, guarded by walSeqMutex
 }
 
 // Config holds configuration for the persistence engine
@@ -53,6 +72,21 @@ type Config struct {
 	EnableAutoGC     bool
 	GCInterval       time.Duration
 	UseCompression   bool
+	// WALArchiveRetention keeps pruned WAL entries for point-in-time recovery, 0 disables archiving
+	WALArchiveRetention time.Duration
+	// SnapshotRetention is the number of snapshots kept, the WAL is pruned up to the oldest one
+	SnapshotRetention int
+	// SnapshotChunkSize is the number of entities stored per snapshot chunk
+	SnapshotChunkSize int
+	// IndexCacheSize is the Badger index cache size in bytes, 0 uses DefaultIndexCacheSize when encrypted
+	IndexCacheSize int64
+	// Durability is the default durability of entity writes, empty means sync
+	Durability common.Durability
+	// GroupCommitInterval is the time between group commits, 0 uses DefaultGroupCommitInterval
+	GroupCommitInterval time.Duration
+	// RestoreBackupRetention is the number of data directories replaced by restores that are kept
+	// next to the data path, the oldest are removed. 0 uses DefaultRestoreBackupRetention
+	RestoreBackupRetention int
 }
 
 func init() {
@@ -66,14 +100,19 @@ func init() {
 // DefaultConfig returns a default configuration
 func DefaultConfig() Config {
 	return Config{
-		Path:             "./data",
-		CacheSize:        10000,
-		SyncWrites:       true,
-		SnapshotInterval: 10 * time.Minute,
-		Logger:           logrus.New(),
-		EnableAutoGC:     true,
-		GCInterval:       5 * time.Minute,
-		UseCompression:   settings.Config.EnableZSTD, // Get from settings
+		Path:                   "./data",
+		CacheSize:              10000,
+		SyncWrites:             true,
+		SnapshotInterval:       10 * time.Minute,
+		Logger:                 logrus.New(),
+		EnableAutoGC:           true,
+		GCInterval:             5 * time.Minute,
+		UseCompression:         settings.Config.EnableZSTD, // Get from settings
+		WALArchiveRetention:    7 * 24 * time.Hour,
+		SnapshotRetention:      3,
+		SnapshotChunkSize:      DefaultSnapshotChunkSize,
+		GroupCommitInterval:    DefaultGroupCommitInterval,
+		RestoreBackupRetention: DefaultRestoreBackupRetention,
 	}
 }
 
@@ -84,16 +123,23 @@ func NewPersistenceEngine(config Config) (*Engine, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
+	// The file persistence engine keeps its own files, and the two formats cannot share a directory
+	if isFileEngineDirectory(config.Path) {
+		return nil, fmt.Errorf("data directory %s holds data of the file storage backend", config.Path)
+	}
+
+	durability, err := resolveDurability(config.Durability)
+	if err != nil {
+		return nil, err
+	}
+
 	// Initialize Badger DB
 	badgerOpts := badger.DefaultOptions(config.Path).
 		WithSyncWrites(config.SyncWrites).
 		WithLogger(config.Logger)
 
-	// Add encryption if key is provided
-	if len(config.EncryptionKey) > 0 {
-		badgerOpts = badgerOpts.
-			WithEncryptionKey(config.EncryptionKey)
-	}
+	// Add encryption if key is provided, with an index cache so reads do not decrypt table indices
+	badgerOpts = withEncryption(badgerOpts, config.EncryptionKey, config.IndexCacheSize)
 
 	db, err := badger.Open(badgerOpts)
 
@@ -126,20 +172,41 @@ func NewPersistenceEngine(config Config) (*Engine, error) {
 	}
 
 	engine := &Engine{
-		db:               db,
-		path:             config.Path,
-		compressor:       compressor,
-		decompressor:     decompressor,
-		entityCache:      NewLRUCache(config.CacheSize),
-		logger:           config.Logger,
-		syncWAL:          config.SyncWrites,
-		snapshotInterval: config.SnapshotInterval,
-		stopSnapshot:     make(chan struct{}),
-		useCompression:   useCompression,
-		walSequence:      0, // Initialize sequence counter
-		currentTxns:      make(map[string]*Transaction),
+		db:                db,
+		path:              config.Path,
+		badgerOptions:     badgerOpts,
+		compressor:        compressor,
+		decompressor:      decompressor,
+		entityCache:       NewLRUCache(config.CacheSize),
+		logger:            config.Logger,
+		syncWAL:           config.SyncWrites,
+		snapshotInterval:  config.SnapshotInterval,
+		stopSnapshot:      make(chan struct{}),
+		useCompression:    useCompression,
+		walSequence:       0, // Initialize sequence counter
+		currentTxns:       make(map[string]*Transaction),
+		walArchiveTTL:     config.WALArchiveRetention,
+		restoreBackups:    config.RestoreBackupRetention,
+		snapshotRetention: config.SnapshotRetention,
+		snapshotChunkSize: config.SnapshotChunkSize,
+		durability:        durability,
+	}
+
+	// Refuse data written by a newer build before reading any of it
+	if err := engine.checkFormatVersion(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	// Continue numbering after the highest WAL sequence ever written
+	if err := engine.loadWALSequence(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to load WAL sequence: %w", err)
 	}
 
+	// Start committing buffered WAL entries
+	engine.commits = newGroupCommitter(config.GroupCommitInterval, engine.commitWAL, config.Logger)
+
 	// Start a snapshot routine
 	if config.SnapshotInterval > 0 {
 		engine.startSnapshotRoutine()
@@ -150,6 +217,15 @@ func NewPersistenceEngine(config Config) (*Engine, error) {
 
 // Close closes the persistence engine
 func (pe *Engine) Close() error {
+	// Commit the buffered WAL entries while the database is still open
+	if pe.commits != nil {
+		pe.commits.close()
+	}
+
+	// A running snapshot waits for writes that still have to commit, which needs the database open
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
 	pe.mu.Lock()
 	defer pe.mu.Unlock()
 
@@ -217,65 +293,78 @@ func (pe *Engine) Decompress(data []byte) ([]byte, error) {
 }
 
 // TakeSnapshot creates a full snapshot of the current state
+// Snapshots beyond the retention are removed afterwards, and WAL entries contained in
+// the oldest retained snapshot are pruned
 func (pe *Engine) TakeSnapshot(store common.DatastoreEngine) error {
-	// Check if engine is closed
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	_, span := tracing.Start(context.Background(), "persistence.snapshot")
+	start := time.Now()
+	sequence, err := pe.takeSnapshot(store)
+	pe.recordSnapshot(start, sequence, err)
+	span.SetAttributes(attribute.Int64("syncopatedb.snapshot.sequence", int64(sequence)))
+	tracing.End(span, err)
+	return err
+}
+
+// takeSnapshot writes a snapshot and returns the last WAL sequence number it contains
+// The store is streamed from a single point into per-type chunks, without copying it first
+// This function requires that the caller holds the snapshot lock
+func (pe *Engine) takeSnapshot(store common.DatastoreEngine) (uint64, error) {
+	// Keep the database open until the snapshot is written
 	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
 	if pe.closed || pe.db == nil {
-		pe.mu.RUnlock()
-		return fmt.Errorf("persistence engine is closed")
+		return 0, fmt.Errorf("persistence engine is closed")
 	}
-	pe.mu.RUnlock()
 
 	// Get the current timestamp and create keys outside the lock
 	timestamp := time.Now().UnixNano()
 	snapshotKey := fmt.Sprintf("snapshot:%d", timestamp)
 
-	// Get entity types and definitions without locking persistence engine
-	entityTypes := store.ListEntityTypes()
-
-	// Create a buffer for serialization
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-
-	// First, write entity definitions
-	if err := enc.Encode(len(entityTypes)); err != nil {
-		return fmt.Errorf("failed to encode entity type count: %w", err)
-	}
-
-	for _, typeName := range entityTypes {
-		def, err := store.GetEntityDefinition(typeName)
-		if err != nil {
-			return fmt.Errorf("failed to get entity definition: %w", err)
-		}
-
-		if err := enc.Encode(def); err != nil {
-			return fmt.Errorf("failed to encode entity definition: %w", err)
+	// WAL entries up to this sequence number are part of the snapshot. The store takes its
+	// point once the writes in flight are committed or rolled back, so a write whose group
+	// commit fails is never part of a snapshot. Later entries are replayed idempotently on load
+	var snapshotSequence uint64
+	manifest, err := pe.writeSnapshotChunks(timestamp, func(chunkSize int, writer common.SnapshotWriter) error {
+		return store.StreamSnapshot(func() {
+			pe.walSeqMutex.Lock()
+			snapshotSequence = pe.walSequence
+			pe.walSeqMutex.Unlock()
+		}, chunkSize, writer)
+	})
+	if err != nil {
+		if cleanupErr := pe.deleteSnapshotChunks(timestamp); cleanupErr != nil {
+			pe.logger.Warnf("Failed to remove chunks of incomplete snapshot: %v", cleanupErr)
 		}
+		return 0, err
+	}
+	manifest.Sequence = snapshotSequence
 
-		// Get and write all entities of this type
-		entities, err := store.GetAllEntitiesOfType(typeName)
-		if err != nil {
-			return fmt.Errorf("failed to get entities: %w", err)
-		}
+	manifestData, err := encodeSnapshotManifest(manifest)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode snapshot manifest: %w", err)
+	}
 
-		if err := enc.Encode(len(entities)); err != nil {
-			return fmt.Errorf("failed to encode entity count: %w", err)
+	// Write the manifest, which makes the snapshot visible
+	err = pe.db.Update(func(txn *badger.Txn) error {
+		// Store the snapshot
+		if err := txn.Set([]byte(snapshotKey), manifestData); err != nil {
+			return err
 		}
 
-		for _, entity := range entities {
-			if err := enc.Encode(entity); err != nil {
-				return fmt.Errorf("failed to encode entity: %w", err)
-			}
+		// Record where the snapshot sits in the WAL for point-in-time recovery
+		if err := txn.Set([]byte(fmt.Sprintf("%s%d", snapshotSequencePrefix, timestamp)), encodeSequence(snapshotSequence)); err != nil {
+			return err
 		}
-	}
 
-	// Compress the snapshot
-	compressedData := pe.Compress(buf.Bytes())
+		pe.walSeqMutex.Lock()
+		walSequence := pe.walSequence
+		pe.walSeqMutex.Unlock()
 
-	// Write the snapshot to the database
-	err := pe.db.Update(func(txn *badger.Txn) error {
-		// Store the snapshot
-		if err := txn.Set([]byte(snapshotKey), compressedData); err != nil {
+		if err := txn.Set([]byte(walSequenceKey), encodeSequence(walSequence)); err != nil {
 			return err
 		}
 
@@ -288,24 +377,36 @@ func (pe *Engine) TakeSnapshot(store common.DatastoreEngine) error {
 	})
 
 	if err != nil {
-		return err
+		if cleanupErr := pe.deleteSnapshotChunks(timestamp); cleanupErr != nil {
+			pe.logger.Warnf("Failed to remove chunks of incomplete snapshot: %v", cleanupErr)
+		}
+		return 0, err
 	}
 
-	// Prune old WAL entries now that we have a new snapshot
-	if err := pe.PruneWALBeforeTimestamp(timestamp); err != nil {
-		pe.logger.Warnf("Failed to prune WAL entries: %v", err)
+	pe.statsMu.Lock()
+	pe.stats.lastSize = manifest.size + int64(len(manifestData))
+	pe.statsMu.Unlock()
+
+	// Drop old snapshots and the WAL entries they no longer need
+	if err := pe.applySnapshotRetention(); err != nil {
+		pe.logger.Warnf("Failed to apply snapshot retention: %v", err)
 		// Continue even if pruning fails - this is not fatal
 	}
 
-	return nil
+	return snapshotSequence, nil
 }
 
 // LoadLatestSnapshot loads the most recent snapshot
 // This should only be called during initialization
 func (pe *Engine) LoadLatestSnapshot(store common.DatastoreEngine) error {
-	var snapshotKey string
+	var timestamp int64
+	var snapshotSequence uint64
+	var snapshotData []byte
+
+	// Without a snapshot, the whole WAL is replayed
+	pe.replayAfterSequence = 0
 
-	// Find the latest snapshot key - Badger handles its own thread safety
+	// Find the latest snapshot - Badger handles its own thread safety
 	err := pe.db.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte("latest_snapshot"))
 		if err == badger.ErrKeyNotFound {
@@ -315,87 +416,52 @@ func (pe *Engine) LoadLatestSnapshot(store common.DatastoreEngine) error {
 			return err
 		}
 
-		return item.Value(func(val []byte) error {
-			timestamp := binary.LittleEndian.Uint64(val)
-			snapshotKey = fmt.Sprintf("snapshot:%d", timestamp)
+		if err := item.Value(func(val []byte) error {
+			timestamp = int64(binary.LittleEndian.Uint64(val))
 			return nil
-		})
+		}); err != nil {
+			return err
+		}
+
+		item, err = txn.Get([]byte(fmt.Sprintf("snapshot:%d", timestamp)))
+		if err != nil {
+			return err
+		}
+		if snapshotData, err = item.ValueCopy(nil); err != nil {
+			return err
+		}
+
+		// Snapshots taken before sequences were recorded are followed by the whole WAL
+		snapshotSequence, err = readSequence(txn, fmt.Sprintf("%s%d", snapshotSequencePrefix, timestamp))
+		return err
 	})
 
 	if err != nil {
 		return err
 	}
 
-	if snapshotKey == "" {
+	if snapshotData == nil {
 		// No snapshot exists
 		return nil
 	}
 
-	// Load the snapshot - Badger handles its own thread safety
-	return pe.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(snapshotKey))
-		if err != nil {
-			return err
-		}
-
-		return item.Value(func(val []byte) error {
-			// Decompress the snapshot
-			data, err := pe.Decompress(val)
-			if err != nil {
-				return fmt.Errorf("failed to decompress snapshot: %w", err)
-			}
-
-			// Deserialize and load into the store
-			buf := bytes.NewBuffer(data)
-			dec := gob.NewDecoder(buf)
-
-			// Read entity definitions
-			var typeCount int
-			if err := dec.Decode(&typeCount); err != nil {
-				return fmt.Errorf("failed to decode entity type count: %w", err)
-			}
-
-			for i := 0; i < typeCount; i++ {
-				var def common.EntityDefinition
-				if err := dec.Decode(&def); err != nil {
-					return fmt.Errorf("failed to decode entity definition: %w", err)
-				}
-
-				// Clean up any duplicate internal fields
-				cleanInternalFields(&def)
-
-				// Mark internal fields
-				for j := range def.Fields {
-					if strings.HasPrefix(def.Fields[j].Name, "_") {
-						def.Fields[j].Internal = true
-					}
-				}
-
-				if err := store.RegisterEntityType(def); err != nil {
-					return fmt.Errorf("failed to register entity type: %w", err)
-				}
-
-				// Read entities for this type
-				var entityCount int
-				if err := dec.Decode(&entityCount); err != nil {
-					return fmt.Errorf("failed to decode entity count: %w", err)
-				}
-
-				for j := 0; j < entityCount; j++ {
-					var entity common.Entity
-					if err := dec.Decode(&entity); err != nil {
-						return fmt.Errorf("failed to decode entity: %w", err)
-					}
+	manifest, _, err := decodeSnapshotManifest(snapshotData)
+	if err != nil {
+		return err
+	}
 
-					if err := store.Insert(entity.Type, entity.ID, entity.Fields); err != nil {
-						return fmt.Errorf("failed to insert entity: %w", err)
-					}
-				}
-			}
+	if manifest != nil {
+		err = pe.loadSnapshotChunks(store, timestamp, manifest)
+	} else {
+		err = pe.loadLegacySnapshot(store, snapshotData)
+	}
+	if err != nil {
+		return err
+	}
 
-			return nil
-		})
-	})
+	// WAL entries contained in the snapshot are skipped by LoadWAL
+	pe.replayAfterSequence = snapshotSequence
+	return nil
 }
 
 // startSnapshotRoutine starts the periodic snapshot routine
@@ -426,9 +492,7 @@ func (pe *Engine) startSnapshotRoutine() {
 					return
 				}
 
-				// We need a reference to the datastore to snapshot it
-				// This will be provided when the snapshot is triggered from the Manager
-				pe.logger.Debug("Snapshot interval reached, waiting for snapshot to be triggered")
+				pe.runScheduledSnapshot()
 			case <-stopChan:
 				pe.logger.Debug("Stopping snapshot routine")
 				return
@@ -467,6 +531,19 @@ func (pe *Engine) RegisterEntityType(store common.DatastoreEngine, def common.En
 
 // Insert adds a new entity and persists it
 func (pe *Engine) Insert(store common.DatastoreEngine, entityType, entityID string, data map[string]interface{}) error {
+	return pe.InsertWithOptions(store, entityType, entityID, data, common.WriteOptions{})
+}
+
+// InsertWithOptions adds a new entity and persists it as durably as the options request
+// The durability only applies to the WAL, writes made without it use SyncWrites
+func (pe *Engine) InsertWithOptions(store common.DatastoreEngine, entityType, entityID string, data map[string]interface{}, options common.WriteOptions) (err error) {
+	durability, err := writeDurability(options, pe.durability)
+	if err != nil {
+		return err
+	}
+	span := startWriteSpan(options, "persistence.insert", entityType, entityID, durability)
+	defer func() { tracing.End(span, err) }()
+
 	// Serialize the entity data outside of any locks
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
@@ -482,11 +559,23 @@ func (pe *Engine) Insert(store common.DatastoreEngine, entityType, entityID stri
 	}
 
 	// Write to WAL
-	return pe.WriteWALEntry(OpInsertEntity, entityType, entityID, buf.Bytes())
+	return pe.writeWALEntry(OpInsertEntity, entityType, entityID, buf.Bytes(), durability)
 }
 
 // Update updates an entity and persists the changes
 func (pe *Engine) Update(store common.DatastoreEngine, entityType string, entityID string, data map[string]interface{}) error {
+	return pe.UpdateWithOptions(store, entityType, entityID, data, common.WriteOptions{})
+}
+
+// UpdateWithOptions updates an entity and persists the changes as durably as the options request
+func (pe *Engine) UpdateWithOptions(store common.DatastoreEngine, entityType string, entityID string, data map[string]interface{}, options common.WriteOptions) (err error) {
+	durability, err := writeDurability(options, pe.durability)
+	if err != nil {
+		return err
+	}
+	span := startWriteSpan(options, "persistence.update", entityType, entityID, durability)
+	defer func() { tracing.End(span, err) }()
+
 	// Serialize the update data outside of any locks
 	var buf bytes.Buffer
 	if err := gob.NewEncoder(&buf).Encode(data); err != nil {
@@ -502,11 +591,23 @@ func (pe *Engine) Update(store common.DatastoreEngine, entityType string, entity
 	}
 
 	// Write to WAL
-	return pe.WriteWALEntry(OpUpdateEntity, entityType, entityID, buf.Bytes())
+	return pe.writeWALEntry(OpUpdateEntity, entityType, entityID, buf.Bytes(), durability)
 }
 
 // Delete removes an entity and persists the deletion
 func (pe *Engine) Delete(store common.DatastoreEngine, entityID string, entityType string) error {
+	return pe.DeleteWithOptions(store, entityID, entityType, common.WriteOptions{})
+}
+
+// DeleteWithOptions removes an entity and persists the deletion as durably as the options request
+func (pe *Engine) DeleteWithOptions(store common.DatastoreEngine, entityID string, entityType string, options common.WriteOptions) (err error) {
+	durability, err := writeDurability(options, pe.durability)
+	if err != nil {
+		return err
+	}
+	span := startWriteSpan(options, "persistence.delete", entityType, entityID, durability)
+	defer func() { tracing.End(span, err) }()
+
 	if !settings.Config.EnableWAL {
 		// Key becomes, e.g., "entity:product:product:123" (using entityType and composite entityID)
 		key := fmt.Sprintf("entity:%s:%s", entityType, entityID)
@@ -517,12 +618,25 @@ func (pe *Engine) Delete(store common.DatastoreEngine, entityID string, entityTy
 		})
 	}
 	// For WAL, entry.EntityID becomes "product:123", WAL key becomes "wal:...:product:product:123"
-	return pe.WriteWALEntry(OpDeleteEntity, entityType, entityID, nil)
+	return pe.writeWALEntry(OpDeleteEntity, entityType, entityID, nil, durability)
 }
 
 // RunValueLogGC runs garbage collection on the value log
 func (pe *Engine) RunValueLogGC(discardRatio float64) error {
-	return pe.db.RunValueLogGC(discardRatio)
+	err := pe.db.RunValueLogGC(discardRatio)
+	metrics.ObserveGC(err, errors.Is(err, badger.ErrNoRewrite))
+	return err
+}
+
+// StorageSize returns the size of the LSM tree and the value log in bytes
+func (pe *Engine) StorageSize() (int64, int64) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return 0, 0
+	}
+	return pe.db.Size()
 }
 
 // getDatabaseSize returns the approximate size of the database in bytes
@@ -574,74 +688,44 @@ func (pe *Engine) createBackup(path string) error {
 
 // RestoreFromBackup restores the database from a backup file
 func (pe *Engine) RestoreFromBackup(store common.DatastoreEngine, backupPath string) error {
-	// This is a complex operation that should be performed when the system is idle
-	// Acquire a write lock to prevent any other operations
-	pe.mu.Lock()
-	defer pe.mu.Unlock()
-
-	// Close the current database
-	if err := pe.db.Close(); err != nil {
-		return fmt.Errorf("failed to close database for restore: %w", err)
-	}
-
-	// Backup the existing data directory
-	backupDir := pe.path + ".bak." + time.Now().Format("20060102150405")
-	if err := os.Rename(pe.path, backupDir); err != nil {
-		return fmt.Errorf("failed to backup existing data directory: %w", err)
-	}
-
-	// Create a new empty directory
-	if err := os.MkdirAll(pe.path, 0755); err != nil {
-		return fmt.Errorf("failed to create data directory: %w", err)
-	}
-
-	// Open the backup file
 	f, err := os.Open(backupPath)
 	if err != nil {
 		return fmt.Errorf("failed to open backup file: %w", err)
 	}
 	defer f.Close()
 
-	// Create a new Badger database for the restore
-	opts := badger.DefaultOptions(pe.path)
-	db, err := badger.Open(opts)
-	if err != nil {
-		return fmt.Errorf("failed to open database for restore: %w", err)
-	}
-
-	// Load the backup
-	if err := db.Load(f, 16); err != nil {
-		db.Close()
-		return fmt.Errorf("failed to load backup: %w", err)
-	}
-
-	// Close the temporary database
-	if err := db.Close(); err != nil {
-		return fmt.Errorf("failed to close database after restore: %w", err)
-	}
+	return pe.Restore(store, f, common.RestoreOptions{})
+}
 
-	// Reopen the engine with the restored data
-	pe.db, err = badger.Open(badger.DefaultOptions(pe.path))
-	if err != nil {
-		return fmt.Errorf("failed to reopen database after restore: %w", err)
+// StreamBackup streams a backup of the database to the provided writer
+// A since version above 0 limits the backup to the changes made after that version
+func (pe *Engine) StreamBackup(w io.Writer, since uint64) error {
+	if err := pe.flushWAL(); err != nil {
+		return err
 	}
 
-	// Load the restored data into the store - this is done outside normal operations
-	if err := pe.LoadLatestSnapshot(store); err != nil {
-		return fmt.Errorf("failed to load snapshot after restore: %w", err)
-	}
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
 
-	if err := pe.LoadWAL(store); err != nil {
-		return fmt.Errorf("failed to load WAL after restore: %w", err)
+	if pe.closed || pe.db == nil {
+		return fmt.Errorf("persistence engine is closed")
 	}
 
-	return nil
+	_, err := pe.db.Backup(w, since)
+	return err
 }
 
-// StreamBackup streams a backup of the database to the provided writer
-func (pe *Engine) StreamBackup(w io.Writer) error {
-	_, err := pe.db.Backup(w, 0)
-	return err
+// BackupVersion returns the current version of the database
+// A backup started afterwards contains every change up to this version, so it can be
+// passed as the since version of the next incremental backup
+func (pe *Engine) BackupVersion() uint64 {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return 0
+	}
+	return pe.db.MaxVersion()
 }
 
 // GetPersistenceProvider returns the persistence provider for the Manager
@@ -736,54 +820,14 @@ func (pe *Engine) SaveCounter(entityType string, counter uint64) error {
 	})
 }
 
-// PruneWALBeforeTimestamp removes WAL entries older than the given timestamp
-func (pe *Engine) PruneWALBeforeTimestamp(timestamp int64) error {
-	return pe.db.Update(func(txn *badger.Txn) error {
-		opts := badger.DefaultIteratorOptions
-		opts.Prefix = []byte("wal:")
-
-		it := txn.NewIterator(opts)
-		defer it.Close()
-
-		keysToDelete := [][]byte{}
-
-		// Collect all WAL keys before the timestamp
-		for it.Rewind(); it.Valid(); it.Next() {
-			item := it.Item()
-			key := item.Key()
-
-			// Parse the timestamp from the key (format: "wal:timestamp:entityType:entityID")
-			keyParts := strings.SplitN(string(key), ":", 4)
-			if len(keyParts) < 2 {
-				continue // Skip malformed keys
-			}
-
-			entryTimestamp, err := strconv.ParseInt(keyParts[1], 10, 64)
-			if err != nil {
-				pe.logger.Warnf("Invalid timestamp in WAL key %s: %v", string(key), err)
-				continue
-			}
-
-			if entryTimestamp <= timestamp {
-				keysToDelete = append(keysToDelete, append([]byte{}, key...))
-			}
-		}
-
-		// Delete collected keys
-		for _, key := range keysToDelete {
-			if err := txn.Delete(key); err != nil {
-				return fmt.Errorf("failed to delete old WAL entry: %w", err)
-			}
-		}
-
-		pe.logger.Infof("Pruned %d WAL entries older than %s", len(keysToDelete),
-			time.Unix(0, timestamp).Format(time.RFC3339))
-		return nil
-	})
-}
-
 // applyOperationWithErrorHandling applies a WAL operation with improved error handling
 func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine, op int, entityType, entityID string, data []byte) error {
+	return replayOperation(store, pe.logger, op, entityType, entityID, data)
+}
+
+// replayOperation applies a logged operation to the store, skipping changes the store already reflects
+// It is shared by the persistence providers, which log operations with the same payloads
+func replayOperation(store common.DatastoreEngine, logger *logrus.Logger, op int, entityType, entityID string, data []byte) error {
 	switch op {
 	case OpRegisterEntityType:
 		var def common.EntityDefinition
@@ -797,11 +841,11 @@ func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine,
 			// Entity type already exists, compare the definitions
 			if compareEntityDefinitions(existingDef, def) {
 				// Definitions are identical, skip registration
-				pe.logger.Debugf("Entity type %s already exists with identical definition, skipping", def.Name)
+				logger.Debugf("Entity type %s already exists with identical definition, skipping", def.Name)
 				return nil
 			} else {
 				// Definitions are different, log a warning
-				pe.logger.Warnf("Entity type %s already exists with different definition, using existing definition", def.Name)
+				logger.Warnf("Entity type %s already exists with different definition, using existing definition", def.Name)
 				return nil
 			}
 		}
@@ -825,10 +869,11 @@ func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine,
 		}
 
 		// Check if entity already exists before inserting
-		_, err := store.Get(entityID)
+		// IDs are only unique within an entity type, so the lookup includes the type
+		_, err := store.GetByType(entityID, entityType)
 		if err == nil {
 			// Entity already exists, skip insertion
-			pe.logger.Debugf("Entity '%s' already exists, skipping insertion", entityID)
+			logger.Debugf("Entity '%s' already exists, skipping insertion", entityID)
 			return nil
 		}
 
@@ -841,22 +886,21 @@ func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine,
 		}
 
 		// Check if entity exists before updating
-		entity, err := store.Get(entityID)
+		_, err := store.GetByType(entityID, entityType)
 		if err != nil {
 			// Entity doesn't exist, skip update
-			pe.logger.Warnf("Entity '%s' doesn't exist, skipping update", entityID)
+			logger.Warnf("Entity '%s' doesn't exist, skipping update", entityID)
 			return nil
 		}
 
-		// Pass the entity type from the entity we retrieved
-		return store.Update(entity.Type, entityID, fields)
+		return store.Update(entityType, entityID, fields)
 
 	case OpDeleteEntity:
 		// Check if entity exists before deleting
-		_, err := store.Get(entityID)
+		_, err := store.GetByType(entityID, entityType)
 		if err != nil {
 			// Entity doesn't exist, skip deletion
-			pe.logger.Warnf("Entity '%s' doesn't exist, skipping deletion", entityID)
+			logger.Warnf("Entity '%s' doesn't exist, skipping deletion", entityID)
 			return nil
 		}
 
@@ -869,7 +913,7 @@ func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine,
 		}
 
 		// For WAL replays, we need to check if the entity type exists
-		_, err := store.GetEntityDefinition(def.Name)
+		existingDef, err := store.GetEntityDefinition(def.Name)
 		if err != nil {
 			// Entity type doesn't exist, register it instead
 
@@ -886,6 +930,13 @@ func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine,
 			return store.RegisterEntityType(def)
 		}
 
+		// Skip versioned updates that are already reflected in the loaded definition
+		if def.Version > 0 && existingDef.Version >= def.Version {
+			logger.Debugf("Entity type %s is already at version %d, skipping update to version %d",
+				def.Name, existingDef.Version, def.Version)
+			return nil
+		}
+
 		// Clean up any duplicate internal fields before updating
 		ensureNoDuplicateInternalFields(&def)
 
@@ -906,6 +957,21 @@ func (pe *Engine) applyOperationWithErrorHandling(store common.DatastoreEngine,
 	case OpTruncateDatabase:
 		// For WAL replay, truncate the entire database
 		return store.TruncateDatabase()
+
+	case OpDropEntityType:
+		// Check if the entity type still exists before dropping
+		if _, err := store.GetEntityDefinition(entityType); err != nil {
+			logger.Debugf("Entity type %s doesn't exist, skipping drop", entityType)
+			return nil
+		}
+
+		return store.DropEntityType(entityType)
+
+	case OpRenameEntityType:
+		return applyRenameEntityType(store, logger, entityType, data)
+
+	case OpCloneEntityType:
+		return applyCloneEntityType(store, logger, entityType, data)
 	default:
 		return fmt.Errorf("unknown operation: %d", op)
 	}
@@ -0,0 +1,340 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/badger/v4/pb"
+	"github.com/klauspost/compress/zstd"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"google.golang.org/protobuf/proto"
+)
+
+// backupViewBatchSize is the size of the entries a backup view collects before writing them
+const backupViewBatchSize = 4 << 20
+
+// DefaultRestoreBackupRetention is the number of data directories replaced by restores that are kept
+// when none is configured
+const DefaultRestoreBackupRetention = 2
+
+// zstdMagic is the magic number at the start of every zstd frame
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// openBackupStream returns a reader for a backup stream, decompressing it if it is zstd-compressed
+func openBackupStream(r io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(r)
+
+	header, err := buffered.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read backup header: %w", err)
+	}
+
+	if bytes.Equal(header, zstdMagic) {
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create backup decompressor: %w", err)
+		}
+		return decoder.IOReadCloser(), nil
+	}
+
+	return io.NopCloser(buffered), nil
+}
+
+// Restore replaces the database with the contents of a backup stream and reloads the store
+// Backups compressed with zstd are detected and decompressed automatically.
+// The backup is loaded into a separate directory first, so a broken backup leaves the
+// current data untouched. The replaced data directory is kept next to the data path, up to the
+// configured number of copies, unless the options discard it.
+// An incremental backup is loaded on top of a copy of the current data instead, and a
+// recovery target rewinds the restored data to that point in its WAL history.
+// Callers must make sure no writes reach the store while it is being restored
+func (pe *Engine) Restore(store common.DatastoreEngine, r io.Reader, options common.RestoreOptions) error {
+	if err := pe.flushWAL(); err != nil {
+		return err
+	}
+
+	// Keep the snapshot routine from snapshotting the store while it is replaced
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	reader, err := openBackupStream(r)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	pe.mu.Lock()
+
+	if pe.closed || pe.db == nil {
+		pe.mu.Unlock()
+		return fmt.Errorf("persistence engine is closed")
+	}
+
+	dataPath := filepath.Clean(pe.path)
+	timestamp := time.Now().Format("20060102150405.000000000")
+	restorePath := dataPath + ".restore." + timestamp
+	previousPath := dataPath + ".bak." + timestamp
+
+	// Load the backup into a fresh database next to the current one
+	sources := []io.Reader{reader}
+	if options.Incremental {
+		current := pe.currentDataStream()
+		defer current.Close()
+		sources = []io.Reader{current, reader}
+	}
+
+	if err := pe.loadBackupInto(restorePath, sources...); err != nil {
+		os.RemoveAll(restorePath)
+		pe.mu.Unlock()
+		return err
+	}
+
+	// Swap the data directories while the database is closed
+	if err := pe.db.Close(); err != nil {
+		os.RemoveAll(restorePath)
+		pe.mu.Unlock()
+		return fmt.Errorf("failed to close database for restore: %w", err)
+	}
+
+	if err := os.Rename(dataPath, previousPath); err != nil {
+		os.RemoveAll(restorePath)
+		reopenErr := pe.reopen()
+		pe.mu.Unlock()
+		if reopenErr != nil {
+			return fmt.Errorf("failed to move existing data directory: %v (reopening failed: %w)", err, reopenErr)
+		}
+		return fmt.Errorf("failed to move existing data directory: %w", err)
+	}
+
+	if err := os.Rename(restorePath, dataPath); err != nil {
+		// Put the previous data back in place
+		os.Rename(previousPath, dataPath)
+		os.RemoveAll(restorePath)
+		reopenErr := pe.reopen()
+		pe.mu.Unlock()
+		if reopenErr != nil {
+			return fmt.Errorf("failed to move restored data directory: %v (reopening failed: %w)", err, reopenErr)
+		}
+		return fmt.Errorf("failed to move restored data directory: %w", err)
+	}
+
+	if err := pe.reopen(); err != nil {
+		pe.mu.Unlock()
+		return fmt.Errorf("failed to reopen database after restore: %w", err)
+	}
+
+	// Continue WAL numbering after the restored history
+	if err := pe.loadWALSequence(); err != nil {
+		pe.mu.Unlock()
+		return fmt.Errorf("failed to load WAL sequence after restore: %w", err)
+	}
+
+	// Replicas of this database cannot continue from the replaced history
+	if err := pe.startNewHistory(); err != nil {
+		pe.mu.Unlock()
+		return err
+	}
+
+	pe.entityCache.Clear()
+	pe.mu.Unlock()
+
+	if options.DiscardPrevious {
+		if err := os.RemoveAll(previousPath); err != nil {
+			pe.logger.Warnf("Failed to remove the replaced data directory %s: %v", previousPath, err)
+		}
+		pe.logger.Infof("Database restored from backup")
+	} else {
+		pe.pruneRestoreBackups(dataPath)
+		pe.logger.Infof("Database restored from backup, previous data kept at %s", previousPath)
+	}
+
+	// Rebuild the in-memory state from the restored data
+	if err := store.Reload(); err != nil {
+		return fmt.Errorf("failed to reload store after restore: %w", err)
+	}
+
+	if options.Target != nil {
+		if err := pe.recoverToPoint(store, *options.Target); err != nil {
+			return fmt.Errorf("backup restored, but recovering to %s failed: %w", options.Target, err)
+		}
+	}
+
+	return nil
+}
+
+// pruneRestoreBackups removes the oldest data directories replaced by restores beyond the retention count
+// Their names end with the time of the restore, so they sort from the oldest to the newest
+func (pe *Engine) pruneRestoreBackups(dataPath string) {
+	retention := pe.restoreBackups
+	if retention <= 0 {
+		retention = DefaultRestoreBackupRetention
+	}
+
+	previous, err := filepath.Glob(dataPath + ".bak.*")
+	if err != nil || len(previous) <= retention {
+		return
+	}
+
+	sort.Strings(previous)
+	for _, path := range previous[:len(previous)-retention] {
+		if err := os.RemoveAll(path); err != nil {
+			pe.logger.Warnf("Failed to remove the replaced data directory %s: %v", path, err)
+		}
+	}
+}
+
+// BackupView is a point-in-time view of the database, streamed as a full backup later
+// It keeps the data as of when it was opened while writes continue, and holds off
+// restores and closing the database until it is closed
+type BackupView struct {
+	pe        *Engine
+	txn       *badger.Txn
+	closeOnce sync.Once
+}
+
+// ViewBackup opens a backup view of the database as of now
+func (pe *Engine) ViewBackup() (*BackupView, error) {
+	if err := pe.flushWAL(); err != nil {
+		return nil, err
+	}
+
+	pe.mu.RLock()
+	if pe.closed || pe.db == nil {
+		pe.mu.RUnlock()
+		return nil, fmt.Errorf("persistence engine is closed")
+	}
+	return &BackupView{pe: pe, txn: pe.db.NewTransaction(false)}, nil
+}
+
+// StreamBackup writes the view as a full backup stream, in the format of Engine.StreamBackup
+func (v *BackupView) StreamBackup(w io.Writer) error {
+	it := v.txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	list := &pb.KVList{}
+	size := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("failed to read backup entry: %w", err)
+		}
+
+		list.Kv = append(list.Kv, &pb.KV{
+			Key:       item.KeyCopy(nil),
+			Value:     value,
+			UserMeta:  []byte{item.UserMeta()},
+			Version:   item.Version(),
+			ExpiresAt: item.ExpiresAt(),
+		})
+		size += len(item.Key()) + len(value)
+
+		if size >= backupViewBatchSize {
+			if err := writeKVList(w, list); err != nil {
+				return err
+			}
+			list.Kv = list.Kv[:0]
+			size = 0
+		}
+	}
+
+	if len(list.Kv) == 0 {
+		return nil
+	}
+	return writeKVList(w, list)
+}
+
+// Close releases the view
+func (v *BackupView) Close() {
+	v.closeOnce.Do(func() {
+		v.txn.Discard()
+		v.pe.mu.RUnlock()
+	})
+}
+
+// writeKVList writes a list of entries as a length-prefixed record of a backup stream
+func writeKVList(w io.Writer, list *pb.KVList) error {
+	data, err := proto.Marshal(list)
+	if err != nil {
+		return fmt.Errorf("failed to encode backup entries: %w", err)
+	}
+	if err := binary.Write(w, binary.LittleEndian, uint64(len(data))); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return fmt.Errorf("failed to write backup: %w", err)
+	}
+	return nil
+}
+
+// currentDataStream streams a full backup of the current database, used as the base of an incremental restore
+// The returned reader must be closed, which stops the backup if it was not read to the end
+func (pe *Engine) currentDataStream() io.ReadCloser {
+	reader, writer := io.Pipe()
+	db := pe.db
+
+	go func() {
+		_, err := db.Backup(writer, 0)
+		writer.CloseWithError(err)
+	}()
+
+	return reader
+}
+
+// loadBackupInto creates a new database at path and loads backup streams into it, in order
+func (pe *Engine) loadBackupInto(path string, sources ...io.Reader) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create restore directory: %w", err)
+	}
+
+	db, err := badger.Open(pe.badgerOptions.WithDir(path).WithValueDir(path))
+	if err != nil {
+		return fmt.Errorf("failed to open database for restore: %w", err)
+	}
+
+	for _, r := range sources {
+		if err := loadBackupStream(db, r); err != nil {
+			db.Close()
+			return fmt.Errorf("failed to load backup: %w", err)
+		}
+	}
+
+	if err := db.Close(); err != nil {
+		return fmt.Errorf("failed to close database after restore: %w", err)
+	}
+
+	return nil
+}
+
+// loadBackupStream loads a backup stream into a database
+// Badger trusts the length prefixes of the stream and panics on malformed input, which is reported as an error
+func loadBackupStream(db *badger.DB, r io.Reader) (err error) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			err = fmt.Errorf("malformed backup stream: %v", recovered)
+		}
+	}()
+
+	return db.Load(r, 16)
+}
+
+// reopen opens the database at the data path again
+// This function requires that the caller holds a write lock
+func (pe *Engine) reopen() error {
+	db, err := badger.Open(pe.badgerOptions)
+	if err != nil {
+		pe.db = nil
+		return err
+	}
+	pe.db = db
+	return nil
+}
@@ -0,0 +1,84 @@
+package persistence
+
+import (
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+)
+
+// DropEntityType records the drop in the WAL and removes all stored data of an entity type
+// The drop is committed before any data is removed, so a failed WAL write leaves the entity type
+// intact on disk, as the datastore restores it in memory
+func (pe *Engine) DropEntityType(store common.DatastoreEngine, entityType string) error {
+	// Check if WAL is disabled in settings
+	if !settings.Config.EnableWAL {
+		return pe.deleteEntityTypeKeys(entityType)
+	}
+
+	// With WAL enabled, write a drop operation to the WAL and wait for its commit
+	if err := pe.writeWALEntry(OpDropEntityType, entityType, "", nil, common.DurabilitySync); err != nil {
+		return err
+	}
+
+	// Counters, deleted IDs and schema history live outside the WAL, so they are
+	// removed directly. The drop is committed by now and removes the entity type
+	// again when the WAL is replayed, so failing here would only undo it in memory
+	if err := pe.deleteEntityTypeKeys(entityType); err != nil {
+		pe.logger.Warnf("Failed to remove the stored data of dropped entity type %s: %v", entityType, err)
+	}
+	return nil
+}
+
+// deleteEntityTypeKeys removes every key that belongs to an entity type
+func (pe *Engine) deleteEntityTypeKeys(entityType string) error {
+	prefixes := []string{
+		fmt.Sprintf("entity:%s:", entityType),
+		fmt.Sprintf("schema_version:%s:", entityType),
+	}
+
+	exactKeys := []string{
+		fmt.Sprintf("entitydef:%s", entityType),
+		fmt.Sprintf("counter:%s", entityType),
+		fmt.Sprintf("deleted_ids:%s", entityType),
+	}
+
+	// A type may have more keys than a single transaction holds, the write batch
+	// commits the deletions in as many transactions as they need
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, prefix := range prefixes {
+		err := pe.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			opts.PrefetchValues = false
+
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				if err := wb.Delete(key); err != nil {
+					return fmt.Errorf("failed to delete key %s: %w", string(key), err)
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, key := range exactKeys {
+		if err := wb.Delete([]byte(key)); err != nil {
+			return fmt.Errorf("failed to delete key %s: %w", key, err)
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to delete the keys of entity type %s: %w", entityType, err)
+	}
+	return nil
+}
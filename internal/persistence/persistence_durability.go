@@ -0,0 +1,169 @@
+package persistence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// DefaultGroupCommitInterval is the time between group commits when none is configured
+const DefaultGroupCommitInterval = 10 * time.Millisecond
+
+// resolveDurability returns the durability used for a write
+// An empty durability falls back to sync, async writes have to be asked for
+func resolveDurability(durability common.Durability) (common.Durability, error) {
+	if durability == "" {
+		return common.DurabilitySync, nil
+	}
+	if !durability.IsValid() {
+		return "", fmt.Errorf("invalid durability %q, expected sync, group or async", durability)
+	}
+	return durability, nil
+}
+
+// writeDurability returns the durability requested by write options, or the default one
+func writeDurability(options common.WriteOptions, defaultDurability common.Durability) (common.Durability, error) {
+	if options.Durability == "" {
+		return defaultDurability, nil
+	}
+	return resolveDurability(options.Durability)
+}
+
+// startWriteSpan starts the span of an entity write in the trace carried by its write options
+func startWriteSpan(options common.WriteOptions, name, entityType, entityID string, durability common.Durability) trace.Span {
+	_, span := tracing.Start(options.Context, name, trace.WithAttributes(
+		attribute.String("db.collection.name", entityType),
+		attribute.String("syncopatedb.entity_id", entityID),
+		attribute.String("syncopatedb.durability", string(durability)),
+	))
+	return span
+}
+
+// groupCommitter batches the commits of a log, so concurrent writers share one fsync
+// Owners record a write before calling wait, and commit makes every write recorded
+// so far durable. Sync writes trigger a commit right away, group writes wait for the
+// next interval and async writes return at once and are committed with the next round
+type groupCommitter struct {
+	commit   func() error
+	interval time.Duration
+	logger   *logrus.Logger
+
+	mu      sync.Mutex
+	waiters []chan error // Writers waiting for the next commit
+	pending bool         // Async writes are waiting for the next commit
+	stopped bool
+
+	now  chan struct{} // Requests a commit before the interval elapses
+	stop chan struct{}
+	done chan struct{}
+}
+
+// newGroupCommitter starts a committer that runs commit at most once per interval
+func newGroupCommitter(interval time.Duration, commit func() error, logger *logrus.Logger) *groupCommitter {
+	if interval <= 0 {
+		interval = DefaultGroupCommitInterval
+	}
+
+	gc := &groupCommitter{
+		commit:   commit,
+		interval: interval,
+		logger:   logger,
+		now:      make(chan struct{}, 1),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go gc.run()
+	return gc
+}
+
+// wait returns once the writes recorded so far are as durable as requested
+func (gc *groupCommitter) wait(durability common.Durability) error {
+	gc.mu.Lock()
+	if gc.stopped {
+		// Nothing commits in the background anymore
+		gc.mu.Unlock()
+		return gc.commit()
+	}
+
+	if durability == common.DurabilityAsync {
+		gc.pending = true
+		gc.mu.Unlock()
+		return nil
+	}
+
+	done := make(chan error, 1)
+	gc.waiters = append(gc.waiters, done)
+	gc.mu.Unlock()
+
+	if durability == common.DurabilitySync {
+		select {
+		case gc.now <- struct{}{}:
+		default: // A commit has already been requested
+		}
+	}
+
+	return <-done
+}
+
+// run commits waiting writes until the committer is closed
+func (gc *groupCommitter) run() {
+	defer close(gc.done)
+
+	ticker := time.NewTicker(gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-gc.now:
+		case <-gc.stop:
+			gc.round()
+			return
+		}
+		gc.round()
+	}
+}
+
+// round commits once if any write is waiting and reports the result to its writers
+func (gc *groupCommitter) round() {
+	gc.mu.Lock()
+	waiters := gc.waiters
+	pending := gc.pending
+	gc.waiters = nil
+	gc.pending = false
+	gc.mu.Unlock()
+
+	if len(waiters) == 0 && !pending {
+		return
+	}
+
+	err := gc.commit()
+	if err != nil && len(waiters) == 0 {
+		// No writer is left to report to
+		gc.logger.Errorf("Failed to commit asynchronous writes: %v", err)
+	}
+	for _, done := range waiters {
+		done <- err
+	}
+}
+
+// close commits the remaining writes and stops the committer
+// Writes waited for afterwards are committed by their writer directly
+func (gc *groupCommitter) close() {
+	gc.mu.Lock()
+	if gc.stopped {
+		gc.mu.Unlock()
+		return
+	}
+	gc.stopped = true
+	gc.mu.Unlock()
+
+	close(gc.stop)
+	<-gc.done
+}
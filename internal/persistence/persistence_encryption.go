@@ -0,0 +1,214 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultIndexCacheSize is the Badger index cache size used for encrypted databases when none is configured
+// Without an index cache, the table indices of an encrypted database are decrypted on every read
+const DefaultIndexCacheSize int64 = 100 << 20
+
+// ParseEncryptionKey parses an AES encryption key of 16, 24 or 32 bytes
+// The key may be hex or base64 encoded, or given as raw bytes
+func ParseEncryptionKey(data []byte) ([]byte, error) {
+	text := bytes.TrimSpace(data)
+	if len(text) == 0 {
+		return nil, fmt.Errorf("encryption key is empty")
+	}
+
+	if key, err := hex.DecodeString(string(text)); err == nil && validEncryptionKeyLength(len(key)) {
+		return key, nil
+	}
+	if key, err := base64.StdEncoding.DecodeString(string(text)); err == nil && validEncryptionKeyLength(len(key)) {
+		return key, nil
+	}
+	if validEncryptionKeyLength(len(data)) {
+		return data, nil
+	}
+
+	return nil, fmt.Errorf("encryption key must be 16, 24 or 32 bytes, hex or base64 encoded, or raw")
+}
+
+// validEncryptionKeyLength reports whether a key selects AES-128, AES-192 or AES-256
+func validEncryptionKeyLength(length int) bool {
+	return length == 16 || length == 24 || length == 32
+}
+
+// LoadEncryptionKey reads the encryption key from a file, or parses value when no file is given
+// It returns a nil key when neither is set, which leaves the database unencrypted
+func LoadEncryptionKey(path, value string) ([]byte, error) {
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read encryption key file: %w", err)
+		}
+		key, err := ParseEncryptionKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("invalid encryption key in %s: %w", path, err)
+		}
+		return key, nil
+	}
+
+	if value == "" {
+		return nil, nil
+	}
+
+	key, err := ParseEncryptionKey([]byte(value))
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %w", err)
+	}
+	return key, nil
+}
+
+// withEncryption applies an encryption key and the matching index cache size to Badger options
+func withEncryption(opts badger.Options, key []byte, indexCacheSize int64) badger.Options {
+	if len(key) == 0 {
+		if indexCacheSize > 0 {
+			opts = opts.WithIndexCacheSize(indexCacheSize)
+		}
+		return opts
+	}
+
+	if indexCacheSize <= 0 {
+		indexCacheSize = DefaultIndexCacheSize
+	}
+
+	return opts.
+		WithEncryptionKey(key).
+		WithIndexCacheSize(indexCacheSize)
+}
+
+// RotateEncryptionKey re-encrypts the database at path with a new key
+// oldKey opens the current data, and an empty key stands for unencrypted data. The data is
+// copied into a new directory encrypted with newKey, which replaces the data directory once
+// it holds every key of the current data. The previous directory is still encrypted with the
+// retired key, so it is removed unless keepPrevious is set, in which case it is kept next to
+// the data path and its path is returned. The database must not be open while the key is rotated
+func RotateEncryptionKey(path string, oldKey, newKey []byte, keepPrevious bool, logger *logrus.Logger) (string, error) {
+	if len(newKey) == 0 {
+		return "", fmt.Errorf("a new encryption key is required")
+	}
+	if !validEncryptionKeyLength(len(newKey)) {
+		return "", fmt.Errorf("encryption key must be 16, 24 or 32 bytes")
+	}
+	if logger == nil {
+		logger = logrus.New()
+	}
+
+	dataPath := filepath.Clean(path)
+	if _, err := os.Stat(dataPath); err != nil {
+		return "", fmt.Errorf("failed to open data directory: %w", err)
+	}
+	if isFileEngineDirectory(dataPath) {
+		return "", fmt.Errorf("data directory %s holds data of the file storage backend, which is not encrypted", dataPath)
+	}
+
+	timestamp := time.Now().Format("20060102150405.000000000")
+	rotatePath := dataPath + ".rotate." + timestamp
+	previousPath := dataPath + ".bak." + timestamp
+
+	source, err := badger.Open(withEncryption(badger.DefaultOptions(dataPath).WithLogger(logger), oldKey, 0))
+	if err != nil {
+		return "", fmt.Errorf("failed to open database with the current key: %w", err)
+	}
+
+	var keys int
+	err = source.View(func(txn *badger.Txn) error {
+		keys = countKeys(txn, "")
+		return nil
+	})
+	if err == nil {
+		err = copyDatabase(source, rotatePath, withEncryption(
+			badger.DefaultOptions(rotatePath).WithSyncWrites(true).WithLogger(logger), newKey, 0))
+	}
+	if closeErr := source.Close(); err == nil && closeErr != nil {
+		err = fmt.Errorf("failed to close database: %w", closeErr)
+	}
+	if err == nil {
+		err = verifyDatabase(withEncryption(badger.DefaultOptions(rotatePath).WithLogger(logger), newKey, 0), keys)
+	}
+	if err != nil {
+		os.RemoveAll(rotatePath)
+		return "", err
+	}
+
+	if err := os.Rename(dataPath, previousPath); err != nil {
+		os.RemoveAll(rotatePath)
+		return "", fmt.Errorf("failed to move existing data directory: %w", err)
+	}
+
+	if err := os.Rename(rotatePath, dataPath); err != nil {
+		// Put the previous data back in place
+		os.Rename(previousPath, dataPath)
+		os.RemoveAll(rotatePath)
+		return "", fmt.Errorf("failed to move re-encrypted data directory: %w", err)
+	}
+
+	if !keepPrevious {
+		if err := os.RemoveAll(previousPath); err != nil {
+			return previousPath, fmt.Errorf("failed to remove data encrypted with the old key at %s: %w", previousPath, err)
+		}
+		return "", nil
+	}
+	return previousPath, nil
+}
+
+// verifyDatabase checks that the database opened with opts holds the expected number of keys
+func verifyDatabase(opts badger.Options, expected int) error {
+	db, err := badger.Open(opts.WithReadOnly(true))
+	if err != nil {
+		return fmt.Errorf("failed to open re-encrypted database: %w", err)
+	}
+	defer db.Close()
+
+	var keys int
+	db.View(func(txn *badger.Txn) error {
+		keys = countKeys(txn, "")
+		return nil
+	})
+	if keys != expected {
+		return fmt.Errorf("re-encrypted database holds %d keys, expected %d", keys, expected)
+	}
+	return nil
+}
+
+// copyDatabase streams every key of source into a new database opened with opts
+func copyDatabase(source *badger.DB, path string, opts badger.Options) error {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return fmt.Errorf("failed to create directory: %w", err)
+	}
+
+	target, err := badger.Open(opts)
+	if err != nil {
+		return fmt.Errorf("failed to open database with the new key: %w", err)
+	}
+
+	// The stream is handed over in memory, so the data never reaches the disk unencrypted
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := source.Backup(writer, 0)
+		writer.CloseWithError(err)
+	}()
+
+	err = loadBackupStream(target, reader)
+	reader.Close()
+	if err != nil {
+		target.Close()
+		return fmt.Errorf("failed to copy data: %w", err)
+	}
+
+	if err := target.Close(); err != nil {
+		return fmt.Errorf("failed to close re-encrypted database: %w", err)
+	}
+	return nil
+}
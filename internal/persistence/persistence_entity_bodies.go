@@ -0,0 +1,214 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// entityBodyPrefix holds the entity bodies of the lazy entity storage mode, keyed by entity type and ID
+// They are reconciled with the loaded data whenever the datastore loads, so they carry no format header
+const entityBodyPrefix = "entitybody:"
+
+// entityBodyKey returns the key of an entity body
+func entityBodyKey(entityType, id string) string {
+	return entityBodyPrefix + entityType + ":" + id
+}
+
+// ReadEntityBodies reads the bodies of entities of one type, skipping IDs that are not stored
+// Recently used bodies are served from the entity cache
+func (pe *Engine) ReadEntityBodies(entityType string, ids []string) ([]common.Entity, error) {
+	entities := make([]common.Entity, 0, len(ids))
+
+	var missing []string
+	for _, id := range ids {
+		data, cached := pe.entityCache.Get(entityType + ":" + id)
+		if !cached {
+			missing = append(missing, id)
+			continue
+		}
+
+		entity, err := decodeEntityBody(data)
+		if err != nil {
+			return nil, err
+		}
+		entities = append(entities, entity)
+	}
+
+	if len(missing) == 0 {
+		return entities, nil
+	}
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		for _, id := range missing {
+			item, err := txn.Get([]byte(entityBodyKey(entityType, id)))
+			if err == badger.ErrKeyNotFound {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			err = item.Value(func(val []byte) error {
+				data, err := pe.Decompress(val)
+				if err != nil {
+					return fmt.Errorf("failed to decompress entity body: %w", err)
+				}
+
+				entity, err := decodeEntityBody(data)
+				if err != nil {
+					return err
+				}
+
+				// Decompression may return the value itself, which is only valid inside this function
+				pe.entityCache.Put(entityType+":"+id, bytes.Clone(data))
+				entities = append(entities, entity)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entities of type %s: %w", entityType, err)
+	}
+
+	return entities, nil
+}
+
+// WriteEntityBodies stores entity bodies and removes the bodies of removed entities in one batch
+func (pe *Engine) WriteEntityBodies(stored []common.Entity, removed []common.Entity) error {
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, entity := range stored {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(entity); err != nil {
+			return fmt.Errorf("failed to encode entity %s: %w", entity.ID, err)
+		}
+
+		if err := wb.Set([]byte(entityBodyKey(entity.Type, entity.ID)), pe.Compress(buf.Bytes())); err != nil {
+			return fmt.Errorf("failed to write entity body: %w", err)
+		}
+		pe.entityCache.Put(entity.Type+":"+entity.ID, buf.Bytes())
+	}
+
+	for _, entity := range removed {
+		if err := wb.Delete([]byte(entityBodyKey(entity.Type, entity.ID))); err != nil {
+			return fmt.Errorf("failed to remove entity body: %w", err)
+		}
+		pe.entityCache.Remove(entity.Type + ":" + entity.ID)
+	}
+
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to write entity bodies: %w", err)
+	}
+	return nil
+}
+
+// PruneEntityBodies removes the stored bodies of the entities keep rejects
+// Only keys are read, and the bodies are removed in one write batch
+func (pe *Engine) PruneEntityBodies(keep func(entityType, id string) bool) error {
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(entityBodyPrefix)
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			entityType, id, ok := strings.Cut(strings.TrimPrefix(string(it.Item().Key()), entityBodyPrefix), ":")
+			if ok && keep(entityType, id) {
+				continue
+			}
+			if err := wb.Delete(it.Item().KeyCopy(nil)); err != nil {
+				return err
+			}
+			pe.entityCache.Remove(entityType + ":" + id)
+		}
+		return nil
+	})
+	if err == nil {
+		err = wb.Flush()
+	}
+	if err != nil {
+		return fmt.Errorf("failed to prune entity bodies: %w", err)
+	}
+	return nil
+}
+
+// ViewEntityBodies returns a read-only view of the entity bodies stored at this point
+// The view holds a Badger read transaction until it is closed
+func (pe *Engine) ViewEntityBodies() (common.EntityBodyView, error) {
+	return &entityBodyView{pe: pe, txn: pe.db.NewTransaction(false)}, nil
+}
+
+// entityBodyView reads entity bodies from a Badger read transaction
+type entityBodyView struct {
+	pe  *Engine
+	txn *badger.Txn
+}
+
+// ForEachEntityBody passes the stored bodies of an entity type to fn in batches of at most batchSize
+// Bodies are read in key order and bypass the entity cache
+func (v *entityBodyView) ForEachEntityBody(entityType string, batchSize int, fn func(entities []common.Entity) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(entityBodyKey(entityType, ""))
+	it := v.txn.NewIterator(opts)
+	defer it.Close()
+
+	batch := make([]common.Entity, 0, batchSize)
+	for it.Rewind(); it.Valid(); it.Next() {
+		err := it.Item().Value(func(val []byte) error {
+			data, err := v.pe.Decompress(val)
+			if err != nil {
+				return fmt.Errorf("failed to decompress entity body: %w", err)
+			}
+
+			entity, err := decodeEntityBody(data)
+			if err != nil {
+				return err
+			}
+			batch = append(batch, entity)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("failed to read entities of type %s: %w", entityType, err)
+		}
+
+		if len(batch) == batchSize {
+			if err := fn(batch); err != nil {
+				return err
+			}
+			batch = batch[:0]
+		}
+	}
+
+	if len(batch) > 0 {
+		return fn(batch)
+	}
+	return nil
+}
+
+// Close discards the read transaction of the view
+func (v *entityBodyView) Close() {
+	v.txn.Discard()
+}
+
+// decodeEntityBody decodes an entity body written by WriteEntityBodies
+func decodeEntityBody(data []byte) (common.Entity, error) {
+	var entity common.Entity
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&entity); err != nil {
+		return common.Entity{}, fmt.Errorf("failed to decode entity body: %w", err)
+	}
+	return entity, nil
+}
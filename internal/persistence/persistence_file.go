@@ -0,0 +1,1006 @@
+package persistence
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
+	"github.com/phillarmonic/syncopate-db/internal/tracing"
+	"github.com/sirupsen/logrus"
+)
+
+// Files of the file persistence engine
+const (
+	fileSnapshotName  = "snapshot.dat"
+	fileSegmentPrefix = "wal-"
+	fileSegmentSuffix = ".log"
+
+	// fileRecordHeaderSize is the size of the length and checksum that precede every record
+	fileRecordHeaderSize = 8
+	// fileMaxRecordSize bounds the length read from a record header, so a damaged header
+	// is detected instead of allocating its length
+	fileMaxRecordSize = 1 << 30
+)
+
+// Operations that only appear in the files of the file persistence engine
+// They record the state the Badger engine keeps under separate keys
+const (
+	fileOpSnapshot      = iota + 100 // Snapshot header, its sequence is the last one the snapshot contains
+	fileOpCounter                    // Auto-increment counter of an entity type
+	fileOpDeletedIDs                 // Deleted IDs of an auto-increment entity type
+	fileOpSchemaVersion              // One version of an entity type definition
+)
+
+// fileRecordTable is the checksum table of file records
+var fileRecordTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errTornRecord reports a record that was only partly written
+var errTornRecord = errors.New("incomplete record")
+
+// fileRecord is a single record of a log segment or snapshot file
+// Operations use the WAL operation codes and payloads of the Badger engine
+type fileRecord struct {
+	Sequence   uint64
+	Timestamp  int64
+	Operation  int
+	EntityType string
+	EntityID   string
+	Data       []byte
+}
+
+// FileConfig holds configuration for the file persistence engine
+type FileConfig struct {
+	Path             string
+	SyncWrites       bool
+	SnapshotInterval time.Duration
+	Logger           *logrus.Logger
+	// Durability is the default durability of writes, empty means sync
+	Durability common.Durability
+	// GroupCommitInterval is the time between group commits, 0 uses DefaultGroupCommitInterval
+	GroupCommitInterval time.Duration
+}
+
+// FileEngine persists the datastore in plain files: an append-only log of operations,
+// split into segments, and a snapshot file. Taking a snapshot starts a new segment and
+// removes the segments the snapshot contains. It depends on nothing but the standard library
+//
+// Every record is written with its length and a CRC-32C checksum. A record cut short by a
+// crash is dropped when the engine opens, so the log always ends with a complete record
+type FileEngine struct {
+	path       string
+	logger     *logrus.Logger
+	durability common.Durability // Durability of writes that do not request one
+	commits    *groupCommitter   // Syncs the segment for waiting writes
+
+	mu       sync.Mutex // Guards the segment, the sequence and the metadata
+	segment  *os.File   // Segment new records are appended to
+	sequence uint64     // Last used sequence number
+	meta     fileMetadata
+	closed   bool
+
+	snapshotMu          sync.Mutex             // Serializes snapshots
+	snapshotStore       common.DatastoreEngine // Store snapshotted by the snapshot routine and on close
+	snapshotInterval    time.Duration
+	stopSnapshot        chan struct{}
+	replayAfterSequence uint64 // Last sequence number contained in the loaded snapshot
+}
+
+// fileMetadata holds the counters, deleted IDs and schema history of all entity types
+// They are small, so they are kept in memory and written to every snapshot
+type fileMetadata struct {
+	counters       map[string]uint64
+	deletedIDs     map[string]map[string]bool
+	schemaVersions map[string]map[int]common.EntityDefinitionVersion
+}
+
+// NewFileEngine opens the file persistence engine in a directory, creating it if needed
+func NewFileEngine(config FileConfig) (*FileEngine, error) {
+	if config.Logger == nil {
+		config.Logger = logrus.New()
+	}
+
+	if err := os.MkdirAll(config.Path, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// Badger keeps a MANIFEST file in its directory, and the two formats cannot share one
+	if _, err := os.Stat(filepath.Join(config.Path, "MANIFEST")); err == nil {
+		return nil, fmt.Errorf("data directory %s holds a Badger database, use the badger storage backend", config.Path)
+	}
+
+	durability, err := resolveDurability(config.Durability)
+	if err != nil {
+		return nil, err
+	}
+
+	fe := &FileEngine{
+		path:             config.Path,
+		logger:           config.Logger,
+		durability:       durability,
+		snapshotInterval: config.SnapshotInterval,
+		meta:             newFileMetadata(),
+	}
+
+	// A leftover temporary snapshot was never completed
+	os.Remove(filepath.Join(fe.path, fileSnapshotName+".tmp"))
+
+	if err := fe.open(); err != nil {
+		return nil, err
+	}
+	fe.commits = newGroupCommitter(config.GroupCommitInterval, fe.syncSegment, fe.logger)
+
+	if config.SnapshotInterval > 0 {
+		fe.startSnapshotRoutine()
+	}
+
+	return fe, nil
+}
+
+// newFileMetadata returns empty metadata
+func newFileMetadata() fileMetadata {
+	return fileMetadata{
+		counters:       make(map[string]uint64),
+		deletedIDs:     make(map[string]map[string]bool),
+		schemaVersions: make(map[string]map[int]common.EntityDefinitionVersion),
+	}
+}
+
+// open reads the metadata and the last sequence number from the snapshot and the log,
+// drops an incomplete record at the end of the log and opens its last segment for appending
+func (fe *FileEngine) open() error {
+	// The snapshot is written to a temporary file and renamed, so it is never incomplete
+	_, err := readRecordFile(filepath.Join(fe.path, fileSnapshotName), func(record fileRecord) error {
+		if record.Operation == fileOpSnapshot {
+			fe.sequence = record.Sequence
+			return nil
+		}
+		return fe.meta.apply(record)
+	})
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read snapshot: %w", err)
+	}
+	snapshotSequence := fe.sequence
+
+	segments, err := fe.listSegments()
+	if err != nil {
+		return err
+	}
+
+	for i, path := range segments {
+		validSize, err := readRecordFile(path, func(record fileRecord) error {
+			if record.Sequence <= snapshotSequence {
+				return nil
+			}
+			if record.Sequence > fe.sequence {
+				fe.sequence = record.Sequence
+			}
+			return fe.meta.apply(record)
+		})
+
+		if errors.Is(err, errTornRecord) {
+			if i < len(segments)-1 {
+				// Only the segment being written when the process stopped can end early
+				fe.logger.Warnf("Log segment %s is damaged, records after offset %d are skipped", filepath.Base(path), validSize)
+				continue
+			}
+
+			fe.logger.Warnf("Dropping incomplete record at the end of log segment %s", filepath.Base(path))
+			if err := os.Truncate(path, validSize); err != nil {
+				return fmt.Errorf("failed to truncate log segment: %w", err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read log segment %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	// Continue writing to the last segment, or start the first one
+	segmentPath := fe.segmentPath(fe.sequence + 1)
+	if len(segments) > 0 {
+		segmentPath = segments[len(segments)-1]
+	}
+
+	fe.segment, err = os.OpenFile(segmentPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open log segment: %w", err)
+	}
+	return nil
+}
+
+// segmentPath returns the path of the segment whose first record has the given sequence number
+func (fe *FileEngine) segmentPath(firstSequence uint64) string {
+	return filepath.Join(fe.path, fmt.Sprintf("%s%020d%s", fileSegmentPrefix, firstSequence, fileSegmentSuffix))
+}
+
+// listSegments returns the paths of all log segments, oldest first
+func (fe *FileEngine) listSegments() ([]string, error) {
+	entries, err := os.ReadDir(fe.path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list data directory: %w", err)
+	}
+
+	type segment struct {
+		path          string
+		firstSequence uint64
+	}
+
+	var segments []segment
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, fileSegmentPrefix) || !strings.HasSuffix(name, fileSegmentSuffix) {
+			continue
+		}
+
+		firstSequence, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(name, fileSegmentPrefix), fileSegmentSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, segment{path: filepath.Join(fe.path, name), firstSequence: firstSequence})
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].firstSequence < segments[j].firstSequence
+	})
+
+	paths := make([]string, len(segments))
+	for i, s := range segments {
+		paths[i] = s.path
+	}
+	return paths, nil
+}
+
+// appendRecord appends a record to the log with the default durability
+func (fe *FileEngine) appendRecord(op int, entityType, entityID string, data []byte) error {
+	return fe.appendDurable(op, entityType, entityID, data, fe.durability)
+}
+
+// appendDurable appends a record to the log and waits as long as the durability requires
+func (fe *FileEngine) appendDurable(op int, entityType, entityID string, data []byte, durability common.Durability) error {
+	start := time.Now()
+	if err := fe.writeRecord(op, entityType, entityID, data); err != nil {
+		return err
+	}
+
+	err := fe.commits.wait(durability)
+	metrics.WALWriteDuration.Observe(time.Since(start).Seconds())
+	return err
+}
+
+// writeRecord assigns the next sequence number to a record and writes it to the log
+// Metadata records are applied to the in-memory metadata as well
+func (fe *FileEngine) writeRecord(op int, entityType, entityID string, data []byte) error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if fe.closed {
+		return fmt.Errorf("persistence engine is closed")
+	}
+
+	record := fileRecord{
+		Sequence:   fe.sequence + 1,
+		Timestamp:  time.Now().UnixNano(),
+		Operation:  op,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Data:       data,
+	}
+
+	frame, err := encodeFileRecord(record)
+	if err != nil {
+		return err
+	}
+
+	if _, err := fe.segment.Write(frame); err != nil {
+		return fmt.Errorf("failed to write log record: %w", err)
+	}
+
+	fe.sequence = record.Sequence
+	return fe.meta.apply(record)
+}
+
+// syncSegment syncs the records written to the current segment to disk
+func (fe *FileEngine) syncSegment() error {
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if fe.closed {
+		return fmt.Errorf("persistence engine is closed")
+	}
+	if err := fe.segment.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log segment: %w", err)
+	}
+	return nil
+}
+
+// appendEncoded gob-encodes a payload and appends it to the log
+func (fe *FileEngine) appendEncoded(op int, entityType, entityID string, payload interface{}) error {
+	return fe.appendEncodedDurable(op, entityType, entityID, payload, fe.durability)
+}
+
+// appendEncodedDurable gob-encodes a payload and appends it to the log with a durability
+func (fe *FileEngine) appendEncodedDurable(op int, entityType, entityID string, payload interface{}, durability common.Durability) error {
+	data, err := encodeRecordPayload(payload)
+	if err != nil {
+		return err
+	}
+	return fe.appendDurable(op, entityType, entityID, data, durability)
+}
+
+// RegisterEntityType records a new entity type in the log
+func (fe *FileEngine) RegisterEntityType(store common.DatastoreEngine, def common.EntityDefinition) error {
+	return fe.appendEncoded(OpRegisterEntityType, def.Name, "", def)
+}
+
+// Insert records a new entity in the log
+func (fe *FileEngine) Insert(store common.DatastoreEngine, entityType, entityID string, data map[string]interface{}) error {
+	return fe.InsertWithOptions(store, entityType, entityID, data, common.WriteOptions{})
+}
+
+// InsertWithOptions records a new entity in the log as durably as the options request
+func (fe *FileEngine) InsertWithOptions(store common.DatastoreEngine, entityType, entityID string, data map[string]interface{}, options common.WriteOptions) (err error) {
+	durability, err := writeDurability(options, fe.durability)
+	if err != nil {
+		return err
+	}
+	span := startWriteSpan(options, "persistence.insert", entityType, entityID, durability)
+	defer func() { tracing.End(span, err) }()
+	return fe.appendEncodedDurable(OpInsertEntity, entityType, entityID, data, durability)
+}
+
+// Update records an entity update in the log
+func (fe *FileEngine) Update(store common.DatastoreEngine, entityType string, entityID string, data map[string]interface{}) error {
+	return fe.UpdateWithOptions(store, entityType, entityID, data, common.WriteOptions{})
+}
+
+// UpdateWithOptions records an entity update in the log as durably as the options request
+func (fe *FileEngine) UpdateWithOptions(store common.DatastoreEngine, entityType string, entityID string, data map[string]interface{}, options common.WriteOptions) (err error) {
+	durability, err := writeDurability(options, fe.durability)
+	if err != nil {
+		return err
+	}
+	span := startWriteSpan(options, "persistence.update", entityType, entityID, durability)
+	defer func() { tracing.End(span, err) }()
+	return fe.appendEncodedDurable(OpUpdateEntity, entityType, entityID, data, durability)
+}
+
+// Delete records an entity deletion in the log
+func (fe *FileEngine) Delete(store common.DatastoreEngine, entityID string, entityType string) error {
+	return fe.DeleteWithOptions(store, entityID, entityType, common.WriteOptions{})
+}
+
+// DeleteWithOptions records an entity deletion in the log as durably as the options request
+func (fe *FileEngine) DeleteWithOptions(store common.DatastoreEngine, entityID string, entityType string, options common.WriteOptions) (err error) {
+	durability, err := writeDurability(options, fe.durability)
+	if err != nil {
+		return err
+	}
+	span := startWriteSpan(options, "persistence.delete", entityType, entityID, durability)
+	defer func() { tracing.End(span, err) }()
+	return fe.appendDurable(OpDeleteEntity, entityType, entityID, nil, durability)
+}
+
+// UpdateEntityType records an updated entity type definition in the log
+func (fe *FileEngine) UpdateEntityType(store common.DatastoreEngine, def common.EntityDefinition) error {
+	return fe.appendEncoded(OpUpdateEntityType, def.Name, "", def)
+}
+
+// TruncateEntityType records the truncation of an entity type in the log
+func (fe *FileEngine) TruncateEntityType(store common.DatastoreEngine, entityType string) error {
+	return fe.appendRecord(OpTruncateEntityType, entityType, "", nil)
+}
+
+// TruncateDatabase records the truncation of the entire database in the log
+func (fe *FileEngine) TruncateDatabase(store common.DatastoreEngine) error {
+	return fe.appendRecord(OpTruncateDatabase, "", "", nil)
+}
+
+// DropEntityType records a drop in the log, which also discards the metadata of the entity type
+func (fe *FileEngine) DropEntityType(store common.DatastoreEngine, entityType string) error {
+	return fe.appendRecord(OpDropEntityType, entityType, "", nil)
+}
+
+// RenameEntityType records a rename in the log
+// The metadata of the old name is discarded, the datastore saves it again under the new name
+func (fe *FileEngine) RenameEntityType(store common.DatastoreEngine, oldName, newName string) error {
+	return fe.appendRecord(OpRenameEntityType, oldName, "", []byte(newName))
+}
+
+// CloneEntityType records a clone in the log
+func (fe *FileEngine) CloneEntityType(store common.DatastoreEngine, source, target string, includeData bool) error {
+	return fe.appendEncoded(OpCloneEntityType, source, "", cloneEntityTypeOperation{Target: target, IncludeData: includeData})
+}
+
+// SaveCounter records an auto-increment counter in the log
+func (fe *FileEngine) SaveCounter(entityType string, counter uint64) error {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, counter)
+	return fe.appendRecord(fileOpCounter, entityType, "", value)
+}
+
+// LoadCounters loads the auto-increment counters into the store
+func (fe *FileEngine) LoadCounters(store common.DatastoreEngine) error {
+	fe.mu.Lock()
+	counters := make(map[string]uint64, len(fe.meta.counters))
+	for entityType, counter := range fe.meta.counters {
+		counters[entityType] = counter
+	}
+	fe.mu.Unlock()
+
+	for entityType, counter := range counters {
+		if err := store.SetAutoIncrementCounter(entityType, counter); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SaveDeletedIDs records the deleted IDs of an entity type in the log
+func (fe *FileEngine) SaveDeletedIDs(entityType string, deletedIDs map[string]bool) error {
+	return fe.appendEncoded(fileOpDeletedIDs, entityType, "", deletedIDs)
+}
+
+// LoadDeletedIDs loads the deleted IDs into the store
+func (fe *FileEngine) LoadDeletedIDs(store common.DatastoreEngine) error {
+	fe.mu.Lock()
+	deletedIDs := make(map[string]map[string]bool, len(fe.meta.deletedIDs))
+	for entityType, ids := range fe.meta.deletedIDs {
+		deletedIDs[entityType] = ids
+	}
+	fe.mu.Unlock()
+
+	for entityType, ids := range deletedIDs {
+		if err := store.LoadDeletedIDs(entityType, ids); err != nil {
+			fe.logger.Warnf("Error loading deleted IDs for entity type %s: %v", entityType, err)
+			// Continue loading other entity types despite errors
+		}
+	}
+	return nil
+}
+
+// SaveSchemaVersion records a version of an entity type definition in the log
+func (fe *FileEngine) SaveSchemaVersion(entityType string, version common.EntityDefinitionVersion) error {
+	return fe.appendEncoded(fileOpSchemaVersion, entityType, "", version)
+}
+
+// LoadSchemaVersions loads the schema version history into the store
+func (fe *FileEngine) LoadSchemaVersions(store common.DatastoreEngine) error {
+	fe.mu.Lock()
+	versionsByType := make(map[string][]common.EntityDefinitionVersion, len(fe.meta.schemaVersions))
+	for entityType, versions := range fe.meta.schemaVersions {
+		for _, version := range versions {
+			versionsByType[entityType] = append(versionsByType[entityType], version)
+		}
+	}
+	fe.mu.Unlock()
+
+	for entityType, versions := range versionsByType {
+		sort.Slice(versions, func(i, j int) bool {
+			return versions[i].Version < versions[j].Version
+		})
+		if err := store.LoadSchemaVersions(entityType, versions); err != nil {
+			return fmt.Errorf("failed to load schema versions for %s: %w", entityType, err)
+		}
+	}
+	return nil
+}
+
+// LoadLatestSnapshot loads the snapshot file into the store
+// This should only be called during initialization
+func (fe *FileEngine) LoadLatestSnapshot(store common.DatastoreEngine) error {
+	// Without a snapshot, the whole log is replayed
+	fe.replayAfterSequence = 0
+
+	var snapshotSequence uint64
+	_, err := readRecordFile(filepath.Join(fe.path, fileSnapshotName), func(record fileRecord) error {
+		switch record.Operation {
+		case fileOpSnapshot:
+			snapshotSequence = record.Sequence
+
+		case OpRegisterEntityType:
+			var def common.EntityDefinition
+			if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&def); err != nil {
+				return fmt.Errorf("failed to decode entity definition: %w", err)
+			}
+
+			prepareSnapshotDefinition(&def)
+			if err := store.RegisterEntityType(def); err != nil {
+				return fmt.Errorf("failed to register entity type: %w", err)
+			}
+
+		case OpInsertEntity:
+			var fields map[string]interface{}
+			if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&fields); err != nil {
+				return fmt.Errorf("failed to decode entity fields: %w", err)
+			}
+
+			if err := store.Insert(record.EntityType, record.EntityID, fields); err != nil {
+				return fmt.Errorf("failed to insert entity: %w", err)
+			}
+		}
+
+		// Metadata was read when the engine opened
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// Log records contained in the snapshot are skipped by LoadWAL
+	fe.replayAfterSequence = snapshotSequence
+	return nil
+}
+
+// LoadWAL applies the log records written after the loaded snapshot to the store
+// This should only be called during initialization before the server starts
+func (fe *FileEngine) LoadWAL(store common.DatastoreEngine) error {
+	segments, err := fe.listSegments()
+	if err != nil {
+		return err
+	}
+
+	errorCount := 0
+	for _, path := range segments {
+		_, err := readRecordFile(path, func(record fileRecord) error {
+			if record.Sequence <= fe.replayAfterSequence || record.Operation >= fileOpSnapshot {
+				return nil
+			}
+
+			if err := replayOperation(store, fe.logger, record.Operation, record.EntityType, record.EntityID, record.Data); err != nil {
+				fe.logger.Warnf("Error applying log record %d: %v, skipping", record.Sequence, err)
+				errorCount++
+			}
+			return nil
+		})
+
+		// A damaged segment was reported when the engine opened
+		if err != nil && !errors.Is(err, errTornRecord) {
+			return fmt.Errorf("failed to read log segment %s: %w", filepath.Base(path), err)
+		}
+	}
+
+	if errorCount > 0 {
+		fe.logger.Warnf("WAL recovery completed with %d errors", errorCount)
+	} else {
+		fe.logger.Info("WAL recovery completed successfully")
+	}
+	return nil
+}
+
+// TakeSnapshot writes a snapshot of the store and removes the log segments it contains
+func (fe *FileEngine) TakeSnapshot(store common.DatastoreEngine) error {
+	fe.snapshotMu.Lock()
+	defer fe.snapshotMu.Unlock()
+
+	_, span := tracing.Start(context.Background(), "persistence.snapshot")
+	err := fe.takeSnapshot(store)
+	tracing.End(span, err)
+	return err
+}
+
+// takeSnapshot writes a snapshot of the store
+// The log moves to a new segment at the point the snapshot is taken, so the segments before
+// it are contained in the snapshot. Writes are logged after they are applied in memory,
+// so the snapshot may also contain a few later records, which are replayed idempotently on load
+// This function requires that the caller holds the snapshot lock
+func (fe *FileEngine) takeSnapshot(store common.DatastoreEngine) (err error) {
+	start := time.Now()
+	var size int64
+	defer func() { metrics.ObserveSnapshot(time.Since(start), size, err) }()
+
+	// The snapshot is written to a temporary file and moved over the previous snapshot
+	tmpPath := filepath.Join(fe.path, fileSnapshotName+".tmp")
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	writer := &fileSnapshotWriter{writer: bufio.NewWriter(file)}
+
+	var meta fileMetadata
+	var previousSegments []string
+
+	err = store.StreamSnapshot(func() {
+		fe.mu.Lock()
+		defer fe.mu.Unlock()
+
+		if fe.closed {
+			writer.err = fmt.Errorf("persistence engine is closed")
+			return
+		}
+
+		segments, err := fe.listSegments()
+		if err != nil {
+			writer.err = err
+			return
+		}
+
+		// Without writes since the last rotation, the new segment is the current one
+		segmentPath := fe.segmentPath(fe.sequence + 1)
+		for _, path := range segments {
+			if path != segmentPath {
+				previousSegments = append(previousSegments, path)
+			}
+		}
+
+		// Records not yet committed by the group committer are synced before the segment is closed
+		if err := fe.segment.Sync(); err != nil {
+			writer.err = fmt.Errorf("failed to sync log segment: %w", err)
+			return
+		}
+
+		segment, err := os.OpenFile(segmentPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			writer.err = fmt.Errorf("failed to start log segment: %w", err)
+			return
+		}
+		if err := fe.segment.Close(); err != nil {
+			fe.logger.Warnf("Failed to close log segment: %v", err)
+		}
+
+		fe.segment = segment
+		meta = fe.meta.clone()
+		writer.writeHeader(fe.sequence)
+	}, DefaultSnapshotChunkSize, writer)
+	if err == nil {
+		err = writer.writeMetadata(meta)
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+
+	if err := os.Rename(tmpPath, filepath.Join(fe.path, fileSnapshotName)); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace snapshot: %w", err)
+	}
+	if err := syncDirectory(fe.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(filepath.Join(fe.path, fileSnapshotName)); err == nil {
+		size = info.Size()
+	}
+
+	// The snapshot contains every record of the previous segments
+	for _, path := range previousSegments {
+		if err := os.Remove(path); err != nil {
+			fe.logger.Warnf("Failed to remove log segment %s: %v", filepath.Base(path), err)
+		}
+	}
+	return nil
+}
+
+// fileSnapshotWriter writes a streamed snapshot as records of a buffered file
+// The first error is kept and returned by every later write
+type fileSnapshotWriter struct {
+	writer *bufio.Writer
+	err    error
+}
+
+// write appends a record to the snapshot
+func (w *fileSnapshotWriter) write(op int, entityType, entityID string, data []byte) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	frame, err := encodeFileRecord(fileRecord{Operation: op, EntityType: entityType, EntityID: entityID, Data: data})
+	if err == nil {
+		_, err = w.writer.Write(frame)
+	}
+	w.err = err
+	return err
+}
+
+// writeEncoded appends a record with a gob-encoded payload to the snapshot
+func (w *fileSnapshotWriter) writeEncoded(op int, entityType, entityID string, payload interface{}) error {
+	if w.err != nil {
+		return w.err
+	}
+
+	data, err := encodeRecordPayload(payload)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	return w.write(op, entityType, entityID, data)
+}
+
+// writeHeader starts the snapshot with its header, whose sequence is the last one the snapshot contains
+func (w *fileSnapshotWriter) writeHeader(sequence uint64) {
+	if w.err != nil {
+		return
+	}
+
+	header, err := encodeFileRecord(fileRecord{Sequence: sequence, Timestamp: time.Now().UnixNano(), Operation: fileOpSnapshot})
+	if err == nil {
+		_, err = w.writer.Write(header)
+	}
+	w.err = err
+}
+
+// WriteEntityType writes the definition of an entity type
+func (w *fileSnapshotWriter) WriteEntityType(def common.EntityDefinition) error {
+	return w.writeEncoded(OpRegisterEntityType, def.Name, "", def)
+}
+
+// WriteEntities writes an insert record for each entity
+func (w *fileSnapshotWriter) WriteEntities(entities []common.Entity) error {
+	for _, entity := range entities {
+		if err := w.writeEncoded(OpInsertEntity, entity.Type, entity.ID, entity.Fields); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeMetadata writes the counters, deleted IDs and schema versions and flushes the snapshot
+func (w *fileSnapshotWriter) writeMetadata(meta fileMetadata) error {
+	for entityType, counter := range meta.counters {
+		value := make([]byte, 8)
+		binary.LittleEndian.PutUint64(value, counter)
+		if err := w.write(fileOpCounter, entityType, "", value); err != nil {
+			return err
+		}
+	}
+	for entityType, ids := range meta.deletedIDs {
+		if err := w.writeEncoded(fileOpDeletedIDs, entityType, "", ids); err != nil {
+			return err
+		}
+	}
+	for entityType, versions := range meta.schemaVersions {
+		for _, version := range versions {
+			if err := w.writeEncoded(fileOpSchemaVersion, entityType, "", version); err != nil {
+				return err
+			}
+		}
+	}
+
+	if w.err != nil {
+		return w.err
+	}
+	return w.writer.Flush()
+}
+
+// SetEngine sets the store that the snapshot routine snapshots, and that is snapshotted on close
+func (fe *FileEngine) SetEngine(store common.DatastoreEngine) {
+	fe.snapshotMu.Lock()
+	defer fe.snapshotMu.Unlock()
+	fe.snapshotStore = store
+}
+
+// startSnapshotRoutine takes a snapshot of the attached store at every snapshot interval
+func (fe *FileEngine) startSnapshotRoutine() {
+	fe.stopSnapshot = make(chan struct{})
+	ticker := time.NewTicker(fe.snapshotInterval)
+	stop := fe.stopSnapshot
+
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				fe.snapshotMu.Lock()
+				if fe.snapshotStore != nil {
+					if err := fe.takeSnapshot(fe.snapshotStore); err != nil {
+						fe.logger.Warnf("Scheduled snapshot failed: %v", err)
+					}
+				}
+				fe.snapshotMu.Unlock()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close takes a final snapshot of the attached store and closes the log
+func (fe *FileEngine) Close() error {
+	fe.mu.Lock()
+	closed := fe.closed
+	fe.mu.Unlock()
+	if closed {
+		return nil
+	}
+
+	if fe.stopSnapshot != nil {
+		close(fe.stopSnapshot)
+		fe.stopSnapshot = nil
+	}
+
+	fe.snapshotMu.Lock()
+	if fe.snapshotStore != nil {
+		if err := fe.takeSnapshot(fe.snapshotStore); err != nil {
+			// Only log as warning, the log still holds every change
+			fe.logger.Warnf("Failed to take final snapshot on close: %v", err)
+		}
+	}
+	fe.snapshotMu.Unlock()
+
+	// Commit the writes still waiting for the group committer
+	fe.commits.close()
+
+	fe.mu.Lock()
+	defer fe.mu.Unlock()
+
+	if fe.closed {
+		return nil
+	}
+	fe.closed = true
+
+	if err := fe.segment.Sync(); err != nil {
+		fe.segment.Close()
+		return fmt.Errorf("failed to sync log segment: %w", err)
+	}
+	return fe.segment.Close()
+}
+
+// apply updates the metadata with a log or snapshot record
+func (m fileMetadata) apply(record fileRecord) error {
+	switch record.Operation {
+	case fileOpCounter:
+		if len(record.Data) != 8 {
+			return fmt.Errorf("invalid counter record for %s", record.EntityType)
+		}
+		m.counters[record.EntityType] = binary.LittleEndian.Uint64(record.Data)
+
+	case fileOpDeletedIDs:
+		var deletedIDs map[string]bool
+		if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&deletedIDs); err != nil {
+			return fmt.Errorf("failed to decode deleted IDs: %w", err)
+		}
+		m.deletedIDs[record.EntityType] = deletedIDs
+
+	case fileOpSchemaVersion:
+		var version common.EntityDefinitionVersion
+		if err := gob.NewDecoder(bytes.NewReader(record.Data)).Decode(&version); err != nil {
+			return fmt.Errorf("failed to decode schema version: %w", err)
+		}
+		if m.schemaVersions[record.EntityType] == nil {
+			m.schemaVersions[record.EntityType] = make(map[int]common.EntityDefinitionVersion)
+		}
+		m.schemaVersions[record.EntityType][version.Version] = version
+
+	case OpDropEntityType, OpRenameEntityType:
+		delete(m.counters, record.EntityType)
+		delete(m.deletedIDs, record.EntityType)
+		delete(m.schemaVersions, record.EntityType)
+	}
+	return nil
+}
+
+// clone returns a copy of the metadata that later records do not change
+// Deleted ID sets and versions are replaced rather than modified, so they are shared
+func (m fileMetadata) clone() fileMetadata {
+	c := newFileMetadata()
+	for entityType, counter := range m.counters {
+		c.counters[entityType] = counter
+	}
+	for entityType, ids := range m.deletedIDs {
+		c.deletedIDs[entityType] = ids
+	}
+	for entityType, versions := range m.schemaVersions {
+		c.schemaVersions[entityType] = make(map[int]common.EntityDefinitionVersion, len(versions))
+		for number, version := range versions {
+			c.schemaVersions[entityType][number] = version
+		}
+	}
+	return c
+}
+
+// encodeRecordPayload gob-encodes the payload of a record
+func encodeRecordPayload(payload interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(payload); err != nil {
+		return nil, fmt.Errorf("failed to encode record payload: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// encodeFileRecord encodes a record with its length and checksum
+func encodeFileRecord(record fileRecord) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Write(make([]byte, fileRecordHeaderSize))
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return nil, fmt.Errorf("failed to encode record: %w", err)
+	}
+
+	frame := buf.Bytes()
+	payload := frame[fileRecordHeaderSize:]
+	binary.LittleEndian.PutUint32(frame[0:4], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[4:8], crc32.Checksum(payload, fileRecordTable))
+	return frame, nil
+}
+
+// readRecordFile calls fn for every record of a file and returns the size of its intact part
+// A record that is cut short or fails its checksum ends the file with errTornRecord
+func readRecordFile(path string, fn func(record fileRecord) error) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	header := make([]byte, fileRecordHeaderSize)
+	var offset int64
+
+	for {
+		if _, err := io.ReadFull(reader, header); err != nil {
+			if err == io.EOF {
+				return offset, nil
+			}
+			if err == io.ErrUnexpectedEOF {
+				return offset, errTornRecord
+			}
+			return offset, err
+		}
+
+		length := binary.LittleEndian.Uint32(header[0:4])
+		if length > fileMaxRecordSize {
+			return offset, errTornRecord
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, errTornRecord
+			}
+			return offset, err
+		}
+		if crc32.Checksum(payload, fileRecordTable) != binary.LittleEndian.Uint32(header[4:8]) {
+			return offset, errTornRecord
+		}
+
+		var record fileRecord
+		if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(&record); err != nil {
+			return offset, fmt.Errorf("failed to decode record at offset %d: %w", offset, err)
+		}
+
+		if err := fn(record); err != nil {
+			return offset, err
+		}
+		offset += int64(fileRecordHeaderSize) + int64(length)
+	}
+}
+
+// syncDirectory flushes a directory, so renames and removals within it are durable
+func syncDirectory(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// isFileEngineDirectory reports whether a directory holds data of the file persistence engine
+func isFileEngineDirectory(path string) bool {
+	if _, err := os.Stat(filepath.Join(path, fileSnapshotName)); err == nil {
+		return true
+	}
+	segments, _ := filepath.Glob(filepath.Join(path, fileSegmentPrefix+"*"+fileSegmentSuffix))
+	return len(segments) > 0
+}
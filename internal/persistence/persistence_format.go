@@ -0,0 +1,563 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+// FormatVersion is the on-disk format written by this build
+//
+//	1: WAL entries and snapshots are bare gob values, each snapshot is a single value
+//	2: snapshots are split into checksummed per-type chunks described by a manifest
+//	3: WAL entries, snapshot manifests and snapshot chunks start with a format header
+//
+// Records of every earlier version are still read. UpgradeFormat rewrites them in this version
+const FormatVersion = 3
+
+// formatVersionKey records the format version of a data directory once every record uses it
+const formatVersionKey = "format_version"
+
+// formatMagic starts the header of every versioned record
+var formatMagic = []byte("SYDB")
+
+// formatHeaderSize is the size of the magic, the record kind and the version
+const formatHeaderSize = 7
+
+// recordKind identifies what a versioned record holds
+type recordKind byte
+
+const (
+	recordWALEntry         recordKind = 'W'
+	recordSnapshotManifest recordKind = 'M'
+	recordSnapshotChunk    recordKind = 'C'
+)
+
+// String returns a readable name of the record kind
+func (k recordKind) String() string {
+	switch k {
+	case recordWALEntry:
+		return "WAL entry"
+	case recordSnapshotManifest:
+		return "snapshot manifest"
+	case recordSnapshotChunk:
+		return "snapshot chunk"
+	default:
+		return fmt.Sprintf("record kind %q", byte(k))
+	}
+}
+
+// appendFormatHeader appends the header of a record in the current format version
+func appendFormatHeader(dst []byte, kind recordKind) []byte {
+	dst = append(dst, formatMagic...)
+	dst = append(dst, byte(kind))
+	return binary.LittleEndian.AppendUint16(dst, FormatVersion)
+}
+
+// readFormatHeader splits a record into its format version and body
+// Records written before headers were introduced are returned whole with version 0
+func readFormatHeader(value []byte, kind recordKind) (int, []byte, error) {
+	if len(value) < formatHeaderSize || !bytes.HasPrefix(value, formatMagic) {
+		return 0, value, nil
+	}
+
+	if recordKind(value[len(formatMagic)]) != kind {
+		return 0, nil, fmt.Errorf("expected a %s, found a %s", kind, recordKind(value[len(formatMagic)]))
+	}
+
+	version := int(binary.LittleEndian.Uint16(value[len(formatMagic)+1:]))
+	if version > FormatVersion {
+		return 0, nil, fmt.Errorf("%s uses format version %d, this build supports up to %d", kind, version, FormatVersion)
+	}
+
+	return version, value[formatHeaderSize:], nil
+}
+
+// encodeWALEntry serializes a WAL entry in the current format version
+func encodeWALEntry(entry WALEntry) ([]byte, error) {
+	buf := bytes.NewBuffer(appendFormatHeader(nil, recordWALEntry))
+	if err := gob.NewEncoder(buf).Encode(entry); err != nil {
+		return nil, fmt.Errorf("failed to encode WAL entry: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeWALEntry parses a WAL entry of any supported format version
+// It returns the format version the entry was written in
+func decodeWALEntry(value []byte) (WALEntry, int, error) {
+	var entry WALEntry
+
+	version, body, err := readFormatHeader(value, recordWALEntry)
+	if err != nil {
+		return entry, 0, err
+	}
+
+	// Versions 1 and 2 wrote the same bare gob value
+	if version == 0 {
+		version = 1
+	}
+
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&entry); err != nil {
+		return entry, version, err
+	}
+	return entry, version, nil
+}
+
+// checkFormatVersion refuses data directories written by a newer build and records the
+// current version in new ones
+func (pe *Engine) checkFormatVersion() error {
+	recorded, err := pe.readFormatVersion()
+	if err != nil {
+		return err
+	}
+
+	if recorded > FormatVersion {
+		return fmt.Errorf("data directory uses format version %d, this build supports up to %d", recorded, FormatVersion)
+	}
+	if recorded > 0 {
+		return nil
+	}
+
+	empty := true
+	err = pe.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range []string{"wal:", walArchivePrefix, "snapshot:"} {
+			if countKeys(txn, prefix) > 0 {
+				empty = false
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if !empty {
+		pe.logger.Infof("Data directory %s uses an older on-disk format, it is still read but can be converted with the upgrade command", pe.path)
+		return nil
+	}
+
+	return pe.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(formatVersionKey), encodeSequence(FormatVersion))
+	})
+}
+
+// readFormatVersion returns the format version recorded in the data directory, 0 if none is
+func (pe *Engine) readFormatVersion() (int, error) {
+	var version uint64
+	err := pe.db.View(func(txn *badger.Txn) error {
+		var err error
+		version, err = readSequence(txn, formatVersionKey)
+		return err
+	})
+	return int(version), err
+}
+
+// FormatReport describes the on-disk format of a data directory
+type FormatReport struct {
+	DirectoryVersion int         // Format version recorded for the directory, 0 if none is recorded
+	WALEntries       map[int]int // Live and archived WAL entries by format version
+	Snapshots        map[int]int // Snapshots by format version
+	SnapshotChunks   int         // Chunks referenced by the snapshots
+	Problems         []string    // Records that cannot be read
+}
+
+// NeedsUpgrade reports whether any record is older than the current format version
+func (r *FormatReport) NeedsUpgrade() bool {
+	if r.DirectoryVersion < FormatVersion {
+		return true
+	}
+	for version, count := range r.WALEntries {
+		if version < FormatVersion && count > 0 {
+			return true
+		}
+	}
+	for version, count := range r.Snapshots {
+		if version < FormatVersion && count > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// VerifyFormat reads every WAL entry and snapshot and reports their format versions
+// Snapshot chunks are checked against the checksums in their manifests
+func (pe *Engine) VerifyFormat() (*FormatReport, error) {
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	return pe.verifyFormat()
+}
+
+// verifyFormat implements VerifyFormat
+// This function requires that the caller holds the snapshot lock
+func (pe *Engine) verifyFormat() (*FormatReport, error) {
+	report := &FormatReport{
+		WALEntries: make(map[int]int),
+		Snapshots:  make(map[int]int),
+	}
+
+	var err error
+	if report.DirectoryVersion, err = pe.readFormatVersion(); err != nil {
+		return nil, fmt.Errorf("failed to read format version: %w", err)
+	}
+
+	err = pe.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range []string{"wal:", walArchivePrefix} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				err := item.Value(func(val []byte) error {
+					_, version, err := decodeWALEntry(val)
+					if err != nil {
+						return err
+					}
+					report.WALEntries[version]++
+					return nil
+				})
+				if err != nil {
+					report.Problems = append(report.Problems, fmt.Sprintf("%s: %v", string(item.Key()), err))
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	for _, snapshot := range snapshots {
+		decoded, chunks, err := pe.verifySnapshot(snapshot.timestamp)
+		report.SnapshotChunks += chunks
+		if err != nil {
+			report.Problems = append(report.Problems, fmt.Sprintf("snapshot:%d: %v", snapshot.timestamp, err))
+			continue
+		}
+		report.Snapshots[decoded.version]++
+	}
+
+	return report, nil
+}
+
+// verifySnapshot reads a snapshot completely, checking every chunk against its manifest
+// It returns the number of chunks the manifest references
+func (pe *Engine) verifySnapshot(timestamp int64) (*decodedSnapshot, int, error) {
+	decoded, err := pe.readSnapshot(timestamp)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if decoded.manifest == nil {
+		if _, err := pe.decodeLegacySnapshot(decoded.legacy); err != nil {
+			return nil, 0, err
+		}
+		return decoded, 0, nil
+	}
+
+	chunks := 0
+	for segmentIndex, segment := range decoded.manifest.Segments {
+		for chunkIndex, chunk := range segment.Chunks {
+			chunks++
+			if _, err := pe.readSnapshotChunk(timestamp, segmentIndex, chunkIndex, chunk); err != nil {
+				return nil, chunks, err
+			}
+		}
+	}
+	return decoded, chunks, nil
+}
+
+// decodedSnapshot is a stored snapshot read in any supported format version
+type decodedSnapshot struct {
+	version  int
+	manifest *snapshotManifest // Set for chunked snapshots
+	legacy   []byte            // Set for version 1 snapshots, which are a single gob stream
+}
+
+// readSnapshot reads the snapshot stored under a timestamp
+func (pe *Engine) readSnapshot(timestamp int64) (*decodedSnapshot, error) {
+	var value []byte
+	err := pe.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(fmt.Sprintf("snapshot:%d", timestamp)))
+		if err != nil {
+			return err
+		}
+		value, err = item.ValueCopy(nil)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, version, err := decodeSnapshotManifest(value)
+	if err != nil {
+		return nil, err
+	}
+	if manifest == nil {
+		return &decodedSnapshot{version: 1, legacy: value}, nil
+	}
+	return &decodedSnapshot{version: version, manifest: manifest}, nil
+}
+
+// formatMigration converts the records of one format version to the current one
+type formatMigration struct {
+	from        int
+	description string
+	migrate     func(pe *Engine) (int, error)
+}
+
+// formatMigrations lists the migrations run by UpgradeFormat, oldest format first
+// Each migration reads the old records, writes them in the current format version and
+// skips records already converted, so an interrupted upgrade can simply be run again
+var formatMigrations = []formatMigration{
+	{from: 1, description: "split single-value snapshots into chunks", migrate: (*Engine).migrateSingleValueSnapshots},
+	{from: 2, description: "add format headers to WAL entries", migrate: (*Engine).migrateWALHeaders},
+	{from: 2, description: "add format headers to snapshot manifests and chunks", migrate: (*Engine).migrateSnapshotHeaders},
+}
+
+// UpgradeFormat rewrites every record older than the current format version and records
+// the current version for the data directory
+// It returns a description of each migration that converted records, and fails if the
+// directory still cannot be read completely afterwards
+func (pe *Engine) UpgradeFormat() ([]string, error) {
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	var applied []string
+	for _, migration := range formatMigrations {
+		converted, err := migration.migrate(pe)
+		if err != nil {
+			return applied, fmt.Errorf("failed to %s: %w", migration.description, err)
+		}
+		if converted > 0 {
+			applied = append(applied, fmt.Sprintf("version %d: %s (%d records)", migration.from, migration.description, converted))
+		}
+	}
+
+	report, err := pe.verifyFormat()
+	if err != nil {
+		return applied, err
+	}
+	if len(report.Problems) > 0 {
+		return applied, fmt.Errorf("%d records cannot be read, first: %s", len(report.Problems), report.Problems[0])
+	}
+
+	err = pe.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(formatVersionKey), encodeSequence(FormatVersion))
+	})
+	if err != nil {
+		return applied, fmt.Errorf("failed to record format version: %w", err)
+	}
+	return applied, nil
+}
+
+// migrateSingleValueSnapshots rewrites version 1 snapshots as chunked snapshots
+func (pe *Engine) migrateSingleValueSnapshots() (int, error) {
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return 0, err
+	}
+
+	converted := 0
+	for _, snapshot := range snapshots {
+		decoded, err := pe.readSnapshot(snapshot.timestamp)
+		if err != nil {
+			return converted, err
+		}
+		if decoded.legacy == nil {
+			continue
+		}
+
+		types, err := pe.decodeLegacySnapshot(decoded.legacy)
+		if err != nil {
+			return converted, fmt.Errorf("snapshot %d: %w", snapshot.timestamp, err)
+		}
+
+		// Remove chunks left behind by an interrupted upgrade
+		if err := pe.deleteSnapshotChunks(snapshot.timestamp); err != nil {
+			return converted, err
+		}
+
+		manifest, err := pe.writeSnapshotChunks(snapshot.timestamp, func(chunkSize int, writer common.SnapshotWriter) error {
+			return streamSnapshotTypes(types, chunkSize, writer)
+		})
+		if err != nil {
+			return converted, err
+		}
+		manifest.Sequence = snapshot.sequence
+		if err := pe.writeSnapshotManifest(snapshot.timestamp, manifest); err != nil {
+			return converted, err
+		}
+		converted++
+	}
+
+	return converted, nil
+}
+
+// migrateWALHeaders adds format headers to live and archived WAL entries
+func (pe *Engine) migrateWALHeaders() (int, error) {
+	converted := 0
+
+	for _, prefix := range []string{"wal:", walArchivePrefix} {
+		wb := pe.db.NewWriteBatch()
+
+		err := pe.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+
+				var value []byte
+				err := item.Value(func(val []byte) error {
+					entry, version, err := decodeWALEntry(val)
+					if err != nil || version >= FormatVersion {
+						// Unreadable entries are left alone and reported by the verification
+						return nil
+					}
+					value, err = encodeWALEntry(entry)
+					return err
+				})
+				if err != nil {
+					return err
+				}
+				if value == nil {
+					continue
+				}
+
+				if err := wb.Set(item.KeyCopy(nil), value); err != nil {
+					return err
+				}
+				converted++
+			}
+			return nil
+		})
+		if err != nil {
+			wb.Cancel()
+			return converted, err
+		}
+		if err := wb.Flush(); err != nil {
+			return converted, err
+		}
+	}
+
+	return converted, nil
+}
+
+// migrateSnapshotHeaders adds format headers to the manifests and chunks of version 2 snapshots
+// Chunks are converted before their manifest, and headers are detected per chunk, so a
+// partly converted snapshot stays readable
+func (pe *Engine) migrateSnapshotHeaders() (int, error) {
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return 0, err
+	}
+
+	converted := 0
+	for _, snapshot := range snapshots {
+		decoded, err := pe.readSnapshot(snapshot.timestamp)
+		if err != nil {
+			return converted, err
+		}
+		if decoded.manifest == nil || decoded.version >= FormatVersion {
+			continue
+		}
+
+		prefix := []byte(fmt.Sprintf("%s%d:", snapshotChunkPrefix, snapshot.timestamp))
+		wb := pe.db.NewWriteBatch()
+
+		err = pe.db.View(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = prefix
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				item := it.Item()
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+
+				version, body, err := readFormatHeader(value, recordSnapshotChunk)
+				if err != nil || version > 0 {
+					continue
+				}
+
+				if err := wb.Set(item.KeyCopy(nil), append(appendFormatHeader(nil, recordSnapshotChunk), body...)); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			wb.Cancel()
+			return converted, err
+		}
+		if err := wb.Flush(); err != nil {
+			return converted, err
+		}
+
+		if err := pe.writeSnapshotManifest(snapshot.timestamp, decoded.manifest); err != nil {
+			return converted, err
+		}
+		converted++
+	}
+
+	return converted, nil
+}
+
+// decodeLegacySnapshot decodes a version 1 snapshot, which is a single gob stream
+func (pe *Engine) decodeLegacySnapshot(value []byte) ([]common.EntityTypeSnapshot, error) {
+	// Decompress the snapshot
+	data, err := pe.Decompress(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+
+	dec := gob.NewDecoder(bytes.NewBuffer(data))
+
+	// Read entity definitions
+	var typeCount int
+	if err := dec.Decode(&typeCount); err != nil {
+		return nil, fmt.Errorf("failed to decode entity type count: %w", err)
+	}
+
+	types := make([]common.EntityTypeSnapshot, 0, typeCount)
+	for i := 0; i < typeCount; i++ {
+		var entityType common.EntityTypeSnapshot
+		if err := dec.Decode(&entityType.Definition); err != nil {
+			return nil, fmt.Errorf("failed to decode entity definition: %w", err)
+		}
+
+		// Read entities for this type
+		var entityCount int
+		if err := dec.Decode(&entityCount); err != nil {
+			return nil, fmt.Errorf("failed to decode entity count: %w", err)
+		}
+
+		entityType.Entities = make([]common.Entity, entityCount)
+		for j := range entityType.Entities {
+			if err := dec.Decode(&entityType.Entities[j]); err != nil {
+				return nil, fmt.Errorf("failed to decode entity: %w", err)
+			}
+		}
+
+		types = append(types, entityType)
+	}
+
+	return types, nil
+}
@@ -0,0 +1,501 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+)
+
+// integrityIssue returns an SY403 error describing an inconsistency in the data directory
+func integrityIssue(format string, args ...interface{}) error {
+	return errors.NewError(errors.ErrCodeDatabaseCorruption, fmt.Sprintf(format, args...))
+}
+
+// storageCheck holds the findings of checkStorage
+type storageCheck struct {
+	issues          []error
+	damagedLatest   bool     // The latest snapshot pointer is missing or points at a damaged snapshot
+	latestTimestamp int64    // Snapshot the latest snapshot pointer refers to, 0 if there is none
+	goodSnapshots   []int64  // Intact snapshots, oldest first
+	removableKeys   [][]byte // Damaged snapshots, orphaned snapshot records and unusable WAL entries
+	removedWAL      int      // WAL entries among removableKeys
+}
+
+// CheckIntegrity validates the data directory and its consistency with the loaded store
+// Inconsistencies are returned as SY403 errors. The returned error is only set if the
+// check itself could not run. The store may be nil to check the data directory only
+func (pe *Engine) CheckIntegrity(store common.DatastoreEngine) ([]error, error) {
+	if err := pe.flushWAL(); err != nil {
+		return nil, err
+	}
+
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	check, err := pe.checkStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	issues := check.issues
+	if store != nil {
+		stateIssues, err := pe.checkStoreRecords(store, false)
+		if err != nil {
+			return nil, err
+		}
+		issues = append(issues, stateIssues...)
+		issues = append(issues, store.CheckIntegrity()...)
+	}
+	return issues, nil
+}
+
+// Repair rebuilds the data directory from the last intact snapshot plus the WAL
+// Damaged snapshots, orphaned snapshot records and unreadable, duplicate or orphaned WAL
+// entries are removed, the store is reloaded, counters and deleted IDs are corrected to
+// match it, and a fresh snapshot is taken. It returns a description of each change
+func (pe *Engine) Repair(store common.DatastoreEngine) ([]string, error) {
+	if err := pe.flushWAL(); err != nil {
+		return nil, err
+	}
+
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	check, err := pe.checkStorage()
+	if err != nil {
+		return nil, err
+	}
+
+	var actions []string
+	if len(check.removableKeys) > 0 {
+		wb := pe.db.NewWriteBatch()
+		defer wb.Cancel()
+
+		for _, key := range check.removableKeys {
+			if err := wb.Delete(key); err != nil {
+				return actions, err
+			}
+		}
+		if err := wb.Flush(); err != nil {
+			return actions, fmt.Errorf("failed to remove damaged records: %w", err)
+		}
+
+		actions = append(actions, fmt.Sprintf("removed %d damaged or orphaned records, %d of them WAL entries",
+			len(check.removableKeys), check.removedWAL))
+	}
+
+	if check.damagedLatest {
+		if err := pe.rebuildFromLastGoodSnapshot(store, check); err != nil {
+			return actions, err
+		}
+		if len(check.goodSnapshots) > 0 {
+			actions = append(actions, fmt.Sprintf("rebuilt from snapshot %d plus the WAL", check.goodSnapshots[len(check.goodSnapshots)-1]))
+		} else {
+			actions = append(actions, "rebuilt from the complete WAL")
+		}
+	} else if err := store.Reload(); err != nil {
+		return actions, fmt.Errorf("failed to reload store: %w", err)
+	}
+
+	stateIssues, err := pe.checkStoreRecords(store, true)
+	if err != nil {
+		return actions, err
+	}
+	if len(stateIssues) > 0 {
+		for _, issue := range stateIssues {
+			actions = append(actions, "corrected "+issue.(*errors.SyncopateError).Message)
+		}
+
+		// Pick up the corrected counters and deleted IDs
+		if err := store.Reload(); err != nil {
+			return actions, fmt.Errorf("failed to reload store: %w", err)
+		}
+	}
+
+	if len(actions) == 0 {
+		return nil, nil
+	}
+
+	// Anchor the repaired state in a snapshot
+	start := time.Now()
+	sequence, err := pe.takeSnapshot(store)
+	pe.recordSnapshot(start, sequence, err)
+	if err != nil {
+		return actions, fmt.Errorf("failed to snapshot repaired state: %w", err)
+	}
+	return actions, nil
+}
+
+// rebuildFromLastGoodSnapshot points the store at the newest intact snapshot and replays
+// the WAL written after it, including archived entries
+// This function requires that the caller holds the snapshot lock
+func (pe *Engine) rebuildFromLastGoodSnapshot(store common.DatastoreEngine, check *storageCheck) error {
+	if settings.Config.EnableWAL {
+		// Recovering to the end of the WAL replays everything after the newest intact snapshot
+		return pe.recoverToPoint(store, common.RecoveryTarget{Sequence: math.MaxUint64})
+	}
+
+	// Without a WAL, the newest intact snapshot is all there is
+	err := pe.db.Update(func(txn *badger.Txn) error {
+		if len(check.goodSnapshots) == 0 {
+			return txn.Delete([]byte("latest_snapshot"))
+		}
+
+		latestValue := make([]byte, 8)
+		binary.LittleEndian.PutUint64(latestValue, uint64(check.goodSnapshots[len(check.goodSnapshots)-1]))
+		return txn.Set([]byte("latest_snapshot"), latestValue)
+	})
+	if err != nil {
+		return err
+	}
+
+	pe.entityCache.Clear()
+	return store.Reload()
+}
+
+// checkStorage validates the snapshots and the WAL of the data directory
+// This function requires that the caller holds the snapshot lock
+func (pe *Engine) checkStorage() (*storageCheck, error) {
+	check := &storageCheck{}
+	report := func(key []byte, format string, args ...interface{}) {
+		check.issues = append(check.issues, integrityIssue(format, args...))
+		if key != nil {
+			check.removableKeys = append(check.removableKeys, key)
+		}
+	}
+
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	known := make(map[int64]bool, len(snapshots))
+	damaged := make(map[int64]bool)
+	for _, snapshot := range snapshots {
+		known[snapshot.timestamp] = true
+		if _, _, err := pe.verifySnapshot(snapshot.timestamp); err != nil {
+			damaged[snapshot.timestamp] = true
+			report([]byte(fmt.Sprintf("snapshot:%d", snapshot.timestamp)), "snapshot %d is damaged: %v", snapshot.timestamp, err)
+			check.removableKeys = append(check.removableKeys, []byte(fmt.Sprintf("%s%d", snapshotSequencePrefix, snapshot.timestamp)))
+			continue
+		}
+		check.goodSnapshots = append(check.goodSnapshots, snapshot.timestamp)
+	}
+
+	err = pe.db.View(func(txn *badger.Txn) error {
+		// The latest snapshot pointer must refer to an intact snapshot
+		item, err := txn.Get([]byte("latest_snapshot"))
+		switch {
+		case err == badger.ErrKeyNotFound:
+			if len(snapshots) > 0 {
+				check.damagedLatest = true
+				report(nil, "latest snapshot pointer is missing although %d snapshots exist", len(snapshots))
+			}
+		case err != nil:
+			return err
+		default:
+			if err := item.Value(func(val []byte) error {
+				if len(val) != 8 {
+					return fmt.Errorf("invalid latest snapshot pointer")
+				}
+				check.latestTimestamp = int64(binary.LittleEndian.Uint64(val))
+				return nil
+			}); err != nil {
+				check.damagedLatest = true
+				report(nil, "%v", err)
+			} else if !known[check.latestTimestamp] {
+				check.damagedLatest = true
+				report(nil, "latest snapshot pointer refers to snapshot %d, which does not exist", check.latestTimestamp)
+			} else if damaged[check.latestTimestamp] {
+				check.damagedLatest = true
+			}
+		}
+
+		// Chunks and sequence records must belong to an existing snapshot
+		orphaned := make(map[int64]int)
+		for _, prefix := range []string{snapshotChunkPrefix, snapshotSequencePrefix} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			opts.PrefetchValues = false
+			it := txn.NewIterator(opts)
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				key := it.Item().KeyCopy(nil)
+				rest := strings.TrimPrefix(string(key), prefix)
+				if end := strings.IndexByte(rest, ':'); end >= 0 {
+					rest = rest[:end]
+				}
+
+				timestamp, err := strconv.ParseInt(rest, 10, 64)
+				if err == nil && known[timestamp] {
+					if damaged[timestamp] && prefix == snapshotChunkPrefix {
+						check.removableKeys = append(check.removableKeys, key)
+					}
+					continue
+				}
+				orphaned[timestamp]++
+				check.removableKeys = append(check.removableKeys, key)
+			}
+			it.Close()
+		}
+		for timestamp, count := range orphaned {
+			report(nil, "%d snapshot records belong to snapshot %d, which does not exist", count, timestamp)
+		}
+
+		return pe.checkWAL(txn, check)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return check, nil
+}
+
+// checkWAL detects unreadable WAL entries, entries stored under the wrong sequence number,
+// sequence numbers used by more than one entry and transactions that were never completed
+func (pe *Engine) checkWAL(txn *badger.Txn, check *storageCheck) error {
+	report := func(key []byte, format string, args ...interface{}) {
+		check.issues = append(check.issues, integrityIssue(format, args...))
+		check.removableKeys = append(check.removableKeys, key)
+		check.removedWAL++
+	}
+
+	// The same entry may be both live and archived, but only under the same key suffix
+	owners := make(map[uint64]string)
+	transactions := make(map[string][][]byte)
+	completed := make(map[string]bool)
+
+	for _, prefix := range []string{"wal:", walArchivePrefix} {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+		it := txn.NewIterator(opts)
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			suffix := strings.TrimPrefix(string(key), prefix)
+
+			var entry WALEntry
+			err := item.Value(func(val []byte) error {
+				var err error
+				entry, _, err = decodeWALEntry(val)
+				return err
+			})
+			if err != nil {
+				report(key, "WAL entry %s cannot be read: %v", string(key), err)
+				continue
+			}
+
+			sequence, ok := parseWALKeySequence(key, prefix)
+			if !ok || sequence != entry.SequenceNum {
+				report(key, "WAL entry %s holds sequence number %d", string(key), entry.SequenceNum)
+				continue
+			}
+
+			if owner, exists := owners[sequence]; exists && owner != suffix {
+				report(key, "WAL sequence number %d is used by both %s and %s", sequence, owner, suffix)
+				continue
+			}
+			owners[sequence] = suffix
+
+			if entry.TransactionID != "" && prefix == "wal:" {
+				transactions[entry.TransactionID] = append(transactions[entry.TransactionID], key)
+				if entry.IsLastInTxn {
+					completed[entry.TransactionID] = true
+				}
+			}
+		}
+		it.Close()
+	}
+
+	ids := make([]string, 0, len(transactions))
+	for id := range transactions {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if completed[id] {
+			continue
+		}
+		for _, key := range transactions[id] {
+			report(key, "WAL entry %s belongs to transaction %s, which was never completed", string(key), id)
+		}
+	}
+	return nil
+}
+
+// checkStoreRecords compares the stored auto-increment counters and deleted IDs with the
+// loaded store. With fix set, the stored records are corrected as well, and the store
+// must be reloaded to pick them up
+func (pe *Engine) checkStoreRecords(store common.DatastoreEngine, fix bool) ([]error, error) {
+	var issues []error
+
+	type record struct {
+		key   []byte
+		value []byte
+	}
+	var counters, deleted []record
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		for prefix, records := range map[string]*[]record{"counter:": &counters, "deleted_ids:": &deleted} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+			it := txn.NewIterator(opts)
+
+			for it.Rewind(); it.Valid(); it.Next() {
+				value, err := it.Item().ValueCopy(nil)
+				if err != nil {
+					it.Close()
+					return err
+				}
+				*records = append(*records, record{key: it.Item().KeyCopy(nil), value: value})
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, counter := range counters {
+		entityType := strings.TrimPrefix(string(counter.key), "counter:")
+
+		def, err := store.GetEntityDefinition(entityType)
+		if err != nil {
+			issues = append(issues, integrityIssue("counter for entity type %s, which does not exist", entityType))
+			if fix {
+				if err := wb.Delete(counter.key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if len(counter.value) != 8 {
+			issues = append(issues, integrityIssue("counter for entity type %s is not a valid number", entityType))
+			if fix {
+				if err := wb.Delete(counter.key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if def.IDGenerator != common.IDTypeAutoIncrement {
+			continue
+		}
+
+		value := binary.LittleEndian.Uint64(counter.value)
+		highest, err := highestNumericID(store, entityType)
+		if err != nil {
+			return nil, err
+		}
+		if value < highest {
+			issues = append(issues, integrityIssue("counter for entity type %s is %d, below the highest ID %d", entityType, value, highest))
+			if fix {
+				if err := wb.Set(counter.key, encodeSequence(highest)); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	for _, record := range deleted {
+		entityType := strings.TrimPrefix(string(record.key), "deleted_ids:")
+
+		if _, err := store.GetEntityDefinition(entityType); err != nil {
+			issues = append(issues, integrityIssue("deleted IDs for entity type %s, which does not exist", entityType))
+			if fix {
+				if err := wb.Delete(record.key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		var deletedIDs map[string]bool
+		data, err := pe.Decompress(record.value)
+		if err == nil {
+			err = gob.NewDecoder(bytes.NewReader(data)).Decode(&deletedIDs)
+		}
+		if err != nil {
+			issues = append(issues, integrityIssue("deleted IDs for entity type %s cannot be read: %v", entityType, err))
+			if fix {
+				if err := wb.Delete(record.key); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		entities, err := store.GetAllEntitiesOfType(entityType)
+		if err != nil {
+			return nil, err
+		}
+
+		var live []string
+		for _, entity := range entities {
+			if deletedIDs[entity.ID] {
+				live = append(live, entity.ID)
+			}
+		}
+		if len(live) == 0 {
+			continue
+		}
+
+		sort.Strings(live)
+		issues = append(issues, integrityIssue("deleted IDs for entity type %s include existing entities %s", entityType, strings.Join(live, ", ")))
+		if fix {
+			for _, id := range live {
+				delete(deletedIDs, id)
+			}
+
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(deletedIDs); err != nil {
+				return nil, err
+			}
+			if err := wb.Set(record.key, pe.Compress(buf.Bytes())); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if fix {
+		if err := wb.Flush(); err != nil {
+			return nil, fmt.Errorf("failed to correct counters and deleted IDs: %w", err)
+		}
+	}
+	return issues, nil
+}
+
+// highestNumericID returns the highest numeric ID of an entity type, 0 if it has none
+func highestNumericID(store common.DatastoreEngine, entityType string) (uint64, error) {
+	entities, err := store.GetAllEntitiesOfType(entityType)
+	if err != nil {
+		return 0, err
+	}
+
+	var highest uint64
+	for _, entity := range entities {
+		if id, err := strconv.ParseUint(entity.ID, 10, 64); err == nil && id > highest {
+			highest = id
+		}
+	}
+	return highest, nil
+}
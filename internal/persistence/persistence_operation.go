@@ -0,0 +1,46 @@
+package persistence
+
+import (
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// Operation is a logged write, in the format the WAL and the file log share
+// Other logs of writes, like the cluster log, use it to replay writes with the same semantics
+type Operation struct {
+	Op         int
+	EntityType string
+	EntityID   string
+	Data       []byte
+}
+
+// NewOperation creates an operation, gob-encoding its payload if it has one
+func NewOperation(op int, entityType, entityID string, payload interface{}) (Operation, error) {
+	operation := Operation{Op: op, EntityType: entityType, EntityID: entityID}
+	if payload == nil {
+		return operation, nil
+	}
+
+	data, err := encodeRecordPayload(payload)
+	if err != nil {
+		return Operation{}, err
+	}
+	operation.Data = data
+	return operation, nil
+}
+
+// NewRenameOperation creates the operation of renaming an entity type
+func NewRenameOperation(oldName, newName string) Operation {
+	return Operation{Op: OpRenameEntityType, EntityType: oldName, Data: []byte(newName)}
+}
+
+// NewCloneOperation creates the operation of cloning an entity type
+func NewCloneOperation(source, target string, includeData bool) (Operation, error) {
+	return NewOperation(OpCloneEntityType, source, "", cloneEntityTypeOperation{Target: target, IncludeData: includeData})
+}
+
+// ReplayOperation applies a logged write to the store
+// Writes the store already reflects are skipped, so a log can be replayed over newer data
+func ReplayOperation(store common.DatastoreEngine, logger *logrus.Logger, operation Operation) error {
+	return replayOperation(store, logger, operation.Op, operation.EntityType, operation.EntityID, operation.Data)
+}
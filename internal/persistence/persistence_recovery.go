@@ -0,0 +1,517 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+)
+
+const (
+	// walArchivePrefix holds WAL entries that were pruned after a snapshot
+	// Key format: walarchive:<sequence>:<entityType>:<entityID>, same value as the WAL entry
+	walArchivePrefix = "walarchive:"
+
+	// snapshotSequencePrefix maps a snapshot timestamp to the last WAL sequence number it contains
+	snapshotSequencePrefix = "snapshot_seq:"
+
+	// walSequenceKey stores the highest WAL sequence number handed out when the last snapshot was taken
+	walSequenceKey = "wal_sequence"
+
+	// walLostSequenceKey stores the highest sequence number of WAL entries that were deleted
+	// without being archived; recovery cannot replay history up to this point
+	walLostSequenceKey = "wal_lost_sequence"
+)
+
+// operationNames maps WAL operations to the names shown in WAL listings
+var operationNames = map[int]string{
+	OpRegisterEntityType: "register_entity_type",
+	OpInsertEntity:       "insert",
+	OpUpdateEntity:       "update",
+	OpDeleteEntity:       "delete",
+	OpUpdateEntityType:   "update_entity_type",
+	OpTruncateEntityType: "truncate_entity_type",
+	OpTruncateDatabase:   "truncate_database",
+	OpDropEntityType:     "drop_entity_type",
+	OpRenameEntityType:   "rename_entity_type",
+	OpCloneEntityType:    "clone_entity_type",
+}
+
+// encodeSequence encodes a sequence number for storage
+func encodeSequence(sequence uint64) []byte {
+	value := make([]byte, 8)
+	binary.LittleEndian.PutUint64(value, sequence)
+	return value
+}
+
+// readSequence reads a stored sequence number, returning 0 if the key does not exist
+func readSequence(txn *badger.Txn, key string) (uint64, error) {
+	item, err := txn.Get([]byte(key))
+	if err == badger.ErrKeyNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	var sequence uint64
+	err = item.Value(func(val []byte) error {
+		if len(val) != 8 {
+			return fmt.Errorf("invalid sequence number stored under %s", key)
+		}
+		sequence = binary.LittleEndian.Uint64(val)
+		return nil
+	})
+	return sequence, err
+}
+
+// raiseSequenceMarker stores a sequence number unless a higher one is already stored
+func raiseSequenceMarker(txn *badger.Txn, key string, sequence uint64) error {
+	current, err := readSequence(txn, key)
+	if err != nil {
+		return err
+	}
+	if current >= sequence {
+		return nil
+	}
+	return txn.Set([]byte(key), encodeSequence(sequence))
+}
+
+// parseWALKeySequence extracts the sequence number from a live or archived WAL key
+func parseWALKeySequence(key []byte, prefix string) (uint64, bool) {
+	rest := strings.TrimPrefix(string(key), prefix)
+	if end := strings.IndexByte(rest, ':'); end >= 0 {
+		rest = rest[:end]
+	}
+
+	sequence, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return sequence, true
+}
+
+// archiveKey returns the archive key of a live WAL key
+func archiveKey(walKey []byte) []byte {
+	return append([]byte(walArchivePrefix), bytes.TrimPrefix(walKey, []byte("wal:"))...)
+}
+
+// lastWALSequence returns the highest sequence number stored under a WAL key prefix
+// Sequence numbers are zero-padded, so the last key in order holds the highest one
+func lastWALSequence(txn *badger.Txn, prefix string) uint64 {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	opts.PrefetchValues = false
+	opts.Reverse = true
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Seek(append([]byte(prefix), 0xff))
+	if !it.Valid() {
+		return 0
+	}
+
+	sequence, _ := parseWALKeySequence(it.Item().Key(), prefix)
+	return sequence
+}
+
+// loadWALSequence continues WAL numbering after the highest sequence number ever written,
+// so sequence numbers stay unique across restarts, pruning, restores and recoveries
+func (pe *Engine) loadWALSequence() error {
+	var sequence uint64
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		stored, err := readSequence(txn, walSequenceKey)
+		if err != nil {
+			return err
+		}
+
+		sequence = stored
+		for _, prefix := range []string{"wal:", walArchivePrefix} {
+			if last := lastWALSequence(txn, prefix); last > sequence {
+				sequence = last
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	pe.walSeqMutex.Lock()
+	pe.walSequence = sequence
+	pe.walSeqMutex.Unlock()
+	return nil
+}
+
+// trimWALArchive deletes archived WAL entries older than the archive retention
+func (pe *Engine) trimWALArchive() error {
+	cutoff := time.Now().Add(-pe.walArchiveTTL).UnixNano()
+
+	return pe.db.Update(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(walArchivePrefix)
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		keysToDelete := [][]byte{}
+		var lastTrimmed uint64
+
+		// Archived entries are ordered by sequence number, so the oldest come first
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+
+			var entry WALEntry
+			if err := item.Value(func(val []byte) error {
+				var err error
+				entry, _, err = decodeWALEntry(val)
+				return err
+			}); err != nil {
+				pe.logger.Warnf("Failed to decode archived WAL entry %s: %v", string(item.Key()), err)
+				continue
+			}
+
+			if entry.Timestamp >= cutoff {
+				break
+			}
+
+			keysToDelete = append(keysToDelete, item.KeyCopy(nil))
+			lastTrimmed = entry.SequenceNum
+		}
+
+		for _, key := range keysToDelete {
+			if err := txn.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete archived WAL entry: %w", err)
+			}
+		}
+
+		if lastTrimmed > 0 {
+			pe.logger.Infof("Removed %d archived WAL entries older than %s", len(keysToDelete), pe.walArchiveTTL)
+			return raiseSequenceMarker(txn, walLostSequenceKey, lastTrimmed)
+		}
+		return nil
+	})
+}
+
+// ListWALEntries lists live and archived WAL entries after a sequence number, oldest first
+// It helps find the sequence number or time to recover to, e.g. that of an accidental truncate
+func (pe *Engine) ListWALEntries(afterSequence uint64, limit int) ([]common.WALRecord, error) {
+	if err := pe.flushWAL(); err != nil {
+		return nil, err
+	}
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return nil, fmt.Errorf("persistence engine is closed")
+	}
+
+	records, err := pe.readWALRecords(afterSequence)
+	if err != nil {
+		return nil, err
+	}
+
+	if limit > 0 && len(records) > limit {
+		records = records[:limit]
+	}
+
+	entries := make([]common.WALRecord, 0, len(records))
+	for _, record := range records {
+		operation, ok := operationNames[record.entry.Operation]
+		if !ok {
+			operation = strconv.Itoa(record.entry.Operation)
+		}
+
+		entries = append(entries, common.WALRecord{
+			SequenceNum: record.entry.SequenceNum,
+			Timestamp:   time.Unix(0, record.entry.Timestamp).UTC(),
+			Operation:   operation,
+			EntityType:  record.entry.EntityType,
+			EntityID:    record.entry.EntityID,
+			Archived:    record.archived,
+		})
+	}
+
+	return entries, nil
+}
+
+// walRecord is a decoded WAL entry along with where it is stored
+type walRecord struct {
+	suffix   string // Key without the wal: or walarchive: prefix
+	value    []byte
+	entry    WALEntry
+	live     bool
+	archived bool
+}
+
+// readWALRecords reads the live and archived WAL entries after a sequence number, ordered by sequence
+// An entry that is both live and archived is returned once
+func (pe *Engine) readWALRecords(afterSequence uint64) ([]*walRecord, error) {
+	records := make(map[string]*walRecord)
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		for _, prefix := range []string{"wal:", walArchivePrefix} {
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = []byte(prefix)
+
+			it := txn.NewIterator(opts)
+			start := []byte(prefix + fmt.Sprintf("%020d", afterSequence+1))
+
+			for it.Seek(start); it.Valid(); it.Next() {
+				item := it.Item()
+				suffix := strings.TrimPrefix(string(item.Key()), prefix)
+
+				record, exists := records[suffix]
+				if !exists {
+					value, err := item.ValueCopy(nil)
+					if err != nil {
+						it.Close()
+						return err
+					}
+
+					record = &walRecord{suffix: suffix, value: value}
+					if record.entry, _, err = decodeWALEntry(value); err != nil {
+						pe.logger.Warnf("Failed to decode WAL entry %s: %v, skipping", string(item.Key()), err)
+						continue
+					}
+					records[suffix] = record
+				}
+
+				if prefix == walArchivePrefix {
+					record.archived = true
+				} else {
+					record.live = true
+				}
+			}
+			it.Close()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sorted := make([]*walRecord, 0, len(records))
+	for _, record := range records {
+		sorted = append(sorted, record)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].entry.SequenceNum < sorted[j].entry.SequenceNum
+	})
+
+	return sorted, nil
+}
+
+// recoveryPlan describes how the stored data is rewound to a recovery target
+type recoveryPlan struct {
+	snapshotTimestamp int64        // Snapshot to start from, 0 to start from an empty database
+	snapshotSequence  uint64       // Last WAL sequence number contained in the snapshot
+	replay            []*walRecord // Entries after the snapshot up to the target
+	discard           []*walRecord // Entries after the target
+}
+
+// RecoverToPoint rewinds the database to a point in its history and reloads the store
+// The newest snapshot taken before the target is loaded, then the live and archived WAL
+// entries written after it are replayed up to the target. Live entries written after the
+// target are archived, so a later recovery can still move forward again while archiving
+// is enabled. Callers must make sure no writes reach the store while it is being recovered
+func (pe *Engine) RecoverToPoint(store common.DatastoreEngine, target common.RecoveryTarget) error {
+	if err := pe.flushWAL(); err != nil {
+		return err
+	}
+
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+	return pe.recoverToPoint(store, target)
+}
+
+// recoverToPoint rewinds the database, see RecoverToPoint
+// This function requires that the caller holds the snapshot lock
+func (pe *Engine) recoverToPoint(store common.DatastoreEngine, target common.RecoveryTarget) error {
+	if !settings.Config.EnableWAL {
+		return fmt.Errorf("point-in-time recovery requires the WAL to be enabled")
+	}
+
+	pe.mu.Lock()
+	if pe.closed || pe.db == nil {
+		pe.mu.Unlock()
+		return fmt.Errorf("persistence engine is closed")
+	}
+
+	plan, err := pe.planRecovery(target)
+	if err == nil {
+		err = pe.applyRecoveryPlan(plan)
+	}
+	if err == nil {
+		// Replicas may have applied entries that were set aside
+		err = pe.startNewHistory()
+	}
+	pe.entityCache.Clear()
+	pe.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+
+	// Rebuild the in-memory state from the snapshot and the rewound WAL
+	if err := store.Reload(); err != nil {
+		return fmt.Errorf("failed to reload store after recovery: %w", err)
+	}
+
+	// Snapshot the recovered state, so it no longer depends on the older snapshot
+	start := time.Now()
+	sequence, err := pe.takeSnapshot(store)
+	pe.recordSnapshot(start, sequence, err)
+	if err != nil {
+		return fmt.Errorf("failed to snapshot recovered state: %w", err)
+	}
+
+	pe.logger.Infof("Database recovered to %s (%d WAL entries replayed, %d after the target set aside)",
+		target, len(plan.replay), len(plan.discard))
+	return nil
+}
+
+// planRecovery picks the snapshot to start from and splits the following WAL entries at the target
+// This function requires that the caller holds a lock
+func (pe *Engine) planRecovery(target common.RecoveryTarget) (*recoveryPlan, error) {
+	plan := &recoveryPlan{}
+	legacySnapshot := false
+
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshots: %w", err)
+	}
+
+	// Find the newest snapshot taken before the target
+	for _, snapshot := range snapshots {
+		if target.Sequence > 0 {
+			if !snapshot.hasSequence || snapshot.sequence > target.Sequence {
+				continue
+			}
+		} else if snapshot.timestamp > target.Time.UnixNano() {
+			continue
+		}
+
+		plan.snapshotTimestamp = snapshot.timestamp
+		plan.snapshotSequence = snapshot.sequence
+		legacySnapshot = !snapshot.hasSequence
+	}
+
+	var lostSequence uint64
+	err = pe.db.View(func(txn *badger.Txn) error {
+		var err error
+		lostSequence, err = readSequence(txn, walLostSequenceKey)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL state: %w", err)
+	}
+
+	if legacySnapshot {
+		return nil, fmt.Errorf("the snapshot taken before %s predates point-in-time recovery and cannot be used", target)
+	}
+
+	if plan.snapshotSequence < lostSequence {
+		return nil, fmt.Errorf("WAL history needed to recover to %s is no longer available (entries up to sequence %d were pruned)",
+			target, lostSequence)
+	}
+
+	records, err := pe.readWALRecords(plan.snapshotSequence)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read WAL: %w", err)
+	}
+
+	if plan.snapshotTimestamp == 0 && (len(records) == 0 || records[0].entry.SequenceNum != 1) {
+		return nil, fmt.Errorf("no snapshot or complete WAL history found before %s", target)
+	}
+
+	for _, record := range records {
+		if target.Includes(record.entry.SequenceNum, record.entry.Timestamp) {
+			plan.replay = append(plan.replay, record)
+		} else {
+			plan.discard = append(plan.discard, record)
+		}
+	}
+
+	return plan, nil
+}
+
+// applyRecoveryPlan points the store at the plan's snapshot and leaves exactly the entries
+// to replay in the live WAL
+// This function requires that the caller holds a write lock
+func (pe *Engine) applyRecoveryPlan(plan *recoveryPlan) error {
+	archive := pe.walArchiveTTL > 0
+	replay := make(map[string]bool, len(plan.replay))
+
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	if plan.snapshotTimestamp > 0 {
+		latestValue := make([]byte, 8)
+		binary.LittleEndian.PutUint64(latestValue, uint64(plan.snapshotTimestamp))
+		if err := wb.Set([]byte("latest_snapshot"), latestValue); err != nil {
+			return err
+		}
+	} else if err := wb.Delete([]byte("latest_snapshot")); err != nil {
+		return err
+	}
+
+	for _, record := range plan.replay {
+		replay[record.suffix] = true
+		if !record.live {
+			if err := wb.Set([]byte("wal:"+record.suffix), record.value); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Clear every other live entry, including any already covered by the snapshot
+	err := pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("wal:")
+		opts.PrefetchValues = archive
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			suffix := strings.TrimPrefix(string(item.Key()), "wal:")
+			if replay[suffix] {
+				continue
+			}
+
+			if archive {
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				if err := wb.Set([]byte(walArchivePrefix+suffix), value); err != nil {
+					return err
+				}
+			}
+			if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to rewind WAL: %w", err)
+	}
+
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to rewind WAL: %w", err)
+	}
+	return nil
+}
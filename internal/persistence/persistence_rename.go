@@ -0,0 +1,225 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+	"github.com/sirupsen/logrus"
+)
+
+// cloneEntityTypeOperation is the WAL payload of a clone operation
+type cloneEntityTypeOperation struct {
+	Target      string
+	IncludeData bool
+}
+
+// RenameEntityType moves the stored data of an entity type to a new name and records the rename in the WAL
+func (pe *Engine) RenameEntityType(store common.DatastoreEngine, oldName, newName string) error {
+	// Counters, deleted IDs and schema history are saved again by the
+	// datastore under the new name, so the old keys are simply removed
+	err := pe.db.Update(func(txn *badger.Txn) error {
+		keys := collectKeys(txn, fmt.Sprintf("schema_version:%s:", oldName))
+		keys = append(keys,
+			[]byte(fmt.Sprintf("counter:%s", oldName)),
+			[]byte(fmt.Sprintf("deleted_ids:%s", oldName)),
+		)
+
+		for _, key := range keys {
+			if err := txn.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete key %s: %w", string(key), err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Check if WAL is disabled in settings
+	if !settings.Config.EnableWAL {
+		// Without WAL, move the definition and entity keys directly
+		def, err := store.GetEntityDefinition(newName)
+		if err != nil {
+			return err
+		}
+
+		// Definitions with relations to the entity type now refer to the new name
+		referencing := referencingDefinitions(store, newName)
+
+		return pe.db.Update(func(txn *badger.Txn) error {
+			if err := pe.setEntityDefinition(txn, def); err != nil {
+				return err
+			}
+
+			for _, referencingDef := range referencing {
+				if err := pe.setEntityDefinition(txn, referencingDef); err != nil {
+					return err
+				}
+			}
+
+			if err := txn.Delete([]byte(fmt.Sprintf("entitydef:%s", oldName))); err != nil {
+				return fmt.Errorf("failed to delete entity definition: %w", err)
+			}
+
+			return copyEntityKeys(txn, oldName, newName, true)
+		})
+	}
+
+	// With WAL enabled, write a rename operation to the WAL
+	return pe.WriteWALEntry(OpRenameEntityType, oldName, "", []byte(newName))
+}
+
+// CloneEntityType stores a copy of an entity type and records the clone in the WAL
+func (pe *Engine) CloneEntityType(store common.DatastoreEngine, source, target string, includeData bool) error {
+	// Check if WAL is disabled in settings
+	if !settings.Config.EnableWAL {
+		// Without WAL, copy the definition and entity keys directly
+		def, err := store.GetEntityDefinition(target)
+		if err != nil {
+			return err
+		}
+
+		return pe.db.Update(func(txn *badger.Txn) error {
+			if err := pe.setEntityDefinition(txn, def); err != nil {
+				return err
+			}
+
+			if !includeData {
+				return nil
+			}
+
+			return copyEntityKeys(txn, source, target, false)
+		})
+	}
+
+	// Serialize the clone parameters
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cloneEntityTypeOperation{Target: target, IncludeData: includeData}); err != nil {
+		return fmt.Errorf("failed to encode clone operation: %w", err)
+	}
+
+	// With WAL enabled, write a clone operation to the WAL
+	return pe.WriteWALEntry(OpCloneEntityType, source, "", buf.Bytes())
+}
+
+// applyRenameEntityType replays a rename operation from the WAL
+func applyRenameEntityType(store common.DatastoreEngine, logger *logrus.Logger, oldName string, data []byte) error {
+	newName := string(data)
+
+	// Only rename if the old type is present and the new one isn't
+	if _, err := store.GetEntityDefinition(oldName); err != nil {
+		logger.Debugf("Entity type %s doesn't exist, skipping rename to %s", oldName, newName)
+		return nil
+	}
+	if _, err := store.GetEntityDefinition(newName); err == nil {
+		logger.Debugf("Entity type %s already exists, skipping rename from %s", newName, oldName)
+		return nil
+	}
+
+	return store.RenameEntityType(oldName, newName)
+}
+
+// applyCloneEntityType replays a clone operation from the WAL
+func applyCloneEntityType(store common.DatastoreEngine, logger *logrus.Logger, source string, data []byte) error {
+	var op cloneEntityTypeOperation
+	if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&op); err != nil {
+		return fmt.Errorf("failed to decode clone operation: %w", err)
+	}
+
+	// Only clone if the source is present and the target isn't
+	if _, err := store.GetEntityDefinition(source); err != nil {
+		logger.Debugf("Entity type %s doesn't exist, skipping clone to %s", source, op.Target)
+		return nil
+	}
+	if _, err := store.GetEntityDefinition(op.Target); err == nil {
+		logger.Debugf("Entity type %s already exists, skipping clone from %s", op.Target, source)
+		return nil
+	}
+
+	return store.CloneEntityType(source, op.Target, op.IncludeData)
+}
+
+// referencingDefinitions returns the definitions of the other entity types with relations to an entity type
+func referencingDefinitions(store common.DatastoreEngine, entityType string) []common.EntityDefinition {
+	var referencing []common.EntityDefinition
+	for _, name := range store.ListEntityTypes() {
+		if name == entityType {
+			continue
+		}
+		def, err := store.GetEntityDefinition(name)
+		if err != nil {
+			continue
+		}
+		for _, relation := range def.Relations {
+			if relation.EntityType == entityType {
+				referencing = append(referencing, def)
+				break
+			}
+		}
+	}
+	return referencing
+}
+
+// setEntityDefinition writes an entity definition key within a transaction
+func (pe *Engine) setEntityDefinition(txn *badger.Txn, def common.EntityDefinition) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(def); err != nil {
+		return fmt.Errorf("failed to encode entity definition: %w", err)
+	}
+
+	key := fmt.Sprintf("entitydef:%s", def.Name)
+	return txn.Set([]byte(key), pe.Compress(buf.Bytes()))
+}
+
+// copyEntityKeys copies all entity keys of one entity type to another, optionally removing the originals
+func copyEntityKeys(txn *badger.Txn, source, target string, removeSource bool) error {
+	sourcePrefix := fmt.Sprintf("entity:%s:", source)
+
+	for _, key := range collectKeys(txn, sourcePrefix) {
+		item, err := txn.Get(key)
+		if err != nil {
+			return fmt.Errorf("failed to read entity: %w", err)
+		}
+
+		value, err := item.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("failed to read entity: %w", err)
+		}
+
+		targetKey := fmt.Sprintf("entity:%s:%s", target, strings.TrimPrefix(string(key), sourcePrefix))
+		if err := txn.Set([]byte(targetKey), value); err != nil {
+			return fmt.Errorf("failed to write entity: %w", err)
+		}
+
+		if removeSource {
+			if err := txn.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete entity: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// collectKeys returns copies of all keys with the given prefix
+func collectKeys(txn *badger.Txn, prefix string) [][]byte {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Rewind(); it.Valid(); it.Next() {
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+
+	return keys
+}
@@ -0,0 +1,305 @@
+package persistence
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/google/uuid"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+)
+
+const (
+	// historyIDKey stores the ID of the WAL history, replaced whenever a restore or recovery rewrites it
+	historyIDKey = "history_id"
+
+	// replicaPositionKey stores the position in its primary's WAL history a replica has applied
+	replicaPositionKey = "replica_position"
+)
+
+// currentHistoryID returns the ID of the WAL history, creating one for a database without it
+func (pe *Engine) currentHistoryID() (string, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return "", fmt.Errorf("persistence engine is closed")
+	}
+
+	var historyID string
+	update := func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(historyIDKey))
+		if err == nil {
+			value, err := item.ValueCopy(nil)
+			historyID = string(value)
+			return err
+		}
+		if !errors.Is(err, badger.ErrKeyNotFound) {
+			return err
+		}
+
+		historyID = uuid.New().String()
+		return txn.Set([]byte(historyIDKey), []byte(historyID))
+	}
+
+	err := pe.db.Update(update)
+	if errors.Is(err, badger.ErrConflict) {
+		// Another request created the ID at the same time
+		err = pe.db.Update(update)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to read history ID: %w", err)
+	}
+	return historyID, nil
+}
+
+// startNewHistory replaces the ID of the WAL history, so replicas bootstrap again
+// This function requires that the caller holds the write lock
+func (pe *Engine) startNewHistory() error {
+	err := pe.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(historyIDKey), []byte(uuid.New().String()))
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start new history: %w", err)
+	}
+	return nil
+}
+
+// ReplicationPosition returns the latest durable position in the WAL history
+// Every WAL entry up to the returned sequence number is on disk, and in a backup started afterwards
+func (pe *Engine) ReplicationPosition() (common.ReplicationPosition, error) {
+	if !settings.Config.EnableWAL {
+		return common.ReplicationPosition{}, fmt.Errorf("replication requires the WAL to be enabled")
+	}
+
+	historyID, err := pe.currentHistoryID()
+	if err != nil {
+		return common.ReplicationPosition{}, err
+	}
+
+	// Entries handed a sequence number so far are committed by the flush
+	pe.walSeqMutex.Lock()
+	sequence := pe.walSequence
+	pe.walSeqMutex.Unlock()
+
+	if err := pe.flushWAL(); err != nil {
+		return common.ReplicationPosition{}, err
+	}
+
+	return common.ReplicationPosition{HistoryID: historyID, Sequence: sequence}, nil
+}
+
+// ReplicationEntries returns up to limit WAL entries after a replica's position, oldest first
+// Archived entries are included, so replicas can catch up on entries pruned after a snapshot.
+// It returns common.ErrReplicaSnapshotRequired if the position is not in the current history,
+// or if entries after it were deleted without being archived
+func (pe *Engine) ReplicationEntries(after common.ReplicationPosition, limit int) (*common.ReplicationBatch, error) {
+	position, err := pe.ReplicationPosition()
+	if err != nil {
+		return nil, err
+	}
+	if after.HistoryID != position.HistoryID || after.Sequence > position.Sequence {
+		return nil, common.ErrReplicaSnapshotRequired
+	}
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return nil, fmt.Errorf("persistence engine is closed")
+	}
+
+	var walEntries []WALEntry
+	err = pe.db.View(func(txn *badger.Txn) error {
+		lostSequence, err := readSequence(txn, walLostSequenceKey)
+		if err != nil {
+			return err
+		}
+		if after.Sequence < lostSequence {
+			return common.ErrReplicaSnapshotRequired
+		}
+
+		walEntries, err = pe.readWALRange(txn, after.Sequence, position.Sequence, limit)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &common.ReplicationBatch{
+		Position: position,
+		Entries:  make([]common.ReplicationEntry, 0, len(walEntries)),
+	}
+	for _, entry := range walEntries {
+		// Replicas compress with their own settings
+		data, err := pe.Decompress(entry.Data)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress WAL entry %d: %w", entry.SequenceNum, err)
+		}
+
+		batch.Entries = append(batch.Entries, common.ReplicationEntry{
+			SequenceNum: entry.SequenceNum,
+			Timestamp:   entry.Timestamp,
+			Operation:   entry.Operation,
+			EntityType:  entry.EntityType,
+			EntityID:    entry.EntityID,
+			Data:        data,
+		})
+	}
+
+	return batch, nil
+}
+
+// readWALRange reads up to limit live and archived WAL entries with sequence numbers in (after, upTo]
+// An entry that is both live and archived is returned once
+func (pe *Engine) readWALRange(txn *badger.Txn, after, upTo uint64, limit int) ([]WALEntry, error) {
+	entries := make(map[uint64]WALEntry)
+
+	for _, prefix := range []string{"wal:", walArchivePrefix} {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(prefix)
+
+		it := txn.NewIterator(opts)
+		read := 0
+
+		for it.Seek([]byte(prefix + fmt.Sprintf("%020d", after+1))); it.Valid() && read < limit; it.Next() {
+			item := it.Item()
+			sequence, ok := parseWALKeySequence(item.Key(), prefix)
+			if !ok {
+				continue
+			}
+			if sequence > upTo {
+				break
+			}
+
+			if _, exists := entries[sequence]; !exists {
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					it.Close()
+					return nil, err
+				}
+
+				entry, _, err := decodeWALEntry(value)
+				if err != nil {
+					pe.logger.Warnf("Failed to decode WAL entry %s: %v, skipping", string(item.Key()), err)
+					continue
+				}
+				entries[sequence] = entry
+			}
+			read++
+		}
+		it.Close()
+	}
+
+	sorted := make([]WALEntry, 0, len(entries))
+	for _, entry := range entries {
+		sorted = append(sorted, entry)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].SequenceNum < sorted[j].SequenceNum
+	})
+
+	if len(sorted) > limit {
+		sorted = sorted[:limit]
+	}
+	return sorted, nil
+}
+
+// ReplicaPosition returns the position in its primary's WAL history this database has applied
+// The position is empty for a database that was never bootstrapped as a replica
+func (pe *Engine) ReplicaPosition() (common.ReplicationPosition, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	var position common.ReplicationPosition
+	if pe.closed || pe.db == nil {
+		return position, fmt.Errorf("persistence engine is closed")
+	}
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(replicaPositionKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		return item.Value(func(val []byte) error {
+			return json.Unmarshal(val, &position)
+		})
+	})
+	if err != nil {
+		return position, fmt.Errorf("failed to read replica position: %w", err)
+	}
+	return position, nil
+}
+
+// saveReplicaPosition stores the position in its primary's WAL history this database has applied
+func (pe *Engine) saveReplicaPosition(position common.ReplicationPosition) error {
+	value, err := json.Marshal(position)
+	if err != nil {
+		return err
+	}
+
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return fmt.Errorf("persistence engine is closed")
+	}
+
+	if err := pe.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(replicaPositionKey), value)
+	}); err != nil {
+		return fmt.Errorf("failed to save replica position: %w", err)
+	}
+	return nil
+}
+
+// ApplyReplicationBatch applies WAL entries shipped by the primary to the store
+// The entries are logged in this database's own WAL like any other write. The new position
+// is stored once they are on disk, so after a crash at most one batch is applied again,
+// which replays idempotently like the WAL on load. An entry that cannot be applied stops
+// the batch at the position before it and returns common.ErrReplicaSnapshotRequired,
+// since the replica no longer matches its primary
+func (pe *Engine) ApplyReplicationBatch(store common.DatastoreEngine, batch *common.ReplicationBatch) error {
+	if len(batch.Entries) == 0 {
+		return nil
+	}
+
+	applied := uint64(0)
+	var applyErr error
+	for _, entry := range batch.Entries {
+		if err := replayOperation(store, pe.logger, entry.Operation, entry.EntityType, entry.EntityID, entry.Data); err != nil {
+			applyErr = fmt.Errorf("failed to apply replicated WAL entry %d: %v: %w", entry.SequenceNum, err, common.ErrReplicaSnapshotRequired)
+			break
+		}
+		applied = entry.SequenceNum
+	}
+
+	if applied > 0 {
+		if err := pe.flushWAL(); err != nil {
+			return err
+		}
+		if err := pe.saveReplicaPosition(common.ReplicationPosition{
+			HistoryID: batch.Position.HistoryID,
+			Sequence:  applied,
+		}); err != nil {
+			return err
+		}
+	}
+	return applyErr
+}
+
+// BootstrapReplica replaces the database with a snapshot of the primary and records its position
+// The snapshot is a backup stream taken after the position was read, so it contains every entry up to it
+func (pe *Engine) BootstrapReplica(store common.DatastoreEngine, r io.Reader, position common.ReplicationPosition) error {
+	if err := pe.Restore(store, r, common.RestoreOptions{DiscardPrevious: true}); err != nil {
+		return fmt.Errorf("failed to load primary snapshot: %w", err)
+	}
+	return pe.saveReplicaPosition(position)
+}
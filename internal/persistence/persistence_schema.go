@@ -36,3 +36,71 @@ func (pe *Engine) UpdateEntityType(store common.DatastoreEngine, def common.Enti
 	// Write to WAL
 	return pe.WriteWALEntry(OpUpdateEntityType, def.Name, "", buf.Bytes())
 }
+
+// SaveSchemaVersion stores a single version of an entity type definition
+func (pe *Engine) SaveSchemaVersion(entityType string, version common.EntityDefinitionVersion) error {
+	// Serialize the schema version
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(version); err != nil {
+		return fmt.Errorf("failed to encode schema version: %w", err)
+	}
+
+	// Zero-pad the version so keys sort in version order
+	key := fmt.Sprintf("schema_version:%s:%010d", entityType, version.Version)
+	return pe.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(key), pe.Compress(buf.Bytes()))
+	})
+}
+
+// LoadSchemaVersions loads the schema version history from the database into the data store
+func (pe *Engine) LoadSchemaVersions(store common.DatastoreEngine) error {
+	versionsByType := make(map[string][]common.EntityDefinitionVersion)
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("schema_version:")
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+
+			err := item.Value(func(val []byte) error {
+				// Decompress the data
+				data, err := pe.Decompress(val)
+				if err != nil {
+					return fmt.Errorf("failed to decompress schema version: %w", err)
+				}
+
+				// Deserialize the schema version
+				var version common.EntityDefinitionVersion
+				if err := gob.NewDecoder(bytes.NewBuffer(data)).Decode(&version); err != nil {
+					return fmt.Errorf("failed to decode schema version: %w", err)
+				}
+
+				entityType := version.Definition.Name
+				versionsByType[entityType] = append(versionsByType[entityType], version)
+				return nil
+			})
+
+			if err != nil {
+				pe.logger.Warnf("Error loading schema version %s: %v", string(item.Key()), err)
+				// Continue loading other versions despite errors
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for entityType, versions := range versionsByType {
+		if err := store.LoadSchemaVersions(entityType, versions); err != nil {
+			return fmt.Errorf("failed to load schema versions for %s: %w", entityType, err)
+		}
+	}
+
+	return nil
+}
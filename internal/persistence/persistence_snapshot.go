@@ -0,0 +1,430 @@
+package persistence
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
+	"github.com/phillarmonic/syncopate-db/internal/settings"
+)
+
+// snapshotStats describes the snapshots taken since the engine was opened
+type snapshotStats struct {
+	taken            int
+	failed           int
+	skipped          int
+	lastAt           time.Time
+	lastDuration     time.Duration
+	lastSequence     uint64
+	lastSize         int64 // Stored size of the last snapshot in bytes
+	lastError        string
+	prunedEntries    int
+	removedSnapshots int
+}
+
+// snapshotInfo identifies a stored snapshot
+type snapshotInfo struct {
+	timestamp   int64
+	sequence    uint64 // Last WAL sequence number contained in the snapshot
+	hasSequence bool   // False for snapshots taken before sequences were recorded
+}
+
+// setSnapshotStore sets the store that the snapshot routine snapshots
+func (pe *Engine) setSnapshotStore(store common.DatastoreEngine) {
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+	pe.snapshotStore = store
+}
+
+// runScheduledSnapshot takes a snapshot for the snapshot routine
+// It is skipped until a store is attached, and while nothing was written to the WAL since the last snapshot
+func (pe *Engine) runScheduledSnapshot() {
+	pe.snapshotMu.Lock()
+	defer pe.snapshotMu.Unlock()
+
+	if pe.snapshotStore == nil {
+		pe.logger.Debug("Snapshot interval reached, but no store is attached yet")
+		return
+	}
+
+	pe.walSeqMutex.Lock()
+	walSequence := pe.walSequence
+	pe.walSeqMutex.Unlock()
+
+	pe.statsMu.Lock()
+	unchanged := pe.stats.taken > 0 && pe.stats.lastSequence == walSequence
+	if unchanged && settings.Config.EnableWAL {
+		pe.stats.skipped++
+		pe.statsMu.Unlock()
+		pe.logger.Debug("Snapshot interval reached, no changes since the last snapshot")
+		return
+	}
+	pe.statsMu.Unlock()
+
+	start := time.Now()
+	sequence, err := pe.takeSnapshot(pe.snapshotStore)
+	pe.recordSnapshot(start, sequence, err)
+
+	if err != nil {
+		pe.logger.Warnf("Scheduled snapshot failed: %v", err)
+		return
+	}
+	pe.logger.Debugf("Scheduled snapshot taken in %s", time.Since(start))
+}
+
+// recordSnapshot updates the snapshot statistics after a snapshot attempt
+func (pe *Engine) recordSnapshot(start time.Time, sequence uint64, err error) {
+	pe.statsMu.Lock()
+	defer pe.statsMu.Unlock()
+
+	metrics.ObserveSnapshot(time.Since(start), pe.stats.lastSize, err)
+	if err != nil {
+		pe.stats.failed++
+		pe.stats.lastError = err.Error()
+		return
+	}
+
+	pe.stats.taken++
+	pe.stats.lastAt = start
+	pe.stats.lastDuration = time.Since(start)
+	pe.stats.lastSequence = sequence
+	pe.stats.lastError = ""
+}
+
+// listSnapshots returns the stored snapshots, oldest first
+func (pe *Engine) listSnapshots() ([]snapshotInfo, error) {
+	var snapshots []snapshotInfo
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		sequences := make(map[int64]uint64)
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte(snapshotSequencePrefix)
+		it := txn.NewIterator(opts)
+		for it.Rewind(); it.Valid(); it.Next() {
+			timestamp, err := strconv.ParseInt(strings.TrimPrefix(string(it.Item().Key()), snapshotSequencePrefix), 10, 64)
+			if err != nil {
+				continue
+			}
+			if err := it.Item().Value(func(val []byte) error {
+				if len(val) == 8 {
+					sequences[timestamp] = binary.LittleEndian.Uint64(val)
+				}
+				return nil
+			}); err != nil {
+				it.Close()
+				return err
+			}
+		}
+		it.Close()
+
+		opts = badger.DefaultIteratorOptions
+		opts.Prefix = []byte("snapshot:")
+		opts.PrefetchValues = false
+		it = txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			timestamp, err := strconv.ParseInt(strings.TrimPrefix(string(it.Item().Key()), "snapshot:"), 10, 64)
+			if err != nil {
+				continue
+			}
+
+			sequence, hasSequence := sequences[timestamp]
+			snapshots = append(snapshots, snapshotInfo{
+				timestamp:   timestamp,
+				sequence:    sequence,
+				hasSequence: hasSequence,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].timestamp < snapshots[j].timestamp
+	})
+	return snapshots, nil
+}
+
+// applySnapshotRetention removes the snapshots beyond the retention count and prunes
+// the WAL entries that the oldest retained snapshot already contains
+func (pe *Engine) applySnapshotRetention() error {
+	retention := pe.snapshotRetention
+	if retention < 1 {
+		retention = 1
+	}
+
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+	if len(snapshots) == 0 {
+		return nil
+	}
+
+	removed := 0
+	if len(snapshots) > retention {
+		expired := snapshots[:len(snapshots)-retention]
+		snapshots = snapshots[len(snapshots)-retention:]
+
+		wb := pe.db.NewWriteBatch()
+		defer wb.Cancel()
+
+		for _, snapshot := range expired {
+			if err := wb.Delete([]byte(fmt.Sprintf("snapshot:%d", snapshot.timestamp))); err != nil {
+				return err
+			}
+			if err := wb.Delete([]byte(fmt.Sprintf("%s%d", snapshotSequencePrefix, snapshot.timestamp))); err != nil {
+				return err
+			}
+		}
+
+		if err := wb.Flush(); err != nil {
+			return fmt.Errorf("failed to remove old snapshots: %w", err)
+		}
+		removed = len(expired)
+
+		for _, snapshot := range expired {
+			if err := pe.deleteSnapshotChunks(snapshot.timestamp); err != nil {
+				return fmt.Errorf("failed to remove old snapshot chunks: %w", err)
+			}
+		}
+	}
+
+	// WAL entries after a snapshot without a recorded sequence cannot be told apart, keep them all
+	pruned := 0
+	if oldest := snapshots[0]; oldest.hasSequence {
+		if pruned, err = pe.PruneWALThroughSequence(oldest.sequence); err != nil {
+			return err
+		}
+	}
+
+	pe.statsMu.Lock()
+	pe.stats.removedSnapshots += removed
+	pe.stats.prunedEntries += pruned
+	pe.statsMu.Unlock()
+
+	if removed > 0 || pruned > 0 {
+		pe.logger.Infof("Removed %d old snapshots and pruned %d WAL entries", removed, pruned)
+	}
+	return nil
+}
+
+// PruneWALThroughSequence removes the WAL entries up to and including a sequence number
+// Pruned entries are moved to the WAL archive while archiving is enabled.
+// It returns the number of pruned entries
+func (pe *Engine) PruneWALThroughSequence(sequence uint64) (int, error) {
+	archive := pe.walArchiveTTL > 0
+	var lastPruned uint64
+	pruned := 0
+
+	// A write batch splits large prunes over several transactions
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("wal:")
+		opts.PrefetchValues = archive
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// Keys are ordered by sequence number, so stop at the first newer entry
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			entrySequence, ok := parseWALKeySequence(item.Key(), "wal:")
+			if !ok {
+				pe.logger.Warnf("Invalid sequence number in WAL key %s", string(item.Key()))
+				continue
+			}
+			if entrySequence > sequence {
+				break
+			}
+
+			if archive {
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return fmt.Errorf("failed to read WAL entry for archiving: %w", err)
+				}
+				if err := wb.Set(archiveKey(item.Key()), value); err != nil {
+					return fmt.Errorf("failed to archive WAL entry: %w", err)
+				}
+			}
+			if err := wb.Delete(item.KeyCopy(nil)); err != nil {
+				return fmt.Errorf("failed to delete old WAL entry: %w", err)
+			}
+
+			lastPruned = entrySequence
+			pruned++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if err := wb.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to prune WAL: %w", err)
+	}
+
+	if !archive {
+		// Without an archive, history before this point can no longer be replayed
+		if lastPruned > 0 {
+			if err := pe.db.Update(func(txn *badger.Txn) error {
+				return raiseSequenceMarker(txn, walLostSequenceKey, lastPruned)
+			}); err != nil {
+				return pruned, err
+			}
+		}
+		return pruned, nil
+	}
+
+	return pruned, pe.trimWALArchive()
+}
+
+// PruneWALBeforeTimestamp removes WAL entries written at or before the given timestamp
+// Entries are pruned in sequence order, up to the first entry written after the timestamp
+func (pe *Engine) PruneWALBeforeTimestamp(timestamp int64) error {
+	var through uint64
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = []byte("wal:")
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			var entry WALEntry
+			if err := it.Item().Value(func(val []byte) error {
+				var err error
+				entry, _, err = decodeWALEntry(val)
+				return err
+			}); err != nil {
+				return fmt.Errorf("failed to decode WAL entry %s: %w", string(it.Item().Key()), err)
+			}
+
+			if entry.Timestamp > timestamp {
+				break
+			}
+			through = entry.SequenceNum
+		}
+		return nil
+	})
+	if err != nil || through == 0 {
+		return err
+	}
+
+	pruned, err := pe.PruneWALThroughSequence(through)
+	if err == nil {
+		pe.logger.Infof("Pruned %d WAL entries older than %s", pruned, time.Unix(0, timestamp).Format(time.RFC3339))
+	}
+	return err
+}
+
+// countKeys counts the keys with a prefix without reading their values
+func countKeys(txn *badger.Txn, prefix string) int {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = []byte(prefix)
+	opts.PrefetchValues = false
+
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	count := 0
+	for it.Rewind(); it.Valid(); it.Next() {
+		count++
+	}
+	return count
+}
+
+// SnapshotStats returns statistics about stored snapshots, the WAL and the snapshot routine
+func (pe *Engine) SnapshotStats() (map[string]interface{}, error) {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
+
+	if pe.closed || pe.db == nil {
+		return nil, fmt.Errorf("persistence engine is closed")
+	}
+
+	snapshots, err := pe.listSnapshots()
+	if err != nil {
+		return nil, err
+	}
+
+	var liveEntries, archivedEntries int
+	var lostSequence uint64
+	err = pe.db.View(func(txn *badger.Txn) error {
+		liveEntries = countKeys(txn, "wal:")
+		archivedEntries = countKeys(txn, walArchivePrefix)
+
+		var err error
+		lostSequence, err = readSequence(txn, walLostSequenceKey)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pe.walSeqMutex.Lock()
+	walSequence := pe.walSequence
+	pe.walSeqMutex.Unlock()
+
+	retention := pe.snapshotRetention
+	if retention < 1 {
+		retention = 1
+	}
+
+	snapshotSummary := map[string]interface{}{
+		"count":     len(snapshots),
+		"retention": retention,
+	}
+	if len(snapshots) > 0 {
+		oldest, latest := snapshots[0], snapshots[len(snapshots)-1]
+		snapshotSummary["oldest_at"] = time.Unix(0, oldest.timestamp).UTC()
+		snapshotSummary["oldest_sequence"] = oldest.sequence
+		snapshotSummary["latest_at"] = time.Unix(0, latest.timestamp).UTC()
+		snapshotSummary["latest_sequence"] = latest.sequence
+	}
+
+	pe.statsMu.Lock()
+	routine := map[string]interface{}{
+		"interval":           pe.snapshotInterval.String(),
+		"taken":              pe.stats.taken,
+		"failed":             pe.stats.failed,
+		"skipped":            pe.stats.skipped,
+		"pruned_wal_entries": pe.stats.prunedEntries,
+		"removed_snapshots":  pe.stats.removedSnapshots,
+	}
+	if pe.stats.taken > 0 {
+		routine["last_at"] = pe.stats.lastAt.UTC()
+		routine["last_duration"] = pe.stats.lastDuration.String()
+		routine["last_size_bytes"] = pe.stats.lastSize
+	}
+	if pe.stats.lastError != "" {
+		routine["last_error"] = pe.stats.lastError
+	}
+	pe.statsMu.Unlock()
+
+	return map[string]interface{}{
+		"snapshots":        snapshotSummary,
+		"snapshot_routine": routine,
+		"wal": map[string]interface{}{
+			"sequence":              walSequence,
+			"live_entries":          liveEntries,
+			"archived_entries":      archivedEntries,
+			"archive_retention":     pe.walArchiveTTL.String(),
+			"lost_through_sequence": lostSequence,
+		},
+	}, nil
+}
@@ -0,0 +1,384 @@
+package persistence
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/phillarmonic/syncopate-db/internal/common"
+)
+
+const (
+	// snapshotChunkPrefix holds the segments of chunked snapshots, keyed by snapshot
+	// timestamp, segment and chunk number
+	snapshotChunkPrefix = "snapshot_chunk:"
+
+	// DefaultSnapshotChunkSize is the number of entities stored per snapshot chunk
+	DefaultSnapshotChunkSize = 1000
+)
+
+// snapshotManifestV2Magic starts the manifests of format version 2, which had no format header
+var snapshotManifestV2Magic = []byte("SYNCSNAP")
+
+// snapshotChecksumTable is used for the checksums of manifests and chunks
+var snapshotChecksumTable = crc32.MakeTable(crc32.Castagnoli)
+
+// snapshotManifest describes a chunked snapshot. It is written after all of its chunks,
+// so a snapshot is only visible once it is complete
+type snapshotManifest struct {
+	Sequence uint64 // Last WAL sequence number contained in the snapshot
+	Segments []snapshotSegment
+
+	size int64 // Stored size of the chunks, not encoded
+}
+
+// snapshotSegment holds one entity type of a snapshot
+type snapshotSegment struct {
+	Definition common.EntityDefinition
+	Entities   int
+	Chunks     []snapshotChunk
+}
+
+// snapshotChunk describes a stored chunk of entities
+type snapshotChunk struct {
+	Entities int
+	Checksum uint32 // CRC-32C of the compressed chunk, without its format header
+}
+
+// snapshotChunkKey returns the key of a snapshot chunk
+func snapshotChunkKey(timestamp int64, segment, chunk int) []byte {
+	return []byte(fmt.Sprintf("%s%d:%06d:%08d", snapshotChunkPrefix, timestamp, segment, chunk))
+}
+
+// snapshotChunkWriter writes the entities of a streamed snapshot as chunks of a write batch
+// Each batch it receives becomes one chunk, and the manifest describes the chunks written so far
+type snapshotChunkWriter struct {
+	pe        *Engine
+	timestamp int64
+	wb        *badger.WriteBatch
+	manifest  *snapshotManifest
+}
+
+// WriteEntityType starts the segment of an entity type
+func (w *snapshotChunkWriter) WriteEntityType(def common.EntityDefinition) error {
+	w.manifest.Segments = append(w.manifest.Segments, snapshotSegment{Definition: def})
+	return nil
+}
+
+// WriteEntities encodes a batch of entities into a chunk of the current segment
+func (w *snapshotChunkWriter) WriteEntities(entities []common.Entity) error {
+	segmentIndex := len(w.manifest.Segments) - 1
+	if segmentIndex < 0 {
+		return fmt.Errorf("snapshot entities written before their entity type")
+	}
+	segment := &w.manifest.Segments[segmentIndex]
+
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(entities); err != nil {
+		return fmt.Errorf("failed to encode entities of type %s: %w", segment.Definition.Name, err)
+	}
+
+	body := w.pe.Compress(buf.Bytes())
+	value := append(appendFormatHeader(nil, recordSnapshotChunk), body...)
+	if err := w.wb.Set(snapshotChunkKey(w.timestamp, segmentIndex, len(segment.Chunks)), value); err != nil {
+		return fmt.Errorf("failed to write snapshot chunk: %w", err)
+	}
+	w.manifest.size += int64(len(value))
+
+	segment.Entities += len(entities)
+	segment.Chunks = append(segment.Chunks, snapshotChunk{
+		Entities: len(entities),
+		Checksum: crc32.Checksum(body, snapshotChecksumTable),
+	})
+	return nil
+}
+
+// writeSnapshotChunks writes the entities a stream function passes to its writer as chunks
+// of at most the configured chunk size. It returns the manifest describing the written chunks
+func (pe *Engine) writeSnapshotChunks(timestamp int64, stream func(chunkSize int, writer common.SnapshotWriter) error) (*snapshotManifest, error) {
+	chunkSize := pe.snapshotChunkSize
+	if chunkSize < 1 {
+		chunkSize = DefaultSnapshotChunkSize
+	}
+
+	// The write batch commits as it fills up, so only a few chunks are held in memory
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	writer := &snapshotChunkWriter{pe: pe, timestamp: timestamp, wb: wb, manifest: &snapshotManifest{}}
+	if err := stream(chunkSize, writer); err != nil {
+		return nil, err
+	}
+
+	if err := wb.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to write snapshot chunks: %w", err)
+	}
+
+	return writer.manifest, nil
+}
+
+// streamSnapshotTypes passes decoded entity types to a snapshot writer in chunks
+func streamSnapshotTypes(types []common.EntityTypeSnapshot, chunkSize int, writer common.SnapshotWriter) error {
+	for _, entityType := range types {
+		if err := writer.WriteEntityType(entityType.Definition); err != nil {
+			return err
+		}
+
+		for start := 0; start < len(entityType.Entities); start += chunkSize {
+			end := start + chunkSize
+			if end > len(entityType.Entities) {
+				end = len(entityType.Entities)
+			}
+			if err := writer.WriteEntities(entityType.Entities[start:end]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteSnapshotChunks removes all chunks of a snapshot
+func (pe *Engine) deleteSnapshotChunks(timestamp int64) error {
+	prefix := []byte(fmt.Sprintf("%s%d:", snapshotChunkPrefix, timestamp))
+
+	var keys [][]byte
+	err := pe.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	wb := pe.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return err
+		}
+	}
+	return wb.Flush()
+}
+
+// encodeSnapshotManifest serializes a manifest behind the format header and a checksum
+func encodeSnapshotManifest(manifest *snapshotManifest) ([]byte, error) {
+	var body bytes.Buffer
+	if err := gob.NewEncoder(&body).Encode(manifest); err != nil {
+		return nil, err
+	}
+
+	value := make([]byte, 0, formatHeaderSize+4+body.Len())
+	value = appendFormatHeader(value, recordSnapshotManifest)
+	value = binary.LittleEndian.AppendUint32(value, crc32.Checksum(body.Bytes(), snapshotChecksumTable))
+	return append(value, body.Bytes()...), nil
+}
+
+// decodeSnapshotManifest parses the manifest of a chunked snapshot and returns its format version
+// It returns a nil manifest for version 1 snapshots, which are a single gob stream
+func decodeSnapshotManifest(value []byte) (*snapshotManifest, int, error) {
+	version, value, err := readFormatHeader(value, recordSnapshotManifest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if version == 0 {
+		if !bytes.HasPrefix(value, snapshotManifestV2Magic) {
+			return nil, 1, nil
+		}
+		version = 2
+		value = value[len(snapshotManifestV2Magic):]
+	}
+
+	if len(value) < 4 {
+		return nil, version, fmt.Errorf("snapshot manifest is truncated")
+	}
+
+	body := value[4:]
+	if binary.LittleEndian.Uint32(value[:4]) != crc32.Checksum(body, snapshotChecksumTable) {
+		return nil, version, fmt.Errorf("snapshot manifest checksum mismatch")
+	}
+
+	var manifest snapshotManifest
+	if err := gob.NewDecoder(bytes.NewReader(body)).Decode(&manifest); err != nil {
+		return nil, version, fmt.Errorf("failed to decode snapshot manifest: %w", err)
+	}
+	return &manifest, version, nil
+}
+
+// writeSnapshotManifest stores the manifest of a snapshot in the current format version
+func (pe *Engine) writeSnapshotManifest(timestamp int64, manifest *snapshotManifest) error {
+	value, err := encodeSnapshotManifest(manifest)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot manifest: %w", err)
+	}
+
+	return pe.db.Update(func(txn *badger.Txn) error {
+		return txn.Set([]byte(fmt.Sprintf("snapshot:%d", timestamp)), value)
+	})
+}
+
+// prepareSnapshotDefinition cleans up a definition read from a snapshot before it is registered
+func prepareSnapshotDefinition(def *common.EntityDefinition) {
+	// Clean up any duplicate internal fields
+	cleanInternalFields(def)
+
+	// Mark internal fields
+	for j := range def.Fields {
+		if strings.HasPrefix(def.Fields[j].Name, "_") {
+			def.Fields[j].Internal = true
+		}
+	}
+}
+
+// loadSnapshotChunks loads the entities of a chunked snapshot into the store
+// Definitions are registered first, then chunks are read, verified and inserted in parallel
+func (pe *Engine) loadSnapshotChunks(store common.DatastoreEngine, timestamp int64, manifest *snapshotManifest) error {
+	type chunkRef struct {
+		segment int
+		chunk   int
+		info    snapshotChunk
+	}
+
+	var chunks []chunkRef
+	for segmentIndex, segment := range manifest.Segments {
+		def := segment.Definition
+		prepareSnapshotDefinition(&def)
+
+		if err := store.RegisterEntityType(def); err != nil {
+			return fmt.Errorf("failed to register entity type: %w", err)
+		}
+
+		for chunkIndex, chunk := range segment.Chunks {
+			chunks = append(chunks, chunkRef{segment: segmentIndex, chunk: chunkIndex, info: chunk})
+		}
+	}
+
+	workers := runtime.GOMAXPROCS(0)
+	if workers > len(chunks) {
+		workers = len(chunks)
+	}
+
+	work := make(chan chunkRef)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ref := range work {
+				if err := pe.loadSnapshotChunk(store, timestamp, ref.segment, ref.chunk, ref.info); err != nil {
+					errs <- err
+					// Drain the remaining work so the producer does not block
+					for range work {
+					}
+					return
+				}
+			}
+		}()
+	}
+
+	for _, ref := range chunks {
+		work <- ref
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	return <-errs
+}
+
+// loadSnapshotChunk reads, verifies and inserts a single snapshot chunk
+func (pe *Engine) loadSnapshotChunk(store common.DatastoreEngine, timestamp int64, segment, chunk int, info snapshotChunk) error {
+	entities, err := pe.readSnapshotChunk(timestamp, segment, chunk, info)
+	if err != nil {
+		return err
+	}
+
+	for _, entity := range entities {
+		if err := store.Insert(entity.Type, entity.ID, entity.Fields); err != nil {
+			return fmt.Errorf("failed to insert entity: %w", err)
+		}
+	}
+	return nil
+}
+
+// readSnapshotChunk reads a snapshot chunk and verifies it against its manifest entry
+// Chunks of format version 2 have no header, which is detected per chunk
+func (pe *Engine) readSnapshotChunk(timestamp int64, segment, chunk int, info snapshotChunk) ([]common.Entity, error) {
+	var entities []common.Entity
+
+	err := pe.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(snapshotChunkKey(timestamp, segment, chunk))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			_, body, err := readFormatHeader(val, recordSnapshotChunk)
+			if err != nil {
+				return err
+			}
+
+			if crc32.Checksum(body, snapshotChecksumTable) != info.Checksum {
+				return fmt.Errorf("checksum mismatch")
+			}
+
+			data, err := pe.Decompress(body)
+			if err != nil {
+				return fmt.Errorf("failed to decompress: %w", err)
+			}
+
+			return gob.NewDecoder(bytes.NewReader(data)).Decode(&entities)
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read snapshot chunk %d of segment %d: %w", chunk, segment, err)
+	}
+
+	if len(entities) != info.Entities {
+		return nil, fmt.Errorf("snapshot chunk %d of segment %d holds %d entities, expected %d",
+			chunk, segment, len(entities), info.Entities)
+	}
+	return entities, nil
+}
+
+// loadLegacySnapshot loads a version 1 snapshot, which is a single gob stream
+func (pe *Engine) loadLegacySnapshot(store common.DatastoreEngine, value []byte) error {
+	types, err := pe.decodeLegacySnapshot(value)
+	if err != nil {
+		return err
+	}
+
+	for _, entityType := range types {
+		def := entityType.Definition
+		prepareSnapshotDefinition(&def)
+
+		if err := store.RegisterEntityType(def); err != nil {
+			return fmt.Errorf("failed to register entity type: %w", err)
+		}
+
+		for _, entity := range entityType.Entities {
+			if err := store.Insert(entity.Type, entity.ID, entity.Fields); err != nil {
+				return fmt.Errorf("failed to insert entity: %w", err)
+			}
+		}
+	}
+
+	return nil
+}
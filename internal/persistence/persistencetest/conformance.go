@@ -0,0 +1,344 @@
+// Package persistencetest provides a conformance suite that every persistence provider must pass
+package persistencetest
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/datastore"
+)
+
+// Factory opens a persistence provider on a data directory
+// The suite closes providers and opens the same directory again to check what was persisted
+type Factory func(t *testing.T, dir string) common.PersistenceProvider
+
+// Run runs the conformance suite against the providers of a factory
+func Run(t *testing.T, open Factory) {
+	t.Run("ReplayLog", func(t *testing.T) { testReplayLog(t, open) })
+	t.Run("SnapshotAndLog", func(t *testing.T) { testSnapshotAndLog(t, open) })
+	t.Run("SchemaVersions", func(t *testing.T) { testSchemaVersions(t, open) })
+	t.Run("EntityTypeOperations", func(t *testing.T) { testEntityTypeOperations(t, open) })
+	t.Run("TruncateDatabase", func(t *testing.T) { testTruncateDatabase(t, open) })
+}
+
+// session is a datastore engine running on a provider
+type session struct {
+	provider common.PersistenceProvider
+	db       *datastore.Engine
+}
+
+// openSession opens a provider on dir and loads a datastore engine from it
+func openSession(t *testing.T, open Factory, dir string) *session {
+	t.Helper()
+
+	provider := open(t, dir)
+	db := datastore.NewDataStoreEngine(datastore.EngineConfig{
+		Persistence:       provider,
+		EnablePersistence: true,
+	})
+	return &session{provider: provider, db: db}
+}
+
+// close closes the provider without taking a snapshot, so the next session replays the log
+func (s *session) close(t *testing.T) {
+	t.Helper()
+
+	if err := s.provider.Close(); err != nil {
+		t.Fatalf("Failed to close provider: %v", err)
+	}
+}
+
+// snapshot takes a snapshot of the session's engine
+func (s *session) snapshot(t *testing.T) {
+	t.Helper()
+
+	if err := s.db.ForceSnapshot(); err != nil {
+		t.Fatalf("Failed to take snapshot: %v", err)
+	}
+}
+
+// reopen runs check against a fresh session on dir twice, since loading must not change what is stored
+func reopen(t *testing.T, open Factory, dir string, check func(db *datastore.Engine)) {
+	t.Helper()
+
+	for i := 0; i < 2; i++ {
+		s := openSession(t, open, dir)
+		check(s.db)
+		s.close(t)
+	}
+}
+
+var usersDefinition = common.EntityDefinition{
+	Name:        "users",
+	IDGenerator: common.IDTypeAutoIncrement,
+	Fields: []common.FieldDefinition{
+		{Name: "email", Type: "string", Unique: true},
+		{Name: "status", Type: "string", Indexed: true},
+	},
+}
+
+// registerUsers registers the users entity type and inserts users with IDs 1 to count
+func registerUsers(t *testing.T, db *datastore.Engine, count int) {
+	t.Helper()
+
+	if err := db.RegisterEntityType(usersDefinition); err != nil {
+		t.Fatalf("Failed to register entity type: %v", err)
+	}
+	insertUsers(t, db, 1, count)
+}
+
+// insertUsers inserts users numbered from first to last
+func insertUsers(t *testing.T, db *datastore.Engine, first, last int) {
+	t.Helper()
+
+	for i := first; i <= last; i++ {
+		if err := db.Insert("users", "", map[string]interface{}{
+			"email":  fmt.Sprintf("user%d@example.com", i),
+			"status": "active",
+		}); err != nil {
+			t.Fatalf("Failed to insert user %d: %v", i, err)
+		}
+	}
+}
+
+// expectCount fails the test unless an entity type holds count entities
+func expectCount(t *testing.T, db *datastore.Engine, entityType string, count int) {
+	t.Helper()
+
+	got, err := db.GetEntityCount(entityType)
+	if err != nil {
+		t.Fatalf("Failed to count %s: %v", entityType, err)
+	}
+	if got != count {
+		t.Fatalf("Expected %d entities of type %s, got %d", count, entityType, got)
+	}
+}
+
+// expectField fails the test unless an entity exists with the given field value
+func expectField(t *testing.T, db *datastore.Engine, entityType, id, field string, value interface{}) {
+	t.Helper()
+
+	entity, err := db.GetByType(id, entityType)
+	if err != nil {
+		t.Fatalf("Expected %s %s to exist: %v", entityType, id, err)
+	}
+	if entity.Fields[field] != value {
+		t.Fatalf("Expected %s of %s %s to be %v, got %v", field, entityType, id, value, entity.Fields[field])
+	}
+}
+
+// testReplayLog checks that writes survive a restart without a snapshot
+func testReplayLog(t *testing.T, open Factory) {
+	dir := t.TempDir()
+
+	s := openSession(t, open, dir)
+	registerUsers(t, s.db, 3)
+	if err := s.db.Update("users", "2", map[string]interface{}{"status": "suspended"}); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if err := s.db.Delete("users", "3"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	s.close(t)
+
+	reopen(t, open, dir, func(db *datastore.Engine) {
+		expectCount(t, db, "users", 2)
+		expectField(t, db, "users", "1", "email", "user1@example.com")
+		expectField(t, db, "users", "2", "status", "suspended")
+		if _, err := db.GetByType("3", "users"); err == nil {
+			t.Fatal("Expected deleted user 3 to stay deleted")
+		}
+
+		// Indices are rebuilt from the replayed entities
+		if err := db.Insert("users", "", map[string]interface{}{"email": "user1@example.com", "status": "active"}); err == nil {
+			t.Fatal("Expected a unique constraint violation")
+		}
+	})
+
+	// Auto-increment IDs continue after the highest one ever used, deleted ones are not reused
+	s = openSession(t, open, dir)
+	insertUsers(t, s.db, 4, 4)
+	s.close(t)
+
+	reopen(t, open, dir, func(db *datastore.Engine) {
+		expectField(t, db, "users", "4", "email", "user4@example.com")
+		if _, err := db.GetByType("3", "users"); err == nil {
+			t.Fatal("Expected deleted ID 3 not to be reused")
+		}
+	})
+}
+
+// testSnapshotAndLog checks that writes before and after snapshots are combined on load
+func testSnapshotAndLog(t *testing.T, open Factory) {
+	dir := t.TempDir()
+
+	s := openSession(t, open, dir)
+	registerUsers(t, s.db, 5)
+	s.snapshot(t)
+
+	insertUsers(t, s.db, 6, 10)
+	if err := s.db.Update("users", "1", map[string]interface{}{"status": "suspended"}); err != nil {
+		t.Fatalf("Failed to update user: %v", err)
+	}
+	if err := s.db.Delete("users", "2"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	s.snapshot(t)
+
+	if err := s.db.Delete("users", "7"); err != nil {
+		t.Fatalf("Failed to delete user: %v", err)
+	}
+	s.close(t)
+
+	reopen(t, open, dir, func(db *datastore.Engine) {
+		expectCount(t, db, "users", 8)
+		expectField(t, db, "users", "1", "status", "suspended")
+		expectField(t, db, "users", "10", "email", "user10@example.com")
+		for _, id := range []string{"2", "7"} {
+			if _, err := db.GetByType(id, "users"); err == nil {
+				t.Fatalf("Expected deleted user %s to stay deleted", id)
+			}
+		}
+		if issues := db.CheckIntegrity(); len(issues) != 0 {
+			t.Fatalf("Expected no integrity issues, got %v", issues)
+		}
+	})
+
+	// A snapshot of a reloaded engine holds the same data
+	s = openSession(t, open, dir)
+	s.snapshot(t)
+	s.close(t)
+
+	reopen(t, open, dir, func(db *datastore.Engine) {
+		expectCount(t, db, "users", 8)
+		expectField(t, db, "users", "1", "status", "suspended")
+	})
+}
+
+// testSchemaVersions checks that definitions and their history survive a restart
+func testSchemaVersions(t *testing.T, open Factory) {
+	dir := t.TempDir()
+
+	s := openSession(t, open, dir)
+	registerUsers(t, s.db, 1)
+
+	updated := common.EntityDefinition{
+		Name:        usersDefinition.Name,
+		IDGenerator: usersDefinition.IDGenerator,
+		Fields:      append([]common.FieldDefinition{{Name: "name", Type: "string"}}, usersDefinition.Fields...),
+	}
+	if err := s.db.UpdateEntityType(updated); err != nil {
+		t.Fatalf("Failed to update entity type: %v", err)
+	}
+	s.close(t)
+
+	check := func(db *datastore.Engine) {
+		def, err := db.GetEntityDefinition("users")
+		if err != nil {
+			t.Fatalf("Expected entity type users to exist: %v", err)
+		}
+		if def.Version != 2 {
+			t.Fatalf("Expected definition at version 2, got %d", def.Version)
+		}
+
+		versions, err := db.GetSchemaVersions("users")
+		if err != nil {
+			t.Fatalf("Failed to get schema versions: %v", err)
+		}
+		if len(versions) != 2 {
+			t.Fatalf("Expected 2 schema versions, got %d", len(versions))
+		}
+	}
+
+	reopen(t, open, dir, check)
+
+	s = openSession(t, open, dir)
+	s.snapshot(t)
+	s.close(t)
+
+	reopen(t, open, dir, check)
+}
+
+// testEntityTypeOperations checks that truncates, renames, clones and drops survive a restart
+func testEntityTypeOperations(t *testing.T, open Factory) {
+	dir := t.TempDir()
+
+	s := openSession(t, open, dir)
+	for _, name := range []string{"truncated", "renamed", "cloned", "dropped"} {
+		if err := s.db.RegisterEntityType(common.EntityDefinition{
+			Name:        name,
+			IDGenerator: common.IDTypeAutoIncrement,
+			Fields:      []common.FieldDefinition{{Name: "value", Type: "integer"}},
+		}); err != nil {
+			t.Fatalf("Failed to register entity type %s: %v", name, err)
+		}
+		for i := 1; i <= 3; i++ {
+			if err := s.db.Insert(name, "", map[string]interface{}{"value": i}); err != nil {
+				t.Fatalf("Failed to insert into %s: %v", name, err)
+			}
+		}
+	}
+
+	if err := s.db.TruncateEntityType("truncated"); err != nil {
+		t.Fatalf("Failed to truncate entity type: %v", err)
+	}
+	if err := s.db.RenameEntityType("renamed", "renamed_new"); err != nil {
+		t.Fatalf("Failed to rename entity type: %v", err)
+	}
+	if err := s.db.CloneEntityType("cloned", "cloned_copy", true); err != nil {
+		t.Fatalf("Failed to clone entity type: %v", err)
+	}
+	if err := s.db.DropEntityType("dropped"); err != nil {
+		t.Fatalf("Failed to drop entity type: %v", err)
+	}
+	s.close(t)
+
+	check := func(db *datastore.Engine, renamedCount int) {
+		expectCount(t, db, "truncated", 0)
+		expectCount(t, db, "renamed_new", renamedCount)
+		expectCount(t, db, "cloned", 3)
+		expectCount(t, db, "cloned_copy", 3)
+		expectField(t, db, "cloned_copy", "2", "value", 2)
+
+		for _, name := range []string{"renamed", "dropped"} {
+			if _, err := db.GetEntityDefinition(name); err == nil {
+				t.Fatalf("Expected entity type %s to be gone", name)
+			}
+		}
+	}
+
+	reopen(t, open, dir, func(db *datastore.Engine) { check(db, 3) })
+
+	s = openSession(t, open, dir)
+	s.snapshot(t)
+
+	// Counters survive a rename
+	if err := s.db.Insert("renamed_new", "", map[string]interface{}{"value": 4}); err != nil {
+		t.Fatalf("Failed to insert into renamed entity type: %v", err)
+	}
+	s.close(t)
+
+	reopen(t, open, dir, func(db *datastore.Engine) {
+		check(db, 4)
+		expectField(t, db, "renamed_new", "4", "value", 4)
+	})
+}
+
+// testTruncateDatabase checks that truncating the database survives a restart
+func testTruncateDatabase(t *testing.T, open Factory) {
+	dir := t.TempDir()
+
+	s := openSession(t, open, dir)
+	registerUsers(t, s.db, 3)
+	s.snapshot(t)
+
+	if err := s.db.TruncateDatabase(); err != nil {
+		t.Fatalf("Failed to truncate database: %v", err)
+	}
+	s.close(t)
+
+	reopen(t, open, dir, func(db *datastore.Engine) {
+		expectCount(t, db, "users", 0)
+	})
+}
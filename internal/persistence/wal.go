@@ -7,6 +7,7 @@ import (
 	"github.com/dgraph-io/badger/v4"
 	"github.com/google/uuid"
 	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/metrics"
 	"github.com/phillarmonic/syncopate-db/internal/settings"
 	"sort"
 	"strings"
@@ -23,6 +24,9 @@ const (
 	OpUpdateEntityType
 	OpTruncateEntityType
 	OpTruncateDatabase
+	OpDropEntityType
+	OpRenameEntityType
+	OpCloneEntityType
 )
 
 // WALEntry represents a write-ahead log entry
@@ -37,6 +41,13 @@ type WALEntry struct {
 	IsLastInTxn   bool // Flag indicating last operation in a transaction
 }
 
+// bufferedWALEntry is a WAL entry waiting for the next commit
+// Acknowledged entries belong to async writes that have already returned to their writer
+type bufferedWALEntry struct {
+	entry        WALEntry
+	acknowledged bool
+}
+
 // The Transaction represents a group of operations that should be applied atomically
 type Transaction struct {
 	ID      string
@@ -101,17 +112,17 @@ func (pe *Engine) CommitTransaction(txnID string) error {
 		pe.walSeqMutex.Unlock()
 
 		// Serialize entry
-		var buf bytes.Buffer
-		if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
-			return fmt.Errorf("failed to encode WAL entry: %w", err)
+		value, err := encodeWALEntry(entry)
+		if err != nil {
+			return err
 		}
 
 		// Create the key with sequence number for proper ordering
-		key := fmt.Sprintf("wal:%020d:%s:%s", entry.SequenceNum, entry.EntityType, entry.EntityID)
+		key := walKey(entry)
 
 		// Write to database
 		if err := pe.db.Update(func(txn *badger.Txn) error {
-			return txn.Set([]byte(key), buf.Bytes())
+			return txn.Set([]byte(key), value)
 		}); err != nil {
 			return fmt.Errorf("failed to write WAL entry: %w", err)
 		}
@@ -146,50 +157,165 @@ func (pe *Engine) AddToTransaction(txnID string, op int, entityType, entityID st
 	return nil
 }
 
-// WriteWALEntry writes an operation to the write-ahead log
+// WriteWALEntry writes an operation to the write-ahead log with the default durability
 func (pe *Engine) WriteWALEntry(op int, entityType, entityID string, data []byte) error {
+	return pe.writeWALEntry(op, entityType, entityID, data, pe.durability)
+}
+
+// writeWALEntry buffers an operation for the next WAL commit and waits as long as the
+// durability requires
+func (pe *Engine) writeWALEntry(op int, entityType, entityID string, data []byte, durability common.Durability) error {
 	// Check if WAL is disabled in settings
 	if !settings.Config.EnableWAL {
 		return nil // Skip WAL if disabled
 	}
 
-	// Get next sequence number with proper locking
+	// Create WAL entry outside the lock
+	entry := WALEntry{
+		Timestamp:  time.Now().UnixNano(),
+		Operation:  op,
+		EntityType: entityType,
+		EntityID:   entityID,
+		Data:       pe.Compress(data),
+	}
+
+	// Assign the next sequence number and buffer the entry in the same order
 	pe.walSeqMutex.Lock()
 	pe.walSequence++
-	sequenceNum := pe.walSequence
+	entry.SequenceNum = pe.walSequence
+	pe.walBuffer = append(pe.walBuffer, bufferedWALEntry{
+		entry:        entry,
+		acknowledged: durability == common.DurabilityAsync,
+	})
 	pe.walSeqMutex.Unlock()
 
-	// Create WAL entry outside the lock
-	entry := WALEntry{
-		Timestamp:   time.Now().UnixNano(),
-		SequenceNum: sequenceNum,
-		Operation:   op,
-		EntityType:  entityType,
-		EntityID:    entityID,
-		Data:        pe.Compress(data),
+	err := pe.commits.wait(durability)
+	metrics.WALWriteDuration.Observe(time.Since(time.Unix(0, entry.Timestamp)).Seconds())
+	return err
+}
+
+// commitWAL writes the buffered WAL entries in one batch and syncs them to disk
+// A failed batch fails the whole group: its keys are removed again and the writers
+// waiting for it get the error and roll back, while acknowledged async entries go
+// back to the buffer and are retried by the next commit
+func (pe *Engine) commitWAL() error {
+	pe.walSeqMutex.Lock()
+	buffered := pe.walBuffer
+	pe.walBuffer = nil
+	pe.walSeqMutex.Unlock()
+
+	if len(buffered) == 0 {
+		return nil
 	}
 
-	// Serialize entry
-	var buf bytes.Buffer
-	if err := gob.NewEncoder(&buf).Encode(entry); err != nil {
-		return fmt.Errorf("failed to encode WAL entry: %w", err)
+	if err := pe.writeWALBatch(buffered); err != nil {
+		pe.requeueWAL(buffered)
+		return err
 	}
+	return nil
+}
 
-	// Create the key with a sequence number for proper ordering
-	key := fmt.Sprintf("wal:%020d:%s:%s", sequenceNum, entityType, entityID)
+// writeWALBatch writes WAL entries in one batch and syncs them to disk
+func (pe *Engine) writeWALBatch(buffered []bufferedWALEntry) error {
+	pe.mu.RLock()
+	defer pe.mu.RUnlock()
 
-	// No need to lock for this DB operation - Badger handles its own thread safety
-	return pe.db.Update(func(txn *badger.Txn) error {
-		return txn.Set([]byte(key), buf.Bytes())
-	})
+	if pe.closed || pe.db == nil {
+		return fmt.Errorf("persistence engine is closed")
+	}
+
+	keys := make([][]byte, 0, len(buffered))
+	err := func() error {
+		wb := pe.db.NewWriteBatch()
+		defer wb.Cancel()
+
+		for _, b := range buffered {
+			value, err := encodeWALEntry(b.entry)
+			if err != nil {
+				return err
+			}
+
+			// Create the key with a sequence number for proper ordering
+			key := []byte(walKey(b.entry))
+			if err := wb.Set(key, value); err != nil {
+				return fmt.Errorf("failed to write WAL entries: %w", err)
+			}
+			keys = append(keys, key)
+		}
+
+		if err := wb.Flush(); err != nil {
+			return fmt.Errorf("failed to write WAL entries: %w", err)
+		}
+		return nil
+	}()
+
+	// Badger syncs the batch itself when it syncs writes
+	if err == nil && !pe.syncWAL {
+		if syncErr := pe.db.Sync(); syncErr != nil {
+			err = fmt.Errorf("failed to sync WAL entries: %w", syncErr)
+		}
+	}
+	if err == nil {
+		return nil
+	}
+
+	// A write batch commits in several transactions, so part of the group may
+	// have been written already
+	if len(keys) > 0 {
+		wb := pe.db.NewWriteBatch()
+		defer wb.Cancel()
+		for _, key := range keys {
+			if delErr := wb.Delete(key); delErr != nil {
+				break
+			}
+		}
+		if delErr := wb.Flush(); delErr != nil {
+			pe.logger.Errorf("Failed to remove the WAL entries of a failed commit: %v", delErr)
+		}
+	}
+	return err
+}
+
+// requeueWAL puts the acknowledged entries of a failed commit back in front of the buffer
+// The other entries are dropped, since their writers receive the error of the commit
+func (pe *Engine) requeueWAL(buffered []bufferedWALEntry) {
+	retry := make([]bufferedWALEntry, 0, len(buffered))
+	for _, b := range buffered {
+		if b.acknowledged {
+			retry = append(retry, b)
+		}
+	}
+	if len(retry) == 0 {
+		return
+	}
+
+	pe.walSeqMutex.Lock()
+	pe.walBuffer = append(retry, pe.walBuffer...)
+	pe.walSeqMutex.Unlock()
+
+	pe.logger.Warnf("Retrying %d asynchronous WAL entries with the next commit", len(retry))
+}
+
+// walKey returns the key of a WAL entry, ordered by sequence number
+func walKey(entry WALEntry) string {
+	return fmt.Sprintf("wal:%020d:%s:%s", entry.SequenceNum, entry.EntityType, entry.EntityID)
+}
+
+// flushWAL commits the buffered WAL entries, so readers of the database see them
+func (pe *Engine) flushWAL() error {
+	if err := pe.commits.wait(common.DurabilitySync); err != nil {
+		return fmt.Errorf("failed to flush WAL: %w", err)
+	}
+	return nil
 }
 
 // LoadWAL loads all WAL entries and applies them to the in-memory store
+// Entries already contained in the loaded snapshot are skipped.
 // This should only be called during initialization before the server starts
-// LoadWAL loads all WAL entries and applies them to the in-memory store
 func (pe *Engine) LoadWAL(store common.DatastoreEngine) error {
 	errorCount := 0
 	skipCount := 0
+	replayAfter := pe.replayAfterSequence
 
 	type walEntryWithKey struct {
 		key   string
@@ -206,14 +332,13 @@ func (pe *Engine) LoadWAL(store common.DatastoreEngine) error {
 		it := txn.NewIterator(opts)
 		defer it.Close()
 
-		for it.Rewind(); it.Valid(); it.Next() {
+		// Keys are ordered by sequence number, so start after the snapshot
+		for it.Seek([]byte(fmt.Sprintf("wal:%020d", replayAfter+1))); it.Valid(); it.Next() {
 			item := it.Item()
 
 			err := item.Value(func(val []byte) error {
-				var entry WALEntry
-				buf := bytes.NewBuffer(val)
-
-				if err := gob.NewDecoder(buf).Decode(&entry); err != nil {
+				entry, _, err := decodeWALEntry(val)
+				if err != nil {
 					pe.logger.Warnf("Failed to decode WAL entry: %v, skipping", err)
 					skipCount++
 					return nil
@@ -320,6 +445,16 @@ func (pe *Engine) LoadWAL(store common.DatastoreEngine) error {
 		}
 	}
 
+	// Continue numbering after the replayed entries, so new entries never sort before them
+	if len(entries) > 0 {
+		lastSequence := entries[len(entries)-1].entry.SequenceNum
+		pe.walSeqMutex.Lock()
+		if pe.walSequence < lastSequence {
+			pe.walSequence = lastSequence
+		}
+		pe.walSeqMutex.Unlock()
+	}
+
 	if errorCount > 0 || skipCount > 0 {
 		pe.logger.Warnf("WAL recovery completed with %d errors and %d skipped entries",
 			errorCount, skipCount)
@@ -371,12 +506,17 @@ func (pe *Engine) applyOperation(store common.DatastoreEngine, op int, entityTyp
 		}
 
 		// For WAL replays, we need to check if the entity type exists
-		_, err := store.GetEntityDefinition(def.Name)
+		existingDef, err := store.GetEntityDefinition(def.Name)
 		if err != nil {
 			// Entity type doesn't exist, register it instead
 			return store.RegisterEntityType(def)
 		}
 
+		// Skip versioned updates that are already reflected in the loaded definition
+		if def.Version > 0 && existingDef.Version >= def.Version {
+			return nil
+		}
+
 		// Mark internal fields
 		for i := range def.Fields {
 			if strings.HasPrefix(def.Fields[i].Name, "_") {
@@ -405,6 +545,18 @@ func (pe *Engine) applyOperation(store common.DatastoreEngine, op int, entityTyp
 	case OpDeleteEntity:
 		return store.Delete(entityType, entityID)
 
+	case OpDropEntityType:
+		if _, err := store.GetEntityDefinition(entityType); err != nil {
+			return nil // Already dropped
+		}
+		return store.DropEntityType(entityType)
+
+	case OpRenameEntityType:
+		return applyRenameEntityType(store, pe.logger, entityType, data)
+
+	case OpCloneEntityType:
+		return applyCloneEntityType(store, pe.logger, entityType, data)
+
 	default:
 		return fmt.Errorf("unknown operation: %d", op)
 	}
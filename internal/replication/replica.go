@@ -0,0 +1,350 @@
+// Package replication keeps a replica in sync with its primary by shipping the primary's WAL
+package replication
+
+import (
+	"context"
+	"encoding/json"
+	stderrors "errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
+	"github.com/phillarmonic/syncopate-db/internal/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// Replica states reported in its status
+const (
+	StateBootstrapping = "bootstrapping"
+	StateStreaming     = "streaming"
+	StateError         = "error"
+)
+
+// Target is the database a replica applies its primary's WAL to
+type Target interface {
+	ReplicaPosition() (common.ReplicationPosition, error)
+	ApplyReplicationBatch(batch *common.ReplicationBatch) error
+	BootstrapReplica(r io.Reader, position common.ReplicationPosition) error
+}
+
+// Timeouts of requests to the primary, including reading their response
+const (
+	DefaultRequestTimeout  = 30 * time.Second // Bounds a request for WAL entries
+	DefaultSnapshotTimeout = time.Hour        // Bounds every request, snapshots of large databases included
+)
+
+// Config holds configuration for a replica
+type Config struct {
+	PrimaryURL     string        // Base URL of the primary, e.g. http://primary:8080
+	ReplicaID      string        // Name the primary reports this replica under
+	PollInterval   time.Duration // Time between requests while the replica is caught up
+	BatchSize      int           // Maximum number of WAL entries per request
+	RequestTimeout time.Duration // Maximum duration of a request for WAL entries
+	Client         *http.Client
+	Logger         *logrus.Logger
+
+	// Exclusive runs a bootstrap while nothing else uses the database, as it replaces
+	// the data queries read. Nil runs bootstraps directly
+	Exclusive func(fn func() error) error
+}
+
+// DefaultConfig returns a default replica configuration
+func DefaultConfig() Config {
+	return Config{
+		PollInterval:   500 * time.Millisecond,
+		BatchSize:      1000,
+		RequestTimeout: DefaultRequestTimeout,
+		Client:         &http.Client{Timeout: DefaultSnapshotTimeout},
+		Logger:         logrus.New(),
+	}
+}
+
+// Replica pulls WAL entries from a primary and applies them to its target
+// A replica without a position, or whose position the primary no longer has,
+// is bootstrapped from a snapshot of the primary first
+type Replica struct {
+	primary *url.URL
+	config  Config
+	target  Target
+	logger  *logrus.Logger
+
+	mu         sync.Mutex
+	status     common.ReplicationStatus
+	caughtUpAt time.Time // Last time the replica had applied everything the primary had
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// NewReplica creates a replica of the primary at config.PrimaryURL
+func NewReplica(config Config, target Target) (*Replica, error) {
+	primary, err := url.Parse(strings.TrimRight(config.PrimaryURL, "/"))
+	if err != nil || (primary.Scheme != "http" && primary.Scheme != "https") || primary.Host == "" {
+		return nil, fmt.Errorf("invalid primary URL %q, expected e.g. http://primary:8080", config.PrimaryURL)
+	}
+
+	defaults := DefaultConfig()
+	if config.PollInterval <= 0 {
+		config.PollInterval = defaults.PollInterval
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaults.BatchSize
+	}
+	if config.RequestTimeout <= 0 {
+		config.RequestTimeout = defaults.RequestTimeout
+	}
+	if config.Client == nil {
+		config.Client = defaults.Client
+	}
+	if config.Logger == nil {
+		config.Logger = defaults.Logger
+	}
+
+	return &Replica{
+		primary:    primary,
+		config:     config,
+		target:     target,
+		logger:     config.Logger,
+		status:     common.ReplicationStatus{Primary: primary.String(), State: StateStreaming},
+		caughtUpAt: time.Now(),
+	}, nil
+}
+
+// Start starts replicating in the background
+func (r *Replica) Start() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.stop != nil {
+		return
+	}
+	r.stop = make(chan struct{})
+	r.done = make(chan struct{})
+
+	go r.run(r.stop, r.done)
+}
+
+// Stop stops replicating and waits for the batch being applied
+func (r *Replica) Stop() {
+	r.mu.Lock()
+	stop, done := r.stop, r.done
+	r.stop, r.done = nil, nil
+	r.mu.Unlock()
+
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+// Status returns the replication state, including how far the replica is behind its primary
+func (r *Replica) Status() common.ReplicationStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	status := r.status
+	if status.LagEntries > 0 {
+		status.LagSeconds = time.Since(r.caughtUpAt).Seconds()
+	}
+	return status
+}
+
+// run syncs with the primary until stopped, right away while behind and every poll interval once caught up
+func (r *Replica) run(stop, done chan struct{}) {
+	defer close(done)
+
+	for {
+		wait := time.Duration(0)
+
+		caughtUp, err := r.Sync()
+		if err != nil {
+			r.logger.Warnf("Replication from %s failed: %v", r.primary, err)
+			wait = r.config.PollInterval
+		} else if caughtUp {
+			wait = r.config.PollInterval
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Sync fetches and applies one batch of WAL entries, bootstrapping the replica first if needed
+// It reports whether the replica has caught up with the primary
+func (r *Replica) Sync() (bool, error) {
+	caughtUp, err := r.sync()
+	if err != nil {
+		r.mu.Lock()
+		r.status.State = StateError
+		r.status.LastError = err.Error()
+		r.mu.Unlock()
+	}
+	return caughtUp, err
+}
+
+// sync runs one round of Sync
+func (r *Replica) sync() (bool, error) {
+	position, err := r.target.ReplicaPosition()
+	if err != nil {
+		return false, err
+	}
+
+	if position.HistoryID == "" {
+		return false, r.bootstrap("the replica has no data of the primary yet")
+	}
+
+	batch, err := r.fetchEntries(position)
+	if stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+		return false, r.bootstrap("the primary no longer has the WAL entries the replica needs")
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if err := r.target.ApplyReplicationBatch(batch); err != nil {
+		if stderrors.Is(err, common.ErrReplicaSnapshotRequired) {
+			return false, r.bootstrap(err.Error())
+		}
+		return false, fmt.Errorf("failed to apply WAL entries: %w", err)
+	}
+
+	applied := position.Sequence
+	if len(batch.Entries) > 0 {
+		applied = batch.Entries[len(batch.Entries)-1].SequenceNum
+	}
+	caughtUp := applied >= batch.Position.Sequence
+
+	r.mu.Lock()
+	r.status.State = StateStreaming
+	r.status.LastError = ""
+	r.status.LastContact = time.Now()
+	r.status.HistoryID = batch.Position.HistoryID
+	r.status.AppliedSequence = applied
+	r.status.PrimarySequence = batch.Position.Sequence
+	r.status.LagEntries = 0
+	if caughtUp {
+		r.caughtUpAt = time.Now()
+	} else {
+		r.status.LagEntries = batch.Position.Sequence - applied
+	}
+	r.mu.Unlock()
+
+	return caughtUp, nil
+}
+
+// bootstrap replaces the replica's data with a snapshot of the primary
+func (r *Replica) bootstrap(reason string) error {
+	r.logger.Infof("Bootstrapping replica from a snapshot of %s: %s", r.primary, reason)
+
+	r.mu.Lock()
+	r.status.State = StateBootstrapping
+	r.mu.Unlock()
+
+	resp, err := r.get(context.Background(), "/api/v1/replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	sequence, err := strconv.ParseUint(resp.Header.Get("X-Replication-Sequence"), 10, 64)
+	historyID := resp.Header.Get("X-Replication-History")
+	if err != nil || historyID == "" {
+		return fmt.Errorf("snapshot response of the primary has no replication position")
+	}
+	position := common.ReplicationPosition{HistoryID: historyID, Sequence: sequence}
+
+	load := func() error {
+		return r.target.BootstrapReplica(resp.Body, position)
+	}
+
+	start := time.Now()
+	if r.config.Exclusive != nil {
+		err = r.config.Exclusive(load)
+	} else {
+		err = load()
+	}
+	if err != nil {
+		return err
+	}
+	r.logger.Infof("Replica bootstrapped at sequence %d in %s", sequence, time.Since(start))
+
+	r.mu.Lock()
+	r.status.State = StateStreaming
+	r.status.LastError = ""
+	r.status.LastContact = time.Now()
+	r.status.HistoryID = historyID
+	r.status.AppliedSequence = sequence
+	r.status.Bootstraps++
+	r.mu.Unlock()
+
+	return nil
+}
+
+// fetchEntries requests the WAL entries after a position from the primary
+func (r *Replica) fetchEntries(position common.ReplicationPosition) (*common.ReplicationBatch, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), r.config.RequestTimeout)
+	defer cancel()
+
+	resp, err := r.get(ctx, "/api/v1/replication/wal", url.Values{
+		"history": {position.HistoryID},
+		"after":   {strconv.FormatUint(position.Sequence, 10)},
+		"limit":   {strconv.Itoa(r.config.BatchSize)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var batch common.ReplicationBatch
+	if err := json.NewDecoder(resp.Body).Decode(&batch); err != nil {
+		return nil, fmt.Errorf("failed to decode WAL entries of the primary: %w", err)
+	}
+	return &batch, nil
+}
+
+// get sends a request to the primary and returns the response if it succeeded
+// A response asking the replica to bootstrap is returned as common.ErrReplicaSnapshotRequired
+func (r *Replica) get(ctx context.Context, path string, query url.Values) (*http.Response, error) {
+	target := r.primary.String() + path
+	if len(query) > 0 {
+		target += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	if r.config.ReplicaID != "" {
+		req.Header.Set("X-Replica-ID", r.config.ReplicaID)
+	}
+
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach primary: %w", err)
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+
+	var errorResponse struct {
+		Message string           `json:"message"`
+		DBCode  errors.ErrorCode `json:"db_code"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&errorResponse)
+
+	if errorResponse.DBCode == errors.ErrCodeReplicaOutOfSync {
+		return nil, common.ErrReplicaSnapshotRequired
+	}
+	return nil, fmt.Errorf("primary responded with %s: %s", resp.Status, errorResponse.Message)
+}
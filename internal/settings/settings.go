@@ -7,6 +7,8 @@ import (
 	"os"
 	"strconv"
 	"strings"
+
+	"github.com/phillarmonic/syncopate-db/internal/common"
 )
 
 type LogLevel string
@@ -27,6 +29,23 @@ func (l LogLevel) IsValid() bool {
 	}
 }
 
+// StorageBackend selects the persistence provider that stores the data directory
+type StorageBackend string
+
+const (
+	StorageBackendBadger StorageBackend = "badger" // Badger key-value store
+	StorageBackendFile   StorageBackend = "file"   // Append-only log and snapshot files
+)
+
+func (b StorageBackend) IsValid() bool {
+	switch b {
+	case StorageBackendBadger, StorageBackendFile:
+		return true
+	default:
+		return false
+	}
+}
+
 type Configuration struct {
 	Port           int      `json:"port"`
 	Debug          bool     `json:"debug"`
@@ -37,6 +56,37 @@ type Configuration struct {
 	ColorizedLogs  bool     `json:"colorized_logs"`   // Setting for colored logs
 	ServerStarted  bool     `json:"server_started"`   // Setting for server-started status
 	IgnoreLogPaths string   `json:"ignore_log_paths"` // Comma-separated list of paths to ignore in access logs
+	LazyEntities   bool     `json:"lazy_entities"`    // Keep entity bodies on disk and only a hot set in memory
+
+	StorageBackend      StorageBackend    `json:"storage_backend"`       // Persistence provider of the data directory
+	Durability          common.Durability `json:"durability"`            // Default durability of writes, empty means sync
+	GroupCommitInterval int               `json:"group_commit_interval"` // Milliseconds between group commits
+
+	ReplicaOf               string `json:"replica_of"`                // URL of the primary when running as a read-only replica
+	ReplicaID               string `json:"replica_id"`                // Name the primary reports this replica under
+	ReplicationPollInterval int    `json:"replication_poll_interval"` // Milliseconds between WAL requests of a caught up replica
+
+	ClusterNodeID      string `json:"cluster_node_id"`      // Name of this node in the cluster, enables cluster mode
+	ClusterRaftAddress string `json:"cluster_raft_address"` // Address the cluster transport listens on
+	ClusterAPIAddress  string `json:"cluster_api_address"`  // URL other nodes forward writes to when this node leads
+	ClusterBootstrap   bool   `json:"cluster_bootstrap"`    // Start a new cluster with this node as its first member
+	ClusterJoin        string `json:"cluster_join"`         // URL of a cluster member to join through
+
+	TracingEndpoint    string `json:"tracing_endpoint"`     // OTLP/HTTP collector spans are exported to, empty disables the export
+	TracingInsecure    bool   `json:"tracing_insecure"`     // Export spans over plain HTTP instead of HTTPS
+	TracingSampleRatio int    `json:"tracing_sample_ratio"` // Percentage of new traces that are sampled
+
+	SlowQueryThreshold   int `json:"slow_query_threshold"`    // Milliseconds after which a query is logged as slow, 0 disables the log
+	SlowQueryLogSize     int `json:"slow_query_log_size"`     // Number of slow queries kept in memory
+	SlowQuerySampleRatio int `json:"slow_query_sample_ratio"` // Percentage of slow queries that are logged
+
+	QueryTimeout    int `json:"query_timeout"`     // Milliseconds a query may run before it fails, 0 disables the timeout
+	MaxQueryJoins   int `json:"max_query_joins"`   // Joins a query may have, 0 disables the limit
+	MaxQueryFilters int `json:"max_query_filters"` // Filters a query may have including those of its joins, 0 disables the limit
+	MaxQueryResults int `json:"max_query_results"` // Entities a query may return, 0 disables the limit
+
+	EncryptionKeyFile string `json:"encryption_key_file"` // File holding the data encryption key
+	EncryptionKey     string `json:"-"`                   // Encryption key used when no key file is set, never serialized
 }
 
 var Config Configuration
@@ -45,6 +95,36 @@ func (c *Configuration) Validate() error {
 	if !c.LogLevel.IsValid() {
 		return errors.New("invalid log_level")
 	}
+	if !c.StorageBackend.IsValid() {
+		return errors.New("invalid storage_backend")
+	}
+	if c.Durability != "" && !c.Durability.IsValid() {
+		return errors.New("invalid durability")
+	}
+	if c.GroupCommitInterval < 0 {
+		return errors.New("invalid group_commit_interval")
+	}
+	if c.ReplicationPollInterval < 0 {
+		return errors.New("invalid replication_poll_interval")
+	}
+	if c.TracingSampleRatio < 0 || c.TracingSampleRatio > 100 {
+		return errors.New("invalid tracing_sample_ratio")
+	}
+	if c.SlowQueryThreshold < 0 {
+		return errors.New("invalid slow_query_threshold")
+	}
+	if c.SlowQueryLogSize < 1 {
+		return errors.New("invalid slow_query_log_size")
+	}
+	if c.SlowQuerySampleRatio < 0 || c.SlowQuerySampleRatio > 100 {
+		return errors.New("invalid slow_query_sample_ratio")
+	}
+	if c.QueryTimeout < 0 {
+		return errors.New("invalid query_timeout")
+	}
+	if c.MaxQueryJoins < 0 || c.MaxQueryFilters < 0 || c.MaxQueryResults < 0 {
+		return errors.New("invalid query limit")
+	}
 	return nil
 }
 
@@ -89,7 +169,38 @@ func init() {
 		EnableHTTPZSTD: loadEnvBool("ENABLE_HTTP_ZSTD", false),
 		ColorizedLogs:  loadEnvBool("COLORIZED_LOGS", true),
 		ServerStarted:  false,
-		IgnoreLogPaths: loadEnvString("IGNORE_LOG_PATHS", "/api/v1/memory,/api/v1/memory/visualization,/health"),
+		IgnoreLogPaths: loadEnvString("IGNORE_LOG_PATHS", "/api/v1/memory,/api/v1/memory/visualization,/health,/metrics"),
+		LazyEntities:   loadEnvBool("LAZY_ENTITIES", false),
+
+		StorageBackend:      StorageBackend(loadEnvString("STORAGE_BACKEND", string(StorageBackendBadger))),
+		Durability:          common.Durability(loadEnvString("DURABILITY", "")),
+		GroupCommitInterval: loadEnvInt("GROUP_COMMIT_INTERVAL", 10),
+
+		ReplicaOf:               loadEnvString("REPLICA_OF", ""),
+		ReplicaID:               loadEnvString("REPLICA_ID", ""),
+		ReplicationPollInterval: loadEnvInt("REPLICATION_POLL_INTERVAL", 500),
+
+		ClusterNodeID:      loadEnvString("CLUSTER_NODE_ID", ""),
+		ClusterRaftAddress: loadEnvString("CLUSTER_RAFT_ADDRESS", "127.0.0.1:7000"),
+		ClusterAPIAddress:  loadEnvString("CLUSTER_API_ADDRESS", ""),
+		ClusterBootstrap:   loadEnvBool("CLUSTER_BOOTSTRAP", false),
+		ClusterJoin:        loadEnvString("CLUSTER_JOIN", ""),
+
+		TracingEndpoint:    loadEnvString("OTLP_ENDPOINT", ""),
+		TracingInsecure:    loadEnvBool("OTLP_INSECURE", false),
+		TracingSampleRatio: loadEnvInt("TRACING_SAMPLE_RATIO", 100),
+
+		SlowQueryThreshold:   loadEnvInt("SLOW_QUERY_THRESHOLD", 0),
+		SlowQueryLogSize:     loadEnvInt("SLOW_QUERY_LOG_SIZE", 100),
+		SlowQuerySampleRatio: loadEnvInt("SLOW_QUERY_SAMPLE_RATIO", 100),
+
+		QueryTimeout:    loadEnvInt("QUERY_TIMEOUT", 0),
+		MaxQueryJoins:   loadEnvInt("MAX_QUERY_JOINS", 0),
+		MaxQueryFilters: loadEnvInt("MAX_QUERY_FILTERS", 0),
+		MaxQueryResults: loadEnvInt("MAX_QUERY_RESULTS", 0),
+
+		EncryptionKeyFile: loadEnvString("ENCRYPTION_KEY_FILE", ""),
+		EncryptionKey:     loadEnvString("ENCRYPTION_KEY", ""),
 	}
 
 	if err := Config.Validate(); err != nil {
@@ -0,0 +1,96 @@
+// Package tracing sets up the OpenTelemetry tracing of SyncopateDB
+// Spans are exported over OTLP/HTTP when an endpoint is configured, otherwise they are only propagated
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/phillarmonic/syncopate-db/internal/about"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentationName names the tracer of every span SyncopateDB starts
+const instrumentationName = "github.com/phillarmonic/syncopate-db"
+
+// Options configures the span export
+type Options struct {
+	Endpoint    string  // OTLP/HTTP collector address, host:port or a URL, empty disables the export
+	Insecure    bool    // Export over plain HTTP
+	SampleRatio float64 // Fraction of new traces that are sampled, traces started upstream follow the parent
+}
+
+// Setup installs the W3C trace context propagator and, when an endpoint is set, a tracer provider exporting to it
+// The returned function flushes and stops the export
+func Setup(ctx context.Context, options Options) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+
+	if options.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporterOptions := []otlptracehttp.Option{}
+	if strings.Contains(options.Endpoint, "://") {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithEndpointURL(options.Endpoint))
+	} else {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithEndpoint(options.Endpoint))
+	}
+	if options.Insecure {
+		exporterOptions = append(exporterOptions, otlptracehttp.WithInsecure())
+	}
+
+	exporter, err := otlptracehttp.New(ctx, exporterOptions...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "syncopatedb"),
+		attribute.String("service.version", about.About().Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the tracing resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(options.SampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// Tracer returns the tracer of SyncopateDB from the installed tracer provider
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Start starts a span as a child of the span in ctx, or a new trace if ctx is nil
+func Start(ctx context.Context, name string, options ...trace.SpanStartOption) (context.Context, trace.Span) {
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	return Tracer().Start(ctx, name, options...)
+}
+
+// End ends a span, recording err on it when not nil
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}